@@ -11,60 +11,225 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/maruel/dumbcas/dumbcaslib"
-	"github.com/maruel/interrupt"
 	"github.com/maruel/subcommands"
 )
 
 var cmdArchive = &subcommands.Command{
-	UsageLine: "archive <.toArchive>",
+	UsageLine: "archive <.toArchive> | -files-from <list> | -stdin -name <name>",
 	ShortDesc: "archive files to a dumbcas archive",
-	LongDesc:  "Archives files listed in <.toArchive> file to a directory in the DumbCas(tm) layout. Files listed may be in relative path or in absolute path and may contain environment variables.",
+	LongDesc:  "Archives files listed in <.toArchive> file to a directory in the DumbCas(tm) layout. Files listed may be in relative path or in absolute path and may contain environment variables. With -files-from, only the files listed are archived, without recursing into directories.",
 	CommandRun: func() subcommands.CommandRun {
 		c := &archiveRun{}
 		c.Init()
 		c.Flags.StringVar(&c.comment, "comment", "", "Comment to embed in the file")
+		c.Flags.Var(&c.tags, "tag", "Tag of the node as key=value, to select it with list -tag or keep it with prune -keep-tag; can be repeated")
+		c.Flags.Var(&c.Compress, "compress", "Compress the archived content with gzip, or with zstd with -compress=zstd")
+		c.Flags.IntVar(&c.CompressLevel, "compress-level", 0, "Level of -compress, between 1 and 9 for gzip and 1 and 22 for zstd; defaults to the default of the algorithm")
+		c.Flags.Int64Var(&c.PackThreshold, "pack-threshold", 0, "Append the files up to this size in bytes to pack files instead of storing each as its own object; local tables only")
+		c.Flags.Int64Var(&c.MaxRate, "max-rate", 0, "Maximum rate at which the content is written to the table, in bytes per second, across all the writers. 0 is unlimited.")
+		c.Flags.IntVar(&c.WriteRetries, "write-retries", -1, "Number of times a failed write to the table is retried, waiting 1s before the first retry and twice as long before each following one. Defaults to 3 for an URL and 0 for a local directory.")
+		c.Flags.Var(&c.excludes, "exclude", "Glob pattern of the files and directories to skip, relative to each input directory; can be repeated")
+		c.Flags.StringVar(&c.excludeFrom, "exclude-from", "", "File listing exclude patterns, one per line")
+		c.Flags.Int64Var(&c.maxFileSize, "max-file-size", 0, "Skip the files larger than this many bytes found in the input directories, e.g. disk images; 0 is unlimited")
+		c.Flags.Int64Var(&c.minFileSize, "min-file-size", 0, "Skip the files smaller than this many bytes found in the input directories")
+		c.Flags.Int64Var(&c.chunkThreshold, "chunk-threshold", 0, "Split the files of at least this many bytes in content-defined chunks of about 1MiB, so the versions of a large mutable file like a disk image share their unchanged parts; 0 stores each file as a single object")
+		c.Flags.Var(&c.includes, "include", "Glob pattern of the files to archive, or of the directories to archive whole, relative to each input directory; when set, only the files matching one are archived, unless they are also excluded; can be repeated")
+		c.Flags.BoolVar(&c.noCache, "no-cache", false, "Rehash every file instead of trusting the cache for the files whose size and timestamp didn't change")
+		c.Flags.StringVar(&c.since, "since", "", "Node, as printed by list, this archive is an increment of: the files with the same path, size and timestamp reuse its hash without being read if the content is still in the table and the node records it as its parent")
+		c.Flags.StringVar(&c.cachePath, "cache-path", "", "File caching the hash of the archived files; defaults to cache.gob in -root, or in the local state directory of a remote table")
+		c.Flags.BoolVar(&c.quiet, "quiet", false, "Do not log the progress")
+		c.Flags.DurationVar(&c.progressInterval, "progress-interval", 5*time.Second, "Interval between the progress logs")
+		c.Flags.StringVar(&c.filesFrom, "files-from", "", "Archive the files listed in this file, one absolute path per line or NUL-terminated, instead of a .toArchive file; each is stored at its path relative to -base, or to the root of the file system")
+		c.Flags.BoolVar(&c.strict, "strict", false, "Fail without creating the node as soon as a file can't be read, instead of archiving the others and listing the skipped ones in the manifest; with -files-from, also fail if a listed path is missing or is a directory")
+		c.Flags.BoolVar(&c.stdin, "stdin", false, "Archive the content read from stdin as a single file named -name instead of a .toArchive file")
+		c.Flags.StringVar(&c.name, "name", "", "Name of the node, instead of the name of the .toArchive file; also the name of the file archived with -stdin")
+		c.Flags.BoolVar(&c.splitNodes, "one-node-per-top-level", false, "Create a node per directory at the root of the archive, named <name>-<directory>, so they can be restored or pruned independently; the other files are in the node <name>")
+		c.Flags.BoolVar(&c.verifyAfter, "verify-after-archive", false, "Verify all the files of the node are in the table once archived, like verify, and fail otherwise")
+		c.Flags.BoolVar(&c.verifyDeep, "verify-deep", false, "Same as -verify-after-archive but also verify the content of each file matches its hash, which reads everything back")
+		c.Flags.StringVar(&c.manifest, "manifest", "", "File to write a JSON summary of the archive to once it succeeded")
+		c.Flags.StringVar(&c.outputFormat, "output-format", "text", "Format of the summary printed once done: text, json, the same summary as -manifest, or quiet to print nothing")
+		c.Flags.StringVar(&c.symlinks, "symlinks", string(dumbcaslib.SymlinkFollow), "How to handle symlinks: follow archives their target, store records them as symlinks, skip ignores them")
+		c.Flags.BoolVar(&c.resume, "resume", false, "Checkpoint the inputs as they are archived and skip the ones archived by a previous interrupted run with the same .toArchive file")
+		c.Flags.BoolVar(&c.xattrs, "xattrs", false, "Archive the extended attributes of the files, e.g. the SELinux labels, to restore them; only supported on Linux")
+		c.Flags.BoolVar(&c.hardlinks, "hardlinks", false, "Record the files sharing an inode so restore recreates them as hardlinks instead of copies")
+		c.Flags.StringVar(&c.base, "base", "", "Directory the inputs are archived relative to, so archiving /home/me/docs with -base=/home/me stores docs/...; by default the content of each input directory is stored at the root")
+		c.Flags.BoolVar(&c.followMounts, "follow-mounts", true, "Descend into the directories on other file systems; set to false to stop at the mount points like find -xdev")
 		return c
 	},
 }
 
 type archiveRun struct {
 	CommonFlags
-	comment string
+	comment     string
+	tags        stringsFlag
+	excludes    stringsFlag
+	excludeFrom string
+	includes    stringsFlag
+	maxFileSize int64
+	minFileSize int64
+	// chunkThreshold is set with -chunk-threshold.
+	chunkThreshold int64
+	symlinks       string
+	followMounts   bool
+	base           string
+	xattrs         bool
+	hardlinks      bool
+	noCache        bool
+	cachePath      string
+	since          string
+	resume         bool
+	manifest       string
+	outputFormat   string
+	verifyAfter    bool
+	verifyDeep     bool
+	splitNodes     bool
+	filesFrom      string
+	strict         bool
+	stdin          bool
+	name           string
+	// Progress reporting.
+	quiet            bool
+	progressInterval time.Duration
 }
 
-// For an item, tries to refresh its sha1 efficiently.
-func updateFile(cache *dumbcaslib.EntryCache, item inputItem) (bool, error) {
+// archiveManifest is the summary written to -manifest and printed with
+// -output-format=json. Node and RootHash are empty if the archive failed.
+type archiveManifest struct {
+	Node     string `json:"node"`
+	RootHash string `json:"root_hash"`
+	Files    int64  `json:"files"`
+	Bytes    int64  `json:"total_bytes"`
+	// Hashed files were read while Cached ones were trusted from the cache.
+	Hashed      int64 `json:"hashed"`
+	HashedBytes int64 `json:"hashed_bytes"`
+	Cached      int64 `json:"cached"`
+	CachedBytes int64 `json:"cached_bytes"`
+	// Archived files were added to the table while the content of the Existing
+	// ones was already in it.
+	Archived           int64 `json:"archived"`
+	ArchivedBytes      int64 `json:"archived_bytes"`
+	Existing           int64 `json:"existing"`
+	ExistingBytes      int64 `json:"existing_bytes"`
+	SkippedBySize      int64 `json:"skipped_by_size"`
+	SkippedBySizeBytes int64 `json:"skipped_by_size_bytes"`
+	Errors             int64 `json:"errors"`
+	// Duration is in seconds.
+	Duration float64 `json:"duration"`
+	// Skipped are the files that couldn't be read, so the node is incomplete.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// For an item, tries to refresh its hash efficiently. force ignores the cached
+// hash.
+func updateFile(cache *dumbcaslib.EntryCache, item inputItem, h hash.Hash, force bool) (bool, error) {
 	now := time.Now().Unix()
 	size := item.Size()
 	timestamp := item.ModTime().Unix()
-	// If the file already exist, check for the timestamp and size to match.
-	if cache.Size == size && cache.Timestamp == timestamp {
+	if !force && cacheMatches(cache, item, h.Size()) {
 		cache.LastTested = now
 		return false, nil
 	}
 
-	digest, err := sha1File(item.fullPath)
+	digest, err := hashFile(h, item.fullPath)
 	if err != nil {
 		return false, err
 	}
 	cache.Sha1 = digest
+	// The manifest is recorded once archived.
+	cache.Manifest = ""
 	cache.Size = size
 	cache.Timestamp = timestamp
 	cache.LastTested = now
 	return true, nil
 }
 
+// cacheMatches returns true if the cached hash of item can be trusted: the
+// timestamp and size must match. The cache is shared across tables so it may
+// have been hashed with another algorithm, of another digest size.
+func cacheMatches(cache *dumbcaslib.EntryCache, item inputItem, digestSize int) bool {
+	return cache.Size == item.Size() && cache.Timestamp == item.ModTime().Unix() && len(cache.Sha1) == digestSize*2
+}
+
+// Reads exclude patterns from a file, ignoring the comments starting with #.
+func readExcludes(filepath string) (dumbcaslib.Excludes, error) {
+	lines, err := readFileAsStrings(filepath)
+	if err != nil {
+		return nil, err
+	}
+	out := dumbcaslib.Excludes{}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "#") {
+			out = append(out, line)
+		}
+	}
+	return out, nil
+}
+
+// readFilesFrom reads the files listed by -files-from. The paths are
+// NUL-terminated if the file contains a NUL, otherwise one per line. The
+// missing paths and the directories are logged and skipped, unless strict is
+// set.
+func readFilesFrom(l *log.Logger, path string, strict bool) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %s", path, err)
+	}
+	sep := "\n"
+	if bytes.IndexByte(data, 0) != -1 {
+		sep = "\x00"
+	}
+	out := []string{}
+	for _, line := range strings.Split(string(data), sep) {
+		if sep == "\n" {
+			line = strings.TrimRight(line, "\r")
+		}
+		if line == "" {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			return nil, fmt.Errorf("%s lists %s which is not an absolute path", path, line)
+		}
+		line = filepath.Clean(line)
+		stat, err := os.Stat(line)
+		if err == nil && stat.IsDir() {
+			err = errors.New("it is a directory")
+		}
+		if err != nil {
+			if strict {
+				return nil, fmt.Errorf("Failed to process %s: %s", line, err)
+			}
+			l.Printf("Skipping %s: %s", line, err)
+			continue
+		}
+		out = append(out, line)
+	}
+	return out, nil
+}
+
+// isValidName returns true if name can be used as a file or node name.
+func isValidName(name string) bool {
+	return name != "" && name == filepath.Base(name) && name != "." && name != ".."
+}
+
 // Reads a file with each line as an entry in the slice.
 func readFileAsStrings(filepath string) ([]string, error) {
 	f, err := os.Open(filepath)
@@ -111,11 +276,11 @@ type statsValues struct {
 	errors           syncInt
 	found            syncInt // enumerateInputs()
 	totalSize        syncInt
-	nbHashed         syncInt // hashInputs()
+	nbHashed         syncInt // hashItem()
 	bytesHashed      syncInt
 	nbNotHashed      syncInt
 	bytesNotHashed   syncInt
-	nbArchived       syncInt // archiveInputs()
+	nbArchived       syncInt // hashItem() and archiveInputs()
 	bytesArchived    syncInt
 	nbNotArchived    syncInt
 	bytesNotArchived syncInt
@@ -127,6 +292,162 @@ type stats struct {
 	interrupted syncInt
 	out         chan<- string
 	done        chan<- bool
+	// checkpoint is only set with -resume.
+	checkpoint *checkpointer
+	// base is only set with -base.
+	base string
+	// xattrs is set with -xattrs.
+	xattrs bool
+	// hardlinks is set with -hardlinks.
+	hardlinks bool
+	// minSize and maxSize are set with -min-file-size and -max-file-size.
+	minSize int64
+	maxSize int64
+	// chunkThreshold is set with -chunk-threshold.
+	chunkThreshold int64
+	// cachePath is set with -cache-path.
+	cachePath string
+	// since is the tree of the node of -since.
+	since *dumbcaslib.Entry
+	// inputs are pruned from the cache of the files that disappeared.
+	inputs []string
+	// cacheHits and cacheMisses count the files whose hash was trusted from the
+	// cache or had to be computed.
+	cacheHits   syncInt
+	cacheMisses syncInt
+	// skippedBySize counts the files skipped because of their size.
+	skippedBySize      syncInt
+	bytesSkippedBySize syncInt
+	// listed are the files read from -files-from.
+	listed map[string]bool
+	// strict is set with -strict.
+	strict bool
+	// skipped are the files that failed to be archived.
+	skippedLock sync.Mutex
+	skipped     []string
+	// log receives the lines logged per file with -vv.
+	log *leveledLogger
+}
+
+// fail records that the file at path couldn't be archived.
+func (s *stats) fail(path, msg string) {
+	s.skippedLock.Lock()
+	s.skipped = append(s.skipped, path)
+	s.skippedLock.Unlock()
+	s.errors.Add(1)
+	s.out <- msg
+}
+
+// aborted returns true once a file failed with -strict, in which case the
+// remaining work is pointless.
+func (s *stats) aborted() bool {
+	return s.strict && s.errors.Get() != 0
+}
+
+// getSkipped returns the sorted files that failed to be archived.
+func (s *stats) getSkipped() []string {
+	s.skippedLock.Lock()
+	defer s.skippedLock.Unlock()
+	out := append([]string{}, s.skipped...)
+	sort.Strings(out)
+	return out
+}
+
+// relPath returns the name under which a file found in input is archived. By
+// default, the files of a directory are relative to it and a file is stored by
+// its name. With -base, the inputs inside it are relative to it instead. The
+// files listed with -files-from keep their absolute path without -base.
+func (s *stats) relPath(input, fullPath string) string {
+	if s.base != "" && isInside(input, s.base) {
+		if rel, err := filepath.Rel(s.base, fullPath); err == nil && rel != "." {
+			return rel
+		}
+	}
+	if s.listed[input] {
+		return strings.TrimLeft(input[len(filepath.VolumeName(input)):], string(filepath.Separator))
+	}
+	if input == fullPath {
+		return filepath.Base(input)
+	}
+	return fullPath[len(input)+1:]
+}
+
+// cacheName is the file of the nodes root caching the hash of the archived
+// files, unless -cache-path is set.
+const cacheName = "cache.gob"
+
+// checkpointsName is the directory of the nodes root holding the checkpoints.
+const checkpointsName = "checkpoints"
+
+// archiveCheckpoint is the progress of an archive saved with -resume.
+type archiveCheckpoint struct {
+	// Inputs are all the inputs of the archive, to not resume a different one.
+	Inputs []string `json:"inputs"`
+	// Done are the inputs fully archived.
+	Done []string `json:"done"`
+	// Entry is the tree of the inputs in Done.
+	Entry *dumbcaslib.Entry `json:"entry"`
+}
+
+// checkpointer saves the progress of an archive in path.
+type checkpointer struct {
+	path string
+	archiveCheckpoint
+}
+
+// loadCheckpointer returns a checkpointer for inputs, loading the progress of
+// a previous run from path when it was for the same inputs.
+func loadCheckpointer(l *log.Logger, path string, inputs []string) *checkpointer {
+	c := &checkpointer{path: path, archiveCheckpoint: archiveCheckpoint{Inputs: inputs, Done: []string{}}}
+	f, err := os.Open(path)
+	if err != nil {
+		return c
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	prev := archiveCheckpoint{}
+	if err := dumbcaslib.LoadReaderAsJSON(f, &prev); err != nil {
+		l.Printf("Ignoring checkpoint %s: %s", path, err)
+		return c
+	}
+	if !reflect.DeepEqual(prev.Inputs, inputs) || prev.Entry == nil {
+		l.Printf("Ignoring checkpoint %s: it was made for other inputs", path)
+		return c
+	}
+	l.Printf("Resuming from %s; skipping %d inputs", path, len(prev.Done))
+	c.Done = prev.Done
+	c.Entry = prev.Entry
+	return c
+}
+
+// isDone returns true if input was archived by a previous run.
+func (c *checkpointer) isDone(input string) bool {
+	for _, d := range c.Done {
+		if d == input {
+			return true
+		}
+	}
+	return false
+}
+
+// save records that input is fully archived in entry.
+func (c *checkpointer) save(input string, entry *dumbcaslib.Entry) error {
+	c.Done = append(c.Done, input)
+	c.Entry = entry
+	data, err := json.Marshal(&c.archiveCheckpoint)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0750); err != nil {
+		return err
+	}
+	// Write then rename so an interruption doesn't leave a truncated file.
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
 }
 
 // Creates a copy of statsValues. Note that the copy *may* be inconsistent.
@@ -165,11 +486,16 @@ type inputItem struct {
 	fullPath string
 	relPath  string
 	os.FileInfo
+	// doneInput is set on the marker sent once all the files of an input are
+	// enumerated; the other fields are not set.
+	doneInput string
 }
 
 // enumerateInputs reads the directories trees of each inputs and send each
-// file into the output channel.
-func (s *stats) enumerateInputs(inputs []string) <-chan inputItem {
+// file into the output channel. The files and directories matching
+// opts.Excludes and the files not within the size limits are skipped, but not
+// the inputs themselves.
+func (s *stats) enumerateInputs(inputs []string, opts dumbcaslib.TreeOptions) <-chan inputItem {
 	// Throtttle after 128k entries.
 	c := make(chan inputItem, 128000)
 	go func() {
@@ -184,20 +510,25 @@ func (s *stats) enumerateInputs(inputs []string) <-chan inputItem {
 		// common use case where it's multiple directories on a single disk-based
 		// HD, it's going to be slower.
 		for _, input := range inputs {
+			if s.checkpoint != nil && s.checkpoint.isDone(input) {
+				continue
+			}
+			if s.aborted() {
+				return
+			}
 			stat, err := os.Stat(input)
 			if err != nil {
 				// Eat the error and continue archiving other items.
-				s.errors.Add(1)
-				s.out <- fmt.Sprintf("Failed to process %s: %s", input, err)
+				s.fail(input, fmt.Sprintf("Failed to process %s: %s", input, err))
 				continue
 			}
 			if stat.IsDir() {
 				// Send the items back in the channel.
-				d := dumbcaslib.EnumerateTree(input)
+				d := dumbcaslib.EnumerateTreeWithOptions(input, opts)
 				cont := true
 				for cont {
 					select {
-					case <-interrupt.Channel:
+					case <-dumbcaslib.Interrupted():
 						// Early exit.
 						s.interrupted.Add(1)
 						return
@@ -209,26 +540,30 @@ func (s *stats) enumerateInputs(inputs []string) <-chan inputItem {
 						}
 						if item.Error != nil {
 							// Eat the error and continue archiving other items.
-							s.errors.Add(1)
-							s.out <- fmt.Sprintf("Failed to process %s: %s", input, err)
-						} else if !item.IsDir() {
-							// Ignores directories. This tool is backing up content, not
-							// directories.
+							s.fail(failedPath(input, item), fmt.Sprintf("Failed to process %s: %s", input, item.Error))
+						} else if item.IsDir() {
+							// Only the empty directories are enumerated, to recreate them.
+							c <- inputItem{fullPath: item.FullPath, relPath: s.relPath(input, item.FullPath), FileInfo: item.FileInfo}
+						} else if s.isSkippedBySize(item.FileInfo) {
+							s.skippedBySize.Add(1)
+							s.bytesSkippedBySize.Add(item.Size())
+							s.out <- fmt.Sprintf("Skipping %s: %d bytes", item.FullPath, item.Size())
+						} else {
 							s.found.Add(1)
 							s.totalSize.Add(item.Size())
-							// TODO(maruel): Not necessarily true?
-							relPath := item.FullPath[len(input)+1:]
-							//s.out <- fmt.Sprintf("%s: %d", relPath, item.Size())
-							c <- inputItem{item.FullPath, relPath, item.FileInfo}
+							relPath := s.relPath(input, item.FullPath)
+							s.log.Tracef("%s: %d", relPath, item.Size())
+							c <- inputItem{fullPath: item.FullPath, relPath: relPath, FileInfo: item.FileInfo}
 						}
 					}
 				}
 			} else {
 				s.found.Add(1)
 				s.totalSize.Add(stat.Size())
-				relPath := filepath.Base(input)
-				c <- inputItem{input, relPath, stat}
+				relPath := s.relPath(input, input)
+				c <- inputItem{fullPath: input, relPath: relPath, FileInfo: stat}
 			}
+			c <- inputItem{doneInput: input}
 		}
 		end := time.Now().UTC()
 		s.out <- fmt.Sprintf("Done enumerating inputs: %s", end.Sub(start).String())
@@ -236,32 +571,175 @@ func (s *stats) enumerateInputs(inputs []string) <-chan inputItem {
 	return c
 }
 
+// isSkippedBySize returns true if the file is outside of -min-file-size and
+// -max-file-size. The symlinks stored as-is are never skipped.
+func (s *stats) isSkippedBySize(fi os.FileInfo) bool {
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return false
+	}
+	return fi.Size() < s.minSize || (s.maxSize != 0 && fi.Size() > s.maxSize)
+}
+
 type itemToArchive struct {
 	fullPath string
 	relPath  string
 	sha1     string
 	size     int64
+	mode     os.FileMode
+	modTime  time.Time
+	symlink  string
+	// dir is set for an empty directory.
+	dir bool
+	// xattrs is only set with -xattrs.
+	xattrs map[string]string
+	// inode is only set with -hardlinks, for a file with multiple links.
+	inode string
+	// cached is true when the hash comes from the cache and the content is
+	// already in the table, so the file doesn't need to be read.
+	cached bool
+	// manifest lists the chunks of a file archived with -chunk-threshold.
+	manifest string
+	// doneInput is forwarded from inputItem.
+	doneInput string
+}
+
+// hashJob is an item processed by a worker of hashInputs(). result receives
+// the item to archive, or is closed without it if the item failed.
+type hashJob struct {
+	item   inputItem
+	cached *dumbcaslib.EntryCache
+	// present is true when the hash in cached, or its manifest and all its
+	// chunks, are already in the table.
+	present bool
+	// since is the entry of the file in the node of -since when the file is
+	// unchanged and its content is still in the table, nil otherwise.
+	since  *dumbcaslib.Entry
+	result chan itemToArchive
 }
 
-// Calculates each entry. Assumes inputs is cleaned paths.
-func (s *stats) hashInputs(a DumbcasApplication, inputs <-chan inputItem) <-chan itemToArchive {
+// existsBatchSize is the maximum number of cached hashes looked up at once
+// in the table.
+const existsBatchSize = 1000
+
+// Calculates each entry and archives it, from up to jobs workers. Assumes
+// inputs is cleaned paths. noCache forces rehashing every file. The items are
+// sent in the order of inputs regardless of the order in which the workers
+// complete, so the tree and the hardlink groups are deterministic.
+func (s *stats) hashInputs(a DumbcasApplication, cas dumbcaslib.CasTable, inputs <-chan inputItem, noCache bool, jobs int) <-chan itemToArchive {
 	c := make(chan itemToArchive, 4096)
 	go func() {
 		// LoadCache must return a valid Cache instance even in case of failure.
-		cache, err := a.LoadCache()
+		cache, err := a.LoadCache(s.cachePath)
 		if err != nil {
 			s.out <- fmt.Sprintf("Failed to load cache: %s\nWARNING: It will be unbearably slow!", err)
 		}
+		// The jobs in the order they were dispatched; it limits the number of
+		// items in flight.
+		pending := make(chan *hashJob, 4096)
+		work := make(chan *hashJob)
+		var wg sync.WaitGroup
+		for i := 0; i < jobs; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := range work {
+					if dumbcaslib.IsInterrupted() || s.aborted() {
+						close(j.result)
+						continue
+					}
+					s.hashItem(cas, j, noCache)
+				}
+			}()
+		}
+		forwarded := make(chan bool)
+		go func() {
+			for j := range pending {
+				if item, ok := <-j.result; ok && !dumbcaslib.IsInterrupted() {
+					select {
+					case c <- item:
+					case <-dumbcaslib.Interrupted():
+					}
+				}
+			}
+			forwarded <- true
+		}()
+		// The files are looked up in the table in batches, so a remote table is
+		// not queried once per file.
+		batch := make([]*hashJob, 0, existsBatchSize)
+		digestSize := cas.NewHash().Size()
+		dispatch := func() {
+			hashes := make([]string, 0, len(batch))
+			// The objects holding the content reused by each job, from the node of
+			// -since or from the cache; nil if the manifest can't be read.
+			objects := map[*hashJob][]string{}
+			for _, j := range batch {
+				var e *dumbcaslib.Entry
+				if j.since != nil {
+					e = j.since
+				} else if !noCache && j.cached != nil && cacheMatches(j.cached, j.item, digestSize) {
+					e = &dumbcaslib.Entry{Sha1: j.cached.Sha1, Manifest: j.cached.Manifest}
+				}
+				if e != nil {
+					if o, err := e.Objects(cas); err == nil {
+						objects[j] = o
+						hashes = append(hashes, o...)
+					}
+				}
+			}
+			var found map[string]bool
+			if len(hashes) != 0 {
+				found = cas.ExistsMany(hashes)
+			}
+			for _, j := range batch {
+				o := objects[j]
+				present := len(o) != 0
+				for _, hash := range o {
+					present = present && found[hash]
+				}
+				if j.since != nil {
+					if !present {
+						// The content was removed from the table since, e.g. by gc, so the
+						// file is archived again.
+						j.since = nil
+					}
+				} else {
+					j.present = present
+				}
+				work <- j
+			}
+			batch = batch[:0]
+		}
 		defer func() {
+			if !dumbcaslib.IsInterrupted() {
+				dispatch()
+			}
+			for _, j := range batch {
+				close(j.result)
+			}
+			close(work)
+			close(pending)
+			wg.Wait()
+			<-forwarded
 			// Must save the cache *before* sending the 'done' signal.
 			close(c)
-			// TODO(maruel): Surface the error.
-			_ = cache.Close()
+			var invalidated int
+			if !dumbcaslib.IsInterrupted() {
+				for _, input := range s.inputs {
+					invalidated += dumbcaslib.PruneCache(cache, input)
+				}
+				if invalidated != 0 {
+					s.log.Debugf("Removed %d entries of deleted files from the cache", invalidated)
+				}
+			}
+			*cache.Stats() = dumbcaslib.CacheStats{Hits: s.cacheHits.Get(), Misses: s.cacheMisses.Get(), Invalidated: int64(invalidated), When: time.Now()}
+			if err := cache.Close(); err != nil {
+				s.log.Warningf("Failed to save the cache: %s", err)
+			}
 			s.done <- true
 		}()
 		for {
 			select {
-			case <-interrupt.Channel:
+			case <-dumbcaslib.Interrupted():
 				// Early exit.
 				s.interrupted.Add(1)
 				return
@@ -270,43 +748,166 @@ func (s *stats) hashInputs(a DumbcasApplication, inputs <-chan inputItem) <-chan
 					s.out <- fmt.Sprintf("Done hashing.")
 					return
 				}
-				if item.IsDir() {
-					panic("This can't happen; enumerateInputs() should eat all the directories.")
+				j := &hashJob{item: item, result: make(chan itemToArchive, 1)}
+				pending <- j
+				if item.doneInput != "" {
+					j.result <- itemToArchive{doneInput: item.doneInput}
+					continue
 				}
-				size := item.Size()
-				cachedItem := dumbcaslib.FindInCache(cache, item.fullPath)
-				if wasHashed, err := updateFile(cachedItem, item); err != nil {
-					// Eat the error and continue archiving other items.
-					s.errors.Add(1)
-					s.out <- fmt.Sprintf("Failed to process %s: %s", item.fullPath, err)
+				if item.IsDir() {
+					j.result <- itemToArchive{fullPath: item.fullPath, relPath: item.relPath, mode: item.Mode().Perm(), modTime: item.ModTime().UTC(), dir: true}
 					continue
-				} else if wasHashed {
-					//s.out <- fmt.Sprintf("Hashed: %s", item.relPath)
-					s.nbHashed.Add(1)
-					s.bytesHashed.Add(size)
-				} else {
-					s.nbNotHashed.Add(1)
-					s.bytesNotHashed.Add(size)
 				}
-				c <- itemToArchive{item.fullPath, item.relPath, cachedItem.Sha1, size}
+				if item.Mode()&os.ModeSymlink == 0 {
+					// The cache is not safe for concurrent use.
+					j.cached = dumbcaslib.FindInCache(cache, item.fullPath)
+					j.since = s.unchangedSince(item)
+				}
+				batch = append(batch, j)
+				if len(batch) == existsBatchSize || len(inputs) == 0 {
+					// Don't hold the batch while waiting for the enumeration.
+					dispatch()
+				}
 			}
 		}
 	}()
 	return c
 }
 
-// Archives one item in the CAS table.
-func (s *stats) archiveItem(item itemToArchive, cas dumbcaslib.CasTable) {
+// hashItem hashes a file or reads a symlink, then archives the file content.
+// Sends the result to j.result.
+func (s *stats) hashItem(cas dumbcaslib.CasTable, j *hashJob, noCache bool) {
+	defer close(j.result)
+	item := j.item
+	size := item.Size()
+	if item.Mode()&os.ModeSymlink != 0 {
+		// Only enumerated with -symlinks=store; there's no content to hash.
+		target, err := os.Readlink(item.fullPath)
+		if err != nil {
+			s.fail(item.fullPath, fmt.Sprintf("Failed to process %s: %s", item.fullPath, err))
+			return
+		}
+		s.nbNotHashed.Add(1)
+		s.bytesNotHashed.Add(size)
+		j.result <- itemToArchive{fullPath: item.fullPath, relPath: item.relPath, size: size, symlink: target}
+		return
+	}
+	cachedItem := j.cached
+	if prev := j.since; prev != nil {
+		// The node of -since references the content, so it is not read.
+		cachedItem.Sha1 = prev.Sha1
+		cachedItem.Manifest = prev.Manifest
+		cachedItem.Size = size
+		cachedItem.Timestamp = item.ModTime().Unix()
+		cachedItem.LastTested = time.Now().Unix()
+		s.nbNotHashed.Add(1)
+		s.bytesNotHashed.Add(size)
+		out := itemToArchive{fullPath: item.fullPath, relPath: item.relPath, sha1: prev.Sha1, size: size, mode: item.Mode().Perm(), modTime: item.ModTime().UTC(), cached: true, manifest: prev.Manifest}
+		s.fileAttributes(&out, item)
+		s.archiveItem(&out, cachedItem, cas)
+		j.result <- out
+		return
+	}
+	wasHashed, err := updateFile(cachedItem, item, cas.NewHash(), noCache)
+	if err == nil && !wasHashed && !j.present {
+		// The cache is shared across tables. The file has to be read to be
+		// archived anyway so don't trust the cached hash.
+		wasHashed, err = updateFile(cachedItem, item, cas.NewHash(), true)
+	}
+	if err != nil {
+		// Eat the error and continue archiving other items.
+		s.fail(item.fullPath, fmt.Sprintf("Failed to process %s: %s", item.fullPath, err))
+		return
+	} else if wasHashed {
+		s.log.Tracef("Hashed: %s", item.relPath)
+		s.cacheMisses.Add(1)
+		s.nbHashed.Add(1)
+		s.bytesHashed.Add(size)
+	} else {
+		s.cacheHits.Add(1)
+		s.nbNotHashed.Add(1)
+		s.bytesNotHashed.Add(size)
+	}
+	out := itemToArchive{fullPath: item.fullPath, relPath: item.relPath, sha1: cachedItem.Sha1, size: size, mode: item.Mode().Perm(), modTime: item.ModTime().UTC(), cached: !wasHashed, manifest: cachedItem.Manifest}
+	s.fileAttributes(&out, item)
+	s.archiveItem(&out, cachedItem, cas)
+	j.result <- out
+}
+
+// fileAttributes reads the extended attributes with -xattrs and the
+// hardlink group with -hardlinks of item into out.
+func (s *stats) fileAttributes(out *itemToArchive, item inputItem) {
+	if s.xattrs {
+		var err error
+		if out.xattrs, err = dumbcaslib.ReadXattrs(item.fullPath); err != nil {
+			// Still archive the content.
+			s.out <- fmt.Sprintf("Failed to read the extended attributes of %s: %s", item.fullPath, err)
+		}
+	}
+	if s.hardlinks {
+		out.inode, _ = dumbcaslib.HardlinkID(item.FileInfo)
+	}
+}
+
+// unchangedSince returns the entry of item in the node of -since if the file
+// has the same size and timestamp, nil otherwise.
+func (s *stats) unchangedSince(item inputItem) *dumbcaslib.Entry {
+	if s.since == nil {
+		return nil
+	}
+	e := s.since
+	for _, name := range strings.Split(item.relPath, string(filepath.Separator)) {
+		if e = e.Files[name]; e == nil {
+			return nil
+		}
+	}
+	if e.IsDir() || e.Symlink != "" || e.Sha1 == "" || e.Size != item.Size() || e.ModTime.IsZero() || !e.ModTime.Equal(item.ModTime()) {
+		return nil
+	}
+	return e
+}
+
+// Archives one item in the CAS table. The manifest of a file archived with
+// -chunk-threshold is recorded in item and in its cache entry.
+func (s *stats) archiveItem(item *itemToArchive, cache *dumbcaslib.EntryCache, cas dumbcaslib.CasTable) {
+	if item.cached && item.manifest != "" {
+		// The manifest and all its chunks are present.
+		s.nbNotArchived.Add(1)
+		s.bytesNotArchived.Add(item.size)
+		return
+	}
+	if item.cached || cas.Exists(item.sha1) {
+		// Don't read the file again, nor upload it to a remote table.
+		s.nbNotArchived.Add(1)
+		s.bytesNotArchived.Add(item.size)
+		return
+	}
 	f, err := os.Open(item.fullPath)
 	if err != nil {
-		s.errors.Add(1)
-		s.out <- fmt.Sprintf("Failed to archive %s: %s", item.fullPath, err)
+		s.fail(item.fullPath, fmt.Sprintf("Failed to archive %s: %s", item.fullPath, err))
 		return
 	}
 	defer func() {
 		_ = f.Close()
 	}()
-	err = cas.AddEntry(f, item.sha1)
+	if s.chunkThreshold != 0 && item.size != 0 && item.size >= s.chunkThreshold {
+		manifest, added, err := dumbcaslib.ArchiveChunks(cas, f)
+		if err != nil {
+			s.fail(item.fullPath, fmt.Sprintf("Failed to archive %s: %s", item.fullPath, err))
+			return
+		}
+		item.manifest = manifest
+		cache.Manifest = manifest
+		if added != 0 {
+			s.nbArchived.Add(1)
+		} else {
+			s.nbNotArchived.Add(1)
+		}
+		s.bytesArchived.Add(added)
+		s.bytesNotArchived.Add(item.size - added)
+		return
+	}
+	err = dumbcaslib.AddEntrySized(cas, f, item.sha1, item.size)
 	if os.IsExist(err) {
 		s.nbNotArchived.Add(1)
 		s.bytesNotArchived.Add(item.size)
@@ -314,27 +915,23 @@ func (s *stats) archiveItem(item itemToArchive, cas dumbcaslib.CasTable) {
 		s.nbArchived.Add(1)
 		s.bytesArchived.Add(item.size)
 	} else {
-		s.errors.Add(1)
-		s.out <- fmt.Sprintf("Failed to archive %s: %s", item.fullPath, err)
+		s.fail(item.fullPath, fmt.Sprintf("Failed to archive %s: %s", item.fullPath, err))
 	}
 }
 
-// Creates the Entry instance and the necessary Entry tree for |item|.
-func makeEntry(root *dumbcaslib.Entry, item itemToArchive) {
-	for _, p := range strings.Split(item.relPath, string(filepath.Separator)) {
-		if root.Files == nil {
-			root.Files = make(map[string]*dumbcaslib.Entry)
-		}
-		if root.Files[p] == nil {
-			root.Files[p] = &dumbcaslib.Entry{}
-		}
-		root = root.Files[p]
+// failedPath returns the path of the file that failed to be enumerated in
+// input.
+func failedPath(input string, item dumbcaslib.TreeItem) string {
+	if item.FullPath != "" {
+		return item.FullPath
+	}
+	if err, ok := item.Error.(*os.PathError); ok {
+		return err.Path
 	}
-	root.Sha1 = item.sha1
-	root.Size = item.size
+	return input
 }
 
-// Archives the items.
+// Assembles the tree of the items and archives it.
 func (s *stats) archiveInputs(a DumbcasApplication, cas dumbcaslib.CasTable, items <-chan itemToArchive) <-chan string {
 	c := make(chan string)
 	go func() {
@@ -343,10 +940,17 @@ func (s *stats) archiveInputs(a DumbcasApplication, cas dumbcaslib.CasTable, ite
 			s.done <- true
 		}()
 		entryRoot := &dumbcaslib.Entry{}
+		if s.checkpoint != nil && s.checkpoint.Entry != nil {
+			entryRoot = s.checkpoint.Entry
+		}
+		// The hardlink groups, keyed by inode. The groups of a resumed archive
+		// must not be reused.
+		links := map[string]int{}
+		lastLink := maxLink(entryRoot)
 		cont := true
 		for cont {
 			select {
-			case <-interrupt.Channel:
+			case <-dumbcaslib.Interrupted():
 				// Early exit.
 				s.interrupted.Add(1)
 				return
@@ -355,9 +959,38 @@ func (s *stats) archiveInputs(a DumbcasApplication, cas dumbcaslib.CasTable, ite
 					cont = false
 					continue
 				}
-				//s.out <- fmt.Sprintf("Archiving: %s", item.relPath)
-				makeEntry(entryRoot, item)
-				s.archiveItem(item, cas)
+				s.log.Tracef("Archiving: %s", item.relPath)
+				if item.doneInput != "" {
+					// The files of the inputs with errors will be retried on resume.
+					if s.checkpoint != nil && s.errors.Get() == 0 {
+						if err := s.checkpoint.save(item.doneInput, entryRoot); err != nil {
+							s.out <- fmt.Sprintf("Failed to write the checkpoint: %s", err)
+						}
+					}
+					continue
+				}
+				if item.dir {
+					entryRoot.AddDir(item.relPath, item.mode).ModTime = item.modTime
+					continue
+				}
+				if item.symlink != "" {
+					entryRoot.AddSymlink(item.relPath, item.symlink)
+					s.nbNotArchived.Add(1)
+					s.bytesNotArchived.Add(item.size)
+					continue
+				}
+				e := entryRoot.AddFile(item.relPath, item.sha1, item.size)
+				e.Mode = item.mode
+				e.ModTime = item.modTime
+				e.Xattrs = item.xattrs
+				e.Manifest = item.manifest
+				if item.inode != "" {
+					if links[item.inode] == 0 {
+						lastLink++
+						links[item.inode] = lastLink
+					}
+					e.Link = links[item.inode]
+				}
 			}
 		}
 		// Serializes the entry file to archive it too.
@@ -365,32 +998,48 @@ func (s *stats) archiveInputs(a DumbcasApplication, cas dumbcaslib.CasTable, ite
 		if err != nil {
 			s.errors.Add(1)
 			s.out <- fmt.Sprintf("Failed to marshal entry file: %s", err)
+			return
+		}
+		entrySha1, err := dumbcaslib.AddBytes(cas, data)
+		if os.IsExist(err) {
+			s.nbNotArchived.Add(1)
+			s.bytesNotArchived.Add(int64(len(data)))
+			c <- entrySha1
+		} else if err == nil {
+			s.nbArchived.Add(1)
+			s.bytesArchived.Add(int64(len(data)))
+			c <- entrySha1
 		} else {
-			entrySha1, err := dumbcaslib.AddBytes(cas, data)
-			if os.IsExist(err) {
-				s.nbNotArchived.Add(1)
-				s.bytesNotArchived.Add(int64(len(data)))
-				c <- entrySha1
-			} else if err == nil {
-				s.nbArchived.Add(1)
-				s.bytesArchived.Add(int64(len(data)))
-				c <- entrySha1
-			} else {
-				s.errors.Add(1)
-				s.out <- fmt.Sprintf("Failed to archive entry file: %s", err)
-			}
+			s.errors.Add(1)
+			s.out <- fmt.Sprintf("Failed to archive entry file: %s", err)
 		}
 	}()
 	return c
 }
 
-// Converts to absolute paths and evaluate environment variables.
+// maxLink returns the largest hardlink group in the tree.
+func maxLink(e *dumbcaslib.Entry) int {
+	max := e.Link
+	for _, child := range e.Files {
+		if l := maxLink(child); l > max {
+			max = l
+		}
+	}
+	return max
+}
+
+// Converts to absolute paths and evaluate environment variables. The paths may
+// use "/" as the separator on Windows too; the ones without a drive letter are
+// on the drive of relDir.
 func cleanupList(relDir string, inputs []string) {
 	for index, item := range inputs {
-		item = os.ExpandEnv(item)
-		item = strings.Replace(item, "/", string(filepath.Separator), 0)
+		item = filepath.FromSlash(os.ExpandEnv(item))
 		if !filepath.IsAbs(item) {
-			item = filepath.Join(relDir, item)
+			if strings.HasPrefix(item, string(filepath.Separator)) {
+				item = filepath.VolumeName(relDir) + item
+			} else {
+				item = filepath.Join(relDir, item)
+			}
 		}
 		inputs[index] = filepath.Clean(item)
 	}
@@ -405,51 +1054,170 @@ func toMb(i int64) float64 {
 // - Updating the hash for each items in the cache.
 // - Archiving items.
 func (c *archiveRun) main(a DumbcasApplication, toArchiveArg string) error {
+	start := time.Now()
+	if c.name != "" && !isValidName(c.name) {
+		return fmt.Errorf("Invalid -name %q", c.name)
+	}
+	tags, err := parseTags(c.tags)
+	if err != nil {
+		return err
+	}
 	if err := c.Parse(a, true); err != nil {
 		return err
 	}
+	if err := c.Lock(a, false); err != nil {
+		return err
+	}
+	defer c.Unlock()
 
 	toArchive, err := filepath.Abs(toArchiveArg)
 	if err != nil {
 		return fmt.Errorf("Failed to process %s", toArchiveArg)
 	}
 
-	inputs, err := readFileAsStrings(toArchive)
+	var inputs []string
+	if c.filesFrom != "" {
+		inputs, err = readFilesFrom(a.GetLog(), toArchive, c.strict)
+	} else {
+		inputs, err = readFileAsStrings(toArchive)
+		cleanupList(filepath.Dir(toArchive), inputs)
+	}
 	if err != nil {
 		return err
 	}
+	listed := map[string]bool{}
+	if c.filesFrom != "" {
+		for _, input := range inputs {
+			listed[input] = true
+		}
+	}
+	excludes := dumbcaslib.Excludes(c.excludes)
+	if c.excludeFrom != "" {
+		more, err := readExcludes(c.excludeFrom)
+		if err != nil {
+			return err
+		}
+		excludes = append(excludes, more...)
+	}
+	if err := excludes.Check(); err != nil {
+		return err
+	}
+	includes := dumbcaslib.Excludes(c.includes)
+	if err := includes.Check(); err != nil {
+		return err
+	}
+	opts := dumbcaslib.TreeOptions{
+		Excludes:      excludes,
+		Includes:      includes,
+		Symlinks:      dumbcaslib.SymlinkMode(c.symlinks),
+		OneFileSystem: !c.followMounts,
+		EmptyDirs:     true,
+	}
+	if err := opts.Symlinks.Check(); err != nil {
+		return err
+	}
+	if c.progressInterval <= 0 {
+		return fmt.Errorf("-progress-interval must be positive")
+	}
+	jobs := c.Jobs
+	if jobs <= 0 {
+		jobs = dumbcaslib.DefaultJobs
+	}
+	if c.minFileSize < 0 || c.maxFileSize < 0 {
+		return fmt.Errorf("-min-file-size and -max-file-size must be positive")
+	}
+	if c.maxFileSize != 0 && c.minFileSize > c.maxFileSize {
+		return fmt.Errorf("-min-file-size must not be larger than -max-file-size")
+	}
+	if c.chunkThreshold < 0 {
+		return fmt.Errorf("-chunk-threshold must be positive")
+	}
+	var since *dumbcaslib.Entry
+	if c.since != "" {
+		if c.splitNodes {
+			return fmt.Errorf("-since is not supported with -one-node-per-top-level")
+		}
+		// The node records its parent by its real name since the tag moves with
+		// each new archive.
+		name, err := dumbcaslib.ResolveNode(c.nodes, filepath.FromSlash(c.since))
+		if err != nil {
+			return fmt.Errorf("Failed to load -since %s: %s", c.since, err)
+		}
+		node, err := dumbcaslib.LoadNode(c.nodes, name)
+		if err != nil {
+			return fmt.Errorf("Failed to load -since %s: %s", c.since, err)
+		}
+		if since, err = dumbcaslib.LoadEntry(c.cas, node.Entry); err != nil {
+			return fmt.Errorf("Failed to load -since %s: %s", c.since, err)
+		}
+		c.since = filepath.ToSlash(name)
+	}
 	// Make sure the file itself is archived too.
 	inputs = append(inputs, toArchive)
-	a.GetLog().Printf("Found %d entries to backup in %s", len(inputs), toArchive)
-	cleanupList(filepath.Dir(toArchive), inputs)
+	a.GetLogger().Infof("Found %d entries to backup in %s", len(inputs), toArchive)
+	base := ""
+	if c.base != "" {
+		if base, err = filepath.Abs(c.base); err != nil {
+			return fmt.Errorf("Failed to process -base %s: %s", c.base, err)
+		}
+		// The .toArchive file itself is stored by its name.
+		for _, input := range inputs[:len(inputs)-1] {
+			if !isInside(input, base) {
+				return fmt.Errorf("%s is not inside -base %s", input, base)
+			}
+		}
+	}
+	if !dumbcaslib.IsRemote(c.Root) {
+		for _, input := range inputs {
+			if isInside(input, c.Root) {
+				return fmt.Errorf("Refusing to archive %s: it is inside the root %s", input, c.Root)
+			}
+		}
+	}
+
+	if c.xattrs && !dumbcaslib.XattrsSupported {
+		a.GetLogger().Warningf("-xattrs is not supported on %s, the extended attributes are not archived", runtime.GOOS)
+	}
+
+	cachePath := c.cachePath
+	if cachePath == "" {
+		cachePath = filepath.Join(c.lockRoot, cacheName)
+	}
 
 	// Start the processes.
 	output := make(chan string)
 	done := make(chan bool, 3)
-	s := stats{out: output, done: done}
-	entry := s.archiveInputs(a, c.cas, s.hashInputs(a, s.enumerateInputs(inputs)))
+	s := stats{out: output, done: done, base: base, xattrs: c.xattrs, hardlinks: c.hardlinks, minSize: c.minFileSize, maxSize: c.maxFileSize, listed: listed, strict: c.strict, chunkThreshold: c.chunkThreshold, cachePath: cachePath, inputs: inputs, since: since, log: a.GetLogger()}
+	if c.resume {
+		s.checkpoint = loadCheckpointer(a.GetLog(), filepath.Join(c.lockRoot, checkpointsName, filepath.Base(toArchive)+".json"), inputs)
+	}
+	entry := s.archiveInputs(a, c.cas, s.hashInputs(a, c.cas, s.enumerateInputs(inputs, opts), c.noCache, jobs))
 
 	headerWasPrinted := false
-	columns := []string{
-		"Found",
-		"Hashed",
-		"In cache",
-		"Archived",
-		"Skipped",
-		"Done",
-	}
-	for i := range columns {
-		columns[i] = fmt.Sprintf("%-19s", columns[i])
+	column := progressHeader()
+
+	// The progress is logged at a constant pace even while other lines are
+	// logged.
+	ticker := time.NewTicker(c.progressInterval)
+	defer ticker.Stop()
+	var progress <-chan time.Time
+	if !c.quiet {
+		progress = ticker.C
 	}
-	column := strings.TrimSpace(strings.Join(columns, ""))
 
 	errDone := errors.New("Dummy")
+	nodeName := ""
+	rootHash := ""
+	// treeHash is the whole tree archived, which is split in multiple nodes
+	// with -one-node-per-top-level.
+	treeHash := ""
 	prevStats := s.Copy()
+	prevTime := time.Now()
 	for err == nil {
 		select {
 		case line := <-output:
 			a.GetLog().Print(line)
-		case <-interrupt.Channel:
+		case <-dumbcaslib.Interrupted():
 			// Early exit. Note this as an error.
 			err = fmt.Errorf("Was interrupted.")
 		case item, ok := <-entry:
@@ -464,10 +1232,17 @@ func (c *archiveRun) main(a DumbcasApplication, toArchiveArg string) error {
 				}
 				continue
 			}
-			if item != "" {
-				node := &dumbcaslib.Node{Entry: item, Comment: c.comment}
-				_, err = c.nodes.AddEntry(node, filepath.Base(toArchive))
-				err = errDone
+			if item != "" && s.aborted() {
+				err = fmt.Errorf("Got %d errors, the node was not created because of -strict.", s.errors.Get())
+			} else if item != "" {
+				name := c.name
+				if name == "" {
+					name = filepath.Base(toArchive)
+				}
+				treeHash = item
+				if nodeName, rootHash, err = c.addNodes(a, item, name, tags); err == nil {
+					err = errDone
+				}
 			} else {
 				e := s.errors.Get()
 				if e != 0 {
@@ -478,17 +1253,23 @@ func (c *archiveRun) main(a DumbcasApplication, toArchiveArg string) error {
 					err = fmt.Errorf("Unexpected error.")
 				}
 			}
-		case <-time.After(5 * time.Second):
+		case now := <-progress:
 			nextStats := s.Copy()
 			if !prevStats.equals(nextStats) {
 				if !headerWasPrinted {
 					a.GetLog().Printf(column)
 					headerWasPrinted = true
 				}
+				// Throughput of the data done, either archived or skipped, since the
+				// last report.
+				prevDone := prevStats.bytesArchived.Get() + prevStats.bytesNotArchived.Get()
+				nextDone := nextStats.bytesArchived.Get() + nextStats.bytesNotArchived.Get()
+				throughput := toMb(nextDone-prevDone) / now.Sub(prevTime).Seconds()
 				prevStats = nextStats
-				fractionDone := float64(prevStats.bytesArchived.Get()+prevStats.bytesNotArchived.Get()) / float64(prevStats.totalSize.Get())
+				prevTime = now
+				fractionDone := float64(nextDone) / float64(prevStats.totalSize.Get())
 				a.GetLog().Printf(
-					"%6d(%8.1fmb) %6d(%8.1fmb) %6d(%8.1fmb) %6d(%8.1fmb) %6d(%8.1fmb) %3.1f%% %d errors",
+					"%6d(%8.1fmb) %6d(%8.1fmb) %6d(%8.1fmb) %6d(%8.1fmb) %6d(%8.1fmb) %3.1f%% %d errors %.1fmb/s",
 					prevStats.found.Get(),
 					toMb(prevStats.totalSize.Get()),
 					prevStats.nbHashed.Get(),
@@ -500,14 +1281,15 @@ func (c *archiveRun) main(a DumbcasApplication, toArchiveArg string) error {
 					prevStats.nbNotArchived.Get(),
 					toMb(prevStats.bytesNotArchived.Get()),
 					100.*fractionDone,
-					prevStats.errors.Get())
+					prevStats.errors.Get(),
+					throughput)
 			}
 		}
 	}
 	if err == errDone {
 		err = nil
 	}
-	if interrupt.IsSet() {
+	if dumbcaslib.IsInterrupted() && c.outputFormat == "text" {
 		fmt.Fprintf(a.GetOut(), "Was interrupted, waiting for processes to terminate.\n")
 	}
 	// Make sure all the worker threads are done. They may still be processing in
@@ -515,34 +1297,257 @@ func (c *archiveRun) main(a DumbcasApplication, toArchiveArg string) error {
 	for i := 0; i < 3; i++ {
 		<-done
 	}
-	fmt.Fprintf(a.GetOut(), column+"\n")
-	fractionDone := float64(s.bytesArchived.Get()+s.bytesNotArchived.Get()) / float64(s.totalSize.Get())
-	fmt.Fprintf(
-		a.GetOut(),
-		"%7d(%7.1fmb) %7d(%7.1fmb) %7d(%7.1fmb) %7d(%7.1fmb) %7d(%7.1fmb) %3.1f%% %d errors\n",
-		s.found.Get(),
-		toMb(s.totalSize.Get()),
-		s.nbHashed.Get(),
-		toMb(s.bytesHashed.Get()),
-		s.nbNotHashed.Get(),
-		toMb(s.bytesNotHashed.Get()),
-		s.nbArchived.Get(),
-		toMb(s.bytesArchived.Get()),
-		s.nbNotArchived.Get(),
-		toMb(s.bytesNotArchived.Get()),
-		100.*fractionDone,
-		s.errors.Get())
+	summary := &archiveManifest{
+		Files:              s.found.Get(),
+		Bytes:              s.totalSize.Get(),
+		Hashed:             s.nbHashed.Get(),
+		HashedBytes:        s.bytesHashed.Get(),
+		Cached:             s.nbNotHashed.Get(),
+		CachedBytes:        s.bytesNotHashed.Get(),
+		Archived:           s.nbArchived.Get(),
+		ArchivedBytes:      s.bytesArchived.Get(),
+		Existing:           s.nbNotArchived.Get(),
+		ExistingBytes:      s.bytesNotArchived.Get(),
+		SkippedBySize:      s.skippedBySize.Get(),
+		SkippedBySizeBytes: s.bytesSkippedBySize.Get(),
+		Errors:             s.errors.Get(),
+		Duration:           time.Since(start).Seconds(),
+	}
+	// With -strict, they are why the node was not created.
+	summary.Skipped = s.getSkipped()
+	if nodeName == "" {
+		c.printSummary(a, summary)
+		return err
+	}
+	summary.Node = nodeName
+	summary.RootHash = rootHash
+	c.printSummary(a, summary)
+	if s.checkpoint != nil {
+		_ = os.Remove(s.checkpoint.path)
+	}
+	if err := c.verifyArchived(a, nodeName, treeHash); err != nil {
+		return err
+	}
+	return c.writeManifest(summary)
+}
+
+// progressHeader returns the header of the progress lines and of the text
+// summary.
+func progressHeader() string {
+	columns := []string{
+		"Found",
+		"Hashed",
+		"In cache",
+		"Archived",
+		"Skipped",
+		"Done",
+	}
+	for i := range columns {
+		columns[i] = fmt.Sprintf("%-19s", columns[i])
+	}
+	return strings.TrimSpace(strings.Join(columns, ""))
+}
+
+// printSummary prints m as selected by -output-format.
+func (c *archiveRun) printSummary(a DumbcasApplication, m *archiveManifest) {
+	switch c.outputFormat {
+	case "json":
+		data, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			a.GetLogger().Warningf("Failed to print the summary: %s", err)
+			return
+		}
+		fmt.Fprintf(a.GetOut(), "%s\n", data)
+	case "text":
+		fmt.Fprintln(a.GetOut(), progressHeader())
+		fractionDone := float64(m.ArchivedBytes+m.ExistingBytes) / float64(m.Bytes)
+		fmt.Fprintf(
+			a.GetOut(),
+			"%7d(%7.1fmb) %7d(%7.1fmb) %7d(%7.1fmb) %7d(%7.1fmb) %7d(%7.1fmb) %3.1f%% %d errors\n",
+			m.Files,
+			toMb(m.Bytes),
+			m.Hashed,
+			toMb(m.HashedBytes),
+			m.Cached,
+			toMb(m.CachedBytes),
+			m.Archived,
+			toMb(m.ArchivedBytes),
+			m.Existing,
+			toMb(m.ExistingBytes),
+			100.*fractionDone,
+			m.Errors)
+		if m.SkippedBySize != 0 {
+			fmt.Fprintf(a.GetOut(), "Skipped by size: %d files (%.1fmb)\n", m.SkippedBySize, toMb(m.SkippedBySizeBytes))
+		}
+		if m.Node != "" && len(m.Skipped) != 0 {
+			fmt.Fprintf(a.GetOut(), "Skipped %d files that couldn't be read, the node is incomplete\n", len(m.Skipped))
+		} else if len(m.Skipped) != 0 {
+			fmt.Fprintf(a.GetOut(), "Skipped %d files that couldn't be read\n", len(m.Skipped))
+		}
+	}
+}
+
+// addNodes adds the node for the tree rootHash. With -one-node-per-top-level,
+// each directory at the root of the tree gets its own node and the node name
+// only has the rest. Returns the name and the tree of the node name.
+func (c *archiveRun) addNodes(a DumbcasApplication, rootHash, name string, tags map[string]string) (string, string, error) {
+	if c.splitNodes {
+		root, err := dumbcaslib.LoadEntry(c.cas, rootHash)
+		if err != nil {
+			return "", "", err
+		}
+		rest := &dumbcaslib.Entry{Files: map[string]*dumbcaslib.Entry{}}
+		for _, child := range root.SortedFiles() {
+			entry := root.Files[child]
+			if !entry.IsDir() {
+				rest.Files[child] = entry
+				continue
+			}
+			// The directory is the root of its node, along with its attributes.
+			hash, err := dumbcaslib.ArchiveEntry(c.cas, entry)
+			if err != nil && !os.IsExist(err) {
+				return "", "", fmt.Errorf("Failed to archive entry file: %s", err)
+			}
+			nodeName, err := c.nodes.AddEntry(&dumbcaslib.Node{Entry: hash, Comment: c.comment, Tags: tags}, name+"-"+child)
+			if err != nil {
+				return "", "", err
+			}
+			a.GetLogger().Infof("Archived %s as %s", child, nodeName)
+		}
+		if rootHash, err = dumbcaslib.ArchiveEntry(c.cas, rest); err != nil && !os.IsExist(err) {
+			return "", "", fmt.Errorf("Failed to archive entry file: %s", err)
+		}
+	}
+	nodeName, err := c.nodes.AddEntry(&dumbcaslib.Node{Entry: rootHash, Comment: c.comment, Tags: tags, Parent: c.since}, name)
+	if err != nil {
+		return "", "", err
+	}
+	return nodeName, rootHash, nil
+}
+
+// verifyArchived verifies the tree entryHash just archived as nodeName with
+// -verify-after-archive or -verify-deep, to catch the writes silently lost by
+// the storage before reporting success.
+func (c *archiveRun) verifyArchived(a DumbcasApplication, nodeName, entryHash string) error {
+	if !c.verifyAfter && !c.verifyDeep {
+		return nil
+	}
+	v := &verifyRun{Deep: c.verifyDeep, MaxErrors: 10, quiet: c.outputFormat != "text"}
+	v.cas = c.cas
+	if err := v.verifyNode(a, nodeName, entryHash); err != nil {
+		return fmt.Errorf("Verification of %s failed: %s", nodeName, err)
+	}
 	return nil
 }
 
+// writeManifest writes m to -manifest, if specified.
+func (c *archiveRun) writeManifest(m *archiveManifest) error {
+	if c.manifest == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.manifest, append(data, '\n'), 0640); err != nil {
+		return fmt.Errorf("Failed to write the manifest: %s", err)
+	}
+	return nil
+}
+
+// mainStdin archives stdin as a single file. The content is streamed to the
+// table so its size isn't bounded by the memory.
+func (c *archiveRun) mainStdin(a DumbcasApplication) error {
+	start := time.Now()
+	if !isValidName(c.name) {
+		return errors.New("Must provide a file name with -name")
+	}
+	tags, err := parseTags(c.tags)
+	if err != nil {
+		return err
+	}
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	if err := c.Lock(a, false); err != nil {
+		return err
+	}
+	defer c.Unlock()
+
+	hash, size, err := dumbcaslib.ArchiveReader(c.cas, a.GetIn())
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Failed to archive stdin: %s", err)
+	}
+	// The content may already be in the table.
+	archived, existing := int64(1), int64(0)
+	if err != nil {
+		archived, existing = 0, 1
+	}
+	root := &dumbcaslib.Entry{}
+	root.AddFile(c.name, hash, size)
+	entry, err := dumbcaslib.ArchiveEntry(c.cas, root)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	nodeName, err := c.nodes.AddEntry(&dumbcaslib.Node{Entry: entry, Comment: c.comment, Tags: tags}, c.name)
+	if err != nil {
+		return err
+	}
+	summary := &archiveManifest{
+		Node:          nodeName,
+		RootHash:      entry,
+		Files:         1,
+		Bytes:         size,
+		Hashed:        1,
+		HashedBytes:   size,
+		Archived:      archived,
+		ArchivedBytes: archived * size,
+		Existing:      existing,
+		ExistingBytes: existing * size,
+		Duration:      time.Since(start).Seconds(),
+	}
+	if c.outputFormat == "text" {
+		fmt.Fprintf(a.GetOut(), "Archived %d bytes as %s\n", size, nodeName)
+	} else {
+		c.printSummary(a, summary)
+	}
+	if err := c.verifyArchived(a, nodeName, entry); err != nil {
+		return err
+	}
+	return c.writeManifest(summary)
+}
+
 func (c *archiveRun) Run(a subcommands.Application, args []string) int {
-	if len(args) != 1 {
-		fmt.Fprintf(a.GetErr(), "%s: Must only provide a .toArchive file.\n", a.GetName())
+	d := a.(DumbcasApplication)
+	if c.outputFormat != "text" && c.outputFormat != "json" && c.outputFormat != "quiet" {
+		fmt.Fprintf(a.GetErr(), "%s: -output-format must be one of text, json or quiet.\n", a.GetName())
 		return 1
 	}
-	interrupt.HandleCtrlC()
-	d := a.(DumbcasApplication)
-	if err := c.main(d, args[0]); err != nil {
+	var err error
+	if c.stdin {
+		if len(args) != 0 || c.filesFrom != "" {
+			fmt.Fprintf(a.GetErr(), "%s: Can't provide a .toArchive file with -stdin.\n", a.GetName())
+			return 1
+		}
+		if c.since != "" {
+			fmt.Fprintf(a.GetErr(), "%s: -since is not supported with -stdin.\n", a.GetName())
+			return 1
+		}
+		err = c.mainStdin(d)
+	} else if c.filesFrom != "" {
+		if len(args) != 0 {
+			fmt.Fprintf(a.GetErr(), "%s: Can't provide a .toArchive file with -files-from.\n", a.GetName())
+			return 1
+		}
+		err = c.main(d, c.filesFrom)
+	} else {
+		if len(args) != 1 {
+			fmt.Fprintf(a.GetErr(), "%s: Must only provide a .toArchive file.\n", a.GetName())
+			return 1
+		}
+		err = c.main(d, args[0])
+	}
+	if err != nil {
 		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
 		return 1
 	}
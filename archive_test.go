@@ -10,9 +10,20 @@ limitations under the License. */
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/maruel/dumbcas/dumbcaslib"
 	"github.com/maruel/ut"
@@ -41,7 +52,7 @@ func TestArchive(t *testing.T) {
 		f.Fatal(err)
 	}
 
-	args := []string{"archive", "-root=\\test_archive", filepath.Join(tempData, "toArchive")}
+	args := []string{"archive", "-root=" + mockRoot("archive"), filepath.Join(tempData, "toArchive")}
 	f.Run(args, 0)
 	f.CheckBuffer(true, false)
 	items, err := dumbcaslib.EnumerateCasAsList(f.cas)
@@ -60,3 +71,1048 @@ func TestArchive(t *testing.T) {
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqual(t, 2, len(nodes))
 }
+
+func TestArchiveExclude(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_exclude")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"toArchive":         "dir1\n",
+		"excludes":          "# Comment\n\n*.tmp\n",
+		"dir1/bar":          "bar\n",
+		"dir1/bar.tmp":      "tmp\n",
+		"dir1/.git/config":  "git\n",
+		"dir1/dir2/foo.tmp": "tmp2\n",
+	}
+	archived := map[string]string{
+		"toArchive": "dir1\n",
+		"bar":       "bar\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+
+	args := []string{"archive", "-root=" + mockRoot("archive"), "-exclude", ".git", "-exclude-from", filepath.Join(tempData, "excludes"), filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+
+	expected := []string{}
+	sha1tree, entries := marshalData(f.TB, archived)
+	for _, v := range sha1tree {
+		expected = append(expected, v)
+	}
+	expected = append(expected, dumbcaslib.Sha1Bytes(entries))
+	sort.Strings(expected)
+	ut.AssertEqual(t, expected, items)
+
+	args = []string{"archive", "-root=" + mockRoot("archive"), "-exclude", "[", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestArchiveFileSize(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_file_size")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"toArchive":  "dir1\n",
+		"dir1/small": "a",
+		"dir1/ok":    "okay",
+		"dir1/large": "too large",
+	}
+	// The inputs themselves are not filtered.
+	archived := map[string]string{
+		"toArchive": "dir1\n",
+		"ok":        "okay",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+
+	args := []string{"archive", "-root=" + mockRoot("archive"), "-min-file-size=2", "-max-file-size=8", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	out := f.GetOut().(*bytes.Buffer).String()
+	ut.AssertEqual(t, true, strings.Contains(out, "Skipped by size: 2 files"))
+	f.CheckBuffer(true, false)
+	items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+
+	expected := []string{}
+	sha1tree, entries := marshalData(f.TB, archived)
+	for _, v := range sha1tree {
+		expected = append(expected, v)
+	}
+	expected = append(expected, dumbcaslib.Sha1Bytes(entries))
+	sort.Strings(expected)
+	ut.AssertEqual(t, expected, items)
+
+	args = []string{"archive", "-root=" + mockRoot("archive"), "-min-file-size=8", "-max-file-size=2", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestArchiveBase(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_base")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"toArchive":     "docs\n",
+		"docs/bar":      "bar\n",
+		"docs/dir2/foo": "foo\n",
+	}
+	// The inputs keep their directory name.
+	archived := map[string]string{
+		"toArchive":     "docs\n",
+		"docs/bar":      "bar\n",
+		"docs/dir2/foo": "foo\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+
+	args := []string{"archive", "-root=" + mockRoot("archive"), "-base", tempData, filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+
+	expected := []string{}
+	sha1tree, entries := marshalData(f.TB, archived)
+	for _, v := range sha1tree {
+		expected = append(expected, v)
+	}
+	expected = append(expected, dumbcaslib.Sha1Bytes(entries))
+	sort.Strings(expected)
+	ut.AssertEqual(t, expected, items)
+
+	// The inputs must be inside -base.
+	args = []string{"archive", "-root=" + mockRoot("archive"), "-base", filepath.Join(tempData, "docs", "dir2"), filepath.Join(tempData, "toArchive")}
+	f.Run(args, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestArchiveFilesFrom(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_files_from")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"src/one":      "one\n",
+		"src/dir/two":  "two\n",
+		"src/unlisted": "unlisted\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	// The directory and the missing file are skipped.
+	listed := []string{
+		filepath.Join(tempData, "src", "one"),
+		filepath.Join(tempData, "src", "dir", "two"),
+		filepath.Join(tempData, "src", "missing"),
+		filepath.Join(tempData, "src", "dir"),
+	}
+	lines := filepath.Join(tempData, "lines")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(lines, []byte(strings.Join(listed, "\n")+"\n"), 0600))
+	nul := filepath.Join(tempData, "nul")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(nul, []byte(strings.Join(listed, "\x00")+"\x00"), 0600))
+
+	for i, list := range []string{lines, nul} {
+		f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-base", tempData, "-files-from", list}, 0)
+		f.CheckBuffer(true, false)
+
+		out := filepath.Join(tempData, fmt.Sprintf("out%d", i))
+		f.Run([]string{"restore", "-root=" + mockRoot("archive"), "-out=" + out, "latest"}, 0)
+		f.CheckBuffer(true, false)
+		actualTree, err := readTree(out)
+		ut.AssertEqual(t, nil, err)
+		expected := map[string]string{
+			"src/one":     "one\n",
+			"src/dir/two": "two\n",
+		}
+		content, err := ioutil.ReadFile(list)
+		ut.AssertEqual(t, nil, err)
+		expected[filepath.Base(list)] = string(content)
+		ut.AssertEqual(t, expected, actualTree)
+
+		f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-strict", "-files-from", list}, 1)
+		f.CheckBuffer(false, true)
+	}
+
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-files-from", lines, lines}, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestCleanupList(t *testing.T) {
+	t.Parallel()
+	relDir, err := filepath.Abs("list")
+	ut.AssertEqual(t, nil, err)
+	inputs := []string{"rel/dir", "./file", "/abs/dir/"}
+	cleanupList(relDir, inputs)
+	expected := []string{
+		filepath.Join(relDir, "rel", "dir"),
+		filepath.Join(relDir, "file"),
+		// On the drive of relDir on Windows.
+		filepath.VolumeName(relDir) + filepath.FromSlash("/abs/dir"),
+	}
+	ut.AssertEqual(t, expected, inputs)
+}
+
+func TestArchiveEmptyDir(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_empty_dir")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"toArchive":    "src\n",
+		"src/dir1/bar": "bar\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	ut.AssertEqual(t, nil, os.MkdirAll(filepath.Join(tempData, "src", "logs", "old"), 0700))
+	ut.AssertEqual(t, nil, os.Chmod(filepath.Join(tempData, "src", "logs", "old"), 0750))
+
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), filepath.Join(tempData, "toArchive")}, 0)
+	f.CheckBuffer(true, false)
+
+	out := filepath.Join(tempData, "out")
+	f.Run([]string{"restore", "-root=" + mockRoot("archive"), "-out=" + out, "latest"}, 0)
+	f.CheckBuffer(true, false)
+	actualTree, err := readTree(out)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, map[string]string{"toArchive": "src\n", "dir1/bar": "bar\n"}, actualTree)
+	stat, err := os.Stat(filepath.Join(out, "logs", "old"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, stat.IsDir())
+	if runtime.GOOS != "windows" {
+		ut.AssertEqual(t, os.FileMode(0750), stat.Mode().Perm())
+	}
+}
+
+func TestArchiveHardlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the inodes are not exposed on Windows")
+	}
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_hardlinks")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"toArchive": "src\n",
+		"src/a":     "content\n",
+		"src/c":     "content\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	ut.AssertEqual(t, nil, os.Link(filepath.Join(tempData, "src", "a"), filepath.Join(tempData, "src", "b")))
+
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-hardlinks", filepath.Join(tempData, "toArchive")}, 0)
+	f.CheckBuffer(true, false)
+
+	out := filepath.Join(tempData, "out")
+	f.Run([]string{"restore", "-root=" + mockRoot("archive"), "-out=" + out, "latest"}, 0)
+	f.CheckBuffer(true, false)
+	actualTree, err := readTree(out)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, map[string]string{"toArchive": "src\n", "a": "content\n", "b": "content\n", "c": "content\n"}, actualTree)
+	stat := func(name string) os.FileInfo {
+		fi, err := os.Stat(filepath.Join(out, name))
+		ut.AssertEqual(t, nil, err)
+		return fi
+	}
+	ut.AssertEqual(t, true, os.SameFile(stat("a"), stat("b")))
+	// Same content but a different file.
+	ut.AssertEqual(t, false, os.SameFile(stat("a"), stat("c")))
+}
+
+func TestArchiveJobs(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_jobs")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{"toArchive": "src\n"}
+	for i := 0; i < 50; i++ {
+		tree[fmt.Sprintf("src/dir%d/file%d", i%5, i)] = fmt.Sprintf("content%d\n", i%20)
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		ut.AssertEqual(t, nil, os.Link(filepath.Join(tempData, "src", fmt.Sprintf("dir%d", i%5), fmt.Sprintf("file%d", i)), filepath.Join(tempData, "src", fmt.Sprintf("link%d", i))))
+	}
+
+	// The tree, including the hardlink groups, doesn't depend on the order in
+	// which the files are hashed. The groups are not recorded on the platforms
+	// not exposing the inodes, which doesn't change the objects stored.
+	var expected []string
+	for _, jobs := range []string{"-jobs=1", "-jobs=16"} {
+		f.cas = dumbcaslib.MakeMemoryCasTable()
+		f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-hardlinks", jobs, filepath.Join(tempData, "toArchive")}, 0)
+		f.CheckBuffer(true, false)
+		items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+		ut.AssertEqual(t, nil, err)
+		// 20 contents, the toArchive file and the tree.
+		ut.AssertEqual(t, 22, len(items))
+		if expected == nil {
+			expected = items
+		}
+		ut.AssertEqual(t, expected, items)
+	}
+}
+
+// lossyCasTable silently drops the writes of the content lost, like a flaky
+// storage.
+type lossyCasTable struct {
+	dumbcaslib.CasTable
+	lost string
+}
+
+func (l *lossyCasTable) AddEntry(source io.Reader, hash string) error {
+	if hash == l.lost {
+		_, err := io.Copy(ioutil.Discard, source)
+		return err
+	}
+	return l.CasTable.AddEntry(source, hash)
+}
+
+func TestArchiveVerify(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_verify")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"toArchive": "dir1\n",
+		"dir1/bar":  "bar\n",
+		"dir1/foo":  "foo\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	args := []string{"archive", "-root=" + mockRoot("archive"), "-verify-deep", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	out := f.GetOut().(*bytes.Buffer).String()
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, true, strings.Contains(out, "Verified 3 files of "))
+
+	// The verification doesn't corrupt the JSON summary.
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-verify-deep", "-output-format=json", filepath.Join(tempData, "toArchive")}, 0)
+	m := archiveManifest{}
+	ut.AssertEqual(t, nil, json.Unmarshal(f.GetOut().(*bytes.Buffer).Bytes(), &m))
+	f.CheckBuffer(true, false)
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-verify-deep", "-output-format=quiet", filepath.Join(tempData, "toArchive")}, 0)
+	f.CheckBuffer(false, false)
+
+	f.cas = &lossyCasTable{CasTable: dumbcaslib.MakeMemoryCasTable(), lost: dumbcaslib.Sha1Bytes([]byte("foo\n"))}
+	args = []string{"archive", "-root=" + mockRoot("archive"), "-verify-after-archive", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 1)
+	out = f.GetOut().(*bytes.Buffer).String()
+	f.CheckBuffer(true, true)
+	ut.AssertEqual(t, true, strings.Contains(out, "foo: missing "))
+}
+
+// recordingCasTable records the entries AddEntry is called for, the lookups
+// and the entries opened.
+type recordingCasTable struct {
+	dumbcaslib.CasTable
+	lock       sync.Mutex
+	added      []string
+	exists     int
+	existsMany [][]string
+	opened     []string
+}
+
+func (r *recordingCasTable) Open(hash string) (dumbcaslib.ReadSeekCloser, error) {
+	r.lock.Lock()
+	r.opened = append(r.opened, hash)
+	r.lock.Unlock()
+	return r.CasTable.Open(hash)
+}
+
+func (r *recordingCasTable) Exists(hash string) bool {
+	r.lock.Lock()
+	r.exists++
+	r.lock.Unlock()
+	return r.CasTable.Exists(hash)
+}
+
+func (r *recordingCasTable) ExistsMany(hashes []string) map[string]bool {
+	r.lock.Lock()
+	r.existsMany = append(r.existsMany, hashes)
+	r.lock.Unlock()
+	return r.CasTable.ExistsMany(hashes)
+}
+
+func (r *recordingCasTable) AddEntry(source io.Reader, hash string) error {
+	r.lock.Lock()
+	r.added = append(r.added, hash)
+	r.lock.Unlock()
+	return r.CasTable.AddEntry(source, hash)
+}
+
+func TestArchiveExisting(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_existing")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"toArchive": "dir1\n",
+		"dir1/bar":  "bar\n",
+		"dir1/foo":  "foo\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	args := []string{"archive", "-root=" + mockRoot("archive"), "-no-cache", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+
+	// The content already in the table is hashed but not written again.
+	r := &recordingCasTable{CasTable: f.cas}
+	f.cas = r
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	for _, hash := range r.added {
+		ut.AssertEqual(t, false, hash == dumbcaslib.Sha1Bytes([]byte("foo\n")))
+		ut.AssertEqual(t, false, hash == dumbcaslib.Sha1Bytes([]byte("bar\n")))
+	}
+
+	// With the cache, the files are looked up in bulk.
+	r = &recordingCasTable{CasTable: r.CasTable}
+	f.cas = r
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), filepath.Join(tempData, "toArchive")}, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, 0, r.exists)
+	// The batches depend on how fast the files are enumerated. The list of
+	// inputs is archived too.
+	looked := 0
+	for _, hashes := range r.existsMany {
+		looked += len(hashes)
+	}
+	ut.AssertEqual(t, 3, looked)
+}
+
+func TestArchiveSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_symlinks")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"toArchive": "dir1\n",
+		"dir1/bar":  "bar\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	ut.AssertEqual(t, nil, os.Symlink("bar", filepath.Join(tempData, "dir1", "link")))
+
+	args := []string{"archive", "-root=" + mockRoot("archive"), "-symlinks=store", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	f.Run([]string{"info", "-root=" + mockRoot("archive"), nodes[0]}, 0)
+	f.CheckOut(" bar(4)\n link -> bar\n toArchive(5)\nTotal 3\n")
+
+	args = []string{"archive", "-root=" + mockRoot("archive"), "-symlinks=foo", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestArchiveInvalidUTF8(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the file names are UTF-16 on Windows")
+	}
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_invalid_utf8")
+	defer removeDir(t, tempData)
+
+	// A Latin-1 name, as found on older Linux file systems.
+	tree := map[string]string{
+		"toArchive":      "src\n",
+		"src/caf\xe9":    "latin-1\n",
+		"src/café":       "utf-8\n",
+		"src/d\xefr/foo": "foo\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		t.Skipf("The file system doesn't support the name: %s", err)
+	}
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-name=latin1", filepath.Join(tempData, "toArchive")}, 0)
+	f.CheckBuffer(true, false)
+
+	out := filepath.Join(tempData, "out")
+	f.Run([]string{"restore", "-root=" + mockRoot("archive"), "-out=" + out, "tags/latin1"}, 0)
+	f.CheckBuffer(true, false)
+	actualTree, err := readTree(out)
+	ut.AssertEqual(t, nil, err)
+	expected := map[string]string{
+		"toArchive":  "src\n",
+		"caf\xe9":    "latin-1\n",
+		"café":       "utf-8\n",
+		"d\xefr/foo": "foo\n",
+	}
+	ut.AssertEqual(t, expected, actualTree)
+}
+
+func TestArchiveProgressFlags(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_progress")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"toArchive": "dir1\n",
+		"dir1/bar":  "bar\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+
+	args := []string{"archive", "-root=" + mockRoot("archive"), "-quiet", "-progress-interval=1ms", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+
+	args = []string{"archive", "-root=" + mockRoot("archive"), "-progress-interval=0", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 1)
+	f.CheckBuffer(false, true)
+	args = []string{"archive", "-root=" + mockRoot("archive"), "-max-rate=-1", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 1)
+	f.CheckBuffer(false, true)
+
+	args = []string{"archive", "-root=" + mockRoot("archive"), "-max-rate=1000000", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+}
+
+func TestArchiveIncremental(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_incremental")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"toArchive": "dir1\n",
+		"dir1/foo":  "foo\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	args := []string{"archive", "-root=" + mockRoot("archive"), filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+
+	// Change the content without changing the size nor the timestamp. Since the
+	// file is trusted from the cache, its content is not read again so the
+	// change goes unnoticed.
+	foo := filepath.Join(tempData, "dir1", "foo")
+	stat, err := os.Stat(foo)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, ioutil.WriteFile(foo, []byte("FOO\n"), 0644))
+	ut.AssertEqual(t, nil, os.Chtimes(foo, stat.ModTime(), stat.ModTime()))
+	changed := dumbcaslib.Sha1Bytes([]byte("FOO\n"))
+
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	_, err = f.cas.Open(changed)
+	ut.AssertEqual(t, false, err == nil)
+
+	// The cached content is not in this table; the file is hashed again.
+	f.cas = dumbcaslib.MakeMemoryCasTable()
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	_, err = f.cas.Open(dumbcaslib.Sha1Bytes([]byte("foo\n")))
+	ut.AssertEqual(t, false, err == nil)
+	_, err = f.cas.Open(changed)
+	ut.AssertEqual(t, nil, err)
+
+	f.cas = dumbcaslib.MakeMemoryCasTable()
+	args = []string{"archive", "-root=" + mockRoot("archive"), "-no-cache", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	_, err = f.cas.Open(changed)
+	ut.AssertEqual(t, nil, err)
+}
+
+func TestArchiveSince(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_since")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"toArchive": "dir1\n",
+		"dir1/foo":  "foo\n",
+		"dir1/bar":  "bar\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	toArchive := filepath.Join(tempData, "toArchive")
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-name=base", toArchive}, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, filepath.Join(mockRoot("archive"), "cache.gob"), f.cachePath)
+
+	// foo keeps its size and timestamp so its hash is taken from the parent node
+	// even with -no-cache, while bar is read again.
+	foo := filepath.Join(tempData, "dir1", "foo")
+	stat, err := os.Stat(foo)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, ioutil.WriteFile(foo, []byte("FOO\n"), 0644))
+	ut.AssertEqual(t, nil, os.Chtimes(foo, stat.ModTime(), stat.ModTime()))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(tempData, "dir1", "bar"), []byte("bar2\n"), 0644))
+
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-no-cache", "-name=next", "-since=tags/base", toArchive}, 0)
+	f.CheckBuffer(true, false)
+	_, err = f.cas.Open(dumbcaslib.Sha1Bytes([]byte("FOO\n")))
+	ut.AssertEqual(t, false, err == nil)
+	_, err = f.cas.Open(dumbcaslib.Sha1Bytes([]byte("bar2\n")))
+	ut.AssertEqual(t, nil, err)
+	node, err := dumbcaslib.LoadNode(f.nodes, "tags/next")
+	ut.AssertEqual(t, nil, err)
+	// The parent is the real node, not the tag that moves with the next archive
+	// named base.
+	base, err := dumbcaslib.ResolveNode(f.nodes, "tags/base")
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, filepath.ToSlash(base), node.Parent)
+	ut.AssertEqual(t, false, dumbcaslib.IsTag(node.Parent))
+	entry, err := dumbcaslib.LoadEntry(f.cas, node.Entry)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, dumbcaslib.Sha1Bytes([]byte("foo\n")), entry.Files["foo"].Sha1)
+
+	// The hash of the parent node isn't reused once its content is gone.
+	ut.AssertEqual(t, nil, f.cas.Remove(dumbcaslib.Sha1Bytes([]byte("foo\n"))))
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-no-cache", "-name=next", "-since=tags/base", toArchive}, 0)
+	f.CheckBuffer(true, false)
+	_, err = f.cas.Open(dumbcaslib.Sha1Bytes([]byte("FOO\n")))
+	ut.AssertEqual(t, nil, err)
+	node, err = dumbcaslib.LoadNode(f.nodes, "tags/next")
+	ut.AssertEqual(t, nil, err)
+	entry, err = dumbcaslib.LoadEntry(f.cas, node.Entry)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, dumbcaslib.Sha1Bytes([]byte("FOO\n")), entry.Files["foo"].Sha1)
+
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-since=tags/missing", toArchive}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-since=tags/base", "-one-node-per-top-level", toArchive}, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestArchiveStrict(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_strict")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"toArchive": "dir1\n",
+		"dir1/bar":  "bar\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	// A broken symlink can't be read, even as root.
+	broken := filepath.Join(tempData, "dir1", "broken")
+	ut.AssertEqual(t, nil, os.Symlink("missing", broken))
+
+	args := []string{"archive", "-root=" + mockRoot("archive"), "-strict", filepath.Join(tempData, "toArchive")}
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-strict", "-output-format=json", filepath.Join(tempData, "toArchive")}, 1)
+	m := archiveManifest{}
+	ut.AssertEqual(t, nil, json.Unmarshal(f.GetOut().(*bytes.Buffer).Bytes(), &m))
+	f.CheckBuffer(true, true)
+	ut.AssertEqual(t, "", m.Node)
+	ut.AssertEqual(t, []string{broken}, m.Skipped)
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 0, len(nodes))
+
+	// Without -strict, the node is created and the file is listed as skipped.
+	manifest := filepath.Join(tempData, "manifest.json")
+	args = []string{"archive", "-root=" + mockRoot("archive"), "-manifest=" + manifest, filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	out := f.GetOut().(*bytes.Buffer).String()
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, true, strings.Contains(out, "Skipped 1 files that couldn't be read"))
+	data, err := ioutil.ReadFile(manifest)
+	ut.AssertEqual(t, nil, err)
+	m = archiveManifest{}
+	ut.AssertEqual(t, nil, json.Unmarshal(data, &m))
+	ut.AssertEqual(t, []string{broken}, m.Skipped)
+	_, err = dumbcaslib.LoadNode(f.nodes, m.Node)
+	ut.AssertEqual(t, nil, err)
+}
+
+func TestArchiveManifest(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_manifest")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"toArchive": "dir1\n",
+		"dir1/bar":  "bar\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+
+	manifest := filepath.Join(tempData, "manifest.json")
+	args := []string{"archive", "-root=" + mockRoot("archive"), "-manifest=" + manifest, filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+
+	data, err := ioutil.ReadFile(manifest)
+	ut.AssertEqual(t, nil, err)
+	m := archiveManifest{}
+	ut.AssertEqual(t, nil, json.Unmarshal(data, &m))
+	node, err := dumbcaslib.LoadNode(f.nodes, m.Node)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, node.Entry, m.RootHash)
+	ut.AssertEqual(t, int64(2), m.Files)
+	ut.AssertEqual(t, int64(len("dir1\n")+len("bar\n")), m.Bytes)
+	ut.AssertEqual(t, true, m.Duration > 0)
+}
+
+func TestArchiveOutputFormat(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_output_format")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"toArchive": "dir1\n",
+		"dir1/bar":  "bar\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	toArchive := filepath.Join(tempData, "toArchive")
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-output-format=json", toArchive}, 0)
+	m := archiveManifest{}
+	ut.AssertEqual(t, nil, json.Unmarshal(f.GetOut().(*bytes.Buffer).Bytes(), &m))
+	f.CheckBuffer(true, false)
+	node, err := dumbcaslib.LoadNode(f.nodes, m.Node)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, node.Entry, m.RootHash)
+	ut.AssertEqual(t, int64(2), m.Files)
+	ut.AssertEqual(t, int64(2), m.Hashed)
+	// The tree of the node is counted too.
+	ut.AssertEqual(t, int64(3), m.Archived)
+	treeSize, err := dumbcaslib.ContentSize(f.cas, node.Entry)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, int64(len("dir1\n")+len("bar\n"))+treeSize, m.ArchivedBytes)
+
+	// The content is now in the table.
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-output-format=json", "-no-cache", toArchive}, 0)
+	m = archiveManifest{}
+	ut.AssertEqual(t, nil, json.Unmarshal(f.GetOut().(*bytes.Buffer).Bytes(), &m))
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, int64(0), m.Archived)
+	ut.AssertEqual(t, int64(3), m.Existing)
+	ut.AssertEqual(t, int64(len("dir1\n")+len("bar\n"))+treeSize, m.ExistingBytes)
+
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-output-format=quiet", toArchive}, 0)
+	f.CheckBuffer(false, false)
+	f.in = bytes.NewBufferString("dump content\n")
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-output-format=quiet", "-stdin", "-name=dump"}, 0)
+	f.CheckBuffer(false, false)
+	f.in = bytes.NewBufferString("dump content\n")
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-output-format=json", "-stdin", "-name=dump"}, 0)
+	m = archiveManifest{}
+	ut.AssertEqual(t, nil, json.Unmarshal(f.GetOut().(*bytes.Buffer).Bytes(), &m))
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, int64(1), m.Existing)
+
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-output-format=xml", toArchive}, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestArchiveStdin(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.in = bytes.NewBufferString("dump content\n")
+	args := []string{"archive", "-root=" + mockRoot("archive"), "-stdin", "-name=mydump"}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(nodes))
+	node, err := dumbcaslib.LoadNode(f.nodes, "tags/mydump")
+	ut.AssertEqual(t, nil, err)
+	entry, err := dumbcaslib.LoadEntry(f.cas, node.Entry)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, int64(len("dump content\n")), entry.Files["mydump"].Size)
+
+	// -name is required and can't be a path.
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-stdin"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-stdin", "-name=a/b"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-stdin", "-name=a", "toArchive"}, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestArchiveNameTags(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_name_tags")
+	defer removeDir(t, tempData)
+	if err := createTree(tempData, map[string]string{"toArchive": "src\n", "src/foo": "foo\n"}); err != nil {
+		f.Fatal(err)
+	}
+
+	args := []string{"archive", "-root=" + mockRoot("archive"), "-name=home", "-tag=schedule=daily", "-tag=pinned", filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	node, err := dumbcaslib.LoadNode(f.nodes, "tags/home")
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, map[string]string{"schedule": "daily", "pinned": ""}, node.Tags)
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(nodes))
+	ut.AssertEqual(t, true, strings.HasSuffix(nodes[0], "_home"))
+
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-name=a/b", filepath.Join(tempData, "toArchive")}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-tag==daily", filepath.Join(tempData, "toArchive")}, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestArchiveOneNodePerTopLevel(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_one_node_per_top_level")
+	defer removeDir(t, tempData)
+	tree := map[string]string{
+		"toArchive":       "home\n",
+		"home/alice/a":    "a\n",
+		"home/bob/dir/b":  "b\n",
+		"home/shared.txt": "shared\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	// The attributes of a top-level directory are kept in its node.
+	empty := filepath.Join(tempData, "home", "empty")
+	ut.AssertEqual(t, nil, os.Mkdir(empty, 0700))
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	ut.AssertEqual(t, nil, os.Chtimes(empty, modTime, modTime))
+
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-name=home", "-one-node-per-top-level", filepath.Join(tempData, "toArchive")}, 0)
+	f.CheckBuffer(true, false)
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 8, len(nodes))
+	node, err := dumbcaslib.LoadNode(f.nodes, "tags/home-empty")
+	ut.AssertEqual(t, nil, err)
+	entry, err := dumbcaslib.LoadEntry(f.cas, node.Entry)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, entry.IsDir())
+	ut.AssertEqual(t, modTime, entry.ModTime)
+
+	expected := map[string]map[string]string{
+		"home":       {"toArchive": "home\n", "shared.txt": "shared\n"},
+		"home-alice": {"a": "a\n"},
+		"home-bob":   {"dir/b": "b\n"},
+	}
+	for name, files := range expected {
+		out := filepath.Join(tempData, "out", name)
+		f.Run([]string{"restore", "-root=" + mockRoot("archive"), "-out=" + out, dumbcaslib.TagName(name)}, 0)
+		f.CheckBuffer(true, false)
+		actualTree, err := readTree(out)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, files, actualTree)
+	}
+}
+
+func TestArchiveInsideRoot(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_inside")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"toArchive":              "data\n",
+		"data/foo":               "foo\n",
+		"root/cas/metadata.json": "{}",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	// The source is inside the root.
+	args := []string{"archive", "-root=" + tempData, filepath.Join(tempData, "toArchive")}
+	f.Run(args, 1)
+	f.CheckBuffer(false, true)
+
+	// The root is inside another root.
+	args = []string{"archive", "-root=" + filepath.Join(tempData, "root", "nested"), filepath.Join(tempData, "toArchive")}
+	f.Run(args, 1)
+	f.CheckBuffer(false, true)
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, nodes)
+}
+
+func TestArchiveResume(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_resume")
+	defer removeDir(t, tempData)
+
+	tree := map[string]string{
+		"toArchive": "dir1\ndir2\n",
+		"dir1/bar":  "bar\n",
+		"dir2/foo":  "foo\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	root := filepath.Join(tempData, "root")
+	toArchive := filepath.Join(tempData, "toArchive")
+	inputs := []string{filepath.Join(tempData, "dir1"), filepath.Join(tempData, "dir2"), toArchive}
+
+	// Fake a previous run interrupted after dir1. dir1 is skipped so its content
+	// comes from the checkpoint.
+	_, _ = f.MakeCasTable("", dumbcaslib.CasOptions{})
+	hash, err := dumbcaslib.AddBytes(f.cas, []byte("checkpointed\n"))
+	ut.AssertEqual(t, nil, err)
+	entry := &dumbcaslib.Entry{}
+	entry.AddFile("checkpointed", hash, int64(len("checkpointed\n")))
+	data, err := json.Marshal(&archiveCheckpoint{Inputs: inputs, Done: inputs[:1], Entry: entry})
+	ut.AssertEqual(t, nil, err)
+	checkpoint := filepath.Join(root, checkpointsName, "toArchive.json")
+	ut.AssertEqual(t, nil, os.MkdirAll(filepath.Dir(checkpoint), 0700))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(checkpoint, data, 0600))
+
+	f.Run([]string{"archive", "-root=" + root, "-resume", toArchive}, 0)
+	f.CheckBuffer(true, false)
+	node, err := dumbcaslib.LoadNode(f.nodes, "tags/toArchive")
+	ut.AssertEqual(t, nil, err)
+	archived, err := dumbcaslib.LoadEntry(f.cas, node.Entry)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"checkpointed", "foo", "toArchive"}, archived.SortedFiles())
+	// The checkpoint is removed once the node is saved.
+	_, err = os.Stat(checkpoint)
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+
+	// A checkpoint made for other inputs is ignored.
+	data, err = json.Marshal(&archiveCheckpoint{Inputs: inputs[1:], Done: inputs[1:2], Entry: entry})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, ioutil.WriteFile(checkpoint, data, 0600))
+	f.Run([]string{"archive", "-root=" + root, "-resume", toArchive}, 0)
+	f.CheckBuffer(true, false)
+	node, err = dumbcaslib.LoadNode(f.nodes, "tags/toArchive")
+	ut.AssertEqual(t, nil, err)
+	archived, err = dumbcaslib.LoadEntry(f.cas, node.Entry)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"bar", "foo", "toArchive"}, archived.SortedFiles())
+}
+
+// archivedTree returns the tree of the node described by the manifest.
+func archivedTree(t *testing.T, f *DumbcasAppMock, manifest string) *dumbcaslib.Entry {
+	data, err := ioutil.ReadFile(manifest)
+	ut.AssertEqual(t, nil, err)
+	m := archiveManifest{}
+	ut.AssertEqual(t, nil, json.Unmarshal(data, &m))
+	entry, err := dumbcaslib.LoadEntry(f.cas, m.RootHash)
+	ut.AssertEqual(t, nil, err)
+	return entry
+}
+
+func TestArchiveChunks(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "archive_chunks")
+	defer removeDir(t, tempData)
+
+	if err := createTree(tempData, map[string]string{"toArchive": "dir1\n", "dir1/small": "small\n"}); err != nil {
+		f.Fatal(err)
+	}
+	content := make([]byte, 6*1024*1024)
+	_, _ = rand.New(rand.NewSource(0)).Read(content)
+	big := filepath.Join(tempData, "dir1", "big")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(big, content, 0644))
+
+	manifest := filepath.Join(tempData, "manifest.json")
+	args := []string{"archive", "-root=" + mockRoot("archive"), "-chunk-threshold=1048576", "-manifest=" + manifest, filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	entry := archivedTree(t, f, manifest).Files["big"]
+	ut.AssertEqual(t, dumbcaslib.Sha1Bytes(content), entry.Sha1)
+	ut.AssertEqual(t, int64(len(content)), entry.Size)
+	chunks, err := dumbcaslib.LoadManifest(f.cas, entry.Manifest)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, len(chunks) > 2)
+	// Only the chunks and their manifest are stored.
+	ut.AssertEqual(t, false, f.cas.Exists(entry.Sha1))
+	ut.AssertEqual(t, "", archivedTree(t, f, manifest).Files["small"].Manifest)
+
+	// Unchanged, the file is not read again.
+	r := &recordingCasTable{CasTable: f.cas}
+	f.cas = r
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, entry.Manifest, archivedTree(t, f, manifest).Files["big"].Manifest)
+	// Only the tree is written.
+	ut.AssertEqual(t, 1, len(r.added))
+
+	// Only the chunks around the change are stored.
+	content[3*1024*1024] ^= 0xff
+	ut.AssertEqual(t, nil, ioutil.WriteFile(big, content, 0644))
+	ut.AssertEqual(t, nil, os.Chtimes(big, treeModTime, treeModTime))
+	r = &recordingCasTable{CasTable: r.CasTable}
+	f.cas = r
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	changed := archivedTree(t, f, manifest).Files["big"]
+	changedChunks, err := dumbcaslib.LoadManifest(f.cas, changed.Manifest)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, len(chunks), len(changedChunks))
+	different := 0
+	for i := range chunks {
+		if chunks[i] != changedChunks[i] {
+			different++
+		}
+	}
+	ut.AssertEqual(t, 1, different)
+	// The changed chunk, its manifest and the tree.
+	ut.AssertEqual(t, 3, len(r.added))
+	f.cas = r.CasTable
+
+	// gc keeps the chunks of both versions.
+	f.Run([]string{"gc", "-root=" + mockRoot("archive"), "-keep-unreferenced-for=0"}, 0)
+	f.CheckBuffer(true, false)
+	for _, e := range []*dumbcaslib.Entry{entry, changed} {
+		r, err := dumbcaslib.OpenEntry(f.cas, e)
+		ut.AssertEqual(t, nil, err)
+		actual, err := ioutil.ReadAll(r)
+		ut.AssertEqual(t, nil, err)
+		_ = r.Close()
+		ut.AssertEqual(t, e.Sha1, dumbcaslib.Sha1Bytes(actual))
+	}
+	f.Run([]string{"verify", "-root=" + mockRoot("archive"), "-deep", "latest"}, 0)
+	f.CheckBuffer(true, false)
+}
@@ -0,0 +1,336 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdBenchmark = &subcommands.Command{
+	UsageLine: "benchmark [archive flags]",
+	ShortDesc: "measures the performance of a table",
+	LongDesc:  "Generates -size bytes of random files, part of them duplicated, archives them twice in -root, then runs stats, fsck and gc and prints how long each step took and how well the content was deduplicated. -root must be an empty table with an empty trash; the nodes archived are moved to trash at the end, then gc removes their content and the trash is emptied, and a local -root that didn't exist is deleted. The common flags are passed to each command and the arguments to archive, e.g. -compress or -pack-threshold, to compare the settings and the storage backends.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &benchmarkRun{size: 1 << 30, fileSize: 1 << 20}
+		c.Init()
+		c.Flags.Var(&c.size, "size", "Total size of the files to generate, e.g. 512M or 1G")
+		c.Flags.Var(&c.fileSize, "file-size", "Size of each generated file, e.g. 64K")
+		c.Flags.Float64Var(&c.duplicates, "duplicates", 0.25, "Fraction of the generated files that are a copy of another one, between 0 and 1")
+		c.Flags.BoolVar(&c.JSON, "json", false, "Print the summary as JSON")
+		return c
+	},
+}
+
+type benchmarkRun struct {
+	CommonFlags
+	size       sizeFlag
+	fileSize   sizeFlag
+	duplicates float64
+	JSON       bool
+}
+
+// sizeFlag is a number of bytes with an optional K, M, G or T suffix, in
+// powers of 1024.
+type sizeFlag int64
+
+func (s *sizeFlag) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *sizeFlag) Set(value string) error {
+	v := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(value), "B"), "I")
+	shift := uint(0)
+	if i := strings.IndexAny(v, "KMGT"); i != -1 && i == len(v)-1 {
+		shift = 10 * uint(strings.IndexByte("KMGT", v[i])+1)
+		v = v[:i]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*s = sizeFlag(n << shift)
+	return nil
+}
+
+// benchmarkPhase is the duration of one step of the benchmark.
+type benchmarkPhase struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration_ns"`
+	// Throughput is in bytes per second, for the steps reading the files.
+	Throughput float64 `json:"throughput,omitempty"`
+}
+
+// benchmarkSummary is the summary printed by benchmark.
+type benchmarkSummary struct {
+	Files int `json:"files"`
+	// Bytes is the size of the generated files, of which UniqueBytes are not
+	// duplicates.
+	Bytes       int64            `json:"bytes"`
+	UniqueBytes int64            `json:"unique_bytes"`
+	Stored      storageStats     `json:"stored"`
+	Phases      []benchmarkPhase `json:"phases"`
+}
+
+// benchmarkFlags are the flags of benchmark not passed to the commands it
+// runs.
+var benchmarkFlags = map[string]bool{"size": true, "file-size": true, "duplicates": true, "json": true}
+
+// benchmarkApp runs the commands of the benchmark with their output sent to
+// out.
+type benchmarkApp struct {
+	DumbcasApplication
+	out io.Writer
+}
+
+func (b *benchmarkApp) GetOut() io.Writer {
+	return b.out
+}
+
+// generateBenchmarkData writes the files to archive in dir and returns their
+// number and the size of the ones that are not a copy of another. The content
+// is streamed so the memory use doesn't grow with size; a duplicate is copied
+// from the file already written.
+func generateBenchmarkData(dir string, size, fileSize int64, duplicates float64) (int, int64, error) {
+	// The content is not compressible but is the same from one run to another.
+	r := rand.New(rand.NewSource(0))
+	var uniques []string
+	var unique int64
+	nb := 0
+	for offset := int64(0); offset < size; offset += fileSize {
+		n := fileSize
+		if size-offset < n {
+			n = size - offset
+		}
+		// Spread the files in directories like a real tree.
+		name := filepath.Join(dir, fmt.Sprintf("%03d", nb/100), fmt.Sprintf("%05d", nb))
+		if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			return 0, 0, err
+		}
+		if len(uniques) != 0 && r.Float64() < duplicates {
+			src, err := os.Open(uniques[r.Intn(len(uniques))])
+			if err != nil {
+				return 0, 0, err
+			}
+			err = writeBenchmarkFile(name, src)
+			_ = src.Close()
+			if err != nil {
+				return 0, 0, err
+			}
+		} else {
+			if err := writeBenchmarkFile(name, io.LimitReader(r, n)); err != nil {
+				return 0, 0, err
+			}
+			uniques = append(uniques, name)
+			unique += n
+		}
+		nb++
+	}
+	return nb, unique, nil
+}
+
+// writeBenchmarkFile writes the content of src to the file name.
+func writeBenchmarkFile(name string, src io.Reader) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// run runs a command on the table being benchmarked and returns its output.
+func (c *benchmarkRun) run(a DumbcasApplication, args ...string) (string, error) {
+	out := &bytes.Buffer{}
+	flags := []string{args[0]}
+	c.Flags.Visit(func(f *flag.Flag) {
+		if !benchmarkFlags[f.Name] {
+			flags = append(flags, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	if subcommands.Run(&benchmarkApp{a, out}, append(flags, args[1:]...)) != 0 {
+		return "", fmt.Errorf("%s failed", args[0])
+	}
+	return out.String(), nil
+}
+
+func (c *benchmarkRun) main(a DumbcasApplication, archiveArgs []string) error {
+	if c.size <= 0 || c.fileSize <= 0 {
+		return errors.New("-size and -file-size must be positive")
+	}
+	if c.duplicates < 0 || c.duplicates > 1 {
+		return errors.New("-duplicates must be between 0 and 1")
+	}
+	if err := c.applyRepo(a); err != nil {
+		return err
+	}
+	if c.Root != "" && !dumbcaslib.IsRemote(c.Root) {
+		if _, err := os.Stat(c.Root); os.IsNotExist(err) {
+			root := c.Root
+			defer func() {
+				if err := os.RemoveAll(root); err != nil {
+					a.GetLogger().Warningf("Failed to remove %s: %s", root, err)
+				}
+			}()
+		}
+	}
+	if err := c.Parse(a, false); err != nil {
+		return err
+	}
+	s := benchmarkSummary{Bytes: int64(c.size)}
+	out, err := c.run(a, "stats", "-json")
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(out), &s.Stored); err != nil {
+		return err
+	}
+	if s.Stored.Blobs != 0 || s.Stored.Nodes != 0 {
+		return fmt.Errorf("-root %s must be an empty table", c.Root)
+	}
+	// The trash is emptied once done, so it must not hold anything else.
+	if t, ok := c.cas.(dumbcaslib.TrashTable); ok {
+		trashed := false
+		for item := range t.EnumerateTrash() {
+			trashed = trashed || item.Error == nil
+		}
+		if trashed {
+			return fmt.Errorf("-root %s must have an empty trash", c.Root)
+		}
+	}
+
+	tmp, err := ioutil.TempDir("", "dumbcas_benchmark")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(tmp); err != nil {
+			a.GetLogger().Warningf("Failed to remove %s: %s", tmp, err)
+		}
+	}()
+	data := filepath.Join(tmp, "data")
+	toArchive := filepath.Join(tmp, "toArchive")
+	if err := ioutil.WriteFile(toArchive, []byte("data\n"), 0600); err != nil {
+		return err
+	}
+	phase := func(name string, throughput bool, f func() error) error {
+		a.GetLogger().Infof("Running %s", name)
+		start := time.Now()
+		if err := f(); err != nil {
+			return err
+		}
+		p := benchmarkPhase{Name: name, Duration: time.Since(start)}
+		if throughput && p.Duration > 0 {
+			p.Throughput = float64(s.Bytes) / p.Duration.Seconds()
+		}
+		s.Phases = append(s.Phases, p)
+		return nil
+	}
+	if err := phase("generate", true, func() error {
+		s.Files, s.UniqueBytes, err = generateBenchmarkData(data, int64(c.size), int64(c.fileSize), c.duplicates)
+		return err
+	}); err != nil {
+		return fmt.Errorf("Failed to generate the files: %s", err)
+	}
+	// The cache of the user is not touched. The second archive finds all the
+	// content already stored.
+	archive := append([]string{"archive", "-quiet", "-no-cache", "-cache-path=" + filepath.Join(tmp, "cache.gob")}, archiveArgs...)
+	archive = append(archive, toArchive)
+	steps := []struct {
+		name       string
+		throughput bool
+		args       []string
+	}{
+		{"archive", true, archive},
+		{"archive-again", true, archive},
+		{"fsck", false, []string{"fsck"}},
+	}
+	for _, step := range steps {
+		if err := phase(step.name, step.throughput, func() error {
+			_, err := c.run(a, step.args...)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	if out, err = c.run(a, "stats", "-json"); err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(out), &s.Stored); err != nil {
+		return err
+	}
+
+	// The table was empty so all its nodes are from the benchmark. Once they
+	// are removed, gc removes all the content.
+	for item := range c.nodes.Enumerate() {
+		if item.Error != nil {
+			return item.Error
+		}
+		if err := c.nodes.Remove(item.Item); err != nil {
+			return fmt.Errorf("Failed to remove node %s: %s", item.Item, err)
+		}
+	}
+	if err := phase("gc", false, func() error {
+		_, err := c.run(a, "gc", "-keep-unreferenced-for=0")
+		return err
+	}); err != nil {
+		return err
+	}
+	if _, err := c.run(a, "trash", "empty"); err != nil {
+		a.GetLogger().Warningf("Failed to empty the trash: %s", err)
+	}
+
+	if c.JSON {
+		data, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(a.GetOut(), "%s\n", data)
+		return nil
+	}
+	fmt.Fprintf(a.GetOut(), "Files:       %d\n", s.Files)
+	fmt.Fprintf(a.GetOut(), "Size:        %d bytes, %d unique\n", s.Bytes, s.UniqueBytes)
+	fmt.Fprintf(a.GetOut(), "Stored:      %d bytes in %d blobs\n", s.Stored.PhysicalBytes, s.Stored.Blobs)
+	fmt.Fprintf(a.GetOut(), "Dedup ratio: %.2f\n", s.Stored.DedupRatio)
+	for _, p := range s.Phases {
+		fmt.Fprintf(a.GetOut(), "%-14s %10s", p.Name+":", p.Duration.Round(time.Millisecond))
+		if p.Throughput != 0 {
+			fmt.Fprintf(a.GetOut(), " %10.1f MiB/s", p.Throughput/(1<<20))
+		}
+		fmt.Fprintf(a.GetOut(), "\n")
+	}
+	return nil
+}
+
+func (c *benchmarkRun) Run(a subcommands.Application, args []string) int {
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
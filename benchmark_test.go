@@ -0,0 +1,101 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestBenchmark(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"benchmark", "-root=" + mockRoot("benchmark"), "-size=64K", "-file-size=4K", "-json"}
+	f.Run(args, 0)
+	s := benchmarkSummary{}
+	ut.AssertEqual(t, nil, json.Unmarshal(f.GetOut().(*bytes.Buffer).Bytes(), &s))
+	ut.AssertEqual(t, 16, s.Files)
+	ut.AssertEqual(t, int64(64*1024), s.Bytes)
+	ut.AssertEqual(t, 2, s.Stored.Nodes)
+	// Each node also has the file listing the inputs.
+	ut.AssertEqual(t, 2*(s.Bytes+int64(len("data\n"))), s.Stored.LogicalBytes)
+	// The duplicates and the second archive are only stored once.
+	ut.AssertEqual(t, true, s.Stored.PhysicalBytes > s.UniqueBytes && s.Stored.PhysicalBytes < s.Bytes)
+	names := []string{}
+	for _, p := range s.Phases {
+		names = append(names, p.Name)
+	}
+	ut.AssertEqual(t, []string{"generate", "archive", "archive-again", "fsck", "gc"}, names)
+
+	// Everything was removed.
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 0, len(nodes))
+	for item := range f.cas.Enumerate() {
+		t.Fatalf("%s was not removed", item.Item)
+	}
+
+	// The trash of the user is not emptied.
+	hash, err := dumbcaslib.AddBytes(f.cas, []byte("trashed"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, f.cas.Remove(hash))
+	f.Run(args, 1)
+	trashed := 0
+	for range f.cas.(dumbcaslib.TrashTable).EnumerateTrash() {
+		trashed++
+	}
+	ut.AssertEqual(t, 1, trashed)
+	ut.AssertEqual(t, nil, f.cas.(dumbcaslib.TrashTable).EmptyTrash())
+
+	// A table already in use is not touched.
+	f.in = bytes.NewBufferString("content\n")
+	f.Run([]string{"archive", "-root=" + mockRoot("benchmark"), "-stdin", "-name=a"}, 0)
+	f.Run(args, 1)
+	f.Run([]string{"benchmark", "-root=" + mockRoot("benchmark"), "-duplicates=2"}, 1)
+}
+
+func TestGenerateBenchmarkData(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "generate_benchmark")
+	defer removeDir(t, tempData)
+	nb, unique, err := generateBenchmarkData(tempData, 10*1024, 1024, 0.5)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 10, nb)
+	// The duplicates are copies of the content of a unique file.
+	contents := map[string]bool{}
+	for item := range dumbcaslib.EnumerateTree(tempData) {
+		ut.AssertEqual(t, nil, item.Error)
+		data, err := ioutil.ReadFile(item.FullPath)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, 1024, len(data))
+		contents[string(data)] = true
+	}
+	ut.AssertEqual(t, unique, int64(len(contents)*1024))
+	ut.AssertEqual(t, true, len(contents) < nb)
+}
+
+func TestSizeFlag(t *testing.T) {
+	t.Parallel()
+	data := map[string]int64{"0": 0, "12": 12, "64K": 64 << 10, "1G": 1 << 30, "1GiB": 1 << 30, "2mb": 2 << 20}
+	for value, expected := range data {
+		var s sizeFlag
+		ut.AssertEqual(t, nil, s.Set(value))
+		ut.AssertEqual(t, expected, int64(s))
+	}
+	for _, value := range []string{"", "K", "-1", "1X", "1KK"} {
+		var s sizeFlag
+		ut.AssertEqual(t, false, s.Set(value) == nil)
+	}
+}
@@ -0,0 +1,87 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdCache = &subcommands.Command{
+	UsageLine: "cache <clear|stats>",
+	ShortDesc: "manages the cache of the hashes of the archived files",
+	LongDesc:  "Clears the cache used by archive to skip hashing the files whose size and timestamp didn't change, or prints its number of entries and how it performed during the last archive. archive removes the entries of the files deleted from its inputs by itself.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &cacheRun{}
+		c.Init()
+		c.Flags.StringVar(&c.cachePath, "cache-path", "", "Cache file, as given to archive -cache-path; defaults to the cache of -root")
+		return c
+	},
+}
+
+type cacheRun struct {
+	CommonFlags
+	cachePath string
+}
+
+func (c *cacheRun) main(a DumbcasApplication, action string) error {
+	cachePath := c.cachePath
+	if cachePath == "" {
+		// The table is only opened to find its cache.
+		if err := c.Parse(a, true); err != nil {
+			return err
+		}
+		cachePath = filepath.Join(c.lockRoot, cacheName)
+	}
+	// A cache that fails to load can still be cleared.
+	cache, err := a.LoadCache(cachePath)
+	if err != nil && action != "clear" {
+		return fmt.Errorf("Failed to load the cache: %s", err)
+	}
+	// The root itself is not an entry.
+	entries := cache.Root().CountMembers() - 1
+	switch action {
+	case "clear":
+		*cache.Root() = dumbcaslib.EntryCache{}
+		*cache.Stats() = dumbcaslib.CacheStats{}
+		a.GetLogger().Infof("Removed %d entries", entries)
+	case "stats":
+		fmt.Fprintf(a.GetOut(), "Entries: %d\n", entries)
+		stats := cache.Stats()
+		if stats.When.IsZero() {
+			fmt.Fprintf(a.GetOut(), "No archive recorded\n")
+			break
+		}
+		ratio := 0.
+		if total := stats.Hits + stats.Misses; total != 0 {
+			ratio = 100. * float64(stats.Hits) / float64(total)
+		}
+		fmt.Fprintf(a.GetOut(), "Last archive: %s\n", stats.When.Format("2006-01-02 15:04:05"))
+		fmt.Fprintf(a.GetOut(), "Hits: %d, misses: %d (%.1f%% hit ratio)\n", stats.Hits, stats.Misses, ratio)
+		fmt.Fprintf(a.GetOut(), "Invalidated: %d\n", stats.Invalidated)
+	}
+	return cache.Close()
+}
+
+func (c *cacheRun) Run(a subcommands.Application, args []string) int {
+	if len(args) != 1 || (args[0] != "clear" && args[0] != "stats") {
+		fmt.Fprintf(a.GetErr(), "%s: Must provide one of clear or stats.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args[0]); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestCacheStatsAndClear(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "cache_stats")
+	defer removeDir(t, tempData)
+
+	f.Run([]string{"cache", "-root=" + mockRoot("cache"), "stats"}, 0)
+	f.CheckOut("Entries: 0\nNo archive recorded\n")
+	// The cache is kept in the root.
+	ut.AssertEqual(t, filepath.Join(mockRoot("cache"), "cache.gob"), f.cachePath)
+
+	tree := map[string]string{
+		"toArchive": "dir1\n",
+		"dir1/foo":  "foo\n",
+		"dir1/bar":  "bar\n",
+	}
+	if err := createTree(tempData, tree); err != nil {
+		f.Fatal(err)
+	}
+	cachePath := filepath.Join(tempData, "cache.gob")
+	args := []string{"archive", "-root=" + mockRoot("archive"), "-cache-path=" + cachePath, filepath.Join(tempData, "toArchive")}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, cachePath, f.cachePath)
+	stats := *f.cache.Stats()
+	ut.AssertEqual(t, int64(3), stats.Misses)
+	ut.AssertEqual(t, int64(0), stats.Hits)
+
+	// The deleted file is removed from the cache.
+	ut.AssertEqual(t, nil, os.Remove(filepath.Join(tempData, "dir1", "bar")))
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	when := time.Date(2012, 3, 4, 5, 6, 7, 0, time.Local)
+	f.cache.Stats().When = when
+	// The temp dir, dir1, foo and toArchive are left below the root.
+	entries := dumbcaslib.FindInCache(f.cache, tempData).CountMembers()
+	ut.AssertEqual(t, 4, entries)
+
+	f.Run([]string{"cache", "-cache-path=" + cachePath, "stats"}, 0)
+	ut.AssertEqual(t, cachePath, f.cachePath)
+	f.CheckOut(fmt.Sprintf("Entries: %d\nLast archive: 2012-03-04 05:06:07\nHits: 2, misses: 0 (100.0%% hit ratio)\nInvalidated: 1\n", f.cache.Root().CountMembers()-1))
+
+	f.Run([]string{"cache", "-cache-path=" + cachePath, "clear"}, 0)
+	f.CheckBuffer(false, false)
+	f.Run([]string{"cache", "-cache-path=" + cachePath, "stats"}, 0)
+	f.CheckOut("Entries: 0\nNo archive recorded\n")
+}
+
+func TestCacheBadArgs(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.Run([]string{"cache"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"cache", "empty"}, 1)
+	f.CheckBuffer(false, true)
+	// Without -cache-path, -root is needed to find the cache.
+	f.Run([]string{"cache", "stats"}, 1)
+	f.CheckBuffer(false, true)
+}
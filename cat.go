@@ -0,0 +1,130 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdCat = &subcommands.Command{
+	UsageLine: "cat <hash>",
+	ShortDesc: "prints the content of an object",
+	LongDesc:  "Copies the content of the dumbcas entry <hash> to stdout. The hash of a file archived in chunks, as printed by find, is found in the nodes and its chunks are concatenated.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &catRun{}
+		c.Init()
+		c.Flags.BoolVar(&c.Verify, "verify", false, "Hash the content while printing it and fail if it doesn't match <hash>")
+		return c
+	},
+}
+
+type catRun struct {
+	CommonFlags
+	Verify bool
+}
+
+func (c *catRun) main(a DumbcasApplication, hash string) error {
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+
+	h := c.cas.NewHash()
+	if !regexp.MustCompile(fmt.Sprintf("^[a-f0-9]{%d}$", h.Size()*2)).MatchString(hash) {
+		return fmt.Errorf("Invalid hash %s", hash)
+	}
+	f, err := c.cas.Open(hash)
+	if os.IsNotExist(err) {
+		// Only the chunks of a chunked file are in the table.
+		if entry := c.findChunked(hash); entry != nil {
+			f, err = dumbcaslib.OpenEntry(c.cas, entry)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %s", hash, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	var src io.Reader = f
+	if c.Verify {
+		src = io.TeeReader(f, h)
+	}
+	if _, err := io.Copy(a.GetOut(), src); err != nil {
+		return fmt.Errorf("Failed to read %s: %s", hash, err)
+	}
+	if c.Verify {
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != hash {
+			c.cas.SetFsckBit()
+			return fmt.Errorf("%s is corrupted, its content hash is %s", hash, actual)
+		}
+	}
+	return nil
+}
+
+// findChunked returns the entry of a file archived in chunks whose content
+// hash is hash, if any node references one.
+func (c *catRun) findChunked(hash string) *dumbcaslib.Entry {
+	// Stops the enumeration when returning early.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for item := range c.nodes.EnumerateCtx(ctx) {
+		// Tags are only aliases to real nodes.
+		if item.Error != nil || dumbcaslib.IsTag(item.Item) {
+			continue
+		}
+		node, err := dumbcaslib.LoadNode(c.nodes, item.Item)
+		if err != nil {
+			continue
+		}
+		entry, err := dumbcaslib.LoadEntry(c.cas, node.Entry)
+		if err != nil {
+			continue
+		}
+		if e := findChunkedEntry(entry, hash); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// findChunkedEntry returns the chunked file of entry whose content hash is
+// hash.
+func findChunkedEntry(entry *dumbcaslib.Entry, hash string) *dumbcaslib.Entry {
+	if entry.Sha1 == hash && entry.Manifest != "" {
+		return entry
+	}
+	for _, child := range entry.Files {
+		if e := findChunkedEntry(child, hash); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (c *catRun) Run(a subcommands.Application, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(a.GetErr(), "%s: Must only provide a <hash>.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args[0]); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
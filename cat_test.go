@@ -0,0 +1,61 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestCat(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasOptions{})
+	_, _ = f.LoadNodesTable("", f.cas)
+	hash, err := dumbcaslib.AddBytes(f.cas, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+
+	f.Run([]string{"cat", "-root=" + mockRoot("cat"), hash}, 0)
+	f.CheckOut("content1")
+	f.Run([]string{"cat", "-root=" + mockRoot("cat"), "-verify", hash}, 0)
+	f.CheckOut("content1")
+
+	f.Run([]string{"cat", "-root=" + mockRoot("cat"), "foo"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"cat", "-root=" + mockRoot("cat"), dumbcaslib.Sha1Bytes([]byte("missing"))}, 1)
+	f.CheckBuffer(false, true)
+
+	// The hash of a chunked file, as printed by find, is found in the nodes.
+	content := make([]byte, 3*1024*1024)
+	_, _ = rand.New(rand.NewSource(0)).Read(content)
+	manifest, size, err := dumbcaslib.ArchiveChunks(f.cas, bytes.NewReader(content))
+	ut.AssertEqual(t, nil, err)
+	big := dumbcaslib.Sha1Bytes(content)
+	root := &dumbcaslib.Entry{Files: map[string]*dumbcaslib.Entry{"big": {Sha1: big, Size: size, Manifest: manifest}}}
+	rootHash, err := dumbcaslib.ArchiveEntry(f.cas, root)
+	ut.AssertEqual(t, nil, err)
+	_, err = f.nodes.AddEntry(&dumbcaslib.Node{Entry: rootHash}, "chunked")
+	ut.AssertEqual(t, nil, err)
+	f.Run([]string{"cat", "-root=" + mockRoot("cat"), "-verify", big}, 0)
+	f.CheckOut(string(content))
+
+	// Corrupt() adds an entry whose content doesn't match its name.
+	f.cas.(dumbcaslib.Corruptable).Corrupt()
+	corrupted := dumbcaslib.Sha1Bytes([]byte{0, 1})
+	f.Run([]string{"cat", "-root=" + mockRoot("cat"), corrupted}, 0)
+	f.CheckOut("content5")
+	f.Run([]string{"cat", "-root=" + mockRoot("cat"), "-verify", corrupted}, 1)
+	f.CheckBuffer(true, true)
+	ut.AssertEqual(t, true, f.cas.GetFsckBit())
+}
@@ -14,68 +14,358 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
+	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/maruel/dumbcas/dumbcaslib"
 	"github.com/maruel/subcommands"
 )
 
+// defaultRemoteWriteRetries is the number of times a failed write is retried on
+// remote storage when -write-retries is not specified.
+const defaultRemoteWriteRetries = 3
+
+// writeRetryDelay is the delay before the first retry of a failed write;
+// MakeRetryingCasTable() doubles the delay before each following retry.
+const writeRetryDelay = time.Second
+
+// cacheMaxEntrySize is the size of the largest object kept in memory with
+// -cache-size.
+const cacheMaxEntrySize = 1024 * 1024
+
 // CommonFlags is common flags for all commands.
 type CommonFlags struct {
 	subcommands.CommandRunBase
 	Root string
+	// Repo is the repository of the configuration file providing Root and the
+	// other flags not given on the command line.
+	Repo         string
+	NodesRoot    string
+	Hash         string
+	PrefixLength int
+	VerifyWrites bool
+	Jobs         int
+	Passphrase   string
+	// PassphraseFile overrides Passphrase.
+	PassphraseFile string
+	Secondaries    stringsFlag
+	TrashDir       string
+	// Compress, CompressLevel, PackThreshold, WriteRetries and MaxRate are only
+	// exposed by the commands writing to the table.
+	Compress      compressFlag
+	CompressLevel int
+	PackThreshold int64
+	WriteRetries  int
+	MaxRate       int64
+	// ReadOnly is only exposed by the commands that can't otherwise guarantee
+	// to not modify the table.
+	ReadOnly bool
+	// CacheSize is only exposed by the commands reading the same objects
+	// repeatedly.
+	CacheSize int64
+	// Verbose and VeryVerbose enable the debug and trace logs.
+	Verbose     bool
+	VeryVerbose bool
 	// These are not "flags" per se but are created indirectly by the -root flag.
 	cas   dumbcaslib.CasTable
 	nodes dumbcaslib.NodesTable
+	// lockRoot is the local directory holding the lock of the table. It only
+	// excludes the operations of this machine when remoteNodes is set.
+	lockRoot    string
+	remoteNodes bool
+	lock        dumbcaslib.Lock
 }
 
 // Init initializes the common flags.
 func (c *CommonFlags) Init() {
-	c.Flags.StringVar(&c.Root, "root", os.Getenv("DUMBCAS_ROOT"), "Root directory; required. Set $DUMBCAS_ROOT to set a default.")
+	c.Flags.StringVar(&c.Root, "root", os.Getenv("DUMBCAS_ROOT"), "Root directory or s3://bucket/path URL; required. Set $DUMBCAS_ROOT to set a default.")
+	c.Flags.StringVar(&c.Repo, "repo", os.Getenv("DUMBCAS_REPO"), "Name of a repository of ~/.dumbcas/config.json providing -root, -nodes-root, -hash, -compress and -secondary; the flags given on the command line override it. Set $DUMBCAS_REPO to set a default.")
+	c.Flags.StringVar(&c.NodesRoot, "nodes-root", "", "Root directory of the nodes, or the URL of the nodes served by dumbcas web, e.g. http://host:8010/content/nodes. Defaults to -root, or to the nodes of the same server when -root is served by dumbcas web; required for the other URLs.")
+	c.Flags.StringVar(&c.Hash, "hash", "", "Hashing algorithm of a new table, sha1, sha256 or blake3. An existing table keeps its own algorithm.")
+	c.Flags.IntVar(&c.PrefixLength, "prefix-length", 0, "Number of hex characters used for the directories of a new table, between 1 and 4. Defaults to 3.")
+	c.Flags.BoolVar(&c.VerifyWrites, "verify-writes", false, "Hash the content while writing it to the table to detect corruption. Slower.")
+	c.Flags.IntVar(&c.Jobs, "jobs", dumbcaslib.DefaultJobs, "Number of concurrent workers enumerating the prefix directories of the table, verifying the objects with fsck or hashing the files to archive.")
+	c.Flags.StringVar(&c.Passphrase, "passphrase", "", "Passphrase of an encrypted table; a new table is encrypted with it. Defaults to $DUMBCAS_PASSPHRASE, which doesn't expose it on the command line.")
+	c.Flags.StringVar(&c.PassphraseFile, "passphrase-file", "", "File containing the passphrase, overrides -passphrase.")
+	c.Flags.Var(&c.Secondaries, "secondary", "Root directory or URL of another copy of the table, used to repair the missing and corrupted objects; can be repeated.")
+	c.Flags.StringVar(&c.TrashDir, "trash-dir", "", "Directory the removed and corrupted objects are moved to, possibly on another volume. It is saved in the table. Defaults to the trash directory of the table.")
+	c.Flags.BoolVar(&c.Verbose, "v", false, "Log the debug messages, including a line per request served by web")
+	c.Flags.BoolVar(&c.VeryVerbose, "vv", false, "Log the debug messages and a line per object, e.g. per file hashed and archived by archive")
+}
+
+// logLevel returns the level selected by -v and -vv.
+func (c *CommonFlags) logLevel() logLevel {
+	switch {
+	case c.VeryVerbose:
+		return levelTrace
+	case c.Verbose:
+		return levelDebug
+	}
+	return levelInfo
 }
 
 // Parse parses the common flags.
 func (c *CommonFlags) Parse(d DumbcasApplication, bypassFsck bool) error {
+	d.GetLogger().SetLevel(c.logLevel())
+	if err := c.applyRepo(d); err != nil {
+		return err
+	}
 	if c.Root == "" {
-		return errors.New("Must provide -root")
+		return errors.New("Must provide -root or -repo")
 	}
-	root, err := filepath.Abs(c.Root)
-	if err != nil {
-		return fmt.Errorf("Failed to find %s", c.Root)
+	if !dumbcaslib.IsRemote(c.Root) {
+		root, err := filepath.Abs(c.Root)
+		if err != nil {
+			return fmt.Errorf("Failed to find %s", c.Root)
+		}
+		c.Root = root
+		if parent := dumbcaslib.FindEnclosingRoot(c.Root); parent != "" {
+			return fmt.Errorf("-root %s is inside the dumbcas root %s; nested roots are not supported", c.Root, parent)
+		}
+	}
+	nodesRoot := c.NodesRoot
+	if nodesRoot == "" {
+		nodesRoot = c.Root
+		if dumbcaslib.IsRemote(c.Root) {
+			// dumbcas web serves the nodes along the objects.
+			root := strings.TrimRight(c.Root, "/")
+			if !strings.HasSuffix(root, webContentPath) {
+				return errors.New("Must provide -nodes-root when -root is an URL")
+			}
+			nodesRoot = strings.TrimSuffix(root, webContentPath) + webNodesPath
+		}
+	} else if !dumbcaslib.IsRemote(nodesRoot) {
+		root, err := filepath.Abs(nodesRoot)
+		if err != nil {
+			return fmt.Errorf("Failed to find %s", nodesRoot)
+		}
+		nodesRoot = root
 	}
-	c.Root = root
 
-	cas, err := d.MakeCasTable(c.Root)
+	if c.MaxRate < 0 {
+		return errors.New("-max-rate must be positive")
+	}
+	if c.CacheSize < 0 {
+		return errors.New("-cache-size must be positive")
+	}
+	secondaries := make([]string, 0, len(c.Secondaries))
+	for _, secondary := range c.Secondaries {
+		if !dumbcaslib.IsRemote(secondary) {
+			root, err := filepath.Abs(secondary)
+			if err != nil {
+				return fmt.Errorf("Failed to find %s", secondary)
+			}
+			secondary = root
+		}
+		secondaries = append(secondaries, secondary)
+	}
+	trashDir := c.TrashDir
+	if trashDir != "" {
+		root, err := filepath.Abs(trashDir)
+		if err != nil {
+			return fmt.Errorf("Failed to find %s", trashDir)
+		}
+		trashDir = root
+	}
+	passphrase := c.Passphrase
+	if passphrase == "" {
+		// Not the flag default so -help doesn't print it.
+		passphrase = os.Getenv("DUMBCAS_PASSPHRASE")
+	}
+	if c.PassphraseFile != "" {
+		data, err := ioutil.ReadFile(c.PassphraseFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read the passphrase: %s", err)
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	}
+
+	cas, err := d.MakeCasTable(c.Root, dumbcaslib.CasOptions{
+		Hash:             c.Hash,
+		PrefixLength:     c.PrefixLength,
+		VerifyWrites:     c.VerifyWrites,
+		Jobs:             c.Jobs,
+		Compression:      string(c.Compress),
+		CompressionLevel: c.CompressLevel,
+		PackThreshold:    c.PackThreshold,
+		Passphrase:       passphrase,
+		Secondaries:      secondaries,
+		TrashDir:         trashDir,
+		ReadOnly:         c.ReadOnly,
+	})
 	if err != nil {
 		return err
 	}
+	writeRetries := c.WriteRetries
+	if writeRetries < 0 {
+		// Remote storage is expected to fail transiently.
+		writeRetries = 0
+		if dumbcaslib.IsRemote(c.Root) {
+			writeRetries = defaultRemoteWriteRetries
+		}
+	}
+	if c.MaxRate != 0 {
+		cas = dumbcaslib.MakeThrottledCasTable(cas, c.MaxRate)
+	}
+	if writeRetries != 0 {
+		cas = dumbcaslib.MakeRetryingCasTable(cas, writeRetries, writeRetryDelay, d.GetLogger().Logger(levelWarning))
+	}
+	if c.ReadOnly {
+		cas = dumbcaslib.MakeReadOnlyCasTable(cas)
+	}
+	if c.CacheSize != 0 {
+		cas = dumbcaslib.MakeLRUCasTable(cas, c.CacheSize, cacheMaxEntrySize)
+	}
 	c.cas = cas
 
 	if c.cas.GetFsckBit() {
 		if !bypassFsck {
 			return fmt.Errorf("Can't run if fsck is needed. Please run fsck first.")
 		}
-		fmt.Fprintf(os.Stderr, "WARNING: fsck is needed.")
+		d.GetLogger().Warningf("fsck is needed.")
 	}
-	nodes, err := d.LoadNodesTable(c.Root, c.cas)
+	nodes, err := d.LoadNodesTable(nodesRoot, c.cas)
 	if err != nil {
 		return err
 	}
 	c.nodes = nodes
+	// The lock, the checkpoints and the gc state are always local.
+	c.lockRoot = nodesRoot
+	c.remoteNodes = dumbcaslib.IsRemote(nodesRoot)
+	if c.remoteNodes {
+		if c.lockRoot, err = remoteStateDir(nodesRoot); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func sha1Reader(f io.Reader) (string, error) {
-	hash := sha1.New()
-	if _, err := io.Copy(hash, f); err != nil {
+// remoteStateDir returns the local directory holding the lock, the
+// checkpoints and the gc state of the nodes at the URL root.
+func remoteStateDir(root string) (string, error) {
+	usr, err := user.Current()
+	if err != nil {
 		return "", err
 	}
-	return hex.EncodeToString(hash.Sum(nil)), nil
+	u, err := url.Parse(root)
+	if err != nil {
+		return "", err
+	}
+	// The credentials don't change the table.
+	u.User = nil
+	sum := sha1.Sum([]byte(u.String()))
+	return filepath.Join(usr.HomeDir, ".dumbcas", "remote", hex.EncodeToString(sum[:8])), nil
+}
+
+// stringsFlag is a flag that can be repeated.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// compressFlag is the algorithm of -compress. -compress alone means gzip.
+type compressFlag string
+
+func (c *compressFlag) String() string {
+	return string(*c)
+}
+
+// Set accepts an algorithm, or the boolean spellings since -compress alone is
+// a boolean flag; true means gzip.
+func (c *compressFlag) Set(value string) error {
+	if b, err := strconv.ParseBool(value); err == nil {
+		if b {
+			value = "gzip"
+		} else {
+			value = ""
+		}
+	}
+	switch value {
+	case "", "gzip", "zstd":
+		*c = compressFlag(value)
+		return nil
+	default:
+		return fmt.Errorf("unknown compression %q; expected gzip or zstd", value)
+	}
+}
+
+// IsBoolFlag lets -compress be used alone. The algorithm must then be given
+// as -compress=zstd, since a boolean flag doesn't take the next argument.
+func (c *compressFlag) IsBoolFlag() bool {
+	return true
 }
 
-func sha1File(filePath string) (string, error) {
+// parseTags parses the key=value pairs of -tag. The value may be omitted.
+func parseTags(tags []string) (map[string]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	out := map[string]string{}
+	for _, tag := range tags {
+		parts := strings.SplitN(tag, "=", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("Invalid tag %q; expected key=value", tag)
+		}
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		out[parts[0]] = parts[1]
+	}
+	return out, nil
+}
+
+// matchTag returns true if the node tags match filter, which is either a key
+// matching any value or a key=value pair.
+func matchTag(tags map[string]string, filter string) bool {
+	parts := strings.SplitN(filter, "=", 2)
+	value, ok := tags[parts[0]]
+	return ok && (len(parts) == 1 || value == parts[1])
+}
+
+// Lock locks the table; exclusive is needed by the commands that must not run
+// while the table is being written to. It must be called after Parse() and the
+// lock released with Unlock().
+func (c *CommonFlags) Lock(d DumbcasApplication, exclusive bool) error {
+	if exclusive && c.remoteNodes {
+		// The other machines writing to the server don't see this lock; the
+		// server's own commands and requests take the lock of the table.
+		return errors.New("This command can't lock the nodes of a remote table; run it on the server")
+	}
+	lock, err := d.MakeLocker(c.lockRoot).Lock(exclusive)
+	if err != nil {
+		return err
+	}
+	c.lock = lock
+	return nil
+}
+
+// Unlock releases the lock acquired with Lock().
+func (c *CommonFlags) Unlock() {
+	if c.lock != nil {
+		_ = c.lock.Unlock()
+		c.lock = nil
+	}
+}
+
+func hashReader(h hash.Hash, f io.Reader) (string, error) {
+	return dumbcaslib.HashReader(h, f)
+}
+
+func hashFile(h hash.Hash, filePath string) (string, error) {
 	f, err := os.Open(filePath)
 	if err != nil {
 		return "", err
@@ -83,5 +373,12 @@ func sha1File(filePath string) (string, error) {
 	defer func() {
 		_ = f.Close()
 	}()
-	return sha1Reader(f)
+	return hashReader(h, f)
+}
+
+// isInside returns true if path is dir or is inside it. Both must be clean
+// absolute paths.
+func isInside(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
@@ -37,6 +37,9 @@ func removeDir(t testing.TB, tempDir string) {
 	ut.AssertEqual(t, nil, err)
 }
 
+// treeModTime is the modification time of the files created by createTree().
+var treeModTime = time.Date(2012, 1, 2, 3, 4, 5, 0, time.UTC)
+
 func createTree(rootDir string, tree map[string]string) error {
 	for relPath, content := range tree {
 		base := filepath.Dir(relPath)
@@ -52,6 +55,14 @@ func createTree(rootDir string, tree map[string]string) error {
 		_, _ = f.WriteString(content)
 		_ = f.Sync()
 		_ = f.Close()
+		// Make the mode independent of the umask.
+		if err := os.Chmod(filepath.Join(rootDir, relPath), 0644); err != nil {
+			return err
+		}
+		// Make the nodes independent of the time the test is run.
+		if err := os.Chtimes(filepath.Join(rootDir, relPath), treeModTime, treeModTime); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -84,7 +95,8 @@ func sha1String(content string) string {
 	return hex.EncodeToString(hash.Sum(nil))
 }
 
-// marshalData returns the tree of sha1s and the json encoded Node as bytes.
+// marshalData returns the tree of sha1s and the json encoded Node as bytes. The
+// files have the mode and the modification time set by createTree().
 func marshalData(t testing.TB, tree map[string]string) (map[string]string, []byte) {
 	sha1tree := map[string]string{}
 	entries := &dumbcaslib.Entry{}
@@ -106,8 +118,10 @@ func marshalData(t testing.TB, tree map[string]string) (map[string]string, []byt
 			e.Files = map[string]*dumbcaslib.Entry{}
 		}
 		e.Files[parts[len(parts)-1]] = &dumbcaslib.Entry{
-			Sha1: h,
-			Size: int64(len(v)),
+			Sha1:    h,
+			Size:    int64(len(v)),
+			Mode:    0644,
+			ModTime: treeModTime,
 		}
 	}
 
@@ -131,8 +145,125 @@ func archiveData(t testing.TB, cas dumbcaslib.CasTable, nodes dumbcaslib.NodesTa
 
 	// And finally add the node.
 	now := time.Now().UTC()
-	nodeName, err := nodes.AddEntry(&dumbcaslib.Node{entrySha1, "useful comment"}, "fictious")
+	nodeName, err := nodes.AddEntry(&dumbcaslib.Node{Entry: entrySha1, Comment: "useful comment"}, "fictious")
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqualf(t, true, strings.HasPrefix(nodeName, now.Format("2006-01")+string(filepath.Separator)), "Invalid node name %s", nodeName)
 	return sha1tree, nodeName, entrySha1
 }
+
+func TestPassphraseFile(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "passphrase")
+	defer removeDir(t, tempData)
+	p := filepath.Join(tempData, "passphrase")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(p, []byte("secret\n"), 0600))
+
+	args := []string{"stats", "-root=" + mockRoot("archive"), "-passphrase=ignored", "-passphrase-file=" + p}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, "secret", f.casOptions.Passphrase)
+
+	args = []string{"stats", "-root=" + mockRoot("archive"), "-passphrase-file=" + filepath.Join(tempData, "missing")}
+	f.Run(args, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestPassphraseEnv(t *testing.T) {
+	// Not parallel since the environment is global.
+	ut.AssertEqual(t, nil, os.Setenv("DUMBCAS_PASSPHRASE", "secret"))
+	defer func() {
+		_ = os.Unsetenv("DUMBCAS_PASSPHRASE")
+	}()
+	// -help prints the defaults.
+	ut.AssertEqual(t, "", cmdStats.CommandRun().GetFlags().Lookup("passphrase").DefValue)
+
+	f := makeDumbcasAppMock(t)
+	f.Run([]string{"stats", "-root=" + mockRoot("archive")}, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, "secret", f.casOptions.Passphrase)
+	f.Run([]string{"stats", "-root=" + mockRoot("archive"), "-passphrase=flag"}, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, "flag", f.casOptions.Passphrase)
+}
+
+func TestCompressFlag(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.in = bytes.NewBufferString("content")
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-stdin", "-name=foo", "-compress"}, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, "gzip", f.casOptions.Compression)
+
+	f.in = bytes.NewBufferString("content")
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-stdin", "-name=foo", "-compress=zstd", "-compress-level=19"}, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, "zstd", f.casOptions.Compression)
+	ut.AssertEqual(t, 19, f.casOptions.CompressionLevel)
+
+	data := map[string]compressFlag{"1": "gzip", "true": "gzip", "gzip": "gzip", "zstd": "zstd", "0": "", "false": ""}
+	for value, expected := range data {
+		var c compressFlag
+		ut.AssertEqual(t, nil, c.Set(value))
+		ut.AssertEqual(t, expected, c)
+	}
+	var c compressFlag
+	ut.AssertEqual(t, false, c.Set("lzma") == nil)
+}
+
+func TestPackThresholdFlag(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.in = bytes.NewBufferString("content")
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-stdin", "-name=foo", "-pack-threshold=4096"}, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, int64(4096), f.casOptions.PackThreshold)
+}
+
+func TestVerboseFlags(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.in = bytes.NewBufferString("content")
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-stdin", "-name=foo"}, 0)
+	ut.AssertEqual(t, false, f.logger.Enabled(levelDebug))
+
+	f.in = bytes.NewBufferString("content")
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-stdin", "-name=bar", "-v"}, 0)
+	ut.AssertEqual(t, true, f.logger.Enabled(levelDebug))
+	ut.AssertEqual(t, false, f.logger.Enabled(levelTrace))
+
+	f.in = bytes.NewBufferString("content")
+	f.Run([]string{"archive", "-root=" + mockRoot("archive"), "-stdin", "-name=baz", "-vv"}, 0)
+	ut.AssertEqual(t, true, f.logger.Enabled(levelTrace))
+	f.CheckBuffer(true, false)
+}
+
+func TestParseTags(t *testing.T) {
+	t.Parallel()
+	tags, err := parseTags([]string{"schedule=daily", "pinned", "expr=a=b"})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, map[string]string{"schedule": "daily", "pinned": "", "expr": "a=b"}, tags)
+	_, err = parseTags([]string{"=daily"})
+	ut.AssertEqual(t, false, err == nil)
+
+	ut.AssertEqual(t, true, matchTag(tags, "schedule"))
+	ut.AssertEqual(t, true, matchTag(tags, "schedule=daily"))
+	ut.AssertEqual(t, false, matchTag(tags, "schedule=weekly"))
+	ut.AssertEqual(t, true, matchTag(tags, "pinned="))
+	ut.AssertEqual(t, false, matchTag(tags, "missing"))
+	ut.AssertEqual(t, false, matchTag(nil, "schedule"))
+}
+
+func TestRemoteNodesRoot(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	// The nodes default to the ones served by the same dumbcas web.
+	f.Run([]string{"list", "-root=http://localhost:1/content/retrieve/default/"}, 0)
+	ut.AssertEqual(t, "http://localhost:1/content/nodes", f.nodesRoot)
+	f.Run([]string{"list", "-root=http://localhost:1/content/retrieve/default", "-nodes-root=http://localhost:2/content/nodes"}, 0)
+	ut.AssertEqual(t, "http://localhost:2/content/nodes", f.nodesRoot)
+	f.CheckOut("Total 0\nTotal 0\n")
+
+	f.Run([]string{"list", "-root=s3://bucket/path"}, 1)
+	f.CheckBuffer(false, true)
+}
@@ -0,0 +1,120 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+)
+
+// repoConfig is a named repository of the configuration file, selected with
+// -repo. The flags given on the command line override its values.
+type repoConfig struct {
+	Root      string `json:"root"`
+	NodesRoot string `json:"nodes_root,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+	Compress  string `json:"compress,omitempty"`
+	// Secondaries are the other copies of the table, e.g. the URL of a remote
+	// one, used to repair it like -secondary.
+	Secondaries []string `json:"secondaries,omitempty"`
+}
+
+// config is the content of ~/.dumbcas/config.json.
+type config struct {
+	// Default is the repository used when neither -repo nor -root is given.
+	Default string                 `json:"default,omitempty"`
+	Repos   map[string]*repoConfig `json:"repos"`
+}
+
+// getConfigPath returns the path of the configuration file.
+func getConfigPath() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(usr.HomeDir, ".dumbcas", "config.json"), nil
+}
+
+// loadConfig loads the configuration file filePath. A missing file is an empty
+// configuration.
+func loadConfig(filePath string) (*config, error) {
+	c := &config{}
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %s", filePath, err)
+	}
+	return c, nil
+}
+
+// applyRepo sets the flags not given on the command line from the repository
+// -repo of the configuration file. Without -repo nor -root, the default
+// repository is used.
+func (c *CommonFlags) applyRepo(d DumbcasApplication) error {
+	set := map[string]bool{}
+	c.Flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if set["root"] {
+		if set["repo"] {
+			return fmt.Errorf("Can't use both -root and -repo")
+		}
+		return nil
+	}
+	name := c.Repo
+	if name == "" && c.Root != "" {
+		// $DUMBCAS_ROOT.
+		return nil
+	}
+	cfg, err := d.LoadConfig()
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		if name = cfg.Default; name == "" {
+			return nil
+		}
+	}
+	repo := cfg.Repos[name]
+	if repo == nil {
+		return fmt.Errorf("Unknown repository %s", name)
+	}
+	if repo.Root == "" {
+		return fmt.Errorf("The repository %s has no root", name)
+	}
+	d.GetLogger().Debugf("Using the repository %s at %s", name, repo.Root)
+	c.Root = repo.Root
+	if !set["nodes-root"] {
+		c.NodesRoot = repo.NodesRoot
+	}
+	if !set["hash"] {
+		c.Hash = repo.Hash
+	}
+	if !set["compress"] {
+		// Normalized like the flag, e.g. "true" is gzip.
+		if err := c.Compress.Set(repo.Compress); err != nil {
+			return fmt.Errorf("The repository %s: %s", name, err)
+		}
+	}
+	if !set["secondary"] {
+		c.Secondaries = repo.Secondaries
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestRepoConfig(t *testing.T) {
+	if os.Getenv("DUMBCAS_ROOT") != "" || os.Getenv("DUMBCAS_REPO") != "" {
+		t.Skip("the environment selects a table")
+	}
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "repo_config")
+	defer removeDir(t, tempData)
+	home := filepath.Join(tempData, "home")
+	other := filepath.Join(tempData, "other")
+	f.config = &config{
+		Default: "other",
+		Repos: map[string]*repoConfig{
+			"home":  {Root: home, Hash: "sha256", Compress: "zstd", Secondaries: []string{"http://host:8010/content/retrieve/default"}},
+			"other": {Root: other, NodesRoot: filepath.Join(tempData, "nodes")},
+			"empty": {},
+			"bool":  {Root: home, Compress: "true"},
+			"bad":   {Root: home, Compress: "lzma"},
+		},
+	}
+
+	f.Run([]string{"stats", "-repo=home"}, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, home, f.nodesRoot)
+	ut.AssertEqual(t, "sha256", f.casOptions.Hash)
+	ut.AssertEqual(t, "zstd", f.casOptions.Compression)
+	ut.AssertEqual(t, []string{"http://host:8010/content/retrieve/default"}, f.casOptions.Secondaries)
+
+	// The flags override the repository.
+	f.Run([]string{"stats", "-repo=home", "-hash=blake3", "-nodes-root=" + other}, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, other, f.nodesRoot)
+	ut.AssertEqual(t, "blake3", f.casOptions.Hash)
+
+	// The default repository is used without -root nor -repo.
+	f.Run([]string{"stats"}, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, filepath.Join(tempData, "nodes"), f.nodesRoot)
+	ut.AssertEqual(t, "", f.casOptions.Hash)
+
+	// The compression is normalized like the flag.
+	f.Run([]string{"stats", "-repo=bool"}, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, "gzip", f.casOptions.Compression)
+	f.Run([]string{"stats", "-repo=bad"}, 1)
+	f.CheckBuffer(false, true)
+
+	f.Run([]string{"stats", "-repo=missing"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"stats", "-repo=empty"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"stats", "-repo=home", "-root=" + home}, 1)
+	f.CheckBuffer(false, true)
+	f.config = &config{}
+	f.Run([]string{"stats"}, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "load_config")
+	defer removeDir(t, tempData)
+	p := filepath.Join(tempData, "config.json")
+
+	c, err := loadConfig(p)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, &config{}, c)
+
+	ut.AssertEqual(t, nil, ioutil.WriteFile(p, []byte(`{"default": "home", "repos": {"home": {"root": "/backup", "compress": "gzip"}}}`), 0600))
+	c, err = loadConfig(p)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, &config{Default: "home", Repos: map[string]*repoConfig{"home": {Root: "/backup", Compress: "gzip"}}}, c)
+
+	ut.AssertEqual(t, nil, ioutil.WriteFile(p, []byte("{"), 0600))
+	_, err = loadConfig(p)
+	ut.AssertEqual(t, false, err == nil)
+}
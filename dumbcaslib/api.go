@@ -0,0 +1,218 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiNode is a node as returned by the API of MakeNodesAPIHandler(). Entry
+// and Comment are only set when a single node is requested.
+type apiNode struct {
+	Name    string            `json:"name"`
+	Created time.Time         `json:"created"`
+	Entry   string            `json:"entry,omitempty"`
+	Comment string            `json:"comment,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+// apiEntry is a child of a directory as returned by "GET /<name>?tree=<dir>".
+type apiEntry struct {
+	Name    string      `json:"name"`
+	Dir     bool        `json:"dir,omitempty"`
+	Hash    string      `json:"hash,omitempty"`
+	Size    int64       `json:"size,omitempty"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+	Symlink string      `json:"symlink,omitempty"`
+	ModTime time.Time   `json:"modTime,omitzero"`
+}
+
+type nodesAPIHandler struct {
+	cas      CasTable
+	nodes    NodesTable
+	maxItems int
+
+	// recentEntries are the trees recently browsed, so paging through a
+	// directory doesn't decode the tree again for each page. They are keyed by
+	// hash so they never become stale.
+	mutex         sync.Mutex
+	recentEntries map[string]*apiEntryCache
+}
+
+type apiEntryCache struct {
+	entry      *Entry
+	lastAccess time.Time
+}
+
+// MakeNodesAPIHandler returns an http.Handler serving the nodes as JSON, to
+// build a custom frontend:
+//   - "GET /" lists the nodes sorted by name, without the tags aliases.
+//   - "GET /<name>" returns a node.
+//   - "GET /<name>?tree=<dir>" lists the children of a directory of the node,
+//     the root when empty, sorted by name. "&after=<child>&limit=N" pages it
+//     like the "GET /list" of MakeCasHandler().
+//
+// Only the directory requested is serialized so a huge tree is browsed one
+// directory at a time.
+func MakeNodesAPIHandler(cas CasTable, nodes NodesTable) http.Handler {
+	return &nodesAPIHandler{cas: cas, nodes: nodes, maxItems: 10, recentEntries: map[string]*apiEntryCache{}}
+}
+
+func (h *nodesAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.Trim(r.URL.Path, "/")
+	if !isValidCasURL(p) {
+		http.Error(w, "Invalid node: "+p, http.StatusBadRequest)
+		return
+	}
+	if p == "" {
+		h.list(w)
+		return
+	}
+	if _, ok := r.URL.Query()["tree"]; ok {
+		h.tree(w, r, p)
+		return
+	}
+	node := h.load(w, p)
+	if node == nil {
+		return
+	}
+	writeJSON(w, &apiNode{p, node.Created, node.Entry, node.Comment, node.Tags})
+}
+
+// list replies all the nodes. The nodes are not opened so it stays fast.
+func (h *nodesAPIHandler) list(w http.ResponseWriter) {
+	out := []apiNode{}
+	for item := range h.nodes.Enumerate() {
+		if item.Error != nil {
+			http.Error(w, item.Error.Error(), http.StatusInternalServerError)
+			return
+		}
+		name := filepath.ToSlash(item.Item)
+		if IsTag(name) {
+			continue
+		}
+		out = append(out, apiNode{Name: name, Created: item.Created, Tags: item.Tags})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	writeJSON(w, out)
+}
+
+// tree replies the children of the directory "?tree=" of the node name.
+func (h *nodesAPIHandler) tree(w http.ResponseWriter, r *http.Request, name string) {
+	q := r.URL.Query()
+	after := q.Get("after")
+	limit := 0
+	if l := q.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit: "+l, http.StatusBadRequest)
+			return
+		}
+	}
+	node := h.load(w, name)
+	if node == nil {
+		return
+	}
+	entry, err := h.getEntry(node.Entry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	path := q.Get("tree")
+	dir, err := (&entryFileSystem{entry, h.cas}).pathToEntry("/" + path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dir == nil {
+		http.Error(w, "Not found: "+path, http.StatusNotFound)
+		return
+	}
+	if !dir.IsDir() {
+		http.Error(w, "Not a directory: "+path, http.StatusBadRequest)
+		return
+	}
+	out := []apiEntry{}
+	for _, child := range dir.SortedFiles() {
+		if child <= after {
+			continue
+		}
+		if limit != 0 && len(out) == limit {
+			break
+		}
+		e := dir.Files[child]
+		out = append(out, apiEntry{child, e.IsDir(), e.Sha1, e.Size, e.Mode, e.Symlink, e.ModTime})
+	}
+	writeJSON(w, out)
+}
+
+// getEntry returns the tree entryName, decoded once for all the pages.
+func (h *nodesAPIHandler) getEntry(entryName string) (*Entry, error) {
+	h.mutex.Lock()
+	if entryObj, ok := h.recentEntries[entryName]; ok {
+		entryObj.lastAccess = time.Now()
+		h.mutex.Unlock()
+		return entryObj.entry, nil
+	}
+	h.mutex.Unlock()
+
+	// Decode the tree without the lock.
+	entry, err := LoadEntry(h.cas, entryName)
+	if err != nil {
+		return nil, err
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.recentEntries[entryName] = &apiEntryCache{entry, time.Now()}
+	for len(h.recentEntries) > h.maxItems {
+		// Find the oldest and remove it.
+		olderName := entryName
+		olderStamp := time.Now()
+		for n, o := range h.recentEntries {
+			if o.lastAccess.Before(olderStamp) {
+				olderStamp = o.lastAccess
+				olderName = n
+			}
+		}
+		delete(h.recentEntries, olderName)
+	}
+	return entry, nil
+}
+
+// load returns the node name or replies the error and returns nil.
+func (h *nodesAPIHandler) load(w http.ResponseWriter, name string) *Node {
+	f, err := h.nodes.Open(name)
+	if err != nil {
+		http.Error(w, "Not found: "+name, http.StatusNotFound)
+		return nil
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	node := &Node{}
+	if err := decodeNode(f, node); err != nil {
+		http.Error(w, "Failed to load "+name+": "+err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return node
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
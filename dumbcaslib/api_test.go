@@ -0,0 +1,91 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func getAPI(t *testing.T, h http.Handler, path string, expectedCode int, out interface{}) {
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest("GET", path, nil))
+	ut.AssertEqualf(t, expectedCode, resp.Code, "%s: %s", path, resp.Body.String())
+	if out != nil {
+		ut.AssertEqual(t, "application/json", resp.Header().Get("Content-Type"))
+		ut.AssertEqual(t, nil, json.Unmarshal(resp.Body.Bytes(), out))
+	}
+}
+
+func TestNodesAPI(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	nodes := MakeMemoryNodesTable(cas)
+	root := &Entry{}
+	root.AddFile("a", Sha1Bytes([]byte("a")), 1)
+	root.AddFile("dir1/b", Sha1Bytes([]byte("bb")), 2)
+	root.AddFile("dir1/c", Sha1Bytes([]byte("c")), 1)
+	root.AddFile("dir1/d", Sha1Bytes([]byte("d")), 1)
+	root.AddSymlink("link", "a")
+	entry, err := ArchiveEntry(cas, root)
+	ut.AssertEqual(t, nil, err)
+	name, err := nodes.AddEntry(&Node{Entry: entry, Comment: "hi", Tags: map[string]string{"k": "v"}}, "foo")
+	ut.AssertEqual(t, nil, err)
+	name = filepath.ToSlash(name)
+	h := MakeNodesAPIHandler(cas, nodes)
+
+	list := []apiNode{}
+	getAPI(t, h, "/", 200, &list)
+	ut.AssertEqual(t, 1, len(list))
+	ut.AssertEqual(t, name, list[0].Name)
+	ut.AssertEqual(t, map[string]string{"k": "v"}, list[0].Tags)
+	ut.AssertEqual(t, "", list[0].Entry)
+
+	node := &apiNode{}
+	getAPI(t, h, "/"+name, 200, node)
+	ut.AssertEqual(t, entry, node.Entry)
+	ut.AssertEqual(t, "hi", node.Comment)
+	getAPI(t, h, "/2000-01/missing", 404, nil)
+	getAPI(t, h, "/../foo", 400, nil)
+
+	children := []apiEntry{}
+	getAPI(t, h, "/"+name+"?tree", 200, &children)
+	ut.AssertEqual(t, []apiEntry{
+		{Name: "a", Hash: Sha1Bytes([]byte("a")), Size: 1},
+		{Name: "dir1", Dir: true},
+		{Name: "link", Symlink: "a"},
+	}, children)
+
+	children = []apiEntry{}
+	getAPI(t, h, "/"+name+"?tree=dir1&after=b&limit=1", 200, &children)
+	ut.AssertEqual(t, []apiEntry{{Name: "c", Hash: Sha1Bytes([]byte("c")), Size: 1}}, children)
+	// The next page reuses the decoded tree.
+	ut.AssertEqual(t, 1, len(h.(*nodesAPIHandler).recentEntries))
+	children = []apiEntry{}
+	getAPI(t, h, "/"+name+"?tree=dir1&after=c&limit=1", 200, &children)
+	ut.AssertEqual(t, []apiEntry{{Name: "d", Hash: Sha1Bytes([]byte("d")), Size: 1}}, children)
+	ut.AssertEqual(t, 1, len(h.(*nodesAPIHandler).recentEntries))
+
+	getAPI(t, h, "/"+name+"?tree=dir2", 404, nil)
+	getAPI(t, h, "/"+name+"?tree=a", 400, nil)
+	getAPI(t, h, "/"+name+"?tree&limit=0", 400, nil)
+
+	// A tag named tree is a node, not its tree.
+	_, err = nodes.AddEntry(&Node{Entry: entry, Comment: "tree"}, "tree")
+	ut.AssertEqual(t, nil, err)
+	node = &apiNode{}
+	getAPI(t, h, "/tags/tree", 200, node)
+	ut.AssertEqual(t, "tree", node.Comment)
+}
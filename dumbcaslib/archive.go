@@ -0,0 +1,195 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// AddFile adds the file relPath to the tree rooted at e, creating the
+// intermediate directory entries as needed. relPath uses the OS path
+// separator. Returns the new Entry so the caller can set its Mode.
+func (e *Entry) AddFile(relPath string, hash string, size int64) *Entry {
+	e = e.add(relPath)
+	e.Sha1 = hash
+	e.Size = size
+	return e
+}
+
+// AddSymlink adds the symlink relPath pointing to target to the tree rooted at
+// e.
+func (e *Entry) AddSymlink(relPath string, target string) *Entry {
+	e = e.add(relPath)
+	e.Symlink = target
+	return e
+}
+
+// AddDir adds the empty directory relPath with the permission bits of mode to
+// the tree rooted at e.
+func (e *Entry) AddDir(relPath string, mode os.FileMode) *Entry {
+	e = e.add(relPath)
+	e.Mode = os.ModeDir | mode.Perm()
+	return e
+}
+
+func (e *Entry) add(relPath string) *Entry {
+	for _, p := range strings.Split(filepath.ToSlash(relPath), "/") {
+		if e.Files == nil {
+			e.Files = make(map[string]*Entry)
+		}
+		if e.Files[p] == nil {
+			e.Files[p] = &Entry{}
+		}
+		e = e.Files[p]
+	}
+	return e
+}
+
+// ArchiveFile hashes the file at filePath and adds it to the table. Returns
+// the hash and the size of the file. Like AddEntry, the error satisfies
+// os.IsExist() when the content was already present.
+func ArchiveFile(cas CasTable, filePath string) (string, int64, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	stat, err := f.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	hash, err := HashReader(cas.NewHash(), f)
+	if err != nil {
+		return "", 0, fmt.Errorf("Failed to hash %s: %s", filePath, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	return hash, stat.Size(), AddEntrySized(cas, f, hash, stat.Size())
+}
+
+// sizedAdder is implemented by the tables that can make use of the size of an
+// entry before it is added.
+type sizedAdder interface {
+	addEntrySized(source io.Reader, hash string, size int64) error
+}
+
+// AddEntrySized is CasTable.AddEntry() for content known to be size bytes
+// long. The local tables preallocate the entry. The entry is rejected if
+// source doesn't return exactly size bytes, e.g. when the file was truncated
+// while being read.
+func AddEntrySized(cas CasTable, source io.Reader, hash string, size int64) error {
+	source = newSizedReader(source, size)
+	if s, ok := cas.(sizedAdder); ok {
+		return s.addEntrySized(source, hash, size)
+	}
+	return cas.AddEntry(source, hash)
+}
+
+// sizedReader fails the read once more than size bytes were read, or when
+// the source ends before.
+type sizedReader struct {
+	source io.Reader
+	size   int64
+	read   int64
+}
+
+// sizedReadSeeker is a sizedReader that can be rewound, so the retries of
+// MakeRetryingCasTable() still work.
+type sizedReadSeeker struct {
+	sizedReader
+	seeker io.Seeker
+	start  int64
+}
+
+func newSizedReader(source io.Reader, size int64) io.Reader {
+	r := sizedReader{source: source, size: size}
+	if seeker, ok := source.(io.Seeker); ok {
+		if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			return &sizedReadSeeker{r, seeker, start}
+		}
+	}
+	return &r
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	n, err := s.source.Read(p)
+	s.read += int64(n)
+	if s.read > s.size {
+		return n, fmt.Errorf("Read more than the expected %d bytes", s.size)
+	}
+	if err == io.EOF && s.read < s.size {
+		return n, fmt.Errorf("Read %d bytes, expected %d: %s", s.read, s.size, io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
+
+func (s *sizedReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := s.seeker.Seek(offset, whence)
+	if err == nil {
+		s.read = pos - s.start
+	}
+	return pos, err
+}
+
+// streamAdder is implemented by the tables that can add an entry whose hash
+// is only known once its content was read.
+type streamAdder interface {
+	addStream(source io.Reader) (string, int64, error)
+}
+
+// ArchiveReader adds the content read from r to the table, hashing it as it is
+// written so it is streamed with bounded memory, e.g. from stdin. Returns the
+// hash and the size of the content. Like AddEntry, the error satisfies
+// os.IsExist() when the content was already present.
+func ArchiveReader(cas CasTable, r io.Reader) (string, int64, error) {
+	if s, ok := cas.(streamAdder); ok {
+		return s.addStream(r)
+	}
+	// The table needs the hash first; stage the content.
+	tmp, err := ioutil.TempFile("", "dumbcas_stream")
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	h := cas.NewHash()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	return hash, size, cas.AddEntry(tmp, hash)
+}
+
+// ArchiveEntry serializes the Entry tree and adds it to the table. The
+// returned hash is what Node.Entry refers to. Like AddEntry, the error
+// satisfies os.IsExist() when the tree was already present.
+func ArchiveEntry(cas CasTable, entry *Entry) (string, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", fmt.Errorf("Failed to marshal entry file: %s", err)
+	}
+	return AddBytes(cas, data)
+}
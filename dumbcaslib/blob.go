@@ -0,0 +1,279 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Entries are normally stored as-is. Entries that are transformed, e.g.
+// compressed, are prefixed with a header:
+//   - blobMagic
+//   - the codec, one byte
+//   - the size of the original content, 8 bytes big endian
+//
+// Encrypted entries continue with the encryption nonce; see crypt.go.
+//
+// The entry is always named after the hash of the original content so
+// deduplication works independently of the codec.
+var blobMagic = []byte("dumbcas\x00")
+
+const blobHeaderSize = 8 + 1 + 8
+
+const (
+	// codecNone is used for content that happens to start with blobMagic.
+	codecNone byte = 0
+	codecGzip byte = 1
+	codecZstd byte = 2
+	// codecEncrypted is set in addition to the codec of encrypted entries.
+	codecEncrypted byte = 0x80
+)
+
+// blobWriter is where a blob is written; the size in the header is filled in
+// once known.
+type blobWriter interface {
+	io.Writer
+	io.WriterAt
+}
+
+// writeBlob writes source into f, encoded with codec at level and encrypted
+// with aead if not nil. level 0 is the default level of the codec. Returns the
+// number of bytes read from source.
+func writeBlob(f blobWriter, source io.Reader, codec byte, level int, aead cipher.AEAD) (int64, error) {
+	if codec == codecNone && aead == nil {
+		// Only add a header if the content could be confused with one.
+		b := bufio.NewReader(source)
+		if start, _ := b.Peek(len(blobMagic)); !bytes.Equal(start, blobMagic) {
+			return io.Copy(f, b)
+		}
+		source = b
+	}
+	header := make([]byte, blobHeaderSize)
+	copy(header, blobMagic)
+	header[len(blobMagic)] = codec
+	if aead != nil {
+		header[len(blobMagic)] |= codecEncrypted
+	}
+	if _, err := f.Write(header); err != nil {
+		return 0, err
+	}
+	var w io.Writer = f
+	var e *encryptingWriter
+	if aead != nil {
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return 0, err
+		}
+		if _, err := f.Write(nonce); err != nil {
+			return 0, err
+		}
+		e = newEncryptingWriter(f, aead, nonce)
+		w = e
+	}
+	var size int64
+	var err error
+	switch codec {
+	case codecNone:
+		size, err = io.Copy(w, source)
+	case codecGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		gz, err2 := gzip.NewWriterLevel(w, level)
+		if err2 != nil {
+			return 0, err2
+		}
+		size, err = io.Copy(gz, source)
+		if err2 := gz.Close(); err == nil {
+			err = err2
+		}
+	case codecZstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		zw, err2 := zstd.NewWriter(w, opts...)
+		if err2 != nil {
+			return 0, err2
+		}
+		size, err = io.Copy(zw, source)
+		if err2 := zw.Close(); err == nil {
+			err = err2
+		}
+	default:
+		return 0, fmt.Errorf("unknown codec %d", codec)
+	}
+	if err == nil && e != nil {
+		err = e.Close()
+	}
+	if err != nil {
+		return size, err
+	}
+	binary.BigEndian.PutUint64(header[len(blobMagic)+1:], uint64(size))
+	_, err = f.WriteAt(header[len(blobMagic)+1:], int64(len(blobMagic)+1))
+	return size, err
+}
+
+// openBlob returns a reader of the original content of the entry stored in f,
+// decrypted with aead. It takes ownership of f.
+func openBlob(f ReadSeekCloser, aead cipher.AEAD) (ReadSeekCloser, error) {
+	header := make([]byte, blobHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		_ = f.Close()
+		return nil, err
+	}
+	if n != blobHeaderSize || !bytes.Equal(header[:len(blobMagic)], blobMagic) {
+		// Stored as-is.
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	d := &decodingReader{
+		f:     f,
+		codec: header[len(blobMagic)],
+		size:  int64(binary.BigEndian.Uint64(header[len(blobMagic)+1:])),
+		aead:  aead,
+	}
+	if c := d.codec &^ codecEncrypted; c != codecNone && c != codecGzip && c != codecZstd {
+		_ = f.Close()
+		return nil, fmt.Errorf("unknown codec %d", d.codec)
+	}
+	if d.codec&codecEncrypted != 0 && aead == nil {
+		_ = f.Close()
+		return nil, ErrEncrypted
+	}
+	if err := d.reset(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// decodingReader decodes an entry stored with a header. Seeking in a
+// compressed entry discards data going forward and restarts decoding from the
+// start going backward, so it is only efficient for sequential reads.
+type decodingReader struct {
+	f      ReadSeekCloser
+	codec  byte
+	size   int64
+	aead   cipher.AEAD
+	offset int64
+	r      io.Reader
+}
+
+func (d *decodingReader) reset() error {
+	if _, err := d.f.Seek(blobHeaderSize, io.SeekStart); err != nil {
+		return err
+	}
+	d.offset = 0
+	if d.codec == codecNone {
+		d.r = io.LimitReader(d.f, d.size)
+		return nil
+	}
+	var src io.Reader = d.f
+	if d.codec&codecEncrypted != 0 {
+		nonce := make([]byte, d.aead.NonceSize())
+		if _, err := io.ReadFull(d.f, nonce); err != nil {
+			return err
+		}
+		src = newDecryptingReader(d.f, d.aead, nonce)
+		if d.codec&^codecEncrypted == codecNone {
+			d.r = io.LimitReader(src, d.size)
+			return nil
+		}
+	}
+	d.closeDecoder()
+	if d.codec&^codecEncrypted == codecZstd {
+		// The content is decoded synchronously as it is read.
+		zr, err := zstd.NewReader(bufio.NewReader(src), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		d.r = zr
+		return nil
+	}
+	gz, err := gzip.NewReader(bufio.NewReader(src))
+	if err != nil {
+		return err
+	}
+	d.r = gz
+	return nil
+}
+
+// closeDecoder releases the zstd decoder, if any.
+func (d *decodingReader) closeDecoder() {
+	if zr, ok := d.r.(*zstd.Decoder); ok {
+		zr.Close()
+	}
+}
+
+func (d *decodingReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.offset += int64(n)
+	return n, err
+}
+
+func (d *decodingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	}
+	if offset < 0 {
+		return d.offset, errors.New("negative position")
+	}
+	if offset == d.offset {
+		return offset, nil
+	}
+	if offset >= d.size {
+		// Don't bother decoding, there's nothing left to read.
+		d.closeDecoder()
+		d.r = bytes.NewReader(nil)
+		d.offset = offset
+		return offset, nil
+	}
+	if d.codec == codecNone {
+		if _, err := d.f.Seek(blobHeaderSize+offset, io.SeekStart); err != nil {
+			return d.offset, err
+		}
+		d.r = io.LimitReader(d.f, d.size-offset)
+		d.offset = offset
+		return offset, nil
+	}
+	if offset < d.offset {
+		if err := d.reset(); err != nil {
+			return d.offset, err
+		}
+	}
+	if _, err := io.CopyN(ioutil.Discard, d, offset-d.offset); err != nil {
+		return d.offset, err
+	}
+	return d.offset, nil
+}
+
+func (d *decodingReader) Close() error {
+	d.closeDecoder()
+	return d.f.Close()
+}
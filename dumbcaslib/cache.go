@@ -14,9 +14,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 )
 
 func init() {
@@ -31,7 +33,10 @@ type EntryCache struct {
 	Size       int64
 	Timestamp  int64 // In Unix() epoch.
 	LastTested int64 // Last time this file was tested for presence.
-	Files      map[string]*EntryCache
+	// Manifest lists the chunks of a file archived with -chunk-threshold, so it
+	// is not read again while unchanged.
+	Manifest string
+	Files    map[string]*EntryCache
 }
 
 // Print prints the EntryCache in Yaml-inspired output.
@@ -65,12 +70,27 @@ func (e *EntryCache) CountMembers() int {
 	return sum
 }
 
+// CacheStats describes how the cache performed during the last archive.
+type CacheStats struct {
+	// Hits are the files whose hash was trusted from the cache.
+	Hits int64
+	// Misses are the files that had to be hashed.
+	Misses int64
+	// Invalidated are the entries removed because their file was gone.
+	Invalidated int64
+	// When is the time the archive completed; zero if none was recorded.
+	When time.Time
+}
+
 // Cache is a cache to entries to speed up adding elements to a CasTable.
 type Cache interface {
 	io.Closer
 
 	// Returns the root entry. Must be non-nil.
 	Root() *EntryCache
+	// Stats returns the statistics of the last archive, saved along the
+	// entries. Must be non-nil.
+	Stats() *CacheStats
 }
 
 // FindInCache finds an item in the cache or create it if not present.
@@ -91,15 +111,57 @@ func FindInCache(c Cache, itemPath string) *EntryCache {
 	return entry
 }
 
+// PruneCache removes the entries of itemPath and below whose file doesn't
+// exist anymore, so the cache doesn't grow with the files deleted since they
+// were archived. It returns the number of entries removed.
+func PruneCache(c Cache, itemPath string) int {
+	relPath := itemPath
+	if filepath.Separator == '/' && relPath[0] == '/' {
+		relPath = relPath[1:]
+	}
+	parts := strings.Split(relPath, string(filepath.Separator))
+	parent := c.Root()
+	for _, p := range parts[:len(parts)-1] {
+		if parent = parent.Files[p]; parent == nil {
+			return 0
+		}
+	}
+	name := parts[len(parts)-1]
+	entry := parent.Files[name]
+	if entry == nil {
+		return 0
+	}
+	if _, err := os.Lstat(itemPath); os.IsNotExist(err) {
+		delete(parent.Files, name)
+		return entry.CountMembers()
+	}
+	return pruneMissing(entry, itemPath)
+}
+
+func pruneMissing(e *EntryCache, itemPath string) int {
+	removed := 0
+	for name, child := range e.Files {
+		childPath := filepath.Join(itemPath, name)
+		if _, err := os.Lstat(childPath); os.IsNotExist(err) {
+			delete(e.Files, name)
+			removed += child.CountMembers()
+		} else {
+			removed += pruneMissing(child, childPath)
+		}
+	}
+	return removed
+}
+
 type memoryCache struct {
 	root   *EntryCache
+	stats  *CacheStats
 	closed bool
 }
 
 // MakeMemoryCache returns an in-memory Cache implementation. Useful for
 // testing.
 func MakeMemoryCache() Cache {
-	return &memoryCache{&EntryCache{}, false}
+	return &memoryCache{&EntryCache{}, &CacheStats{}, false}
 }
 
 func (m *memoryCache) Root() *EntryCache {
@@ -109,6 +171,10 @@ func (m *memoryCache) Root() *EntryCache {
 	return m.root
 }
 
+func (m *memoryCache) Stats() *CacheStats {
+	return m.stats
+}
+
 func (m *memoryCache) Close() error {
 	if m.closed {
 		return errors.New("was unexpectedly closed twice")
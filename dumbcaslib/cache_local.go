@@ -18,23 +18,28 @@ import (
 	"path/filepath"
 )
 
-// LoadCache loads the cache from ~/.dumbcas/cache.json and keeps it open until
-// the call to Close(). It is guaranteed to return a non-nil Cache instance even
-// in case of failure to load the cache from disk and that error is non-nil.
+// LoadCache loads the cache from filePath, ~/.dumbcas/cache.gob if empty, and
+// keeps it open until the call to Close(), which saves it back. It is
+// guaranteed to return a non-nil Cache instance even in case of failure to
+// load the cache from disk and that error is non-nil.
 //
 // TODO(maruel): Ensure proper file locking. One way is to always create a new
 // file when adding data and then periodically garbage-collect the files.
-func LoadCache() (Cache, error) {
-	cacheDir, err := getCachePath()
-	if err != nil {
-		return &cache{&EntryCache{}, ""}, err
+func LoadCache(filePath string) (Cache, error) {
+	if filePath == "" {
+		cacheDir, err := getCachePath()
+		if err != nil {
+			return &cache{&EntryCache{}, &CacheStats{}, ""}, err
+		}
+		filePath = filepath.Join(cacheDir, "cache.gob")
 	}
-	return loadCacheInner(cacheDir)
+	return loadCacheInner(filePath)
 }
 
-func loadCacheInner(cacheDir string) (Cache, error) {
-	cache := &cache{&EntryCache{}, filepath.Join(cacheDir, "cache.gob")}
-	if err := os.Mkdir(cacheDir, 0700); err != nil && !os.IsExist(err) {
+func loadCacheInner(filePath string) (Cache, error) {
+	cache := &cache{&EntryCache{}, &CacheStats{}, filePath}
+	cacheDir := filepath.Dir(filePath)
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
 		return cache, fmt.Errorf("Failed to access %s: %s", cacheDir, err)
 	}
 	f, err := os.OpenFile(cache.filePath, os.O_RDONLY, 0600)
@@ -61,12 +66,18 @@ func loadCacheInner(cacheDir string) (Cache, error) {
 		// sorry.
 		err = fmt.Errorf("failed loading cache: %s", err)
 		cache.root = &EntryCache{}
+		return cache, err
+	}
+	// The statistics follow the entries; older caches don't have them.
+	if d.Decode(cache.stats) != nil {
+		cache.stats = &CacheStats{}
 	}
-	return cache, err
+	return cache, nil
 }
 
 type cache struct {
 	root     *EntryCache
+	stats    *CacheStats
 	filePath string
 }
 
@@ -82,27 +93,39 @@ func (c *cache) Root() *EntryCache {
 	return c.root
 }
 
-func encode(filePath string, root *EntryCache) error {
-	f, err := os.OpenFile(filePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+func (c *cache) Stats() *CacheStats {
+	return c.stats
+}
+
+// encode saves root and stats to filePath. It writes a temporary file then
+// renames it so an interruption doesn't leave a truncated cache, which would be
+// discarded on the next load.
+func encode(filePath string, root *EntryCache, stats *CacheStats) error {
+	tmp := filePath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	if f == nil {
 		return fmt.Errorf("failed to save cache %s: %s", filePath, err)
 	}
-	defer func() {
-		_ = f.Close()
-	}()
 	// TODO(maruel): Trim anything > ~1yr old.
 	e := gob.NewEncoder(f)
-	if err := e.Encode(root); err != nil {
+	if err = e.Encode(root); err == nil {
+		err = e.Encode(stats)
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
 		return fmt.Errorf("failed to write %s: %s", filePath, err)
 	}
-	return nil
+	return os.Rename(tmp, filePath)
 }
 
 func (c *cache) Close() error {
 	if c.filePath == "" {
 		return nil
 	}
-	if err := encode(c.filePath, c.root); err != nil {
+	if err := encode(c.filePath, c.root, c.stats); err != nil {
 		return err
 	}
 	stat, err := os.Stat(c.filePath)
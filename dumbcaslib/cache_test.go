@@ -11,6 +11,7 @@ package dumbcaslib
 
 import (
 	"bytes"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
@@ -22,7 +23,7 @@ import (
 func TestCacheNormal(t *testing.T) {
 	// Just makes sure loading the real cache doesn't crash.
 	t.Parallel()
-	cache, err := LoadCache()
+	cache, err := LoadCache("")
 	ut.AssertEqual(t, nil, err)
 	defer cache.Close()
 	ut.AssertEqual(t, false, nil == cache.Root())
@@ -40,7 +41,7 @@ func TestCacheRedirected(t *testing.T) {
 	tempData := makeTempDir(t, "cache")
 	defer removeDir(t, tempData)
 	load := func() (Cache, error) {
-		return loadCacheInner(tempData)
+		return loadCacheInner(filepath.Join(tempData, "cache.gob"))
 	}
 	testCacheImpl(t, load)
 }
@@ -73,6 +74,7 @@ func testCacheImpl(t testing.TB, load func() (Cache, error)) {
 		i.Size = 1
 		i.Timestamp = 2
 		i.LastTested = now
+		*c.Stats() = CacheStats{Hits: 3, Misses: 1, When: time.Unix(now, 0)}
 		c.Close()
 	}
 	{
@@ -86,6 +88,49 @@ func testCacheImpl(t testing.TB, load func() (Cache, error)) {
 		if bar.Sha1 != "x" || bar.Size != 1 || bar.Timestamp != 2 || bar.LastTested != now {
 			t.Fatalf("Oops: %d", c.Root().CountMembers())
 		}
+		ut.AssertEqual(t, int64(3), c.Stats().Hits)
+		ut.AssertEqual(t, int64(1), c.Stats().Misses)
+		ut.AssertEqual(t, now, c.Stats().When.Unix())
 		c.Close()
 	}
 }
+
+func TestCacheSaveAtomic(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cache_atomic")
+	defer removeDir(t, tempData)
+	c, err := loadCacheInner(filepath.Join(tempData, "cache.gob"))
+	ut.AssertEqual(t, nil, err)
+	i := FindInCache(c, filepath.Join("foo", "bar"))
+	i.Sha1 = "x"
+	i.Size = 1
+	ut.AssertEqual(t, nil, c.Close())
+	names, err := readDirNames(tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"cache.gob"}, names)
+}
+
+func TestPruneCache(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cache_prune")
+	defer removeDir(t, tempData)
+	ut.AssertEqual(t, nil, os.MkdirAll(filepath.Join(tempData, "dir"), 0700))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(tempData, "dir", "kept"), []byte("a"), 0600))
+	c := MakeMemoryCache()
+	FindInCache(c, filepath.Join(tempData, "dir", "kept")).Sha1 = "x"
+	FindInCache(c, filepath.Join(tempData, "dir", "gone")).Sha1 = "y"
+	FindInCache(c, filepath.Join(tempData, "old", "a")).Sha1 = "z"
+	FindInCache(c, filepath.Join(tempData, "old", "b")).Sha1 = "z"
+
+	ut.AssertEqual(t, 0, PruneCache(c, filepath.Join(tempData, "unknown")))
+	ut.AssertEqual(t, 4, PruneCache(c, tempData))
+	dir := FindInCache(c, tempData)
+	ut.AssertEqual(t, []string{"dir"}, dir.SortedFiles())
+	ut.AssertEqual(t, []string{"kept"}, dir.Files["dir"].SortedFiles())
+	ut.AssertEqual(t, 0, PruneCache(c, tempData))
+
+	// An input that is gone is removed as a whole.
+	removeDir(t, filepath.Join(tempData, "dir"))
+	ut.AssertEqual(t, 2, PruneCache(c, filepath.Join(tempData, "dir")))
+	ut.AssertEqual(t, []string{}, dir.SortedFiles())
+}
@@ -11,25 +11,310 @@ package dumbcaslib
 
 import (
 	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/sha1"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 // CasTable describes the interface to a content-addressed-storage.
 type CasTable interface {
 	Table
+	// EnumerateCtx is like Enumerate() but stops and closes the channel once ctx
+	// is done, so the caller can stop reading early.
+	EnumerateCtx(ctx context.Context) <-chan EnumerationEntry
 	// AddEntry adds a node to the table.
 	AddEntry(source io.Reader, name string) error
+	// Exists returns true if the entry is in the table. It is cheaper than
+	// Open() since the content is neither read nor verified.
+	Exists(name string) bool
+	// ExistsMany is Exists() for many entries at once, which the remote tables
+	// answer in bulk. Returns the entries found; the others are absent from
+	// the map.
+	ExistsMany(names []string) map[string]bool
 	// SetFsckBit sets the bit that the table needs to be checked for consistency.
 	SetFsckBit()
 	// GetFsckBit returns if the fsck bit is set.
 	GetFsckBit() bool
 	// ClearFsckBit clears the fsck bit.
 	ClearFsckBit()
+	// NewHash returns a new instance of the hashing algorithm used to name the
+	// entries.
+	NewHash() hash.Hash
+}
+
+// CasOptions are the options used to create a CasTable. The options defining
+// the table layout are only used when the table is created; opening an
+// existing table with different values is an error.
+type CasOptions struct {
+	// Hash is the name of the hashing algorithm, "sha1", "sha256" or "blake3".
+	// Defaults to the table's algorithm, or DefaultHash for a new table.
+	Hash string
+	// PrefixLength is the number of hex characters of the hash used as the
+	// directory name. Defaults to the table's value, or DefaultPrefixLength for
+	// a new table.
+	PrefixLength int
+	// VerifyWrites hashes the content while it is written by AddEntry and
+	// rejects it if it doesn't match the name. It is slower but catches bugs and
+	// memory corruption before the data is persisted under the wrong name.
+	VerifyWrites bool
+	// Compress gzips the entries added with AddEntry. Entries are still named
+	// after the hash of their original content and Open() transparently
+	// decompresses them, so compressed and uncompressed entries can be mixed.
+	Compress bool
+	// Compression is the algorithm compressing the entries added with
+	// AddEntry, "gzip" or "zstd". It overrides Compress. The algorithm is
+	// recorded in each entry so entries compressed differently can be mixed
+	// too.
+	Compression string
+	// CompressionLevel is the level of Compression, between 1 and 9 for gzip
+	// and 1 and 22 for zstd. Defaults to the default level of the algorithm.
+	CompressionLevel int
+	// Jobs is the number of prefix directories Enumerate reads concurrently.
+	// Defaults to DefaultJobs.
+	Jobs int
+	// Passphrase encrypts the entries of a new table and is required to read or
+	// add entries to an encrypted table. The table is still enumerated without
+	// it.
+	Passphrase string
+	// Secondaries are the roots of other copies of the table, used to repair
+	// the missing and corrupted entries; see MakeFallbackCasTable().
+	Secondaries []string
+	// TrashDir is the directory the removed and invalid entries of a local
+	// table are moved to, e.g. on a cheaper volume. It must not be inside the
+	// table. It is saved in the metadata of the table so it is used afterward;
+	// specifying another one is an error. Defaults to the "trash" directory of
+	// the table.
+	TrashDir string
+	// ReadOnly never modifies a local table: Enumerate skips the unexpected
+	// files instead of moving them to the trash and flagging the table for
+	// fsck, and a missing table is not created. Use MakeReadOnlyCasTable() to
+	// also refuse the other modifications.
+	ReadOnly bool
+	// PackThreshold is the size up to which the entries added to a local table
+	// are appended to pack files instead of being stored as their own file,
+	// which saves a block and an inode per tiny file. 0 disables packing.
+	PackThreshold int64
+}
+
+// MakeCasTable returns the CasTable stored at root. root is either a local
+// directory, an URL in the form "s3://bucket/path" or the URL of a table served
+// by "dumbcas web" like "http://host:8010/content/retrieve/default".
+func MakeCasTable(root string, opts CasOptions) (CasTable, error) {
+	secondaries := opts.Secondaries
+	opts.Secondaries = nil
+	cas, err := makeCasTable(root, opts)
+	if err != nil || len(secondaries) == 0 {
+		return cas, err
+	}
+	tables := make([]CasTable, 0, len(secondaries))
+	for _, secondary := range secondaries {
+		if !IsRemote(secondary) && !isDir(filepath.Join(secondary, casName)) {
+			// Don't create an empty table on a typo.
+			return nil, fmt.Errorf("MakeCasTable(%s): no table found", secondary)
+		}
+		// The layout of the copy may differ.
+		t, err := makeCasTable(secondary, CasOptions{Jobs: opts.Jobs, Passphrase: opts.Passphrase})
+		if err != nil {
+			return nil, err
+		}
+		if hashName(t.NewHash()) != hashName(cas.NewHash()) {
+			return nil, fmt.Errorf("MakeCasTable(%s): the table uses a different hash algorithm than %s", secondary, root)
+		}
+		tables = append(tables, t)
+	}
+	return MakeFallbackCasTable(cas, tables...), nil
+}
+
+func makeCasTable(root string, opts CasOptions) (CasTable, error) {
+	if IsRemote(root) && opts.TrashDir != "" {
+		return nil, fmt.Errorf("MakeCasTable(%s): a trash directory is only supported for a local table", root)
+	}
+	if strings.HasPrefix(root, "s3://") {
+		return MakeS3CasTable(root, opts)
+	}
+	if strings.HasPrefix(root, "http://") || strings.HasPrefix(root, "https://") {
+		return MakeHTTPCasTable(root, opts)
+	}
+	return MakeLocalCasTable(root, opts)
+}
+
+// IsRemote returns true if root is an URL instead of a local directory.
+func IsRemote(root string) bool {
+	return strings.Contains(root, "://")
+}
+
+// DefaultPrefixLength creates 16^3 (4096) directories. Preferable values are 2
+// or 3.
+const DefaultPrefixLength = 3
+
+// maxPrefixLength is the largest supported prefix length, 16^4 (65536)
+// directories.
+const maxPrefixLength = 4
+
+const metadataName = "metadata.json"
+
+// DefaultJobs is the default number of prefix directories enumerated
+// concurrently. Enumeration is I/O bound so it is not related to the number of
+// CPUs.
+const DefaultJobs = 8
+
+func (o *CasOptions) check() error {
+	if o.Hash != "" && hashAlgorithms[o.Hash] == nil {
+		return fmt.Errorf("unknown hash algorithm %s", o.Hash)
+	}
+	if o.PrefixLength < 0 || o.PrefixLength > maxPrefixLength {
+		return fmt.Errorf("prefix length must be between 1 and %d", maxPrefixLength)
+	}
+	if o.Jobs < 0 {
+		return fmt.Errorf("jobs must be positive")
+	}
+	if o.PackThreshold < 0 || o.PackThreshold > maxPackSize {
+		return fmt.Errorf("pack threshold must be between 0 and %d", maxPackSize)
+	}
+	if o.Compression != "" && o.Compression != "gzip" && o.Compression != "zstd" {
+		return fmt.Errorf("unknown compression %s", o.Compression)
+	}
+	if o.CompressionLevel != 0 {
+		max := 9
+		switch o.codec() {
+		case codecNone:
+			return fmt.Errorf("compression level requires a compression")
+		case codecZstd:
+			max = 22
+		}
+		if o.CompressionLevel < 1 || o.CompressionLevel > max {
+			return fmt.Errorf("compression level must be between 1 and %d", max)
+		}
+	}
+	return nil
+}
+
+func (o *CasOptions) jobs() int {
+	if o.Jobs == 0 {
+		return DefaultJobs
+	}
+	return o.Jobs
+}
+
+// forEachPrefix calls fn for each prefix from up to jobs goroutines and returns
+// once all the calls completed. It stops dispatching prefixes once
+// interrupted or ctx is done.
+func forEachPrefix(ctx context.Context, prefixes []string, jobs int, fn func(prefix string)) {
+	c := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for prefix := range c {
+				fn(prefix)
+			}
+		}()
+	}
+loop:
+	for _, prefix := range prefixes {
+		if IsInterrupted() {
+			break
+		}
+		select {
+		case c <- prefix:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(c)
+	wg.Wait()
+}
+
+func (o *CasOptions) codec() byte {
+	switch {
+	case o.Compression == "zstd":
+		return codecZstd
+	case o.Compression == "gzip" || o.Compress:
+		return codecGzip
+	}
+	return codecNone
+}
+
+// casMetadata is the layout of a table, saved along its entries so the table
+// remembers how it was created.
+type casMetadata struct {
+	Hash         string         `json:"hash"`
+	PrefixLength int            `json:"prefix_length,omitempty"`
+	Encryption   *casEncryption `json:"encryption,omitempty"`
+	// TrashDir is the trash directory of a local table set by
+	// CasOptions.TrashDir, so it doesn't need to be specified every time.
+	TrashDir string `json:"trash_dir,omitempty"`
+}
+
+// newCasMetadata returns the layout of a new table.
+func newCasMetadata(opts CasOptions) (*casMetadata, error) {
+	m := &casMetadata{Hash: opts.Hash, PrefixLength: opts.PrefixLength, TrashDir: opts.TrashDir}
+	if m.Hash == "" {
+		m.Hash = DefaultHash
+	}
+	if m.PrefixLength == 0 {
+		m.PrefixLength = DefaultPrefixLength
+	}
+	if opts.Passphrase != "" {
+		var err error
+		if m.Encryption, err = newCasEncryption(opts.Passphrase); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// cipher returns the cipher of the table, nil if it's not encrypted or the
+// passphrase wasn't provided.
+func (m *casMetadata) cipher(opts CasOptions) (cipher.AEAD, error) {
+	if m.Encryption == nil {
+		if opts.Passphrase != "" {
+			return nil, errors.New("the table is not encrypted, can't use a passphrase")
+		}
+		return nil, nil
+	}
+	if opts.Passphrase == "" {
+		return nil, nil
+	}
+	return m.Encryption.open(opts.Passphrase)
+}
+
+// check verifies that an existing table can be used with opts.
+func (m *casMetadata) check(opts CasOptions) error {
+	if hashAlgorithms[m.Hash] == nil {
+		return fmt.Errorf("unknown hash algorithm %s", m.Hash)
+	}
+	if opts.Hash != "" && opts.Hash != m.Hash {
+		return fmt.Errorf("the table uses %s, can't use it as %s", m.Hash, opts.Hash)
+	}
+	if m.PrefixLength < 1 || m.PrefixLength > maxPrefixLength {
+		return fmt.Errorf("invalid prefix length %d", m.PrefixLength)
+	}
+	if opts.PrefixLength != 0 && opts.PrefixLength != m.PrefixLength {
+		return fmt.Errorf("the table uses a prefix length of %d, can't use it as %d", m.PrefixLength, opts.PrefixLength)
+	}
+	if m.TrashDir != "" && !filepath.IsAbs(m.TrashDir) {
+		return fmt.Errorf("the trash directory %s is not absolute", m.TrashDir)
+	}
+	if opts.TrashDir != "" && m.TrashDir != "" && opts.TrashDir != m.TrashDir {
+		return fmt.Errorf("the table uses the trash directory %s, can't use %s", m.TrashDir, opts.TrashDir)
+	}
+	return nil
 }
 
 // EnumerateCasAsList returns a sorted list of all the entries in a CasTable.
@@ -46,78 +331,397 @@ func EnumerateCasAsList(cas CasTable) ([]string, error) {
 	return items, nil
 }
 
+// OpenRange opens length bytes of the content of hash starting at offset,
+// e.g. to export a member of an archive or to serve an HTTP range. A negative
+// length reads up to the end. It relies on the ReadSeekCloser returned by
+// Open() seeking to any offset of the content, which all the implementations
+// do.
+func OpenRange(cas CasTable, hash string, offset, length int64) (io.ReadCloser, error) {
+	f, err := cas.Open(hash)
+	if err != nil {
+		return nil, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err == nil && (offset < 0 || offset > size) {
+		err = fmt.Errorf("offset %d is outside of %s of %d bytes", offset, hash, size)
+	}
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+	return &rangeReader{io.LimitReader(f, length), f}, nil
+}
+
+// rangeReader reads a range of an entry opened by OpenRange.
+type rangeReader struct {
+	io.Reader
+	io.Closer
+}
+
+// ErrReadOnly is returned when modifying a table made read-only with
+// MakeReadOnlyCasTable().
+var ErrReadOnly = errors.New("The table is read-only")
+
+// MakeReadOnlyCasTable returns a CasTable that forwards the reads to cas and
+// refuses any modification. The fsck bit is not set either, the corruptions
+// found are only returned as errors. The trash of cas can still be enumerated.
+func MakeReadOnlyCasTable(cas CasTable) CasTable {
+	var trash TrashTable
+	if t, ok := cas.(TrashTable); ok {
+		trash = &readOnlyTrash{t}
+	}
+	var pack PackTable
+	if _, ok := cas.(PackTable); ok {
+		pack = &readOnlyPack{}
+	}
+	return withOptional(&readOnlyCasTable{cas}, trash, nil, pack)
+}
+
+type readOnlyCasTable struct {
+	CasTable
+}
+
+type readOnlyTrash struct {
+	TrashTable
+}
+
+func (r *readOnlyTrash) RestoreTrash(item string) error {
+	return ErrReadOnly
+}
+
+func (r *readOnlyTrash) EmptyTrash() error {
+	return ErrReadOnly
+}
+
+type readOnlyPack struct{}
+
+func (r *readOnlyPack) Repack() (int, int64, error) {
+	return 0, 0, ErrReadOnly
+}
+
+func (r *readOnlyCasTable) AddEntry(source io.Reader, name string) error {
+	return ErrReadOnly
+}
+
+func (r *readOnlyCasTable) Remove(name string) error {
+	return ErrReadOnly
+}
+
+func (r *readOnlyCasTable) SetFsckBit() {
+}
+
+func (r *readOnlyCasTable) ClearFsckBit() {
+}
+
+// MakeRetryingCasTable returns a CasTable that retries the failed AddEntry
+// calls up to retries times, waiting delay before the first retry and twice as
+// long before each following one. Only a source implementing io.Seeker can be
+// rewound, so any other source is never retried. Each retry is logged to l.
+func MakeRetryingCasTable(cas CasTable, retries int, delay time.Duration, l *log.Logger) CasTable {
+	return forwardOptional(&retryingCasTable{cas, retries, delay, l}, cas)
+}
+
+type retryingCasTable struct {
+	CasTable
+	retries int
+	delay   time.Duration
+	log     *log.Logger
+}
+
+func (r *retryingCasTable) AddEntry(source io.Reader, name string) error {
+	seeker, _ := source.(io.Seeker)
+	var start int64
+	if seeker != nil {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seeker = nil
+		}
+	}
+	delay := r.delay
+	for i := 0; ; i++ {
+		err := r.CasTable.AddEntry(source, name)
+		// A failed AddEntry doesn't leave a partial entry behind, so the source
+		// is rewound and written again after the delay, which doubles each time.
+		if err == nil || os.IsExist(err) || err == ErrReadOnly || seeker == nil || i == r.retries || IsInterrupted() {
+			return err
+		}
+		r.log.Printf("Failed to write %s, retrying in %s: %s", name, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		if _, err2 := seeker.Seek(start, io.SeekStart); err2 != nil {
+			return err
+		}
+	}
+}
+
+// MakeThrottledCasTable returns a CasTable that limits the rate at which the
+// sources of AddEntry are read to bytesPerSecond, shared across all the
+// concurrent calls.
+func MakeThrottledCasTable(cas CasTable, bytesPerSecond int64) CasTable {
+	return forwardOptional(&throttledCasTable{cas, &rateLimiter{rate: float64(bytesPerSecond), last: time.Now()}}, cas)
+}
+
+type throttledCasTable struct {
+	CasTable
+	limiter *rateLimiter
+}
+
+func (t *throttledCasTable) AddEntry(source io.Reader, name string) error {
+	return t.CasTable.AddEntry(&throttledReader{source, t.limiter}, name)
+}
+
+// rateLimiter is a token bucket holding up to one second worth of bytes. The
+// tokens are reserved before sleeping so concurrent readers are served in
+// turn.
+type rateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// chunk is the largest read done at once.
+func (r *rateLimiter) chunk() int {
+	if r.rate < 32*1024 {
+		return int(r.rate) + 1
+	}
+	return 32 * 1024
+}
+
+func (r *rateLimiter) wait(n int) {
+	r.lock.Lock()
+	now := time.Now()
+	r.tokens += now.Sub(r.last).Seconds() * r.rate
+	if r.tokens > r.rate {
+		r.tokens = r.rate
+	}
+	r.last = now
+	r.tokens -= float64(n)
+	delay := time.Duration(0)
+	if r.tokens < 0 {
+		delay = time.Duration(-r.tokens / r.rate * float64(time.Second))
+	}
+	r.lock.Unlock()
+	time.Sleep(delay)
+}
+
+type throttledReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if c := t.limiter.chunk(); len(p) > c {
+		p = p[:c]
+	}
+	n, err := t.r.Read(p)
+	t.limiter.wait(n)
+	return n, err
+}
+
 // MakeMemoryCasTable returns a CasTable implementation that keeps all the data
-// in memory. Is it useful for testing.
+// in memory, named after their sha-1. It behaves like a local table, e.g.
+// Open() returns os.ErrNotExist for a missing entry and os.ErrInvalid for an
+// invalid hash, so it is useful for testing and as a fast tier in front of a
+// slower table.
 func MakeMemoryCasTable() CasTable {
-	return &memoryCasTable{make(map[string][]byte), false}
+	m := &memoryCasTable{entries: make(map[string][]byte), trash: make(map[string][]byte)}
+	m.validPath = regexp.MustCompile(fmt.Sprintf("^([a-f0-9]{%d})$", m.NewHash().Size()*2))
+	return m
 }
 
+// memoryCasTable is safe for concurrent use, like the other implementations.
 type memoryCasTable struct {
+	lock     sync.Mutex
 	entries  map[string][]byte
+	trash    map[string][]byte
 	needFsck bool
+	// validPath matches the names of the entries, derived from NewHash().
+	validPath *regexp.Regexp
 }
 
 func (m *memoryCasTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	_, _ = w.Write(m.entries[r.URL.Path[1:]])
+	if !isValidCasURL(r.URL.Path) {
+		http.Error(w, "Invalid CAS url: "+r.URL.Path, http.StatusBadRequest)
+		return
+	}
+	f, err := m.Open(r.URL.Path[1:])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	http.ServeContent(w, r, entryHeaders(w, r, r.URL.Path[1:]), time.Time{}, f)
 }
 
 func (m *memoryCasTable) Enumerate() <-chan EnumerationEntry {
+	return m.EnumerateCtx(context.Background())
+}
+
+func (m *memoryCasTable) EnumerateCtx(ctx context.Context) <-chan EnumerationEntry {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	// First make a copy of the keys.
-	keys := make([]string, len(m.entries))
-	i := 0
-	for k := range m.entries {
-		keys[i] = k
-		i++
+	entries := make([]EnumerationEntry, 0, len(m.entries))
+	for k, v := range m.entries {
+		entries = append(entries, EnumerationEntry{Item: k, Size: int64(len(v))})
 	}
 	c := make(chan EnumerationEntry)
 	go func() {
-		for _, k := range keys {
-			c <- EnumerationEntry{Item: k}
+		defer close(c)
+		for _, e := range entries {
+			if !sendEntry(ctx, c, e) {
+				return
+			}
 		}
-		close(c)
 	}()
 	return c
 }
 
 func (m *memoryCasTable) AddEntry(source io.Reader, item string) error {
-	if _, ok := m.entries[item]; ok {
+	if !m.validPath.MatchString(item) {
+		return os.ErrInvalid
+	}
+	m.lock.Lock()
+	_, ok := m.entries[item]
+	m.lock.Unlock()
+	if ok {
 		return os.ErrExist
 	}
+	// Don't block the readers while reading source.
 	data, err := ioutil.ReadAll(source)
-	if err == nil {
-		m.entries[item] = data
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.entries[item]; ok {
+		return os.ErrExist
+	}
+	m.entries[item] = data
+	return nil
+}
+
+func (m *memoryCasTable) Exists(item string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.entries[item]
+	return ok
+}
+
+func (m *memoryCasTable) ExistsMany(items []string) map[string]bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	out := map[string]bool{}
+	for _, item := range items {
+		if _, ok := m.entries[item]; ok {
+			out[item] = true
+		}
 	}
-	return err
+	return out
 }
 
 func (m *memoryCasTable) Open(item string) (ReadSeekCloser, error) {
+	if !m.validPath.MatchString(item) {
+		return nil, os.ErrInvalid
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	data, ok := m.entries[item]
 	if !ok {
-		return nil, fmt.Errorf("Missing: %s", item)
+		return nil, os.ErrNotExist
 	}
 	return closableBuffer{bytes.NewReader(data)}, nil
 }
 
 func (m *memoryCasTable) Remove(item string) error {
+	if !m.validPath.MatchString(item) {
+		return os.ErrInvalid
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	if _, ok := m.entries[item]; !ok {
 		return os.ErrNotExist
 	}
+	m.trash[item] = m.entries[item]
 	delete(m.entries, item)
 	return nil
 }
 
+func (m *memoryCasTable) EnumerateTrash() <-chan EnumerationEntry {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	entries := make([]EnumerationEntry, 0, len(m.trash))
+	for k, v := range m.trash {
+		entries = append(entries, EnumerationEntry{Item: k, Size: int64(len(v))})
+	}
+	c := make(chan EnumerationEntry)
+	go func() {
+		for _, e := range entries {
+			c <- e
+		}
+		close(c)
+	}()
+	return c
+}
+
+func (m *memoryCasTable) RestoreTrash(item string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	data, ok := m.trash[item]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if _, ok := m.entries[item]; ok {
+		return os.ErrExist
+	}
+	if actual := Sha1Bytes(data); actual != item {
+		return fmt.Errorf("%s is corrupted, its content hash is %s", item, actual)
+	}
+	m.entries[item] = data
+	delete(m.trash, item)
+	return nil
+}
+
+func (m *memoryCasTable) EmptyTrash() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.trash = make(map[string][]byte)
+	return nil
+}
+
 func (m *memoryCasTable) SetFsckBit() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	m.needFsck = true
 }
 
 func (m *memoryCasTable) GetFsckBit() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	return m.needFsck
 }
 
 func (m *memoryCasTable) ClearFsckBit() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	m.needFsck = false
 }
 
+func (m *memoryCasTable) NewHash() hash.Hash {
+	return sha1.New()
+}
+
 func (m *memoryCasTable) Corrupt() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	m.entries[Sha1Bytes([]byte{0, 1})] = []byte("content5")
 }
@@ -0,0 +1,193 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+type fallbackCasTable struct {
+	CasTable
+	secondaries []CasTable
+}
+
+// MakeFallbackCasTable returns a CasTable that reads the entries missing or
+// corrupted in primary from the secondaries, in order, and repairs primary
+// with them. Everything else is done on primary only, including its trash.
+//
+// The entries of primary are hashed while they are read from start to end, so
+// they are not read twice. A corrupted entry fails once fully read and is
+// moved to the trash of primary, so the next Open() repairs it.
+func MakeFallbackCasTable(primary CasTable, secondaries ...CasTable) CasTable {
+	return forwardOptional(&fallbackCasTable{primary, secondaries}, primary)
+}
+
+func (f *fallbackCasTable) Open(hash string) (ReadSeekCloser, error) {
+	r, err := f.CasTable.Open(hash)
+	if err == nil {
+		return &verifyingReader{ReadSeekCloser: r, f: f, hash: hash, h: f.NewHash()}, nil
+	}
+	if err == os.ErrInvalid || err == ErrEncrypted {
+		return nil, err
+	}
+	for _, s := range f.secondaries {
+		sr, err2 := s.Open(hash)
+		if err2 != nil {
+			continue
+		}
+		if checkEntry(sr, s.NewHash(), hash) != nil {
+			_ = sr.Close()
+			continue
+		}
+		// It fails if primary is read-only or still has the entry but couldn't
+		// read it, in which case the entry is read from the secondary.
+		if f.CasTable.AddEntry(sr, hash) == nil {
+			_ = sr.Close()
+			return f.CasTable.Open(hash)
+		}
+		if _, err2 := sr.Seek(0, io.SeekStart); err2 != nil {
+			_ = sr.Close()
+			continue
+		}
+		return sr, nil
+	}
+	return nil, err
+}
+
+// ServeHTTP serves the entries with primary, repairing the missing ones from
+// the secondaries first.
+func (f *fallbackCasTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "" || r.URL.Path[0] != '/' || !isValidCasURL(r.URL.Path) || f.CasTable.Exists(r.URL.Path[1:]) {
+		f.CasTable.ServeHTTP(w, r)
+		return
+	}
+	hash := r.URL.Path[1:]
+	sr, err := f.Open(hash)
+	if err != nil || f.CasTable.Exists(hash) {
+		if err == nil {
+			_ = sr.Close()
+		}
+		// Let primary report the error or serve the repaired entry.
+		f.CasTable.ServeHTTP(w, r)
+		return
+	}
+	defer func() {
+		_ = sr.Close()
+	}()
+	http.ServeContent(w, r, entryHeaders(w, r, hash), time.Time{}, sr)
+}
+
+// verifyingReader hashes an entry of primary while it is read from start to
+// end. A mismatch is returned in place of io.EOF and moves the entry to the
+// trash of primary; the read errors leave it in place.
+type verifyingReader struct {
+	ReadSeekCloser
+	f    *fallbackCasTable
+	hash string
+	// h is nil once the reader seeked elsewhere than the start.
+	h hash.Hash
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.ReadSeekCloser.Read(p)
+	if v.h == nil {
+		return n, err
+	}
+	_, _ = v.h.Write(p[:n])
+	if err == io.EOF {
+		actual := hex.EncodeToString(v.h.Sum(nil))
+		v.h = nil
+		if actual != v.hash {
+			// It fails if primary is read-only.
+			_ = v.f.CasTable.Remove(v.hash)
+			return n, fmt.Errorf("%s is corrupted, its content hash is %s", v.hash, actual)
+		}
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := v.ReadSeekCloser.Seek(offset, whence)
+	if err == nil && pos == 0 {
+		v.h = v.f.NewHash()
+	} else {
+		v.h = nil
+	}
+	return pos, err
+}
+
+// Exists returns true if the entry is in primary or in a secondary. Like
+// Open(), an entry found in a secondary is copied to primary so the callers
+// skipping the entries that exist, like archive, don't leave primary without
+// them.
+func (f *fallbackCasTable) Exists(hash string) bool {
+	if f.CasTable.Exists(hash) {
+		return true
+	}
+	for _, s := range f.secondaries {
+		if s.Exists(hash) {
+			return f.copyEntry(hash)
+		}
+	}
+	return false
+}
+
+// ExistsMany is Exists() looking up in each secondary the entries not found
+// so far.
+func (f *fallbackCasTable) ExistsMany(hashes []string) map[string]bool {
+	found := f.CasTable.ExistsMany(hashes)
+	for _, s := range f.secondaries {
+		missing := make([]string, 0, len(hashes))
+		for _, hash := range hashes {
+			if !found[hash] {
+				missing = append(missing, hash)
+			}
+		}
+		if len(missing) == 0 {
+			break
+		}
+		for hash := range s.ExistsMany(missing) {
+			if f.copyEntry(hash) {
+				found[hash] = true
+			}
+		}
+	}
+	return found
+}
+
+// copyEntry copies hash from a secondary to primary with Open(). Returns false
+// if no valid copy was found.
+func (f *fallbackCasTable) copyEntry(hash string) bool {
+	r, err := f.Open(hash)
+	if err != nil {
+		return false
+	}
+	_ = r.Close()
+	return true
+}
+
+// checkEntry verifies the content of f matches hash and rewinds it.
+func checkEntry(f ReadSeekCloser, h hash.Hash, hash string) error {
+	actual, err := HashReader(h, f)
+	if err != nil {
+		return err
+	}
+	if actual != hash {
+		return fmt.Errorf("%s is corrupted, its content hash is %s", hash, actual)
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
@@ -0,0 +1,132 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func readEntry(t testing.TB, cas CasTable, hash string) string {
+	f, err := cas.Open(hash)
+	ut.AssertEqual(t, nil, err)
+	data, err := ioutil.ReadAll(f)
+	_ = f.Close()
+	ut.AssertEqual(t, nil, err)
+	return string(data)
+}
+
+func TestFallbackCasTable(t *testing.T) {
+	t.Parallel()
+	primary := MakeMemoryCasTable()
+	corrupted := MakeMemoryCasTable()
+	secondary := MakeMemoryCasTable()
+	cas := MakeFallbackCasTable(primary, corrupted, secondary)
+	testCasTableImpl(t, cas)
+
+	hash1, err := AddBytes(secondary, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	hash2, err := AddBytes(secondary, []byte("content2"))
+	ut.AssertEqual(t, nil, err)
+	corrupted.(*memoryCasTable).entries[hash1] = []byte("bad")
+
+	// Missing in the primary.
+	ut.AssertEqual(t, "content1", readEntry(t, cas, hash1))
+	ut.AssertEqual(t, "content1", readEntry(t, primary, hash1))
+
+	// Corrupted in the primary. The corruption is found once the entry is
+	// read, then it is repaired.
+	primary.(*memoryCasTable).entries[hash2] = []byte("bad")
+	f, err := cas.Open(hash2)
+	ut.AssertEqual(t, nil, err)
+	_, err = ioutil.ReadAll(f)
+	_ = f.Close()
+	ut.AssertEqual(t, false, err == nil)
+	ut.AssertEqual(t, "content2", readEntry(t, cas, hash2))
+	ut.AssertEqual(t, "content2", readEntry(t, primary, hash2))
+	ut.AssertEqual(t, "bad", string(primary.(*memoryCasTable).trash[hash2]))
+
+	// Missing everywhere.
+	_, err = cas.Open(Sha1Bytes([]byte("content3")))
+	ut.AssertEqual(t, false, err == nil)
+
+	// Exists and ExistsMany look up the secondaries too and repair primary.
+	hash4, err := AddBytes(secondary, []byte("content4"))
+	ut.AssertEqual(t, nil, err)
+	hash5, err := AddBytes(secondary, []byte("content5"))
+	ut.AssertEqual(t, nil, err)
+	missing := Sha1Bytes([]byte("content6"))
+	ut.AssertEqual(t, true, cas.Exists(hash4))
+	ut.AssertEqual(t, "content4", readEntry(t, primary, hash4))
+	ut.AssertEqual(t, false, cas.Exists(missing))
+	ut.AssertEqual(t, map[string]bool{hash1: true, hash5: true}, cas.ExistsMany([]string{hash1, hash5, missing}))
+	ut.AssertEqual(t, "content5", readEntry(t, primary, hash5))
+	// A corrupted copy doesn't count.
+	corrupted.(*memoryCasTable).entries[missing] = []byte("bad")
+	ut.AssertEqual(t, false, cas.Exists(missing))
+	ut.AssertEqual(t, map[string]bool{}, cas.ExistsMany([]string{missing}))
+
+	// A read-only primary is not repaired.
+	readOnly := MakeFallbackCasTable(MakeReadOnlyCasTable(MakeMemoryCasTable()), secondary)
+	ut.AssertEqual(t, "content1", readEntry(t, readOnly, hash1))
+
+	// The web server falls back too.
+	hash7, err := AddBytes(secondary, []byte("content7"))
+	ut.AssertEqual(t, nil, err)
+	server := httptest.NewServer(readOnly)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/" + hash7)
+	ut.AssertEqual(t, nil, err)
+	data, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 200, resp.StatusCode)
+	ut.AssertEqual(t, "content7", string(data))
+	resp, err = http.Get(server.URL + "/" + missing)
+	ut.AssertEqual(t, nil, err)
+	_ = resp.Body.Close()
+	ut.AssertEqual(t, 404, resp.StatusCode)
+}
+
+func TestMakeCasTableSecondaries(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_secondaries")
+	defer removeDir(t, tempData)
+
+	secondary, err := MakeLocalCasTable(filepath.Join(tempData, "secondary"), CasOptions{PrefixLength: 1})
+	ut.AssertEqual(t, nil, err)
+	hash, err := AddBytes(secondary, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+
+	primaryRoot := filepath.Join(tempData, "primary")
+	cas, err := MakeCasTable(primaryRoot, CasOptions{Secondaries: []string{filepath.Join(tempData, "secondary")}})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "content1", readEntry(t, cas, hash))
+	_, err = os.Stat(cas.(*casTrashPack).CasTable.(*fallbackCasTable).CasTable.(*casTable).filePath(hash))
+	ut.AssertEqual(t, nil, err)
+
+	_, err = MakeCasTable(primaryRoot, CasOptions{Secondaries: []string{filepath.Join(tempData, "missing")}})
+	ut.AssertEqual(t, false, err == nil)
+	_, err = MakeLocalCasTable(filepath.Join(tempData, "sha256"), CasOptions{Hash: "sha256"})
+	ut.AssertEqual(t, nil, err)
+	_, err = MakeCasTable(primaryRoot, CasOptions{Secondaries: []string{filepath.Join(tempData, "sha256")}})
+	ut.AssertEqual(t, false, err == nil)
+	// The hashes have the same size.
+	_, err = MakeLocalCasTable(filepath.Join(tempData, "blake3"), CasOptions{Hash: "blake3"})
+	ut.AssertEqual(t, nil, err)
+	_, err = MakeCasTable(filepath.Join(tempData, "sha256"), CasOptions{Secondaries: []string{filepath.Join(tempData, "blake3")}})
+	ut.AssertEqual(t, false, err == nil)
+}
@@ -0,0 +1,318 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func makeFakeHTTPCasTable(t testing.TB, remote CasTable) (CasTable, func()) {
+	server := httptest.NewServer(MakeCasHandler(remote, MakeMemoryLocker()))
+	cas, err := MakeCasTable(server.URL+"/", CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	return cas, server.Close
+}
+
+func TestHTTPCasTable(t *testing.T) {
+	t.Parallel()
+	remote := MakeMemoryCasTable()
+	cas, closer := makeFakeHTTPCasTable(t, remote)
+	defer closer()
+
+	items, err := EnumerateCasAsList(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, items)
+
+	file1, err := AddBytes(cas, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	_, err = AddBytes(cas, []byte("content1"))
+	ut.AssertEqualf(t, true, os.IsExist(err), "Unexpected error: %s", err)
+	items, err = EnumerateCasAsList(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{file1}, items)
+
+	// The content is verified by the server.
+	err = cas.AddEntry(bytes.NewReader([]byte("content2")), Sha1Bytes([]byte("content3")))
+	ut.AssertEqual(t, false, err == nil)
+
+	f, err := cas.Open(file1)
+	ut.AssertEqual(t, nil, err)
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "content1", string(data))
+
+	_, err = cas.Open("0")
+	ut.AssertEqual(t, false, err == nil)
+	_, err = cas.Open(Sha1Bytes([]byte("missing")))
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+	ut.AssertEqual(t, true, cas.Exists(file1))
+	ut.AssertEqual(t, false, cas.Exists(Sha1Bytes([]byte("missing"))))
+	ut.AssertEqual(t, map[string]bool{file1: true}, cas.ExistsMany([]string{file1, Sha1Bytes([]byte("missing")), "0"}))
+
+	ut.AssertEqual(t, nil, cas.Remove(file1))
+	ut.AssertEqual(t, false, cas.Exists(file1))
+	ut.AssertEqual(t, false, cas.Remove(file1) == nil)
+	items, err = EnumerateCasAsList(remote)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, items)
+}
+
+func TestHTTPCasTableSeek(t *testing.T) {
+	t.Parallel()
+	cas, closer := makeFakeHTTPCasTable(t, MakeMemoryCasTable())
+	defer closer()
+	testServeRangeImpl(t, cas)
+
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	hash, err := AddBytes(cas, content)
+	ut.AssertEqual(t, nil, err)
+	f, err := cas.Open(hash)
+	ut.AssertEqual(t, nil, err)
+	defer f.Close()
+	_, err = f.Seek(995, io.SeekStart)
+	ut.AssertEqual(t, nil, err)
+	data, err := ioutil.ReadAll(f)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "56789", string(data))
+}
+
+func TestHTTPCasTableOpenRange(t *testing.T) {
+	t.Parallel()
+	cas, closer := makeFakeHTTPCasTable(t, MakeMemoryCasTable())
+	defer closer()
+	testOpenRangeImpl(t, cas)
+}
+
+func TestHTTPCasTableHash(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_http")
+	defer removeDir(t, tempData)
+	remote, err := MakeLocalCasTable(tempData, CasOptions{Hash: "sha256"})
+	ut.AssertEqual(t, nil, err)
+	server := httptest.NewServer(MakeCasHandler(remote, nil))
+	defer server.Close()
+
+	cas, err := MakeCasTable(server.URL, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 32, cas.NewHash().Size())
+	_, err = MakeCasTable(server.URL, CasOptions{Hash: "sha1"})
+	ut.AssertEqual(t, false, err == nil)
+
+	// The server is not writable.
+	_, err = AddBytes(cas, []byte("content1"))
+	ut.AssertEqual(t, false, err == nil)
+}
+
+func TestHTTPCasTableExistsManyOldServer(t *testing.T) {
+	t.Parallel()
+	remote := MakeMemoryCasTable()
+	handler := MakeCasHandler(remote, nil)
+	// A server predating "POST /exists".
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/exists" {
+			http.NotFound(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	cas, err := MakeCasTable(server.URL, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	file1, err := AddBytes(remote, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, map[string]bool{file1: true}, cas.ExistsMany([]string{file1, Sha1Bytes([]byte("missing"))}))
+}
+
+func TestHTTPCasTableExistsManyBatches(t *testing.T) {
+	t.Parallel()
+	remote := MakeMemoryCasTable()
+	handler := MakeCasHandler(remote, nil)
+	posts := 0
+	heads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			posts++
+		} else if r.Method == "HEAD" {
+			heads++
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	cas, err := MakeCasTable(server.URL, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	file1, err := AddBytes(remote, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	hashes := make([]string, 0, maxExistsHashes+1)
+	for i := 0; i < maxExistsHashes; i++ {
+		hashes = append(hashes, Sha1Bytes([]byte(fmt.Sprintf("missing%d", i))))
+	}
+	hashes = append(hashes, file1)
+	ut.AssertEqual(t, map[string]bool{file1: true}, cas.ExistsMany(hashes))
+	ut.AssertEqual(t, 2, posts)
+	ut.AssertEqual(t, 0, heads)
+
+	// The server refuses a larger body.
+	resp, err := http.Post(server.URL+"/exists", "text/plain", strings.NewReader(strings.Join(hashes, "\n")))
+	ut.AssertEqual(t, nil, err)
+	_ = resp.Body.Close()
+	ut.AssertEqual(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	resp, err = http.Post(server.URL+"/exists", "text/plain", strings.NewReader(strings.Repeat(" \n", maxExistsHashes*21+1)))
+	ut.AssertEqual(t, nil, err)
+	_ = resp.Body.Close()
+	ut.AssertEqual(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
+
+func TestHTTPCasTableChunked(t *testing.T) {
+	t.Parallel()
+	remote := MakeMemoryCasTable()
+	handler := MakeCasHandler(remote, MakeMemoryLocker())
+	chunks := 0
+	// Drops the end of the second chunk as if the connection was lost.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/upload/") && r.URL.Query().Get("offset") != "" {
+			if chunks++; chunks == 2 {
+				r.Body = ioutil.NopCloser(io.LimitReader(r.Body, 2))
+				handler.ServeHTTP(httptest.NewRecorder(), r)
+				http.Error(w, "Bad gateway", http.StatusBadGateway)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	cas, err := MakeCasTable(server.URL, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	cas.(*httpCasTable).chunkSize = 4
+	cas.(*httpCasTable).retryDelay = 0
+
+	content := []byte("0123456789abcdefghi")
+	hash := Sha1Bytes(content)
+	ut.AssertEqual(t, nil, cas.AddEntry(bytes.NewReader(content), hash))
+	// 5 chunks plus the rest of the one that failed.
+	ut.AssertEqual(t, 6, chunks)
+	ut.AssertEqual(t, string(content), readEntry(t, remote, hash))
+
+	err = cas.AddEntry(bytes.NewReader(content), hash)
+	ut.AssertEqual(t, true, os.IsExist(err))
+	// The content is verified on commit.
+	err = cas.AddEntry(bytes.NewReader(content), Sha1Bytes([]byte("other")))
+	ut.AssertEqual(t, false, err == nil)
+	ut.AssertEqual(t, false, remote.Exists(Sha1Bytes([]byte("other"))))
+}
+
+func TestHTTPCasTableChunkedOldServer(t *testing.T) {
+	t.Parallel()
+	remote := MakeMemoryCasTable()
+	handler := MakeCasHandler(remote, MakeMemoryLocker())
+	// A server predating the chunked uploads.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/upload/") {
+			http.Error(w, "Invalid Method", http.StatusMethodNotAllowed)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	cas, err := MakeCasTable(server.URL, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	cas.(*httpCasTable).chunkSize = 4
+
+	content := []byte("0123456789abcdefghi")
+	hash := Sha1Bytes(content)
+	ut.AssertEqual(t, nil, cas.AddEntry(bytes.NewReader(content), hash))
+	ut.AssertEqual(t, string(content), readEntry(t, remote, hash))
+}
+
+func TestCasHandlerUpload(t *testing.T) {
+	t.Parallel()
+	remote := MakeMemoryCasTable()
+	locker := MakeMemoryLocker()
+	handler := MakeCasHandler(remote, locker)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return resp
+	}
+	create := func() string {
+		resp := do("POST", "/upload/", "")
+		ut.AssertEqual(t, 201, resp.Code)
+		return "/upload/" + strings.TrimSpace(resp.Body.String())
+	}
+	// The sessions are created by the server.
+	ut.AssertEqual(t, 404, do("POST", "/upload/0123456789abcdef0123456789abcdef?offset=0", "abc").Code)
+	ut.AssertEqual(t, 400, do("POST", "/upload/foo?offset=0", "abc").Code)
+	session := create()
+	ut.AssertEqual(t, "0\n", do("GET", session, "").Body.String())
+	ut.AssertEqual(t, 409, do("POST", session+"?offset=3", "def").Code)
+	ut.AssertEqual(t, "3\n", do("POST", session+"?offset=0", "abc").Body.String())
+	resp := do("POST", session+"?offset=2", "def")
+	ut.AssertEqual(t, 409, resp.Code)
+	ut.AssertEqual(t, "3", resp.Header().Get("Upload-Offset"))
+	ut.AssertEqual(t, "6\n", do("POST", session+"?offset=3", "def").Body.String())
+	ut.AssertEqual(t, "6\n", do("GET", session, "").Body.String())
+	ut.AssertEqual(t, 400, do("POST", session+"?commit=0", "").Code)
+	// The session is kept when the commit can't take the lock.
+	lock, err := locker.Lock(true)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 503, do("POST", session+"?commit="+Sha1Bytes([]byte("abcdef")), "").Code)
+	ut.AssertEqual(t, nil, lock.Unlock())
+	ut.AssertEqual(t, 201, do("POST", session+"?commit="+Sha1Bytes([]byte("abcdef")), "").Code)
+	ut.AssertEqual(t, "abcdef", readEntry(t, remote, Sha1Bytes([]byte("abcdef"))))
+	// The session is gone once committed.
+	ut.AssertEqual(t, 404, do("GET", session, "").Code)
+
+	session = create()
+	ut.AssertEqual(t, 200, do("POST", session+"?offset=0", "abc").Code)
+	ut.AssertEqual(t, 200, do("DELETE", session, "").Code)
+	ut.AssertEqual(t, 404, do("GET", session, "").Code)
+	ut.AssertEqual(t, 400, do("POST", "/upload/../foo?offset=0", "abc").Code)
+
+	// Read-only.
+	resp = httptest.NewRecorder()
+	MakeCasHandler(remote, nil).ServeHTTP(resp, httptest.NewRequest("POST", "/upload/", nil))
+	ut.AssertEqual(t, 405, resp.Code)
+}
+
+func TestCasHandlerUploadLocal(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_upload_local")
+	defer removeDir(t, tempData)
+	remote, err := MakeLocalCasTable(tempData, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	server := httptest.NewServer(MakeCasHandler(remote, MakeMemoryLocker()))
+	defer server.Close()
+	cas, err := MakeCasTable(server.URL, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	cas.(*httpCasTable).chunkSize = 4
+
+	// The upload is staged in the table then renamed into place.
+	content := []byte("0123456789abcdefghi")
+	hash := Sha1Bytes(content)
+	ut.AssertEqual(t, nil, cas.AddEntry(bytes.NewReader(content), hash))
+	ut.AssertEqual(t, string(content), readEntry(t, remote, hash))
+	names, err := readDirNames(filepath.Join(tempData, casName, uploadsName))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 0, len(names))
+	items, err := EnumerateCasAsList(remote)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{hash}, items)
+}
@@ -11,27 +11,115 @@ package dumbcaslib
 
 import (
 	"bytes"
-	"crypto/sha1"
+	"context"
+	"crypto/cipher"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
-
-	"github.com/maruel/interrupt"
+	"strings"
+	"sync"
+	"time"
 )
 
 const casName = "cas"
 const needFsckName = "need_fsck"
 
+// tempPrefix is the prefix of the files being written by AddEntry.
+const tempPrefix = ".tmp-"
+
+// uploadsName is the directory staging the chunked uploads of the web server.
+const uploadsName = "uploads"
+
 type casTable struct {
 	rootDir      string
 	casDir       string
 	prefixLength int
 	hashLength   int
 	validPath    *regexp.Regexp
+	trashDir     string
 	trash        trash
+	newHash      func() hash.Hash
+	verifyWrites bool
+	codec        byte
+	level        int
+	jobs         int
+	// readOnly disables the trashing of the unexpected files by Enumerate.
+	readOnly bool
+	// aead is nil if the table is not encrypted or the passphrase is missing.
+	aead      cipher.AEAD
+	encrypted bool
+	// packs holds the entries up to packThreshold bytes; 0 disables packing.
+	packs         *packs
+	packThreshold int64
+
+	// inflight are the entries being written by AddEntry(), so concurrent
+	// writers of the same content don't all copy it.
+	lock     sync.Mutex
+	inflight map[string]*inflightWrite
+}
+
+// inflightWrite is closed once the write is done.
+type inflightWrite struct {
+	done chan struct{}
+	err  error
+}
+
+// loadCasMetadata returns the metadata of the table in casDir. Tables created
+// before the metadata file was introduced are SHA-1 based and their prefix
+// length is deduced from the directories present.
+func loadCasMetadata(casDir string) (*casMetadata, error) {
+	m := &casMetadata{}
+	f, err := os.Open(filepath.Join(casDir, metadataName))
+	if os.IsNotExist(err) {
+		m.Hash = DefaultHash
+	} else if err != nil {
+		return nil, err
+	} else {
+		defer func() {
+			_ = f.Close()
+		}()
+		if err := LoadReaderAsJSON(f, m); err != nil {
+			return nil, err
+		}
+	}
+	if m.PrefixLength == 0 {
+		if m.PrefixLength, err = guessPrefixLength(casDir); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// guessPrefixLength returns the length of the prefix directories present in
+// casDir.
+func guessPrefixLength(casDir string) (int, error) {
+	names, err := readDirNames(casDir)
+	if err != nil {
+		return 0, err
+	}
+	rePrefix := regexp.MustCompile(fmt.Sprintf("^[a-f0-9]{1,%d}$", maxPrefixLength))
+	for _, name := range names {
+		if rePrefix.MatchString(name) && isDir(filepath.Join(casDir, name)) {
+			return len(name), nil
+		}
+	}
+	return DefaultPrefixLength, nil
+}
+
+func (m *casMetadata) save(casDir string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(casDir, metadataName), data, 0640)
 }
 
 // filePath converts an entry in the table into a proper file path.
@@ -54,127 +142,539 @@ func prefixSpace(prefixLength uint) int {
 	return 1 << (prefixLength * 4)
 }
 
-// MakeLocalCasTable returns a CasTable rooted at rootDir.
-func MakeLocalCasTable(rootDir string) (CasTable, error) {
-	// Creates 16^3 (4096) directories. Preferable values are 2 or 3.
-	prefixLength := 3
-	// Currently hardcoded for SHA-1 but could be used for any length.
-	hashLength := sha1.Size * 2
+// FindEnclosingRoot returns the closest parent directory of rootDir that is
+// itself the root of a local table, or "" if there is none. A table is
+// recognized by its metadata file, so an unrelated "cas" directory isn't
+// mistaken for one. rootDir must be absolute.
+func FindEnclosingRoot(rootDir string) string {
+	dir := filepath.Clean(rootDir)
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+		if _, err := os.Stat(filepath.Join(dir, casName, metadataName)); err == nil {
+			return dir
+		}
+	}
+}
 
+// CheckLocalCasTable returns an error if the local table at rootDir can't be
+// read, e.g. when its volume is unmounted. Unlike opening or enumerating the
+// table, it never modifies it.
+func CheckLocalCasTable(rootDir string) error {
+	casDir := filepath.Join(rootDir, casName)
+	info, err := os.Stat(casDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", casDir)
+	}
+	_, err = loadCasMetadata(casDir)
+	return err
+}
+
+// MakeLocalCasTable returns a CasTable rooted at rootDir.
+func MakeLocalCasTable(rootDir string, opts CasOptions) (CasTable, error) {
 	if !filepath.IsAbs(rootDir) {
 		return nil, fmt.Errorf("MakeCasTable(%s) is not valid", rootDir)
 	}
+	if err := opts.check(); err != nil {
+		return nil, fmt.Errorf("MakeCasTable(%s): %s", rootDir, err)
+	}
 	rootDir = filepath.Clean(rootDir)
 	casDir := filepath.Join(rootDir, casName)
-	if err := os.MkdirAll(casDir, 0750); err != nil && !os.IsExist(err) {
-		return nil, fmt.Errorf("MakeCasTable(%s): failed to create the directory: %s", casDir, err)
-	} else if !os.IsExist(err) {
+	trashDir := filepath.Join(casDir, trashName)
+	if opts.TrashDir != "" {
+		if !filepath.IsAbs(opts.TrashDir) {
+			return nil, fmt.Errorf("MakeCasTable(%s): the trash directory %s is not absolute", rootDir, opts.TrashDir)
+		}
+		opts.TrashDir = filepath.Clean(opts.TrashDir)
+		if err := checkTrashDir(casDir, opts.TrashDir); err != nil {
+			return nil, fmt.Errorf("MakeCasTable(%s): %s", rootDir, err)
+		}
+	}
+	var metadata *casMetadata
+	if _, err := os.Stat(casDir); os.IsNotExist(err) {
+		if opts.ReadOnly {
+			return nil, fmt.Errorf("MakeCasTable(%s): no table found", rootDir)
+		}
+		if err := os.MkdirAll(casDir, 0750); err != nil {
+			return nil, fmt.Errorf("MakeCasTable(%s): failed to create the directory: %s", casDir, err)
+		}
+		if metadata, err = newCasMetadata(opts); err != nil {
+			return nil, fmt.Errorf("MakeCasTable(%s): %s", casDir, err)
+		}
 		// Create all the prefixes at initialization time so they don't need to be
 		// tested all the time.
-		for i := 0; i < prefixSpace(uint(prefixLength)); i++ {
-			prefix := fmt.Sprintf("%0*x", prefixLength, i)
+		for i := 0; i < prefixSpace(uint(metadata.PrefixLength)); i++ {
+			prefix := fmt.Sprintf("%0*x", metadata.PrefixLength, i)
 			if err := os.Mkdir(filepath.Join(casDir, prefix), 0750); err != nil && !os.IsExist(err) {
-				return nil, fmt.Errorf("Failed to create %s: %s\n", prefix, err)
+				return nil, fmt.Errorf("MakeCasTable(%s): failed to create %s: %s", casDir, prefix, err)
 			}
 		}
+		if err := metadata.save(casDir); err != nil {
+			return nil, fmt.Errorf("MakeCasTable(%s): failed to write metadata: %s", casDir, err)
+		}
+	} else {
+		if metadata, err = loadCasMetadata(casDir); err != nil {
+			return nil, fmt.Errorf("MakeCasTable(%s): failed to read metadata: %s", casDir, err)
+		}
+		if err := metadata.check(opts); err != nil {
+			return nil, fmt.Errorf("MakeCasTable(%s): %s", casDir, err)
+		}
+		if opts.TrashDir != "" && metadata.TrashDir == "" {
+			// Moving the trash of the table elsewhere would lose track of its items.
+			if names, _ := readDirNames(trashDir); len(names) != 0 {
+				return nil, fmt.Errorf("MakeCasTable(%s): the trash %s is not empty, can't use %s", casDir, trashDir, opts.TrashDir)
+			}
+			metadata.TrashDir = opts.TrashDir
+			if !opts.ReadOnly {
+				if err := metadata.save(casDir); err != nil {
+					return nil, fmt.Errorf("MakeCasTable(%s): failed to write metadata: %s", casDir, err)
+				}
+			}
+		}
+	}
+	if metadata.TrashDir != "" {
+		trashDir = metadata.TrashDir
 	}
+	aead, err := metadata.cipher(opts)
+	if err != nil {
+		return nil, fmt.Errorf("MakeCasTable(%s): %s", casDir, err)
+	}
+	newHash := hashAlgorithms[metadata.Hash]
+	hashLength := newHash().Size() * 2
 	return &casTable{
-		rootDir,
-		casDir,
-		prefixLength,
-		hashLength,
-		regexp.MustCompile(fmt.Sprintf("^([a-f0-9]{%d})$", hashLength)),
-		makeTrash(casDir),
+		rootDir:       rootDir,
+		casDir:        casDir,
+		prefixLength:  metadata.PrefixLength,
+		hashLength:    hashLength,
+		validPath:     regexp.MustCompile(fmt.Sprintf("^([a-f0-9]{%d})$", hashLength)),
+		trashDir:      trashDir,
+		trash:         makeTrashAt(casDir, trashDir),
+		newHash:       newHash,
+		verifyWrites:  opts.VerifyWrites,
+		codec:         opts.codec(),
+		level:         opts.CompressionLevel,
+		jobs:          opts.jobs(),
+		readOnly:      opts.ReadOnly,
+		aead:          aead,
+		encrypted:     metadata.Encryption != nil,
+		packs:         makePacks(casDir),
+		packThreshold: opts.PackThreshold,
+		inflight:      map[string]*inflightWrite{},
 	}, nil
 }
 
-// Expects the format "/<hash>". In particular, refuses "/<hash>/".
+// Expects the format "/<hash>". In particular, refuses "/<hash>/". The optional
+// query parameter "name" is the file name to serve the content as.
 func (c *casTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "" || r.URL.Path[0] != '/' {
 		http.Error(w, "Internal failure. CasTable received an invalid url: "+r.URL.Path, http.StatusNotImplemented)
 		return
 	}
 	casItem := c.filePath(r.URL.Path[1:])
-	if casItem == "" {
+	if casItem == "" || !isValidCasURL(r.URL.Path) {
 		http.Error(w, "Invalid CAS url: "+r.URL.Path, http.StatusBadRequest)
 		return
 	}
-	http.ServeFile(w, r, casItem)
+	f, size, modTime, err := c.openRaw(r.URL.Path[1:])
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob, err := openBlob(f, c.aead)
+	if err == ErrEncrypted {
+		// Never serve the encrypted content as-is.
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		_ = blob.Close()
+	}()
+	name := entryHeaders(w, r, r.URL.Path[1:])
+	if d, ok := blob.(*decodingReader); ok && d.codec == codecGzip && r.Header.Get("Range") == "" && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		// Send the gzip stream as-is and let the client decompress it.
+		var sniff [512]byte
+		n, _ := io.ReadFull(blob, sniff[:])
+		if _, err := f.Seek(blobHeaderSize, io.SeekStart); err == nil {
+			ctype := mime.TypeByExtension(filepath.Ext(name))
+			if ctype == "" {
+				ctype = http.DetectContentType(sniff[:n])
+			}
+			w.Header().Set("Content-Type", ctype)
+			w.Header().Set("Vary", "Accept-Encoding")
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", size-blobHeaderSize))
+			_, _ = io.Copy(w, f)
+			return
+		}
+	}
+	http.ServeContent(w, r, name, modTime, blob)
 }
 
 // Enumerates all the entries in the table. If a file or directory is found in
 // the directory tree that doesn't match the expected format, it will be moved
-// into the trash.
+// into the trash; the temporary files of AddEntry are skipped. The prefix
+// directories are read concurrently so the entries are not returned in order.
+// The packed entries are returned last.
 func (c *casTable) Enumerate() <-chan EnumerationEntry {
+	return c.EnumerateCtx(context.Background())
+}
+
+func (c *casTable) EnumerateCtx(ctx context.Context) <-chan EnumerationEntry {
 	rePrefix := regexp.MustCompile(fmt.Sprintf("^[a-f0-9]{%d}$", c.prefixLength))
 	reRest := regexp.MustCompile(fmt.Sprintf("^[a-f0-9]{%d}$", c.hashLength-c.prefixLength))
 	items := make(chan EnumerationEntry)
 
-	// TODO(maruel): No need to read all at once.
 	go func() {
-		prefixes, err := readDirNames(c.casDir)
+		defer close(items)
+		names, err := readDirNames(c.casDir)
 		if err != nil {
-			items <- EnumerationEntry{Error: fmt.Errorf("Failed reading ss", c.casDir)}
-		} else {
-			for _, prefix := range prefixes {
-				if interrupt.IsSet() {
-					break
+			sendEntry(ctx, items, EnumerationEntry{Error: fmt.Errorf("Failed reading %s: %s", c.casDir, err)})
+			return
+		}
+		prefixes := make([]string, 0, len(names))
+		for _, prefix := range names {
+			if prefix == trashName || prefix == needFsckName || prefix == metadataName || prefix == packsName || prefix == uploadsName || strings.HasPrefix(prefix, tempPrefix) {
+				continue
+			}
+			if !rePrefix.MatchString(prefix) {
+				c.quarantine(prefix)
+				continue
+			}
+			prefixes = append(prefixes, prefix)
+		}
+		forEachPrefix(ctx, prefixes, c.jobs, func(prefix string) {
+			// TODO(maruel): No need to read all at once.
+			prefixPath := filepath.Join(c.casDir, prefix)
+			subitems, err := readDirInfos(prefixPath)
+			if err != nil {
+				if !c.readOnly {
+					c.SetFsckBit()
 				}
-				if prefix == trashName {
-					continue
+				sendEntry(ctx, items, EnumerationEntry{Error: fmt.Errorf("Failed reading %s", prefixPath)})
+				return
+			}
+			for _, item := range subitems {
+				if IsInterrupted() || ctx.Err() != nil {
+					return
 				}
-				if !rePrefix.MatchString(prefix) {
-					_ = c.trash.move(prefix)
-					c.SetFsckBit()
+				if strings.HasPrefix(item.Name(), tempPrefix) {
+					// Being written; left over if the process was killed.
 					continue
 				}
-				// TODO(maruel): No need to read all at once.
-				prefixPath := filepath.Join(c.casDir, prefix)
-				subitems, err := readDirNames(prefixPath)
-				if err != nil {
-					items <- EnumerationEntry{Error: fmt.Errorf("Failed reading %s", prefixPath)}
-					c.SetFsckBit()
+				if !reRest.MatchString(item.Name()) {
+					c.quarantine(filepath.Join(prefix, item.Name()))
 					continue
 				}
-				for _, item := range subitems {
-					if !reRest.MatchString(item) {
-						_ = c.trash.move(filepath.Join(prefix, item))
-						c.SetFsckBit()
-						continue
-					}
-					items <- EnumerationEntry{Item: prefix + item}
+				if !sendEntry(ctx, items, EnumerationEntry{Item: prefix + item.Name(), Size: item.Size()}) {
+					return
 				}
 			}
+		})
+		for hash, loc := range c.packs.snapshot() {
+			if IsInterrupted() || ctx.Err() != nil {
+				return
+			}
+			if _, err := os.Stat(c.filePath(hash)); err == nil {
+				// Already enumerated.
+				continue
+			}
+			if !sendEntry(ctx, items, EnumerationEntry{Item: hash, Size: loc.length}) {
+				return
+			}
 		}
-		close(items)
 	}()
 	return items
 }
 
+// quarantine moves an unexpected file found by Enumerate to the trash and
+// flags the table for fsck, unless the table is read-only.
+func (c *casTable) quarantine(relPath string) {
+	if !c.readOnly {
+		_ = c.trash.move(relPath)
+		c.SetFsckBit()
+	}
+}
+
 // Adds an entry with the hash calculated already if not alreaady present. It's
 // a performance optimization to be able to not write the object unless needed.
+// When verifyWrites is set, the content is hashed while being copied and the
+// entry is discarded if the hash doesn't match.
+//
+// The content is written to a temporary file in the prefix directory then
+// renamed into place, so an interrupted write never leaves a truncated entry.
+// Content up to the pack threshold is appended to a pack file instead.
 func (c *casTable) AddEntry(source io.Reader, hash string) error {
+	return c.addEntrySized(source, hash, -1)
+}
+
+// addEntrySized is AddEntry() preallocating size bytes when the content is
+// stored as-is. size is -1 when unknown.
+func (c *casTable) addEntrySized(source io.Reader, hash string, size int64) error {
 	dst := c.filePath(hash)
-	df, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
-	if os.IsExist(err) {
-		return err
+	if dst == "" {
+		return os.ErrInvalid
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return os.ErrExist
+	}
+	if _, ok := c.packs.get(hash); ok {
+		return os.ErrExist
+	}
+	if c.encrypted && c.aead == nil {
+		return ErrEncrypted
 	}
+	// If the same entry is being written, wait for it instead of reading source.
+	// When that write fails, try again with this source.
+	c.lock.Lock()
+	for {
+		other, ok := c.inflight[hash]
+		if !ok {
+			break
+		}
+		c.lock.Unlock()
+		<-other.done
+		if other.err == nil {
+			return os.ErrExist
+		}
+		c.lock.Lock()
+	}
+	w := &inflightWrite{done: make(chan struct{})}
+	c.inflight[hash] = w
+	c.lock.Unlock()
+	w.err = c.addEntry(source, hash, dst, size)
+	c.lock.Lock()
+	delete(c.inflight, hash)
+	c.lock.Unlock()
+	close(w.done)
+	return w.err
+}
+
+func (c *casTable) addEntry(source io.Reader, hash, dst string, size int64) error {
+	if c.packThreshold > 0 && size <= c.packThreshold && !c.packs.wasRemoved(hash) {
+		data, err := ioutil.ReadAll(io.LimitReader(source, c.packThreshold+1))
+		if err != nil {
+			return fmt.Errorf("Failed to read %s: %s", hash, err)
+		}
+		if int64(len(data)) <= c.packThreshold {
+			return c.addPacked(data, hash)
+		}
+		// The size was unknown and the content is too large to be packed.
+		source = io.MultiReader(bytes.NewReader(data), source)
+	}
+	df, err := ioutil.TempFile(filepath.Dir(dst), tempPrefix)
 	if err != nil {
 		return fmt.Errorf("Failed to copy(dst) %s: %s", dst, err)
 	}
+	tmp := df.Name()
+	renamed := false
 	defer func() {
-		_ = df.Close()
+		if !renamed {
+			_ = df.Close()
+			_ = os.Remove(tmp)
+		}
 	}()
-	_, err = io.Copy(df, source)
-	return err
+	if size > 0 && c.codec == codecNone && c.aead == nil {
+		preallocate(df, size)
+	}
+	h := c.newHash()
+	if c.verifyWrites {
+		source = io.TeeReader(source, h)
+	}
+	_, err = writeBlob(df, source, c.codec, c.level, c.aead)
+	if err2 := df.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	if c.verifyWrites {
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != hash {
+			return fmt.Errorf("Failed to add %s: content hash is %s", hash, actual)
+		}
+	}
+	if err := os.Chmod(tmp, 0640); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	renamed = true
+	return nil
+}
+
+func (c *casTable) uploadDir() string {
+	return filepath.Join(c.casDir, uploadsName)
+}
+
+// addStaged renames the file at p into place when the entry is stored as-is,
+// otherwise it adds its content with AddEntry().
+func (c *casTable) addStaged(p, hash string) error {
+	dst := c.filePath(hash)
+	if dst == "" {
+		return os.ErrInvalid
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	start := make([]byte, len(blobMagic))
+	n, _ := io.ReadFull(f, start)
+	if c.codec != codecNone || c.encrypted || (c.packThreshold > 0 && stat.Size() <= c.packThreshold) || bytes.Equal(start[:n], blobMagic) {
+		defer func() {
+			_ = f.Close()
+		}()
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return c.addEntrySized(f, hash, stat.Size())
+	}
+	// It can't be renamed while open on Windows.
+	_ = f.Close()
+	if c.Exists(hash) {
+		return os.ErrExist
+	}
+	if err := os.Chmod(p, 0640); err != nil {
+		return err
+	}
+	return os.Rename(p, dst)
+}
+
+// addPacked appends the encoded content to the current pack.
+func (c *casTable) addPacked(data []byte, hash string) error {
+	if c.verifyWrites {
+		if actual := HashBytes(c.newHash(), data); actual != hash {
+			return fmt.Errorf("Failed to add %s: content hash is %s", hash, actual)
+		}
+	}
+	blob := &memBlob{}
+	if _, err := writeBlob(blob, bytes.NewReader(data), c.codec, c.level, c.aead); err != nil {
+		return fmt.Errorf("Failed to add %s: %s", hash, err)
+	}
+	return c.packs.add(hash, blob.buf)
+}
+
+// addStream writes the content to a temporary file in the table while hashing
+// it, then renames it into place.
+func (c *casTable) addStream(source io.Reader) (string, int64, error) {
+	if c.encrypted && c.aead == nil {
+		return "", 0, ErrEncrypted
+	}
+	df, err := ioutil.TempFile(c.casDir, tempPrefix)
+	if err != nil {
+		return "", 0, fmt.Errorf("Failed to create a temporary file in %s: %s", c.casDir, err)
+	}
+	tmp := df.Name()
+	renamed := false
+	defer func() {
+		if !renamed {
+			_ = df.Close()
+			_ = os.Remove(tmp)
+		}
+	}()
+	h := c.newHash()
+	size, err := writeBlob(df, io.TeeReader(source, h), c.codec, c.level, c.aead)
+	if err2 := df.Close(); err == nil {
+		err = err2
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	if err != nil {
+		return hash, size, err
+	}
+	if _, err := os.Stat(c.filePath(hash)); err == nil {
+		return hash, size, os.ErrExist
+	}
+	if _, ok := c.packs.get(hash); ok {
+		return hash, size, os.ErrExist
+	}
+	if err := os.Chmod(tmp, 0640); err != nil {
+		return hash, size, err
+	}
+	if err := os.Rename(tmp, c.filePath(hash)); err != nil {
+		return hash, size, err
+	}
+	renamed = true
+	return hash, size, nil
+}
+
+func (c *casTable) Exists(hash string) bool {
+	fp := c.filePath(hash)
+	if fp == "" {
+		return false
+	}
+	if _, err := os.Stat(fp); err == nil {
+		return true
+	}
+	_, ok := c.packs.get(hash)
+	return ok
+}
+
+// ExistsMany calls Exists() for each entry; a stat is cheap enough.
+func (c *casTable) ExistsMany(hashes []string) map[string]bool {
+	out := map[string]bool{}
+	for _, hash := range hashes {
+		if c.Exists(hash) {
+			out[hash] = true
+		}
+	}
+	return out
 }
 
 func (c *casTable) Open(hash string) (ReadSeekCloser, error) {
+	f, _, _, err := c.openRaw(hash)
+	if err != nil {
+		return nil, err
+	}
+	return openBlob(f, c.aead)
+}
+
+// openRaw returns the entry as stored, either as its own file or in a pack,
+// with its stored size and modification time.
+func (c *casTable) openRaw(hash string) (ReadSeekCloser, int64, time.Time, error) {
 	fp := c.filePath(hash)
 	if fp == "" {
-		return nil, os.ErrInvalid
+		return nil, 0, time.Time{}, os.ErrInvalid
+	}
+	f, err := os.Open(fp)
+	if os.IsNotExist(err) {
+		if loc, ok := c.packs.get(hash); ok {
+			f, size, modTime, err := c.packs.open(loc)
+			if os.IsNotExist(err) {
+				// Rewritten by a repack of another process.
+				if loc, ok = c.packs.reload(hash); ok {
+					return c.packs.open(loc)
+				}
+			}
+			return f, size, modTime, err
+		}
+	}
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, time.Time{}, err
 	}
-	return os.Open(fp)
+	return f, stat.Size(), stat.ModTime(), nil
 }
 
 func (c *casTable) SetFsckBit() {
@@ -197,17 +697,79 @@ func (c *casTable) ClearFsckBit() {
 	_ = os.Remove(filepath.Join(c.casDir, needFsckName))
 }
 
+func (c *casTable) NewHash() hash.Hash {
+	return c.newHash()
+}
+
 func (c *casTable) Remove(hash string) error {
 	match := c.validPath.FindStringSubmatch(hash)
 	if match == nil {
 		return fmt.Errorf("Remove(%s) is invalid", hash)
 	}
+	if loc, ok := c.packs.get(hash); ok {
+		// Extract it so it is trashed and restored like any other entry.
+		dst := c.filePath(hash)
+		if _, err := os.Stat(dst); os.IsNotExist(err) {
+			if err := c.packs.extract(loc, dst); err != nil {
+				return fmt.Errorf("Failed to extract %s: %s", hash, err)
+			}
+		}
+		if err := c.packs.remove(hash); err != nil {
+			return err
+		}
+	}
 	return c.trash.move(filepath.Join(hash[:c.prefixLength], hash[c.prefixLength:]))
 }
 
+func (c *casTable) Repack() (int, int64, error) {
+	return c.packs.repack()
+}
+
+func (c *casTable) EnumerateTrash() <-chan EnumerationEntry {
+	items := make(chan EnumerationEntry)
+	go func() {
+		defer close(items)
+		entries, err := c.trash.enumerate()
+		if err != nil {
+			items <- EnumerationEntry{Error: fmt.Errorf("Failed reading the trash: %s", err)}
+			return
+		}
+		for _, e := range entries {
+			items <- e
+		}
+	}()
+	return items
+}
+
+// RestoreTrash verifies the content of an entry before moving it back into
+// the table.
+func (c *casTable) RestoreTrash(item string) error {
+	hash, err := trashItemHash(item, c.prefixLength, c.validPath)
+	if err != nil {
+		return err
+	}
+	relPath := filepath.FromSlash(item)
+	f, err := os.Open(filepath.Join(c.trashDir, relPath))
+	if err != nil {
+		return err
+	}
+	blob, err := openBlob(f, c.aead)
+	if err != nil {
+		return err
+	}
+	if err := verifyEntry(blob, c.newHash(), hash); err != nil {
+		return err
+	}
+	return c.trash.restore(relPath)
+}
+
+func (c *casTable) EmptyTrash() error {
+	return c.trash.empty()
+}
+
 // AddBytes adds an entry in a CasTable when the data is already in memory but
 // not yet hashed.
 func AddBytes(c CasTable, data []byte) (string, error) {
-	hash := Sha1Bytes(data)
+	hash := HashBytes(c.NewHash(), data)
 	return hash, c.AddEntry(bytes.NewBuffer(data), hash)
 }
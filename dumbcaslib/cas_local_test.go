@@ -10,8 +10,22 @@ limitations under the License. */
 package dumbcaslib
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/maruel/ut"
 )
@@ -44,7 +58,964 @@ func TestCasTableImpl(t *testing.T) {
 	tempData := makeTempDir(t, "cas")
 	defer removeDir(t, tempData)
 
-	cas, err := MakeLocalCasTable(tempData)
+	cas, err := MakeLocalCasTable(tempData, CasOptions{})
 	ut.AssertEqual(t, nil, err)
 	testCasTableImpl(t, cas)
 }
+
+func TestCasTableSha256(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_sha256")
+	defer removeDir(t, tempData)
+
+	cas, err := MakeLocalCasTable(tempData, CasOptions{Hash: "sha256"})
+	ut.AssertEqual(t, nil, err)
+	testCasTableImpl(t, cas)
+	hash, err := AddBytes(cas, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 64, len(hash))
+
+	// The table remembers its algorithm.
+	cas, err = MakeLocalCasTable(tempData, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 32, cas.NewHash().Size())
+	_, err = MakeLocalCasTable(tempData, CasOptions{Hash: "sha256"})
+	ut.AssertEqual(t, nil, err)
+
+	// It refuses to be used with another algorithm.
+	_, err = MakeLocalCasTable(tempData, CasOptions{Hash: "sha1"})
+	ut.AssertEqual(t, false, err == nil)
+	_, err = MakeLocalCasTable(tempData, CasOptions{Hash: "md4"})
+	ut.AssertEqual(t, false, err == nil)
+}
+
+func TestCasTablePrefixLength(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_prefix")
+	defer removeDir(t, tempData)
+
+	cas, err := MakeLocalCasTable(tempData, CasOptions{PrefixLength: 2})
+	ut.AssertEqual(t, nil, err)
+	testCasTableImpl(t, cas)
+	names, err := readDirNames(filepath.Join(tempData, casName))
+	ut.AssertEqual(t, nil, err)
+	// 256 prefixes plus the metadata file and the trash.
+	ut.AssertEqual(t, 258, len(names))
+
+	_, err = MakeLocalCasTable(tempData, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	_, err = MakeLocalCasTable(tempData, CasOptions{PrefixLength: 3})
+	ut.AssertEqual(t, false, err == nil)
+
+	// A table without metadata deduces the prefix length from its directories.
+	ut.AssertEqual(t, nil, os.Remove(filepath.Join(tempData, casName, metadataName)))
+	_, err = MakeLocalCasTable(tempData, CasOptions{PrefixLength: 3})
+	ut.AssertEqual(t, false, err == nil)
+	_, err = MakeLocalCasTable(tempData, CasOptions{PrefixLength: 2})
+	ut.AssertEqual(t, nil, err)
+
+	_, err = MakeLocalCasTable(tempData, CasOptions{PrefixLength: 5})
+	ut.AssertEqual(t, false, err == nil)
+}
+
+func TestCasTableEnumerateJobs(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_jobs")
+	defer removeDir(t, tempData)
+
+	cas, err := MakeLocalCasTable(tempData, CasOptions{PrefixLength: 1, Jobs: 3})
+	ut.AssertEqual(t, nil, err)
+	expected := []string{}
+	for i := 0; i < 64; i++ {
+		hash, err := AddBytes(cas, []byte(fmt.Sprintf("content%d", i)))
+		ut.AssertEqual(t, nil, err)
+		expected = append(expected, hash)
+	}
+	sort.Strings(expected)
+	casDir := filepath.Join(tempData, casName)
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(casDir, "a", "invalid"), nil, 0600))
+	ut.AssertEqual(t, nil, os.Mkdir(filepath.Join(casDir, "invalid"), 0700))
+
+	items, err := EnumerateCasAsList(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, items)
+	ut.AssertEqual(t, true, cas.GetFsckBit())
+	// Both are moved in the same time directory.
+	names, err := readDirNames(filepath.Join(casDir, trashName))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, len(names))
+	trashDir := filepath.Join(casDir, trashName, names[0])
+	ut.AssertEqual(t, true, isDir(filepath.Join(trashDir, "invalid")))
+	_, err = os.Stat(filepath.Join(trashDir, "a", "invalid"))
+	ut.AssertEqual(t, nil, err)
+
+	_, err = MakeLocalCasTable(tempData, CasOptions{Jobs: -1})
+	ut.AssertEqual(t, false, err == nil)
+}
+
+func TestCasTableEnumerateCtx(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_ctx")
+	defer removeDir(t, tempData)
+
+	cas, err := MakeLocalCasTable(tempData, CasOptions{PrefixLength: 1, Jobs: 2})
+	ut.AssertEqual(t, nil, err)
+	for i := 0; i < 64; i++ {
+		_, err := AddBytes(cas, []byte(fmt.Sprintf("content%d", i)))
+		ut.AssertEqual(t, nil, err)
+	}
+	// The channel is closed once cancelled even if it's not read anymore.
+	ctx, cancel := context.WithCancel(context.Background())
+	items := cas.EnumerateCtx(ctx)
+	item := <-items
+	ut.AssertEqual(t, nil, item.Error)
+	cancel()
+	count := 1
+	for range items {
+		count++
+	}
+	ut.AssertEqual(t, true, count < 64)
+}
+
+func TestCasTableErrors(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_errors")
+	defer removeDir(t, tempData)
+
+	// The errors must name what failed instead of garbling the message.
+	cas, err := MakeLocalCasTable(filepath.Join(tempData, "root"), CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	casDir := filepath.Join(tempData, "root", casName)
+	removeDir(t, casDir)
+	item := <-cas.Enumerate()
+	ut.AssertEqual(t, true, item.Error != nil)
+	ut.AssertEqual(t, true, strings.HasPrefix(item.Error.Error(), "Failed reading "+casDir+": "))
+	ut.AssertEqual(t, false, strings.Contains(item.Error.Error(), "%!"))
+
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		// Permissions are not enforced.
+		return
+	}
+	readOnly := filepath.Join(tempData, "read_only")
+	ut.AssertEqual(t, nil, os.Mkdir(readOnly, 0500))
+	defer func() {
+		_ = os.Chmod(readOnly, 0700)
+	}()
+	_, err = MakeLocalCasTable(filepath.Join(readOnly, "root"), CasOptions{})
+	ut.AssertEqual(t, true, err != nil)
+	ut.AssertEqual(t, true, strings.HasPrefix(err.Error(), "MakeCasTable("+filepath.Join(readOnly, "root", casName)+"): failed to create the directory: "))
+	ut.AssertEqual(t, false, strings.Contains(err.Error(), "%!"))
+}
+
+func TestCasTableTrash(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_trash")
+	defer removeDir(t, tempData)
+
+	cas, err := MakeLocalCasTable(tempData, CasOptions{Compress: true})
+	ut.AssertEqual(t, nil, err)
+	testTrashTableImpl(t, cas, func(item string) {
+		p := filepath.Join(tempData, casName, trashName, filepath.FromSlash(item))
+		ut.AssertEqual(t, nil, ioutil.WriteFile(p, []byte("corrupted"), 0600))
+	})
+}
+
+func TestCasTableTrashDir(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_trash_dir")
+	defer removeDir(t, tempData)
+
+	trashDir := filepath.Join(tempData, "elsewhere")
+	cas, err := MakeLocalCasTable(filepath.Join(tempData, "root"), CasOptions{TrashDir: trashDir})
+	ut.AssertEqual(t, nil, err)
+	testTrashTableImpl(t, cas, func(item string) {
+		p := filepath.Join(trashDir, filepath.FromSlash(item))
+		ut.AssertEqual(t, nil, ioutil.WriteFile(p, []byte("corrupted"), 0600))
+	})
+	_, err = os.Stat(filepath.Join(tempData, "root", casName, trashName))
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+
+	// The trash directory is saved in the metadata of the table.
+	cas, err = MakeLocalCasTable(filepath.Join(tempData, "root"), CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, trashDir, cas.(*casTable).trashDir)
+	_, err = MakeLocalCasTable(filepath.Join(tempData, "root"), CasOptions{TrashDir: trashDir + string(filepath.Separator)})
+	ut.AssertEqual(t, nil, err)
+	_, err = MakeLocalCasTable(filepath.Join(tempData, "root"), CasOptions{TrashDir: filepath.Join(tempData, "other")})
+	ut.AssertEqual(t, false, err == nil)
+
+	// An existing table adopts a trash directory only if its own trash is empty.
+	other := filepath.Join(tempData, "other_root")
+	cas, err = MakeLocalCasTable(other, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, os.MkdirAll(filepath.Join(other, casName, trashName, "item"), 0700))
+	_, err = MakeLocalCasTable(other, CasOptions{TrashDir: trashDir})
+	ut.AssertEqual(t, false, err == nil)
+	ut.AssertEqual(t, nil, os.RemoveAll(filepath.Join(other, casName, trashName)))
+	_, err = MakeLocalCasTable(other, CasOptions{TrashDir: filepath.Join(tempData, "other_trash")})
+	ut.AssertEqual(t, nil, err)
+	cas, err = MakeLocalCasTable(other, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, filepath.Join(tempData, "other_trash"), cas.(*casTable).trashDir)
+
+	for _, dir := range []string{"relative", filepath.Join(tempData, "root", casName, "abc")} {
+		_, err = MakeLocalCasTable(filepath.Join(tempData, "root"), CasOptions{TrashDir: dir})
+		ut.AssertEqual(t, false, err == nil)
+	}
+	_, err = MakeCasTable("s3://bucket/path", CasOptions{TrashDir: trashDir})
+	ut.AssertEqual(t, false, err == nil)
+}
+
+func TestCasTableTrashTwice(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_trash_twice")
+	defer removeDir(t, tempData)
+
+	cas, err := MakeLocalCasTable(tempData, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	hash, err := AddBytes(cas, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, cas.Remove(hash))
+	_, err = AddBytes(cas, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, cas.Remove(hash))
+
+	// Both copies survive, each in its own time directory.
+	items := enumerateTrashAsList(t, cas)
+	ut.AssertEqual(t, 2, len(items))
+	for _, item := range items {
+		parts := strings.Split(item, "/")
+		ut.AssertEqual(t, []string{hash[:3], hash[3:]}, parts[1:])
+		_, err := time.Parse(trashTimeFormat, parts[0])
+		ut.AssertEqual(t, nil, err)
+	}
+	ut.AssertEqual(t, true, items[0] != items[1])
+
+	// Restored to its original path; the empty time directory is removed.
+	trash := cas.(TrashTable)
+	ut.AssertEqual(t, nil, trash.RestoreTrash(items[0]))
+	ut.AssertEqual(t, "content1", readEntry(t, cas, hash))
+	ut.AssertEqual(t, true, os.IsExist(trash.RestoreTrash(items[1])))
+	names, err := readDirNames(filepath.Join(tempData, casName, trashName))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, len(names))
+
+	// An item trashed before the time directories were introduced.
+	ut.AssertEqual(t, nil, trash.EmptyTrash())
+	legacy := filepath.Join(tempData, casName, trashName, hash[:3])
+	ut.AssertEqual(t, nil, os.MkdirAll(legacy, 0700))
+	ut.AssertEqual(t, nil, os.Rename(cas.(*casTable).filePath(hash), filepath.Join(legacy, hash[3:])))
+	ut.AssertEqual(t, []string{hash[:3] + "/" + hash[3:]}, enumerateTrashAsList(t, cas))
+	ut.AssertEqual(t, nil, trash.RestoreTrash(hash[:3]+"/"+hash[3:]))
+	ut.AssertEqual(t, "content1", readEntry(t, cas, hash))
+}
+
+func TestRenameAcross(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "rename_across")
+	defer removeDir(t, tempData)
+
+	src := filepath.Join(tempData, "src")
+	ut.AssertEqual(t, nil, os.MkdirAll(filepath.Join(src, "a"), 0700))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(src, "a", "b"), []byte("content1"), 0600))
+	dst := filepath.Join(tempData, "dst")
+	ut.AssertEqual(t, nil, renameAcross(src, dst))
+	_, err := os.Stat(src)
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+	data, err := ioutil.ReadFile(filepath.Join(dst, "a", "b"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "content1", string(data))
+}
+
+func TestCasTableVerifyWrites(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_verify")
+	defer removeDir(t, tempData)
+
+	cas, err := MakeLocalCasTable(tempData, CasOptions{VerifyWrites: true})
+	ut.AssertEqual(t, nil, err)
+	testCasTableImpl(t, cas)
+
+	// The content doesn't match its name.
+	hash := Sha1Bytes([]byte("content1"))
+	err = cas.AddEntry(bytes.NewBufferString("content2"), hash)
+	ut.AssertEqual(t, false, err == nil)
+	_, err = cas.Open(hash)
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+	items, err := EnumerateCasAsList(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, items)
+}
+
+// failingReader returns some data then fails, like a disk error would.
+type failingReader struct {
+	data []byte
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if len(f.data) == 0 {
+		return 0, errors.New("read failure")
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+func TestCasTableAddEntryAtomic(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_atomic")
+	defer removeDir(t, tempData)
+
+	cas, err := MakeLocalCasTable(tempData, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	hash := Sha1Bytes([]byte("content1"))
+	err = cas.AddEntry(&failingReader{[]byte("cont")}, hash)
+	ut.AssertEqual(t, false, err == nil)
+	_, err = cas.Open(hash)
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+
+	// No temporary file is left behind.
+	prefixDir := filepath.Dir(cas.(*casTable).filePath(hash))
+	names, err := readDirNames(prefixDir)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, names)
+
+	ut.AssertEqual(t, nil, cas.AddEntry(bytes.NewBufferString("content1"), hash))
+	ut.AssertEqual(t, true, os.IsExist(cas.AddEntry(bytes.NewBufferString("content1"), hash)))
+	stat, err := os.Stat(cas.(*casTable).filePath(hash))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, os.FileMode(0640), stat.Mode().Perm())
+}
+
+func TestAddEntrySized(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_sized")
+	defer removeDir(t, tempData)
+
+	cas, err := MakeLocalCasTable(tempData, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	hash := Sha1Bytes([]byte("content1"))
+	// The stream ends early.
+	err = AddEntrySized(cas, bytes.NewBufferString("cont"), hash, 8)
+	ut.AssertEqual(t, errors.New("Read 4 bytes, expected 8: unexpected EOF"), err)
+	// The stream is longer than expected.
+	err = AddEntrySized(cas, bytes.NewBufferString("content1"), hash, 4)
+	ut.AssertEqual(t, errors.New("Read more than the expected 4 bytes"), err)
+	_, err = cas.Open(hash)
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+	names, err := readDirNames(filepath.Dir(cas.(*casTable).filePath(hash)))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, names)
+
+	ut.AssertEqual(t, nil, AddEntrySized(cas, bytes.NewBufferString("content1"), hash, 8))
+	stat, err := os.Stat(cas.(*casTable).filePath(hash))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, int64(8), stat.Size())
+
+	// The source can still be rewound by the retries.
+	buf := &bytes.Buffer{}
+	mem := MakeMemoryCasTable()
+	r := MakeRetryingCasTable(&flakyCasTable{mem, 1}, 1, time.Millisecond, log.New(buf, "", 0))
+	ut.AssertEqual(t, nil, AddEntrySized(r, bytes.NewReader([]byte("content1")), hash, 8))
+	ut.AssertEqual(t, 1, strings.Count(buf.String(), "retrying"))
+}
+
+func TestCasTableCompress(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_compress")
+	defer removeDir(t, tempData)
+
+	cas, err := MakeLocalCasTable(tempData, CasOptions{Compress: true, VerifyWrites: true})
+	ut.AssertEqual(t, nil, err)
+	testCasTableImpl(t, cas)
+
+	content := bytes.Repeat([]byte("compressible "), 1000)
+	hash, err := AddBytes(cas, content)
+	ut.AssertEqual(t, nil, err)
+	stat, err := os.Stat(cas.(*casTable).filePath(hash))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, stat.Size() < int64(len(content)/10))
+
+	f, err := cas.Open(hash)
+	ut.AssertEqual(t, nil, err)
+	data, err := ioutil.ReadAll(f)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, content, data)
+	size, err := f.Seek(0, io.SeekEnd)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, int64(len(content)), size)
+	_, err = f.Seek(13, io.SeekStart)
+	ut.AssertEqual(t, nil, err)
+	data = make([]byte, 11)
+	_, err = io.ReadFull(f, data)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "compressibl", string(data))
+	ut.AssertEqual(t, nil, f.Close())
+
+	req := httptest.NewRequest("GET", "/"+hash, nil)
+	resp := httptest.NewRecorder()
+	cas.ServeHTTP(resp, req)
+	ut.AssertEqual(t, 200, resp.Code)
+	ut.AssertEqual(t, content, resp.Body.Bytes())
+
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp = httptest.NewRecorder()
+	cas.ServeHTTP(resp, req)
+	ut.AssertEqual(t, 200, resp.Code)
+	ut.AssertEqual(t, "gzip", resp.Header().Get("Content-Encoding"))
+	gz, err := gzip.NewReader(resp.Body)
+	ut.AssertEqual(t, nil, err)
+	data, err = ioutil.ReadAll(gz)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, content, data)
+}
+
+func TestCasTableZstd(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_zstd")
+	defer removeDir(t, tempData)
+
+	cas, err := MakeLocalCasTable(tempData, CasOptions{Compression: "zstd", CompressionLevel: 19, VerifyWrites: true})
+	ut.AssertEqual(t, nil, err)
+	testCasTableImpl(t, cas)
+
+	content := bytes.Repeat([]byte("compressible "), 1000)
+	hash, err := AddBytes(cas, content)
+	ut.AssertEqual(t, nil, err)
+	stat, err := os.Stat(cas.(*casTable).filePath(hash))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, stat.Size() < int64(len(content)/10))
+
+	f, err := cas.Open(hash)
+	ut.AssertEqual(t, nil, err)
+	_, err = f.Seek(13, io.SeekStart)
+	ut.AssertEqual(t, nil, err)
+	data := make([]byte, 11)
+	_, err = io.ReadFull(f, data)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "compressibl", string(data))
+	_, err = f.Seek(0, io.SeekStart)
+	ut.AssertEqual(t, nil, err)
+	data, err = ioutil.ReadAll(f)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, content, data)
+	ut.AssertEqual(t, nil, f.Close())
+
+	// The codec is per entry so the same table can hold entries compressed
+	// differently, and read them whatever its options.
+	gz, err := MakeLocalCasTable(tempData, CasOptions{Compress: true})
+	ut.AssertEqual(t, nil, err)
+	other, err := AddBytes(gz, []byte("other content"))
+	ut.AssertEqual(t, nil, err)
+	plain, err := MakeLocalCasTable(tempData, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, string(content), readEntry(t, plain, hash))
+	ut.AssertEqual(t, "other content", readEntry(t, plain, other))
+
+	for _, opts := range []CasOptions{
+		{Compression: "lz4"},
+		{CompressionLevel: 1},
+		{Compression: "gzip", CompressionLevel: 10},
+		{Compression: "zstd", CompressionLevel: 23},
+	} {
+		_, err = MakeLocalCasTable(tempData, opts)
+		ut.AssertEqualf(t, false, err == nil, "%v", opts)
+	}
+}
+
+func TestCasTableContentLikeHeader(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_header")
+	defer removeDir(t, tempData)
+
+	cas, err := MakeLocalCasTable(tempData, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	// Content that would be confused with a compressed entry is still returned
+	// as-is.
+	content := append(append([]byte{}, blobMagic...), codecGzip, 0, 0)
+	hash, err := AddBytes(cas, content)
+	ut.AssertEqual(t, nil, err)
+	f, err := cas.Open(hash)
+	ut.AssertEqual(t, nil, err)
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, content, data)
+}
+
+func TestCasTableEncrypted(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_encrypted")
+	defer removeDir(t, tempData)
+
+	cas, err := MakeLocalCasTable(tempData, CasOptions{Compress: true, VerifyWrites: true, Passphrase: "secret"})
+	ut.AssertEqual(t, nil, err)
+	testCasTableImpl(t, cas)
+
+	// Uncompressed content spanning multiple chunks.
+	plain, err := MakeLocalCasTable(tempData, CasOptions{Passphrase: "secret"})
+	ut.AssertEqual(t, nil, err)
+	content := bytes.Repeat([]byte("secret content "), 10000)
+	hash, err := AddBytes(plain, content)
+	ut.AssertEqual(t, nil, err)
+	raw, err := ioutil.ReadFile(cas.(*casTable).filePath(hash))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, false, bytes.Contains(raw, []byte("secret")))
+
+	f, err := cas.Open(hash)
+	ut.AssertEqual(t, nil, err)
+	data, err := ioutil.ReadAll(f)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, content, data)
+	_, err = f.Seek(int64(len(content)-8), io.SeekStart)
+	ut.AssertEqual(t, nil, err)
+	data, err = ioutil.ReadAll(f)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "content ", string(data))
+	ut.AssertEqual(t, nil, f.Close())
+
+	// The gzip stream of a compressed entry is not served as-is.
+	hash2, err := AddBytes(cas, []byte("secret2"))
+	ut.AssertEqual(t, nil, err)
+	req := httptest.NewRequest("GET", "/"+hash2, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	cas.ServeHTTP(resp, req)
+	ut.AssertEqual(t, 200, resp.Code)
+	ut.AssertEqual(t, "", resp.Header().Get("Content-Encoding"))
+	ut.AssertEqual(t, "secret2", resp.Body.String())
+
+	// A truncated entry is detected.
+	p := cas.(*casTable).filePath(hash)
+	ut.AssertEqual(t, nil, os.Chmod(p, 0600))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(p, raw[:len(raw)-cryptChunkSize/2], 0600))
+	f, err = cas.Open(hash)
+	ut.AssertEqual(t, nil, err)
+	_, err = ioutil.ReadAll(f)
+	_ = f.Close()
+	ut.AssertEqual(t, false, err == nil)
+
+	// Without the passphrase, the table can only be enumerated.
+	locked, err := MakeLocalCasTable(tempData, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	items, err := EnumerateCasAsList(locked)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, len(items) >= 2)
+	_, err = locked.Open(hash2)
+	ut.AssertEqual(t, ErrEncrypted, err)
+	_, err = AddBytes(locked, []byte("content3"))
+	ut.AssertEqual(t, ErrEncrypted, err)
+	resp = httptest.NewRecorder()
+	locked.ServeHTTP(resp, httptest.NewRequest("GET", "/"+hash2, nil))
+	ut.AssertEqual(t, 403, resp.Code)
+
+	_, err = MakeLocalCasTable(tempData, CasOptions{Passphrase: "wrong"})
+	ut.AssertEqual(t, false, err == nil)
+
+	other := makeTempDir(t, "cas_not_encrypted")
+	defer removeDir(t, other)
+	_, err = MakeLocalCasTable(other, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	_, err = MakeLocalCasTable(other, CasOptions{Passphrase: "secret"})
+	ut.AssertEqual(t, false, err == nil)
+}
+
+func TestCasTableServeRange(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_serve_range")
+	defer removeDir(t, tempData)
+
+	cas, err := MakeLocalCasTable(tempData, CasOptions{Compress: true, PrefixLength: 1})
+	ut.AssertEqual(t, nil, err)
+	testServeRangeImpl(t, cas)
+}
+
+func TestCasTableOpenRange(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_open_range")
+	defer removeDir(t, tempData)
+
+	data := []CasOptions{
+		{},
+		{Compress: true},
+		{Compression: "zstd"},
+		{Passphrase: "secret"},
+		{PackThreshold: 1 << 20},
+	}
+	for i, opts := range data {
+		cas, err := MakeLocalCasTable(filepath.Join(tempData, fmt.Sprintf("%d", i)), opts)
+		ut.AssertEqualIndex(t, i, nil, err)
+		testOpenRangeImpl(t, cas)
+	}
+}
+
+func TestCasTableServeName(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_serve_name")
+	defer removeDir(t, tempData)
+
+	for _, compress := range []bool{false, true} {
+		cas, err := MakeLocalCasTable(filepath.Join(tempData, fmt.Sprintf("%v", compress)), CasOptions{Compress: compress})
+		ut.AssertEqual(t, nil, err)
+		hash, err := AddBytes(cas, []byte("%PDF-1.4 not really"))
+		ut.AssertEqual(t, nil, err)
+
+		// Without a name, the content is sniffed.
+		resp := httptest.NewRecorder()
+		cas.ServeHTTP(resp, httptest.NewRequest("GET", "/"+hash, nil))
+		ut.AssertEqual(t, 200, resp.Code)
+		ut.AssertEqual(t, "application/pdf", resp.Header().Get("Content-Type"))
+		ut.AssertEqual(t, "", resp.Header().Get("Content-Disposition"))
+
+		req := httptest.NewRequest("GET", "/"+hash+"?name=dir/foo.txt", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp = httptest.NewRecorder()
+		cas.ServeHTTP(resp, req)
+		ut.AssertEqual(t, 200, resp.Code)
+		ut.AssertEqual(t, "text/plain; charset=utf-8", resp.Header().Get("Content-Type"))
+		ut.AssertEqual(t, "inline; filename=foo.txt", resp.Header().Get("Content-Disposition"))
+
+		resp = httptest.NewRecorder()
+		cas.ServeHTTP(resp, httptest.NewRequest("GET", "/"+hash[:4]+"/../"+hash[4:], nil))
+		ut.AssertEqual(t, 400, resp.Code)
+	}
+}
+
+func TestArchiveReader(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_stream")
+	defer removeDir(t, tempData)
+
+	local, err := MakeLocalCasTable(tempData, CasOptions{Compress: true})
+	ut.AssertEqual(t, nil, err)
+	// The memory table doesn't support streaming so the content is staged.
+	for _, cas := range []CasTable{local, MakeMemoryCasTable()} {
+		content := bytes.Repeat([]byte("dump "), 100000)
+		hash, size, err := ArchiveReader(cas, bytes.NewReader(content))
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, Sha1Bytes(content), hash)
+		ut.AssertEqual(t, int64(len(content)), size)
+		f, err := cas.Open(hash)
+		ut.AssertEqual(t, nil, err)
+		data, err := ioutil.ReadAll(f)
+		_ = f.Close()
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, content, data)
+
+		_, _, err = ArchiveReader(cas, bytes.NewReader(content))
+		ut.AssertEqual(t, true, os.IsExist(err))
+		items, err := EnumerateCasAsList(cas)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, []string{hash}, items)
+	}
+	ut.AssertEqual(t, false, local.GetFsckBit())
+
+	// A failed read leaves no temporary file behind.
+	_, _, err = ArchiveReader(local, &failingReader{[]byte("cont")})
+	ut.AssertEqual(t, false, err == nil)
+	names, err := readDirNames(local.(*casTable).casDir)
+	ut.AssertEqual(t, nil, err)
+	for _, name := range names {
+		ut.AssertEqual(t, false, strings.HasPrefix(name, tempPrefix))
+	}
+}
+
+func TestFindEnclosingRoot(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_nested")
+	defer removeDir(t, tempData)
+
+	nested := filepath.Join(tempData, "a", "b")
+	ut.AssertEqual(t, "", FindEnclosingRoot(nested))
+	// A directory named cas isn't a table.
+	ut.AssertEqual(t, nil, os.MkdirAll(filepath.Join(tempData, "a", casName), 0700))
+	ut.AssertEqual(t, "", FindEnclosingRoot(nested))
+	_, err := MakeLocalCasTable(tempData, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, tempData, FindEnclosingRoot(nested))
+	// The root itself isn't reported.
+	ut.AssertEqual(t, "", FindEnclosingRoot(tempData))
+}
+
+func TestCasTableNativePath(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_native_path")
+	defer removeDir(t, tempData)
+	if runtime.GOOS == "windows" {
+		// e.g. C:\Users\me\AppData\Local\Temp\cas_native_path123.
+		ut.AssertEqual(t, true, filepath.VolumeName(tempData) != "")
+	}
+
+	// A directory name with a space, as commonly found on Windows.
+	root := filepath.Join(tempData, "My Backups", "dumbcas")
+	cas, err := MakeLocalCasTable(root, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	hash, err := AddBytes(cas, []byte("content"))
+	ut.AssertEqual(t, nil, err)
+	p := cas.(*casTable).filePath(hash)
+	ut.AssertEqual(t, filepath.Join(root, casName, hash[:3], hash[3:]), p)
+	ut.AssertEqual(t, "content", readEntry(t, cas, hash))
+
+	// Reopen it with a path not cleaned.
+	cas, err = MakeLocalCasTable(root+string(filepath.Separator)+"."+string(filepath.Separator), CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "content", readEntry(t, cas, hash))
+
+	// A path without a drive letter is relative on Windows.
+	_, err = MakeLocalCasTable(`\backup`, CasOptions{})
+	ut.AssertEqual(t, false, err == nil)
+	_, err = MakeLocalCasTable("backup", CasOptions{})
+	ut.AssertEqual(t, false, err == nil)
+}
+
+func TestCasTableBlake3(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_blake3")
+	defer removeDir(t, tempData)
+
+	cas, err := MakeLocalCasTable(tempData, CasOptions{Hash: "blake3"})
+	ut.AssertEqual(t, nil, err)
+	testCasTableImpl(t, cas)
+	hash, err := AddBytes(cas, []byte{})
+	ut.AssertEqual(t, nil, err)
+	// Reference test vector of the empty input.
+	ut.AssertEqual(t, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262", hash)
+
+	cas, err = MakeLocalCasTable(tempData, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	items, err := EnumerateCasAsList(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{hash}, items)
+
+	// It refuses to be used with another algorithm, even of the same size.
+	_, err = MakeLocalCasTable(tempData, CasOptions{Hash: "sha256"})
+	ut.AssertEqual(t, false, err == nil)
+	_, err = MakeLocalCasTable(tempData, CasOptions{Hash: "sha1"})
+	ut.AssertEqual(t, false, err == nil)
+}
+
+// gatedReader signals started on its first Read and then blocks until release
+// is closed.
+type gatedReader struct {
+	r       io.Reader
+	started chan struct{}
+	release chan struct{}
+	read    bool
+}
+
+func (g *gatedReader) Read(p []byte) (int, error) {
+	if !g.read {
+		g.read = true
+		close(g.started)
+		<-g.release
+	}
+	return g.r.Read(p)
+}
+
+func TestCasTableAddEntryConcurrent(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_concurrent")
+	defer removeDir(t, tempData)
+	cas, err := MakeLocalCasTable(tempData, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+
+	content := []byte("content1")
+	hash := Sha1Bytes(content)
+	first := &gatedReader{r: bytes.NewReader(content), started: make(chan struct{}), release: make(chan struct{})}
+	errs := make(chan error)
+	go func() {
+		errs <- cas.AddEntry(first, hash)
+	}()
+	<-first.started
+
+	// The second writer waits for the first one without reading its source.
+	second := &gatedReader{r: bytes.NewReader(content), started: make(chan struct{}), release: make(chan struct{})}
+	go func() {
+		errs <- cas.AddEntry(second, hash)
+	}()
+	close(first.release)
+	results := []error{<-errs, <-errs}
+	ut.AssertEqual(t, false, second.read)
+	ut.AssertEqual(t, true, (results[0] == nil && os.IsExist(results[1])) || (results[1] == nil && os.IsExist(results[0])))
+	items, err := EnumerateCasAsList(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{hash}, items)
+}
+
+func TestCasTablePackImpl(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_pack_impl")
+	defer removeDir(t, tempData)
+
+	opts := CasOptions{Compress: true, VerifyWrites: true, PackThreshold: 1024}
+	cas, err := MakeLocalCasTable(filepath.Join(tempData, "impl"), opts)
+	ut.AssertEqual(t, nil, err)
+	testCasTableImpl(t, cas)
+	cas, err = MakeLocalCasTable(filepath.Join(tempData, "range"), opts)
+	ut.AssertEqual(t, nil, err)
+	testServeRangeImpl(t, cas)
+	cas, err = MakeLocalCasTable(filepath.Join(tempData, "trash"), opts)
+	ut.AssertEqual(t, nil, err)
+	testTrashTableImpl(t, cas, func(item string) {
+		p := filepath.Join(tempData, "trash", casName, trashName, filepath.FromSlash(item))
+		ut.AssertEqual(t, nil, ioutil.WriteFile(p, []byte("corrupted"), 0600))
+	})
+
+	_, err = MakeLocalCasTable(tempData, CasOptions{PackThreshold: -1})
+	ut.AssertEqual(t, false, err == nil)
+}
+
+func TestCasTablePack(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_pack")
+	defer removeDir(t, tempData)
+
+	opts := CasOptions{Compress: true, Passphrase: "secret", PackThreshold: 100}
+	cas, err := MakeLocalCasTable(tempData, opts)
+	ut.AssertEqual(t, nil, err)
+	small1, err := AddBytes(cas, []byte("small1"))
+	ut.AssertEqual(t, nil, err)
+	small2, err := AddBytes(cas, []byte("small2"))
+	ut.AssertEqual(t, nil, err)
+	large := bytes.Repeat([]byte("large"), 100)
+	largeHash := HashBytes(cas.NewHash(), large)
+	// The size is unknown.
+	ut.AssertEqual(t, nil, cas.AddEntry(bytes.NewBuffer(large), largeHash))
+	_, err = AddBytes(cas, []byte("small1"))
+	ut.AssertEqual(t, true, os.IsExist(err))
+
+	_, err = os.Stat(cas.(*casTable).filePath(small1))
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+	_, err = os.Stat(cas.(*casTable).filePath(largeHash))
+	ut.AssertEqual(t, nil, err)
+	names, err := readDirNames(filepath.Join(tempData, casName, packsName))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(names))
+
+	// Another instance sees the packed entries.
+	cas, err = MakeLocalCasTable(tempData, opts)
+	ut.AssertEqual(t, nil, err)
+	expected := []string{small1, small2, largeHash}
+	sort.Strings(expected)
+	items, err := EnumerateCasAsList(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, items)
+	ut.AssertEqual(t, "small2", readEntry(t, cas, small2))
+	ut.AssertEqual(t, string(large), readEntry(t, cas, largeHash))
+
+	// The removed entry is trashed like any other and is not packed again.
+	ut.AssertEqual(t, nil, cas.Remove(small1))
+	_, err = cas.Open(small1)
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+	ut.AssertEqual(t, 1, len(enumerateTrashAsList(t, cas)))
+	_, err = AddBytes(cas, []byte("small1"))
+	ut.AssertEqual(t, nil, err)
+	_, err = os.Stat(cas.(*casTable).filePath(small1))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, cas.Remove(small1))
+
+	packs, reclaimed, err := cas.(PackTable).Repack()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, packs)
+	ut.AssertEqual(t, true, reclaimed > 0)
+	packs, _, err = cas.(PackTable).Repack()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 0, packs)
+
+	cas, err = MakeLocalCasTable(tempData, opts)
+	ut.AssertEqual(t, nil, err)
+	expected = []string{small2, largeHash}
+	sort.Strings(expected)
+	items, err = EnumerateCasAsList(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, items)
+	ut.AssertEqual(t, "small2", readEntry(t, cas, small2))
+	// Packing again after the repack.
+	small1, err = AddBytes(cas, []byte("small1"))
+	ut.AssertEqual(t, nil, err)
+	_, err = os.Stat(cas.(*casTable).filePath(small1))
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+	ut.AssertEqual(t, "small1", readEntry(t, cas, small1))
+}
+
+func TestCasTablePackConcurrent(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_pack_concurrent")
+	defer removeDir(t, tempData)
+
+	opts := CasOptions{PackThreshold: 100}
+	casA, err := MakeLocalCasTable(tempData, opts)
+	ut.AssertEqual(t, nil, err)
+	a1, err := AddBytes(casA, []byte("a1"))
+	ut.AssertEqual(t, nil, err)
+
+	// casA sees what casB packed since on a miss.
+	casB, err := MakeLocalCasTable(tempData, opts)
+	ut.AssertEqual(t, nil, err)
+	b1, err := AddBytes(casB, []byte("b1"))
+	ut.AssertEqual(t, nil, err)
+	casA.(*casTable).packs.refreshed = time.Time{}
+	ut.AssertEqual(t, "b1", readEntry(t, casA, b1))
+
+	// The small packs of each process are merged.
+	if runtime.GOOS == "windows" {
+		// The packs open by the other processes can't be removed.
+		casA.(*casTable).packs.current.close()
+		casB.(*casTable).packs.current.close()
+	}
+	casC, err := MakeLocalCasTable(tempData, opts)
+	ut.AssertEqual(t, nil, err)
+	packs, reclaimed, err := casC.(PackTable).Repack()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, packs)
+	ut.AssertEqual(t, int64(0), reclaimed)
+	names, err := readDirNames(filepath.Join(tempData, casName, packsName))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(names))
+
+	// casA finds the entries in the merged pack and doesn't append to its
+	// merged pack anymore.
+	ut.AssertEqual(t, "a1", readEntry(t, casA, a1))
+	ut.AssertEqual(t, "b1", readEntry(t, casB, b1))
+	a2, err := AddBytes(casA, []byte("a2"))
+	ut.AssertEqual(t, nil, err)
+	casC.(*casTable).packs.refreshed = time.Time{}
+	ut.AssertEqual(t, "a2", readEntry(t, casC, a2))
+
+	// A failed write to the index starts a new pack.
+	ut.AssertEqual(t, nil, casA.(*casTable).packs.current.idx.Close())
+	_, err = AddBytes(casA, []byte("lost"))
+	ut.AssertEqual(t, false, err == nil)
+	a3, err := AddBytes(casA, []byte("a3"))
+	ut.AssertEqual(t, nil, err)
+	casD, err := MakeLocalCasTable(tempData, opts)
+	ut.AssertEqual(t, nil, err)
+	expected := []string{a1, a2, a3, b1}
+	sort.Strings(expected)
+	items, err := EnumerateCasAsList(casD)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, items)
+	ut.AssertEqual(t, "a3", readEntry(t, casD, a3))
+}
+
+func TestCasTablePackServeGzip(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_pack_gzip")
+	defer removeDir(t, tempData)
+
+	cas, err := MakeLocalCasTable(tempData, CasOptions{Compress: true, PackThreshold: 100})
+	ut.AssertEqual(t, nil, err)
+	hash, err := AddBytes(cas, []byte("packed content"))
+	ut.AssertEqual(t, nil, err)
+	req := httptest.NewRequest("GET", "/"+hash, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := httptest.NewRecorder()
+	cas.ServeHTTP(resp, req)
+	ut.AssertEqual(t, 200, resp.Code)
+	ut.AssertEqual(t, "gzip", resp.Header().Get("Content-Encoding"))
+	gz, err := gzip.NewReader(resp.Body)
+	ut.AssertEqual(t, nil, err)
+	data, err := ioutil.ReadAll(gz)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "packed content", string(data))
+}
@@ -0,0 +1,156 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type lruCasTable struct {
+	CasTable
+	maxBytes     int64
+	maxEntrySize int64
+
+	lock    sync.Mutex
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	hash string
+	data []byte
+}
+
+// MakeLRUCasTable returns a CasTable that keeps the content of the entries
+// most recently opened or served in memory, up to maxBytes. Only the entries
+// up to maxEntrySize bytes are kept. The entries are immutable so the cache
+// only needs to forget the removed ones.
+func MakeLRUCasTable(cas CasTable, maxBytes, maxEntrySize int64) CasTable {
+	return forwardOptional(makeLRUCasTable(cas, maxBytes, maxEntrySize), cas)
+}
+
+func makeLRUCasTable(cas CasTable, maxBytes, maxEntrySize int64) *lruCasTable {
+	if maxEntrySize > maxBytes {
+		maxEntrySize = maxBytes
+	}
+	return &lruCasTable{
+		CasTable:     cas,
+		maxBytes:     maxBytes,
+		maxEntrySize: maxEntrySize,
+		order:        list.New(),
+		entries:      map[string]*list.Element{},
+	}
+}
+
+// get returns the cached content of hash, if any.
+func (l *lruCasTable) get(hash string) ([]byte, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	e, ok := l.entries[hash]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(e)
+	return e.Value.(*lruEntry).data, true
+}
+
+// put caches data, evicting the least recently used entries as needed.
+func (l *lruCasTable) put(hash string, data []byte) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, ok := l.entries[hash]; ok {
+		return
+	}
+	l.entries[hash] = l.order.PushFront(&lruEntry{hash, data})
+	l.size += int64(len(data))
+	for l.size > l.maxBytes {
+		l.evict(l.order.Back())
+	}
+}
+
+func (l *lruCasTable) evict(e *list.Element) {
+	entry := l.order.Remove(e).(*lruEntry)
+	delete(l.entries, entry.hash)
+	l.size -= int64(len(entry.data))
+}
+
+// load opens hash and caches it if it is small enough. Returns the content
+// when it was cached, otherwise the opened entry.
+func (l *lruCasTable) load(hash string) ([]byte, ReadSeekCloser, error) {
+	if data, ok := l.get(hash); ok {
+		return data, nil, nil
+	}
+	f, err := l.CasTable.Open(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	if size > l.maxEntrySize {
+		return nil, f, nil
+	}
+	data, err := ioutil.ReadAll(f)
+	_ = f.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	l.put(hash, data)
+	return data, nil, nil
+}
+
+func (l *lruCasTable) Open(hash string) (ReadSeekCloser, error) {
+	data, f, err := l.load(hash)
+	if data == nil {
+		return f, err
+	}
+	return closableBuffer{bytes.NewReader(data)}, nil
+}
+
+// ServeHTTP serves the cached entries from memory and the others with the
+// underlying table.
+func (l *lruCasTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "" || r.URL.Path[0] != '/' || !isValidCasURL(r.URL.Path) {
+		l.CasTable.ServeHTTP(w, r)
+		return
+	}
+	hash := r.URL.Path[1:]
+	data, f, err := l.load(hash)
+	if f != nil {
+		_ = f.Close()
+	}
+	if err != nil || data == nil {
+		// Let the table report the error or serve the large entry.
+		l.CasTable.ServeHTTP(w, r)
+		return
+	}
+	http.ServeContent(w, r, entryHeaders(w, r, hash), time.Time{}, bytes.NewReader(data))
+}
+
+func (l *lruCasTable) Remove(hash string) error {
+	l.lock.Lock()
+	if e, ok := l.entries[hash]; ok {
+		l.evict(e)
+	}
+	l.lock.Unlock()
+	return l.CasTable.Remove(hash)
+}
@@ -0,0 +1,74 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestLRUCasTable(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	lru := makeLRUCasTable(cas, 16, 8)
+	testCasTableImpl(t, lru)
+
+	hash1, err := AddBytes(cas, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	hash2, err := AddBytes(cas, []byte("content2"))
+	ut.AssertEqual(t, nil, err)
+	hash3, err := AddBytes(cas, []byte("content3"))
+	ut.AssertEqual(t, nil, err)
+	large, err := AddBytes(cas, []byte("large content"))
+	ut.AssertEqual(t, nil, err)
+
+	// The cached entries are served even once they are gone from the table.
+	ut.AssertEqual(t, "content1", readEntry(t, lru, hash1))
+	ut.AssertEqual(t, "content2", readEntry(t, lru, hash2))
+	ut.AssertEqual(t, "large content", readEntry(t, lru, large))
+	delete(cas.(*memoryCasTable).entries, hash1)
+	delete(cas.(*memoryCasTable).entries, large)
+	ut.AssertEqual(t, "content1", readEntry(t, lru, hash1))
+	_, err = lru.Open(large)
+	ut.AssertEqual(t, os.ErrNotExist, err)
+
+	// hash2 is the least recently used.
+	ut.AssertEqual(t, "content3", readEntry(t, lru, hash3))
+	delete(cas.(*memoryCasTable).entries, hash2)
+	_, err = lru.Open(hash2)
+	ut.AssertEqual(t, os.ErrNotExist, err)
+	ut.AssertEqual(t, int64(16), lru.size)
+
+	// Served from memory.
+	w := httptest.NewRecorder()
+	lru.ServeHTTP(w, httptest.NewRequest("GET", "/"+hash1+"?name=a.txt", nil))
+	ut.AssertEqual(t, 200, w.Code)
+	ut.AssertEqual(t, "content1", w.Body.String())
+	ut.AssertEqual(t, `inline; filename=a.txt`, w.Header().Get("Content-Disposition"))
+	w = httptest.NewRecorder()
+	lru.ServeHTTP(w, httptest.NewRequest("GET", "/"+hash2, nil))
+	ut.AssertEqual(t, 404, w.Code)
+
+	// Removing an entry forgets it.
+	cas.(*memoryCasTable).entries[hash3] = []byte("content3")
+	ut.AssertEqual(t, nil, lru.Remove(hash3))
+	_, err = lru.Open(hash3)
+	ut.AssertEqual(t, os.ErrNotExist, err)
+	ut.AssertEqual(t, int64(8), lru.size)
+}
+
+func TestLRUCasTableServeRange(t *testing.T) {
+	t.Parallel()
+	// The entry is served from memory after the first request.
+	testServeRangeImpl(t, MakeLRUCasTable(MakeMemoryCasTable(), 1024, 1024))
+}
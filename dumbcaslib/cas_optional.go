@@ -0,0 +1,86 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+// The wrappers like MakeReadOnlyCasTable() embed the CasTable they wrap, which
+// hides the optional interfaces it implements from the type assertions of the
+// callers. forwardOptional() adds them back.
+
+type casTrash struct {
+	CasTable
+	TrashTable
+}
+
+type casCorrupt struct {
+	CasTable
+	Corruptable
+}
+
+type casPack struct {
+	CasTable
+	PackTable
+}
+
+type casTrashCorrupt struct {
+	CasTable
+	TrashTable
+	Corruptable
+}
+
+type casTrashPack struct {
+	CasTable
+	TrashTable
+	PackTable
+}
+
+type casCorruptPack struct {
+	CasTable
+	Corruptable
+	PackTable
+}
+
+type casTrashCorruptPack struct {
+	CasTable
+	TrashTable
+	Corruptable
+	PackTable
+}
+
+// forwardOptional returns wrapper, which wraps cas, also implementing the
+// optional interfaces TrashTable, Corruptable and PackTable that cas
+// implements.
+func forwardOptional(wrapper, cas CasTable) CasTable {
+	trash, _ := cas.(TrashTable)
+	corrupt, _ := cas.(Corruptable)
+	pack, _ := cas.(PackTable)
+	return withOptional(wrapper, trash, corrupt, pack)
+}
+
+// withOptional returns wrapper also implementing the optional interfaces that
+// are not nil.
+func withOptional(wrapper CasTable, trash TrashTable, corrupt Corruptable, pack PackTable) CasTable {
+	switch {
+	case trash != nil && corrupt != nil && pack != nil:
+		return &casTrashCorruptPack{wrapper, trash, corrupt, pack}
+	case trash != nil && corrupt != nil:
+		return &casTrashCorrupt{wrapper, trash, corrupt}
+	case trash != nil && pack != nil:
+		return &casTrashPack{wrapper, trash, pack}
+	case corrupt != nil && pack != nil:
+		return &casCorruptPack{wrapper, corrupt, pack}
+	case trash != nil:
+		return &casTrash{wrapper, trash}
+	case corrupt != nil:
+		return &casCorrupt{wrapper, corrupt}
+	case pack != nil:
+		return &casPack{wrapper, pack}
+	}
+	return wrapper
+}
@@ -0,0 +1,556 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The entries of a local table smaller than CasOptions.PackThreshold are
+// appended to pack files instead of being stored as their own file, which
+// would waste a block and an inode each. The packs are in the packsName
+// directory of the table:
+//   - <id>.pack is the blobs, as they would be stored as a file, concatenated.
+//   - <id>.idx has a line "<hash> <offset> <length>" per blob of <id>.pack.
+//   - removed has a line "<hash>" per packed entry removed from the table.
+//
+// Each process appends to its own pack named after a random id so tables
+// written concurrently or merged with rsync don't conflict; Repack() merges
+// the small packs left by each run. The index is only appended to so an
+// interrupted write leaves at most a truncated last line, which is ignored.
+const packsName = "packs"
+
+// removedName is the file listing the packed entries removed from the table.
+const removedName = "removed"
+
+// maxPackSize is the size at which a new pack file is started.
+const maxPackSize = 64 * 1024 * 1024
+
+// smallPackSize is the size under which Repack() merges the packs.
+const smallPackSize = maxPackSize / 2
+
+// packRefreshInterval is how often a lookup of an entry not packed looks for
+// the entries packed by the other processes since.
+const packRefreshInterval = time.Second
+
+// PackTable is implemented by the tables storing small entries in pack files.
+type PackTable interface {
+	// Repack rewrites the pack files holding removed entries to reclaim their
+	// space and merges the small ones. It must not run while another process
+	// adds entries to the table. Returns the number of pack files rewritten and
+	// the bytes reclaimed.
+	Repack() (int, int64, error)
+}
+
+// packLocation is where a blob is stored in the pack files.
+type packLocation struct {
+	pack   string
+	offset int64
+	length int64
+}
+
+// packWriter is the pack file being appended to by this process.
+type packWriter struct {
+	name string
+	pack *os.File
+	idx  *os.File
+	size int64
+}
+
+func (w *packWriter) close() {
+	_ = w.pack.Close()
+	_ = w.idx.Close()
+}
+
+// packs is the set of pack files of a table. The index is loaded on first use
+// then what the other processes append to it is loaded on a miss, at most
+// every packRefreshInterval. It is loaded again when a pack is gone, rewritten
+// by a repack.
+type packs struct {
+	dir    string
+	lock   sync.Mutex
+	loaded bool
+	// read is the bytes of each index and of the removed file loaded so far.
+	read map[string]int64
+	// refreshed is when the files were last looked at.
+	refreshed time.Time
+	entries   map[string]packLocation
+	removed   map[string]bool
+	// dead is the bytes of the removed and duplicate entries in each pack.
+	dead    map[string]int64
+	current *packWriter
+}
+
+func makePacks(casDir string) *packs {
+	return &packs{dir: filepath.Join(casDir, packsName)}
+}
+
+// load reads the indexes and the removed entries on first use. Must be called
+// with the lock held.
+func (p *packs) load() error {
+	if p.loaded {
+		return nil
+	}
+	return p.refresh()
+}
+
+// refresh loads what was appended to the indexes and to the removed file
+// since the last load, or everything again if one of them is gone. Must be
+// called with the lock held.
+func (p *packs) refresh() error {
+	p.refreshed = time.Now()
+	names, err := readDirNames(p.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sizes := map[string]int64{}
+	for _, name := range names {
+		if name != removedName && !strings.HasSuffix(name, ".idx") {
+			continue
+		}
+		if stat, err := os.Stat(filepath.Join(p.dir, name)); err == nil {
+			sizes[name] = stat.Size()
+		}
+	}
+	reset := !p.loaded
+	for name, n := range p.read {
+		if size, ok := sizes[name]; !ok || size < n {
+			reset = true
+		}
+	}
+	if reset {
+		p.read = map[string]int64{}
+		p.entries = map[string]packLocation{}
+		p.removed = map[string]bool{}
+		p.dead = map[string]int64{}
+	}
+	if _, ok := sizes[removedName]; ok {
+		if err := p.readTail(removedName, func(fields []string) {
+			if len(fields) != 1 {
+				return
+			}
+			p.removed[fields[0]] = true
+			if loc, ok := p.entries[fields[0]]; ok {
+				delete(p.entries, fields[0])
+				p.dead[loc.pack] += loc.length
+			}
+		}); err != nil {
+			return err
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := sizes[name]; !ok || name == removedName {
+			continue
+		}
+		pack := strings.TrimSuffix(name, ".idx")
+		err := p.readTail(name, func(fields []string) {
+			if len(fields) != 3 {
+				return
+			}
+			offset, err1 := strconv.ParseInt(fields[1], 10, 64)
+			length, err2 := strconv.ParseInt(fields[2], 10, 64)
+			if err1 != nil || err2 != nil {
+				return
+			}
+			if _, ok := p.entries[fields[0]]; ok || p.removed[fields[0]] {
+				p.dead[pack] += length
+				return
+			}
+			p.entries[fields[0]] = packLocation{pack, offset, length}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	p.loaded = true
+	return nil
+}
+
+// readTail calls fn with the fields of each complete line appended to the
+// file name of the pack directory since the last call. Must be called with the
+// lock held.
+func (p *packs) readTail(name string, fn func(fields []string)) error {
+	n, err := readPackLines(filepath.Join(p.dir, name), p.read[name], fn)
+	if os.IsNotExist(err) {
+		// Removed by a repack since it was listed.
+		return nil
+	}
+	p.read[name] = n
+	return err
+}
+
+// readPackLines calls fn with the fields of each complete line of the file
+// after offset. Returns the offset after the last complete line.
+func readPackLines(filePath string, offset int64, fn func(fields []string)) (int64, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return offset, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			// A truncated last line is an interrupted write, or a write in
+			// progress.
+			return offset, nil
+		} else if err != nil {
+			return offset, err
+		}
+		offset += int64(len(line))
+		fn(strings.Fields(line))
+	}
+}
+
+// get returns where hash is packed.
+func (p *packs) get(hash string) (packLocation, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.load() != nil {
+		return packLocation{}, false
+	}
+	loc, ok := p.entries[hash]
+	if !ok && time.Since(p.refreshed) >= packRefreshInterval && p.refresh() == nil {
+		// It may have been packed by another process since.
+		loc, ok = p.entries[hash]
+	}
+	return loc, ok
+}
+
+// reload returns where hash is packed after loading the indexes again, once
+// the pack returned by get() is gone.
+func (p *packs) reload(hash string) (packLocation, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.loaded = false
+	if p.load() != nil {
+		return packLocation{}, false
+	}
+	loc, ok := p.entries[hash]
+	return loc, ok
+}
+
+// wasRemoved returns true if hash was packed then removed. It can't be packed
+// again until the table is repacked since the removal would hide it.
+func (p *packs) wasRemoved(hash string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.load() == nil && p.removed[hash]
+}
+
+// snapshot returns the packed entries.
+func (p *packs) snapshot() map[string]packLocation {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	out := map[string]packLocation{}
+	if p.load() == nil {
+		for k, v := range p.entries {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// add appends the encoded blob of hash to the current pack. Returns
+// os.ErrExist if it was already packed.
+func (p *packs) add(hash string, blob []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.load(); err != nil {
+		return err
+	}
+	if _, ok := p.entries[hash]; ok {
+		return os.ErrExist
+	}
+	return p.appendLocked(hash, blob)
+}
+
+// appendLocked appends blob to the current pack, starting a new one as
+// needed. Must be called with the lock held.
+func (p *packs) appendLocked(hash string, blob []byte) error {
+	if p.current != nil {
+		if _, err := os.Stat(filepath.Join(p.dir, p.current.name+".idx")); err != nil {
+			// Merged by a repack of another process.
+			p.current.close()
+			p.current = nil
+		}
+	}
+	if p.current != nil && p.current.size+int64(len(blob)) > maxPackSize {
+		p.current.close()
+		p.current = nil
+	}
+	if p.current == nil {
+		w, err := p.create()
+		if err != nil {
+			return err
+		}
+		p.current = w
+	}
+	w := p.current
+	// A partial blob is overwritten by the next one.
+	if _, err := w.pack.WriteAt(blob, w.size); err != nil {
+		return fmt.Errorf("Failed to write to pack %s: %s", w.name, err)
+	}
+	line := fmt.Sprintf("%s %d %d\n", hash, w.size, len(blob))
+	if _, err := io.WriteString(w.idx, line); err != nil {
+		// The index may end with a partial line; don't append after it.
+		w.close()
+		p.current = nil
+		return fmt.Errorf("Failed to write to the index of pack %s: %s", w.name, err)
+	}
+	// This process is the only one appending to it.
+	p.read[w.name+".idx"] += int64(len(line))
+	p.entries[hash] = packLocation{w.name, w.size, int64(len(blob))}
+	w.size += int64(len(blob))
+	return nil
+}
+
+// create starts a new pack file with a random name.
+func (p *packs) create() (*packWriter, error) {
+	if err := os.MkdirAll(p.dir, 0750); err != nil {
+		return nil, fmt.Errorf("Failed to create %s: %s", p.dir, err)
+	}
+	id := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return nil, err
+	}
+	name := hex.EncodeToString(id)
+	pack, err := os.OpenFile(filepath.Join(p.dir, name+".pack"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create pack %s: %s", name, err)
+	}
+	idx, err := os.OpenFile(filepath.Join(p.dir, name+".idx"), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0640)
+	if err != nil {
+		_ = pack.Close()
+		return nil, fmt.Errorf("Failed to create pack %s: %s", name, err)
+	}
+	return &packWriter{name: name, pack: pack, idx: idx}, nil
+}
+
+// open returns the encoded blob of a packed entry, its size and the
+// modification time of its pack.
+func (p *packs) open(loc packLocation) (ReadSeekCloser, int64, time.Time, error) {
+	f, err := os.Open(filepath.Join(p.dir, loc.pack+".pack"))
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, time.Time{}, err
+	}
+	return &packReader{io.NewSectionReader(f, loc.offset, loc.length), f}, loc.length, stat.ModTime(), nil
+}
+
+// extract copies the encoded blob of a packed entry to dst, as if it had been
+// stored as a file.
+func (p *packs) extract(loc packLocation, dst string) error {
+	src, _, _, err := p.open(loc)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+	df, err := ioutil.TempFile(filepath.Dir(dst), tempPrefix)
+	if err != nil {
+		return err
+	}
+	tmp := df.Name()
+	renamed := false
+	defer func() {
+		if !renamed {
+			_ = df.Close()
+			_ = os.Remove(tmp)
+		}
+	}()
+	_, err = io.Copy(df, src)
+	if err2 := df.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, 0640); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	renamed = true
+	return nil
+}
+
+// remove records that a packed entry was removed from the table.
+func (p *packs) remove(hash string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.load(); err != nil {
+		return err
+	}
+	loc, ok := p.entries[hash]
+	if !ok {
+		return os.ErrNotExist
+	}
+	f, err := os.OpenFile(filepath.Join(p.dir, removedName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s\n", hash)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to remove packed %s: %s", hash, err)
+	}
+	delete(p.entries, hash)
+	p.removed[hash] = true
+	p.dead[loc.pack] += loc.length
+	return nil
+}
+
+// repack copies the live entries of the packs with dead entries, and of the
+// small packs when there are more than one, to new packs then deletes them.
+func (p *packs) repack() (int, int64, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.loaded = false
+	if err := p.load(); err != nil {
+		return 0, 0, err
+	}
+	if p.current != nil {
+		// It may be rewritten too.
+		p.current.close()
+		p.current = nil
+	}
+	sizes := map[string]int64{}
+	for _, loc := range p.entries {
+		sizes[loc.pack] += loc.length
+	}
+	for pack, dead := range p.dead {
+		sizes[pack] += dead
+	}
+	var small []string
+	for pack, size := range sizes {
+		if size < smallPackSize {
+			small = append(small, pack)
+		}
+	}
+	isDirty := map[string]bool{}
+	for pack := range p.dead {
+		isDirty[pack] = true
+	}
+	if len(small) > 1 {
+		for _, pack := range small {
+			isDirty[pack] = true
+		}
+	}
+	live := map[string][]string{}
+	for hash, loc := range p.entries {
+		if isDirty[loc.pack] {
+			live[loc.pack] = append(live[loc.pack], hash)
+		}
+	}
+	dirty := make([]string, 0, len(isDirty))
+	for pack := range isDirty {
+		dirty = append(dirty, pack)
+	}
+	sort.Strings(dirty)
+	count := 0
+	var reclaimed int64
+	for _, pack := range dirty {
+		hashes := live[pack]
+		sort.Slice(hashes, func(i, j int) bool {
+			return p.entries[hashes[i]].offset < p.entries[hashes[j]].offset
+		})
+		for _, hash := range hashes {
+			loc := p.entries[hash]
+			src, _, _, err := p.open(loc)
+			if err != nil {
+				return count, reclaimed, err
+			}
+			blob, err := ioutil.ReadAll(src)
+			_ = src.Close()
+			if err != nil {
+				return count, reclaimed, fmt.Errorf("Failed to read packed %s: %s", hash, err)
+			}
+			if err := p.appendLocked(hash, blob); err != nil {
+				return count, reclaimed, err
+			}
+		}
+		// The index goes first; a pack without index is unused.
+		if err := os.Remove(filepath.Join(p.dir, pack+".idx")); err != nil {
+			return count, reclaimed, err
+		}
+		if err := os.Remove(filepath.Join(p.dir, pack+".pack")); err != nil {
+			return count, reclaimed, err
+		}
+		delete(p.read, pack+".idx")
+		count++
+		reclaimed += p.dead[pack]
+		delete(p.dead, pack)
+	}
+	if p.current != nil {
+		p.current.close()
+		p.current = nil
+	}
+	// None of the removed entries is in a pack anymore.
+	if err := os.Remove(filepath.Join(p.dir, removedName)); err != nil && !os.IsNotExist(err) {
+		return count, reclaimed, err
+	}
+	delete(p.read, removedName)
+	p.removed = map[string]bool{}
+	return count, reclaimed, nil
+}
+
+// packReader is a blob in a pack file.
+type packReader struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (p *packReader) Close() error {
+	return p.f.Close()
+}
+
+// memBlob is an in-memory blob, for the entries to pack.
+type memBlob struct {
+	buf []byte
+}
+
+func (m *memBlob) Write(p []byte) (int, error) {
+	m.buf = append(m.buf, p...)
+	return len(p), nil
+}
+
+func (m *memBlob) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(m.buf)) {
+		return 0, fmt.Errorf("invalid offset %d", off)
+	}
+	return copy(m.buf[off:], p), nil
+}
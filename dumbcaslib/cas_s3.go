@@ -0,0 +1,711 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3CasTable stores each entry as an object keyed "<path>/cas/<prefix>/<rest>".
+//
+// The credentials are read from $AWS_ACCESS_KEY_ID, $AWS_SECRET_ACCESS_KEY and
+// $AWS_SESSION_TOKEN, the region from $AWS_REGION. $AWS_ENDPOINT_URL can be
+// used to point to an S3 compatible service.
+type s3CasTable struct {
+	client       *s3Client
+	prefix       string
+	prefixLength int
+	hashLength   int
+	validPath    *regexp.Regexp
+	newHash      func() hash.Hash
+	verifyWrites bool
+	codec        byte
+	level        int
+	jobs         int
+	// aead is nil if the table is not encrypted or the passphrase is missing.
+	aead      cipher.AEAD
+	encrypted bool
+}
+
+// MakeS3CasTable returns a CasTable stored in an S3 bucket. root is in the
+// form "s3://bucket/path".
+func MakeS3CasTable(root string, opts CasOptions) (CasTable, error) {
+	if err := opts.check(); err != nil {
+		return nil, fmt.Errorf("MakeCasTable(%s): %s", root, err)
+	}
+	u, err := url.Parse(root)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("MakeCasTable(%s) is not valid", root)
+	}
+	client, err := makeS3Client(u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("MakeCasTable(%s): %s", root, err)
+	}
+	prefix := casName + "/"
+	if p := strings.Trim(u.Path, "/"); p != "" {
+		prefix = p + "/" + prefix
+	}
+	return makeS3CasTable(client, prefix, opts)
+}
+
+func makeS3CasTable(client *s3Client, prefix string, opts CasOptions) (CasTable, error) {
+	metadata := &casMetadata{}
+	resp, err := client.do("GET", prefix+metadataName, nil, nil, nil, 0)
+	if os.IsNotExist(err) {
+		if metadata, err = newCasMetadata(opts); err != nil {
+			return nil, fmt.Errorf("MakeCasTable(%s): %s", client.describe(prefix), err)
+		}
+		data, err := json.Marshal(metadata)
+		if err != nil {
+			return nil, err
+		}
+		if err := client.put(prefix+metadataName, bytes.NewReader(data), int64(len(data))); err != nil {
+			return nil, fmt.Errorf("MakeCasTable(%s): failed to write metadata: %s", client.describe(prefix), err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("MakeCasTable(%s): failed to read metadata: %s", client.describe(prefix), err)
+	} else {
+		err = LoadReaderAsJSON(resp.Body, metadata)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("MakeCasTable(%s): failed to read metadata: %s", client.describe(prefix), err)
+		}
+		if err := metadata.check(opts); err != nil {
+			return nil, fmt.Errorf("MakeCasTable(%s): %s", client.describe(prefix), err)
+		}
+	}
+	aead, err := metadata.cipher(opts)
+	if err != nil {
+		return nil, fmt.Errorf("MakeCasTable(%s): %s", client.describe(prefix), err)
+	}
+	newHash := hashAlgorithms[metadata.Hash]
+	hashLength := newHash().Size() * 2
+	return &s3CasTable{
+		client:       client,
+		prefix:       prefix,
+		prefixLength: metadata.PrefixLength,
+		hashLength:   hashLength,
+		validPath:    regexp.MustCompile(fmt.Sprintf("^([a-f0-9]{%d})$", hashLength)),
+		newHash:      newHash,
+		verifyWrites: opts.VerifyWrites,
+		codec:        opts.codec(),
+		level:        opts.CompressionLevel,
+		jobs:         opts.jobs(),
+		aead:         aead,
+		encrypted:    metadata.Encryption != nil,
+	}, nil
+}
+
+// key converts an entry in the table into an object key.
+func (s *s3CasTable) key(hash string) string {
+	if !s.validPath.MatchString(hash) {
+		return ""
+	}
+	return s.prefix + hash[:s.prefixLength] + "/" + hash[s.prefixLength:]
+}
+
+func (s *s3CasTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "" || r.URL.Path[0] != '/' {
+		http.Error(w, "Internal failure. CasTable received an invalid url: "+r.URL.Path, http.StatusNotImplemented)
+		return
+	}
+	if !isValidCasURL(r.URL.Path) {
+		http.Error(w, "Invalid CAS url: "+r.URL.Path, http.StatusBadRequest)
+		return
+	}
+	f, err := s.Open(r.URL.Path[1:])
+	if err == os.ErrInvalid {
+		http.Error(w, "Invalid CAS url: "+r.URL.Path, http.StatusBadRequest)
+		return
+	}
+	if err == ErrEncrypted {
+		// Never serve the encrypted content as-is.
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	http.ServeContent(w, r, entryHeaders(w, r, r.URL.Path[1:]), time.Time{}, f)
+}
+
+// Enumerate lists the prefix "directories" first then lists their content
+// concurrently.
+func (s *s3CasTable) Enumerate() <-chan EnumerationEntry {
+	return s.EnumerateCtx(context.Background())
+}
+
+func (s *s3CasTable) EnumerateCtx(ctx context.Context) <-chan EnumerationEntry {
+	rePrefix := regexp.MustCompile(fmt.Sprintf("^[a-f0-9]{%d}$", s.prefixLength))
+	reRest := regexp.MustCompile(fmt.Sprintf("^[a-f0-9]{%d}$", s.hashLength-s.prefixLength))
+	items := make(chan EnumerationEntry)
+	go func() {
+		defer close(items)
+		prefixes := []string{}
+		err := s.client.listAll(ctx, s.prefix, "/", func(objects []s3Object, dirs []string) {
+			for _, obj := range objects {
+				rel := obj.Key[len(s.prefix):]
+				if rel != needFsckName && rel != metadataName {
+					_ = s.moveToTrash(rel)
+					s.SetFsckBit()
+				}
+			}
+			for _, dir := range dirs {
+				rel := strings.TrimSuffix(dir[len(s.prefix):], "/")
+				if rel != trashName {
+					prefixes = append(prefixes, rel)
+				}
+			}
+		})
+		if err != nil {
+			sendEntry(ctx, items, EnumerationEntry{Error: fmt.Errorf("Failed listing %s: %s", s.client.describe(s.prefix), err)})
+			return
+		}
+		forEachPrefix(ctx, prefixes, s.jobs, func(prefix string) {
+			dir := s.prefix + prefix + "/"
+			err := s.client.listAll(ctx, dir, "", func(objects []s3Object, dirs []string) {
+				for _, obj := range objects {
+					rest := obj.Key[len(dir):]
+					if !rePrefix.MatchString(prefix) || !reRest.MatchString(rest) {
+						_ = s.moveToTrash(prefix + "/" + rest)
+						s.SetFsckBit()
+						continue
+					}
+					if !sendEntry(ctx, items, EnumerationEntry{Item: prefix + rest, Size: obj.Size}) {
+						return
+					}
+				}
+			})
+			if err != nil {
+				s.SetFsckBit()
+				sendEntry(ctx, items, EnumerationEntry{Error: fmt.Errorf("Failed listing %s: %s", s.client.describe(dir), err)})
+			}
+		})
+	}()
+	return items
+}
+
+// AddEntry stages the content in a temporary file since S3 needs to know the
+// size of an object before it is uploaded.
+func (s *s3CasTable) AddEntry(source io.Reader, hash string) error {
+	key := s.key(hash)
+	if key == "" {
+		return fmt.Errorf("AddEntry(%s) is invalid", hash)
+	}
+	if _, err := s.client.head(key); err == nil {
+		return os.ErrExist
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if s.encrypted && s.aead == nil {
+		return ErrEncrypted
+	}
+	tmp, err := ioutil.TempFile("", "dumbcas_s3")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	h := s.newHash()
+	if s.verifyWrites {
+		source = io.TeeReader(source, h)
+	}
+	if _, err := writeBlob(tmp, source, s.codec, s.level, s.aead); err != nil {
+		return err
+	}
+	if s.verifyWrites {
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != hash {
+			return fmt.Errorf("Failed to add %s: content hash is %s", hash, actual)
+		}
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return s.client.put(key, tmp, size)
+}
+
+func (s *s3CasTable) Exists(hash string) bool {
+	key := s.key(hash)
+	if key == "" {
+		return false
+	}
+	_, err := s.client.head(key)
+	return err == nil
+}
+
+// ExistsMany sends the HEAD requests from up to jobs goroutines, since S3 has
+// no bulk equivalent.
+func (s *s3CasTable) ExistsMany(hashes []string) map[string]bool {
+	var lock sync.Mutex
+	out := map[string]bool{}
+	forEachPrefix(context.Background(), hashes, s.jobs, func(hash string) {
+		if s.Exists(hash) {
+			lock.Lock()
+			out[hash] = true
+			lock.Unlock()
+		}
+	})
+	return out
+}
+
+func (s *s3CasTable) Open(hash string) (ReadSeekCloser, error) {
+	key := s.key(hash)
+	if key == "" {
+		return nil, os.ErrInvalid
+	}
+	size, err := s.client.head(key)
+	if err != nil {
+		return nil, err
+	}
+	return openBlob(&s3Reader{client: s.client, key: key, size: size}, s.aead)
+}
+
+func (s *s3CasTable) Remove(hash string) error {
+	if !s.validPath.MatchString(hash) {
+		return fmt.Errorf("Remove(%s) is invalid", hash)
+	}
+	return s.moveToTrash(hash[:s.prefixLength] + "/" + hash[s.prefixLength:])
+}
+
+// moveToTrash moves an object relative to the table into the trash. S3 has no
+// rename so it is a copy followed by a delete.
+func (s *s3CasTable) moveToTrash(rel string) error {
+	if err := s.client.copy(s.prefix+rel, s.prefix+trashName+"/"+rel); err != nil {
+		return err
+	}
+	return s.client.remove(s.prefix + rel)
+}
+
+func (s *s3CasTable) EnumerateTrash() <-chan EnumerationEntry {
+	items := make(chan EnumerationEntry)
+	go func() {
+		defer close(items)
+		dir := s.prefix + trashName + "/"
+		err := s.client.listAll(context.Background(), dir, "", func(objects []s3Object, dirs []string) {
+			for _, obj := range objects {
+				items <- EnumerationEntry{Item: obj.Key[len(dir):], Size: obj.Size}
+			}
+		})
+		if err != nil {
+			items <- EnumerationEntry{Error: fmt.Errorf("Failed listing %s: %s", s.client.describe(dir), err)}
+		}
+	}()
+	return items
+}
+
+// RestoreTrash verifies the content of an entry before copying it back into
+// the table.
+func (s *s3CasTable) RestoreTrash(item string) error {
+	hash, err := trashItemHash(item, s.prefixLength, s.validPath)
+	if err != nil {
+		return err
+	}
+	src := s.prefix + trashName + "/" + item
+	size, err := s.client.head(src)
+	if err != nil {
+		return err
+	}
+	if _, err := s.client.head(s.key(hash)); err == nil {
+		return os.ErrExist
+	}
+	blob, err := openBlob(&s3Reader{client: s.client, key: src, size: size}, s.aead)
+	if err != nil {
+		return err
+	}
+	if err := verifyEntry(blob, s.newHash(), hash); err != nil {
+		return err
+	}
+	if err := s.client.copy(src, s.key(hash)); err != nil {
+		return err
+	}
+	return s.client.remove(src)
+}
+
+func (s *s3CasTable) EmptyTrash() error {
+	dir := s.prefix + trashName + "/"
+	var out error
+	err := s.client.listAll(context.Background(), dir, "", func(objects []s3Object, dirs []string) {
+		for _, obj := range objects {
+			if err := s.client.remove(obj.Key); err != nil && out == nil {
+				out = err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return out
+}
+
+func (s *s3CasTable) SetFsckBit() {
+	_ = s.client.put(s.prefix+needFsckName, bytes.NewReader(nil), 0)
+}
+
+func (s *s3CasTable) GetFsckBit() bool {
+	_, err := s.client.head(s.prefix + needFsckName)
+	return err == nil
+}
+
+func (s *s3CasTable) ClearFsckBit() {
+	_ = s.client.remove(s.prefix + needFsckName)
+}
+
+func (s *s3CasTable) NewHash() hash.Hash {
+	return s.newHash()
+}
+
+// s3Reader reads an object with HTTP range requests so it can seek without
+// downloading the whole object.
+type s3Reader struct {
+	client *s3Client
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		h := http.Header{}
+		h.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+		resp, err := r.client.do("GET", r.key, nil, h, nil, 0)
+		if err != nil {
+			return 0, err
+		}
+		r.body = resp.Body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return r.offset, fmt.Errorf("negative position")
+	}
+	if offset != r.offset {
+		_ = r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// s3Client is a minimal S3 client signing its requests with AWS Signature
+// Version 4.
+type s3Client struct {
+	bucket       string
+	endpoint     *url.URL
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+func makeS3Client(bucket string) (*s3Client, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	// Use virtual-hosted style on AWS and path style on custom endpoints.
+	endpoint := fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, region)
+	if e := os.Getenv("AWS_ENDPOINT_URL"); e != "" {
+		endpoint = strings.TrimRight(e, "/") + "/" + bucket
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	c := &s3Client{
+		bucket:       bucket,
+		endpoint:     u,
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       http.DefaultClient,
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("$AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return c, nil
+}
+
+func (c *s3Client) describe(key string) string {
+	return "s3://" + c.bucket + "/" + key
+}
+
+// do sends a signed request. A 404 is returned as os.ErrNotExist and any other
+// non 2xx status as an error.
+func (c *s3Client) do(method, key string, query url.Values, header http.Header, body io.Reader, length int64) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = c.endpoint.Path + "/" + key
+	u.RawPath = c.endpoint.Path + "/" + awsURIEscape(key, false)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = length
+		if length == 0 {
+			// Otherwise net/http would use chunked encoding for an empty body.
+			req.Body = http.NoBody
+		}
+	}
+	c.sign(req, time.Now().UTC())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		_ = resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s %s", method, c.describe(key), resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+func (c *s3Client) head(key string) (int64, error) {
+	resp, err := c.do("HEAD", key, nil, nil, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+func (c *s3Client) put(key string, body io.Reader, length int64) error {
+	resp, err := c.do("PUT", key, nil, nil, body, length)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *s3Client) copy(src, dst string) error {
+	h := http.Header{}
+	h.Set("x-amz-copy-source", "/"+c.bucket+"/"+awsURIEscape(src, false))
+	resp, err := c.do("PUT", dst, nil, h, nil, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *s3Client) remove(key string) error {
+	resp, err := c.do("DELETE", key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+type s3Object struct {
+	Key  string
+	Size int64
+}
+
+type s3ListResult struct {
+	Contents       []s3Object
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list returns one page of keys starting with prefix, the common prefixes when
+// delimiter is set and the token to retrieve the next page, if any.
+func (c *s3Client) list(prefix, delimiter, token string) (*s3ListResult, error) {
+	q := url.Values{}
+	q.Set("list-type", "2")
+	q.Set("prefix", prefix)
+	if delimiter != "" {
+		q.Set("delimiter", delimiter)
+	}
+	if token != "" {
+		q.Set("continuation-token", token)
+	}
+	resp, err := c.do("GET", "", q, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	result := &s3ListResult{}
+	if err := xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// listAll calls fn with each page of objects and common prefixes until the
+// listing is complete, interrupted or ctx is done.
+func (c *s3Client) listAll(ctx context.Context, prefix, delimiter string, fn func(objects []s3Object, dirs []string)) error {
+	token := ""
+	for !IsInterrupted() && ctx.Err() == nil {
+		result, err := c.list(prefix, delimiter, token)
+		if err != nil {
+			return err
+		}
+		dirs := make([]string, 0, len(result.CommonPrefixes))
+		for _, c := range result.CommonPrefixes {
+			dirs = append(dirs, c.Prefix)
+		}
+		fn(result.Contents, dirs)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	return nil
+}
+
+// sign adds the AWS Signature Version 4 headers. The payload is not signed so
+// it can be streamed.
+func (c *s3Client) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", "UNSIGNED-PAYLOAD")
+	if c.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", c.sessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsURIEscape escapes everything but the unreserved characters, as required
+// by the signature. '/' is kept unless encodeSlash is set.
+func awsURIEscape(s string, encodeSlash bool) string {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			out = append(out, b)
+		} else {
+			out = append(out, fmt.Sprintf("%%%02X", b)...)
+		}
+	}
+	return string(out)
+}
+
+// canonicalQuery encodes the query sorted by key, as required by the
+// signature.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, awsURIEscape(k, true)+"="+awsURIEscape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
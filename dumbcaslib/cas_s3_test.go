@@ -0,0 +1,209 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maruel/ut"
+)
+
+// fakeS3 implements the subset of the S3 API used by s3CasTable, with path
+// style addressing. It lists at most 2 keys per page to exercise pagination.
+type fakeS3 struct {
+	lock    sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		http.Error(w, "unsigned", http.StatusForbidden)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	switch {
+	case r.Method == "GET" && r.URL.Query().Get("list-type") == "2":
+		prefix := r.URL.Query().Get("prefix")
+		delimiter := r.URL.Query().Get("delimiter")
+		seen := map[string]bool{}
+		keys := []string{}
+		for k := range f.objects {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			if delimiter != "" {
+				if i := strings.Index(k[len(prefix):], delimiter); i != -1 {
+					k = k[:len(prefix)+i+len(delimiter)]
+				}
+			}
+			if k > r.URL.Query().Get("continuation-token") && !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		result := s3ListResult{}
+		if len(keys) > 2 {
+			keys = keys[:2]
+			result.IsTruncated = true
+			result.NextContinuationToken = keys[1]
+		}
+		for _, k := range keys {
+			if strings.HasSuffix(k, "/") {
+				result.CommonPrefixes = append(result.CommonPrefixes, struct{ Prefix string }{k})
+			} else {
+				result.Contents = append(result.Contents, s3Object{k, int64(len(f.objects[k]))})
+			}
+		}
+		_ = xml.NewEncoder(w).Encode(result)
+	case r.Method == "GET" || r.Method == "HEAD":
+		data, ok := f.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	case r.Method == "PUT" && r.Header.Get("x-amz-copy-source") != "":
+		src, _ := url.PathUnescape(strings.TrimPrefix(r.Header.Get("x-amz-copy-source"), "/bucket/"))
+		data, ok := f.objects[src]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		f.objects[key] = data
+	case r.Method == "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = data
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusNotImplemented)
+	}
+}
+
+func makeFakeS3CasTable(t testing.TB, opts CasOptions) (CasTable, *fakeS3, func()) {
+	fake := &fakeS3{objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	u, _ := url.Parse(server.URL + "/bucket")
+	client := &s3Client{
+		bucket:    "bucket",
+		endpoint:  u,
+		region:    "us-east-1",
+		accessKey: "key",
+		secretKey: "secret",
+		client:    http.DefaultClient,
+	}
+	cas, err := makeS3CasTable(client, "backup/cas/", opts)
+	ut.AssertEqual(t, nil, err)
+	return cas, fake, server.Close
+}
+
+func TestS3CasTableServeRange(t *testing.T) {
+	t.Parallel()
+	cas, _, closer := makeFakeS3CasTable(t, CasOptions{Compress: true})
+	defer closer()
+	testServeRangeImpl(t, cas)
+}
+
+func TestS3CasTableOpenRange(t *testing.T) {
+	t.Parallel()
+	cas, _, closer := makeFakeS3CasTable(t, CasOptions{Compress: true})
+	defer closer()
+	testOpenRangeImpl(t, cas)
+}
+
+func TestS3CasTable(t *testing.T) {
+	t.Parallel()
+	cas, fake, closer := makeFakeS3CasTable(t, CasOptions{})
+	defer closer()
+	testCasTableImpl(t, cas)
+
+	// Enumerate goes through multiple pages.
+	expected := []string{}
+	for _, c := range []string{"a", "b", "c", "d", "e"} {
+		h, err := AddBytes(cas, []byte(c))
+		ut.AssertEqual(t, nil, err)
+		expected = append(expected, h)
+	}
+	sort.Strings(expected)
+	items, err := EnumerateCasAsList(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, items)
+	_, ok := fake.objects["backup/cas/"+expected[0][:3]+"/"+expected[0][3:]]
+	ut.AssertEqual(t, true, ok)
+
+	// Invalid objects are moved to the trash.
+	fake.objects["backup/cas/foo"] = []byte("bar")
+	fake.objects["backup/cas/foo2/bar"] = []byte("bar")
+	items, err = EnumerateCasAsList(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, items)
+	ut.AssertEqual(t, true, cas.GetFsckBit())
+	_, ok = fake.objects["backup/cas/trash/foo"]
+	ut.AssertEqual(t, true, ok)
+	_, ok = fake.objects["backup/cas/trash/foo2/bar"]
+	ut.AssertEqual(t, true, ok)
+}
+
+func TestS3CasTableEncrypted(t *testing.T) {
+	t.Parallel()
+	cas, fake, closer := makeFakeS3CasTable(t, CasOptions{Passphrase: "secret"})
+	defer closer()
+	testServeRangeImpl(t, cas)
+
+	hash, err := AddBytes(cas, []byte("secret content"))
+	ut.AssertEqual(t, nil, err)
+	raw := fake.objects["backup/cas/"+hash[:3]+"/"+hash[3:]]
+	ut.AssertEqual(t, false, bytes.Contains(raw, []byte("secret")))
+}
+
+func TestS3CasTableTrash(t *testing.T) {
+	t.Parallel()
+	cas, fake, closer := makeFakeS3CasTable(t, CasOptions{})
+	defer closer()
+	testTrashTableImpl(t, cas, func(item string) {
+		fake.objects["backup/cas/trash/"+item] = []byte("corrupted")
+	})
+}
+
+func TestS3CasTableSeek(t *testing.T) {
+	t.Parallel()
+	cas, _, closer := makeFakeS3CasTable(t, CasOptions{Compress: true})
+	defer closer()
+
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	hash, err := AddBytes(cas, content)
+	ut.AssertEqual(t, nil, err)
+	f, err := cas.Open(hash)
+	ut.AssertEqual(t, nil, err)
+	defer f.Close()
+	_, err = f.Seek(995, io.SeekStart)
+	ut.AssertEqual(t, nil, err)
+	data, err := ioutil.ReadAll(f)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "56789", string(data))
+
+	_, err = MakeS3CasTable("s3://", CasOptions{})
+	ut.AssertEqual(t, false, err == nil)
+}
@@ -10,9 +10,21 @@ limitations under the License. */
 package dumbcaslib
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
+	"log"
+	"net/http/httptest"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/maruel/ut"
 )
@@ -23,6 +35,309 @@ func TestFakeCasTable(t *testing.T) {
 	testCasTableImpl(t, cas)
 }
 
+func TestFakeCasTableErrors(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	hash := Sha1Bytes([]byte("content1"))
+	_, err := cas.Open(hash)
+	ut.AssertEqual(t, os.ErrNotExist, err)
+	_, err = cas.Open("foo")
+	ut.AssertEqual(t, os.ErrInvalid, err)
+	ut.AssertEqual(t, os.ErrInvalid, cas.AddEntry(bytes.NewBufferString("content1"), "foo"))
+	ut.AssertEqual(t, os.ErrInvalid, cas.Remove("foo"))
+	ut.AssertEqual(t, os.ErrNotExist, cas.Remove(hash))
+	// The names have the length of the table's hash.
+	ut.AssertEqual(t, cas.NewHash().Size()*2, len(hash))
+	ut.AssertEqual(t, os.ErrInvalid, cas.AddEntry(bytes.NewBufferString("content1"), hash+"00"))
+
+	// A failed read doesn't add the entry.
+	ut.AssertEqual(t, errors.New("read failure"), cas.AddEntry(&failingReader{[]byte("cont")}, hash))
+	_, err = cas.Open(hash)
+	ut.AssertEqual(t, os.ErrNotExist, err)
+}
+
+func TestFakeCasTableTrash(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	testTrashTableImpl(t, cas, func(item string) {
+		cas.(*memoryCasTable).trash[item] = []byte("corrupted")
+	})
+}
+
+func TestReadOnlyCasTable(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	hash, err := AddBytes(cas, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	r := MakeReadOnlyCasTable(cas)
+	items, err := EnumerateCasAsList(r)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{hash}, items)
+	f, err := r.Open(hash)
+	ut.AssertEqual(t, nil, err)
+	_ = f.Close()
+
+	_, err = AddBytes(r, []byte("content2"))
+	ut.AssertEqual(t, ErrReadOnly, err)
+	ut.AssertEqual(t, ErrReadOnly, r.Remove(hash))
+	r.SetFsckBit()
+	ut.AssertEqual(t, false, cas.GetFsckBit())
+	items, err = EnumerateCasAsList(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{hash}, items)
+}
+
+func TestCasTableWrappersForwardOptional(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "cas_wrappers")
+	defer removeDir(t, tempData)
+	local, err := MakeLocalCasTable(tempData, CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	wrappers := map[string]func(cas CasTable) CasTable{
+		"fallback":  func(cas CasTable) CasTable { return MakeFallbackCasTable(cas, MakeMemoryCasTable()) },
+		"lru":       func(cas CasTable) CasTable { return MakeLRUCasTable(cas, 1024, 1024) },
+		"read-only": MakeReadOnlyCasTable,
+		"retrying": func(cas CasTable) CasTable {
+			return MakeRetryingCasTable(cas, 1, time.Millisecond, log.New(ioutil.Discard, "", 0))
+		},
+		"throttled": func(cas CasTable) CasTable { return MakeThrottledCasTable(cas, 1024) },
+	}
+	for name, wrap := range wrappers {
+		_, ok := wrap(MakeMemoryCasTable()).(TrashTable)
+		ut.AssertEqualf(t, true, ok, "%s", name)
+		_, ok = wrap(MakeMemoryCasTable()).(PackTable)
+		ut.AssertEqualf(t, false, ok, "%s", name)
+		_, ok = wrap(local).(PackTable)
+		ut.AssertEqualf(t, true, ok, "%s", name)
+		// The wrappers stack.
+		_, ok = wrap(MakeThrottledCasTable(local, 1024)).(TrashTable)
+		ut.AssertEqualf(t, true, ok, "%s", name)
+		_, ok = wrap(MakeMemoryCasTable()).(Corruptable)
+		ut.AssertEqualf(t, name != "read-only", ok, "%s", name)
+	}
+
+	// The trash of a read-only table can't be modified.
+	hash, err := AddBytes(local, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, local.Remove(hash))
+	r := MakeReadOnlyCasTable(local)
+	items := []string{}
+	for item := range r.(TrashTable).EnumerateTrash() {
+		ut.AssertEqual(t, nil, item.Error)
+		items = append(items, item.Item)
+	}
+	ut.AssertEqual(t, 1, len(items))
+	ut.AssertEqual(t, ErrReadOnly, r.(TrashTable).RestoreTrash(items[0]))
+	ut.AssertEqual(t, ErrReadOnly, r.(TrashTable).EmptyTrash())
+	_, _, err = r.(PackTable).Repack()
+	ut.AssertEqual(t, ErrReadOnly, err)
+}
+
+// flakyCasTable fails the first AddEntry calls after consuming part of the
+// source.
+type flakyCasTable struct {
+	CasTable
+	failures int
+}
+
+func (f *flakyCasTable) AddEntry(source io.Reader, name string) error {
+	if f.failures != 0 {
+		f.failures--
+		_, _ = source.Read(make([]byte, 2))
+		return errors.New("Transient failure")
+	}
+	return f.CasTable.AddEntry(source, name)
+}
+
+func TestRetryingCasTable(t *testing.T) {
+	t.Parallel()
+	content := []byte("content1")
+	hash := HashBytes(sha1.New(), content)
+	buf := &bytes.Buffer{}
+	l := log.New(buf, "", 0)
+
+	cas := MakeMemoryCasTable()
+	r := MakeRetryingCasTable(&flakyCasTable{cas, 2}, 2, time.Millisecond, l)
+	ut.AssertEqual(t, nil, r.AddEntry(bytes.NewReader(content), hash))
+	ut.AssertEqual(t, 2, strings.Count(buf.String(), "retrying"))
+	// The delay doubles on each retry.
+	ut.AssertEqual(t, true, strings.Contains(buf.String(), "retrying in 1ms:"))
+	ut.AssertEqual(t, true, strings.Contains(buf.String(), "retrying in 2ms:"))
+	f, err := cas.Open(hash)
+	ut.AssertEqual(t, nil, err)
+	data, err := ioutil.ReadAll(f)
+	_ = f.Close()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, content, data)
+	ut.AssertEqual(t, os.ErrExist, r.AddEntry(bytes.NewReader(content), hash))
+
+	// Too many failures.
+	buf.Reset()
+	r = MakeRetryingCasTable(&flakyCasTable{MakeMemoryCasTable(), 3}, 2, time.Millisecond, l)
+	ut.AssertEqual(t, errors.New("Transient failure"), r.AddEntry(bytes.NewReader(content), hash))
+	ut.AssertEqual(t, 2, strings.Count(buf.String(), "retrying"))
+
+	// A source that can't be rewound isn't retried.
+	buf.Reset()
+	r = MakeRetryingCasTable(&flakyCasTable{MakeMemoryCasTable(), 1}, 2, time.Millisecond, l)
+	ut.AssertEqual(t, errors.New("Transient failure"), r.AddEntry(bytes.NewBuffer(content), hash))
+	ut.AssertEqual(t, "", buf.String())
+}
+
+func TestThrottledCasTable(t *testing.T) {
+	t.Parallel()
+	cas := MakeThrottledCasTable(MakeMemoryCasTable(), 200*1024)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := AddBytes(cas, bytes.Repeat([]byte{byte(i)}, 20*1024))
+			ut.AssertEqual(t, nil, err)
+		}(i)
+	}
+	wg.Wait()
+	// The limit applies to both writers; 40kb takes at least 200ms.
+	ut.AssertEqual(t, true, time.Since(start) >= 150*time.Millisecond)
+	items, err := EnumerateCasAsList(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(items))
+}
+
+func TestFakeCasTableServeRange(t *testing.T) {
+	t.Parallel()
+	testServeRangeImpl(t, MakeMemoryCasTable())
+}
+
+// testServeRangeImpl verifies that ServeHTTP honors Range and If-Range.
+func testServeRangeImpl(t testing.TB, cas CasTable) {
+	hash, err := AddBytes(cas, []byte("0123456789"))
+	ut.AssertEqual(t, nil, err)
+	etag := "\"" + hash + "\""
+
+	req := httptest.NewRequest("GET", "/"+hash, nil)
+	req.Header.Set("Range", "bytes=2-5")
+	resp := httptest.NewRecorder()
+	cas.ServeHTTP(resp, req)
+	ut.AssertEqual(t, 206, resp.Code)
+	ut.AssertEqual(t, "bytes 2-5/10", resp.Header().Get("Content-Range"))
+	ut.AssertEqual(t, "2345", resp.Body.String())
+	ut.AssertEqual(t, etag, resp.Header().Get("ETag"))
+
+	// Resuming a download of the same content.
+	req.Header.Set("If-Range", etag)
+	req.Header.Set("Range", "bytes=7-")
+	resp = httptest.NewRecorder()
+	cas.ServeHTTP(resp, req)
+	ut.AssertEqual(t, 206, resp.Code)
+	ut.AssertEqual(t, "789", resp.Body.String())
+
+	// The validator doesn't match so the whole content is returned.
+	req.Header.Set("If-Range", "\"other\"")
+	resp = httptest.NewRecorder()
+	cas.ServeHTTP(resp, req)
+	ut.AssertEqual(t, 200, resp.Code)
+	ut.AssertEqual(t, "0123456789", resp.Body.String())
+
+	resp = httptest.NewRecorder()
+	cas.ServeHTTP(resp, httptest.NewRequest("GET", "/"+Sha1Bytes([]byte("missing")), nil))
+	ut.AssertEqual(t, 404, resp.Code)
+}
+
+func TestFakeCasTableOpenRange(t *testing.T) {
+	t.Parallel()
+	testOpenRangeImpl(t, MakeMemoryCasTable())
+}
+
+// testOpenRangeImpl verifies that OpenRange reads the right bytes anywhere in
+// an entry, so that Seek works on the entries returned by Open().
+func testOpenRangeImpl(t testing.TB, cas CasTable) {
+	// Larger than the chunks of the compressed and encrypted entries.
+	content := make([]byte, 300000)
+	for i := range content {
+		content[i] = byte(i * 7 % 251)
+	}
+	hash, err := AddBytes(cas, content)
+	ut.AssertEqual(t, nil, err)
+
+	data := []struct {
+		offset, length int64
+		expected       []byte
+	}{
+		{0, 10, content[:10]},
+		{150001, 100, content[150001:150101]},
+		{299995, -1, content[299995:]},
+		{299995, 100, content[299995:]},
+		{300000, 10, []byte{}},
+	}
+	for i, line := range data {
+		r, err := OpenRange(cas, hash, line.offset, line.length)
+		ut.AssertEqualIndex(t, i, nil, err)
+		actual, err := ioutil.ReadAll(r)
+		ut.AssertEqualIndex(t, i, nil, err)
+		ut.AssertEqualIndex(t, i, line.expected, actual)
+		ut.AssertEqualIndex(t, i, nil, r.Close())
+	}
+
+	_, err = OpenRange(cas, hash, 300001, 1)
+	ut.AssertEqual(t, false, err == nil)
+	_, err = OpenRange(cas, hash, -1, 1)
+	ut.AssertEqual(t, false, err == nil)
+	_, err = OpenRange(cas, Sha1Bytes([]byte("missing")), 0, 1)
+	ut.AssertEqual(t, false, err == nil)
+}
+
+func enumerateTrashAsList(t testing.TB, cas CasTable) []string {
+	items := []string{}
+	for v := range cas.(TrashTable).EnumerateTrash() {
+		ut.AssertEqual(t, nil, v.Error)
+		items = append(items, v.Item)
+	}
+	sort.Strings(items)
+	return items
+}
+
+// testTrashTableImpl verifies the trash of a CasTable. corrupt must modify the
+// content of an item in the trash.
+func testTrashTableImpl(t testing.TB, cas CasTable, corrupt func(item string)) {
+	trash := cas.(TrashTable)
+	ut.AssertEqual(t, []string{}, enumerateTrashAsList(t, cas))
+	file1, err := AddBytes(cas, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	file2, err := AddBytes(cas, []byte("content2"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, cas.Remove(file1))
+	ut.AssertEqual(t, nil, cas.Remove(file2))
+	items := enumerateTrashAsList(t, cas)
+	ut.AssertEqual(t, 2, len(items))
+
+	// Restore one item, the other one is corrupted.
+	for _, item := range items {
+		if TrashItemHash(item) == file1 {
+			ut.AssertEqual(t, nil, trash.RestoreTrash(item))
+		} else {
+			corrupt(item)
+			ut.AssertEqual(t, false, trash.RestoreTrash(item) == nil)
+		}
+	}
+	ut.AssertEqual(t, false, trash.RestoreTrash("invalid") == nil)
+	entries, err := EnumerateCasAsList(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{file1}, entries)
+	f, err := cas.Open(file1)
+	ut.AssertEqual(t, nil, err)
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "content1", string(data))
+
+	ut.AssertEqual(t, 1, len(enumerateTrashAsList(t, cas)))
+	ut.AssertEqual(t, nil, trash.EmptyTrash())
+	ut.AssertEqual(t, []string{}, enumerateTrashAsList(t, cas))
+	ut.AssertEqual(t, nil, cas.Remove(file1))
+}
+
 func testCasTableImpl(t testing.TB, cas CasTable) {
 	items, err := EnumerateCasAsList(cas)
 	ut.AssertEqual(t, nil, err)
@@ -30,6 +345,12 @@ func testCasTableImpl(t testing.TB, cas CasTable) {
 
 	file1, err := AddBytes(cas, []byte("content1"))
 	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, cas.Exists(file1))
+	missing := HashBytes(cas.NewHash(), []byte("missing"))
+	ut.AssertEqual(t, false, cas.Exists(missing))
+	ut.AssertEqual(t, false, cas.Exists("0"))
+	ut.AssertEqual(t, map[string]bool{file1: true}, cas.ExistsMany([]string{file1, missing, "0"}))
+	ut.AssertEqual(t, map[string]bool{}, cas.ExistsMany(nil))
 
 	items, err = EnumerateCasAsList(cas)
 	ut.AssertEqual(t, nil, err)
@@ -57,6 +378,7 @@ func testCasTableImpl(t testing.TB, cas CasTable) {
 
 	err = cas.Remove(file1)
 	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, false, cas.Exists(file1))
 
 	err = cas.Remove(file1)
 	ut.AssertEqual(t, false, err == nil)
@@ -68,3 +390,138 @@ func testCasTableImpl(t testing.TB, cas CasTable) {
 	cas.ClearFsckBit()
 	ut.AssertEqual(t, false, cas.GetFsckBit())
 }
+
+func TestCasHandler(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	locker := MakeMemoryLocker()
+	h := MakeCasHandler(cas, locker)
+	hash := Sha1Bytes([]byte("content1"))
+	put := func(path, content string) int {
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, httptest.NewRequest("PUT", path, strings.NewReader(content)))
+		return resp.Code
+	}
+
+	// The table is modified under the shared lock, so not while gc runs.
+	lock, err := locker.Lock(true)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 503, put("/"+hash, "content1"))
+	ut.AssertEqual(t, nil, lock.Unlock())
+
+	ut.AssertEqual(t, 400, put("/"+hash, "content2"))
+	ut.AssertEqual(t, 201, put("/"+hash, "content1"))
+	ut.AssertEqual(t, 200, put("/"+hash, "content1"))
+	ut.AssertEqual(t, 413, put("/"+Sha1Bytes([]byte("large")), strings.Repeat("a", maxPutSize+1)))
+	ut.AssertEqual(t, 400, put("/foo", "content1"))
+	ut.AssertEqual(t, 400, put("/"+hash+"/", "content1"))
+	items, err := EnumerateCasAsList(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{hash}, items)
+
+	// GET is served by the table.
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest("GET", "/"+hash, nil))
+	ut.AssertEqual(t, 200, resp.Code)
+	ut.AssertEqual(t, "content1", resp.Body.String())
+
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest("GET", "/list", nil))
+	ut.AssertEqual(t, 200, resp.Code)
+	ut.AssertEqual(t, hash+"\n", resp.Body.String())
+
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest("GET", "/info", nil))
+	ut.AssertEqual(t, "{\"hash\":\"sha1\"}\n", resp.Body.String())
+
+	del := func(path string) int {
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, httptest.NewRequest("DELETE", path, nil))
+		return resp.Code
+	}
+	lock, err = locker.Lock(true)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 503, del("/"+hash))
+	ut.AssertEqual(t, nil, lock.Unlock())
+	ut.AssertEqual(t, 200, del("/"+hash))
+	ut.AssertEqual(t, 404, del("/"+hash))
+
+	h = MakeCasHandler(cas, nil)
+	ut.AssertEqual(t, 405, put("/"+hash, "content1"))
+	ut.AssertEqual(t, 405, del("/"+hash))
+
+	h = MakeCasHandler(MakeReadOnlyCasTable(MakeMemoryCasTable()), locker)
+	ut.AssertEqual(t, 403, put("/"+hash, "content1"))
+}
+
+func TestCasHandlerList(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	hashes := []string{}
+	for _, c := range []string{"content1", "content2", "content3", "content4"} {
+		hash, err := AddBytes(cas, []byte(c))
+		ut.AssertEqual(t, nil, err)
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	h := MakeCasHandler(cas, nil)
+	get := func(path string) (int, string) {
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, httptest.NewRequest("GET", path, nil))
+		return resp.Code, resp.Body.String()
+	}
+	lines := func(body string) []string {
+		l := strings.Split(strings.TrimSuffix(body, "\n"), "\n")
+		sort.Strings(l)
+		return l
+	}
+
+	code, body := get("/list")
+	ut.AssertEqual(t, 200, code)
+	ut.AssertEqual(t, hashes, lines(body))
+
+	// Paginate.
+	code, body = get("/list?limit=3")
+	ut.AssertEqual(t, 200, code)
+	ut.AssertEqual(t, strings.Join(hashes[:3], "\n")+"\n", body)
+	code, body = get("/list?limit=3&after=" + hashes[2])
+	ut.AssertEqual(t, 200, code)
+	ut.AssertEqual(t, hashes[3]+"\n", body)
+	code, body = get("/list?after=" + hashes[0])
+	ut.AssertEqual(t, 200, code)
+	ut.AssertEqual(t, hashes[1:], lines(body))
+
+	code, body = get("/list?format=json&limit=1")
+	ut.AssertEqual(t, 200, code)
+	var entries []listEntry
+	ut.AssertEqual(t, nil, json.Unmarshal([]byte(body), &entries))
+	ut.AssertEqual(t, []listEntry{{hashes[0], 8}}, entries)
+	code, body = get("/list?format=json&after=" + hashes[3])
+	ut.AssertEqual(t, 200, code)
+	ut.AssertEqual(t, "[\n]\n", body)
+
+	code, _ = get("/list?limit=0")
+	ut.AssertEqual(t, 400, code)
+	code, _ = get("/list?format=xml")
+	ut.AssertEqual(t, 400, code)
+
+	// A disconnected client stops the enumeration; otherwise it'd hang.
+	h = MakeCasHandler(&stuckCasTable{cas}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/list", nil).WithContext(ctx))
+}
+
+// stuckCasTable never completes the enumeration until ctx is done.
+type stuckCasTable struct {
+	CasTable
+}
+
+func (s *stuckCasTable) EnumerateCtx(ctx context.Context) <-chan EnumerationEntry {
+	c := make(chan EnumerationEntry)
+	go func() {
+		<-ctx.Done()
+		close(c)
+	}()
+	return c
+}
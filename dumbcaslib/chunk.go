@@ -0,0 +1,274 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The chunks are cut where the gear hash of the last bytes has its chunkBits
+// top bits cleared, so a boundary only depends on the content around it and
+// an insertion only changes the chunks around it. The sizes are bounded to
+// keep the number of chunks of a huge file reasonable.
+const (
+	chunkMinSize = 256 * 1024
+	chunkMaxSize = 4 * 1024 * 1024
+	// chunkBits makes the chunks 1MiB on average past chunkMinSize.
+	chunkBits = 20
+	chunkMask = (1<<chunkBits - 1) << (64 - chunkBits)
+)
+
+// gear are the random values of the bytes in the rolling hash. They must never
+// change, otherwise the files chunked before wouldn't share any chunk with the
+// files chunked after.
+var gear [256]uint64
+
+func init() {
+	// splitmix64, so the table is reproducible without being stored.
+	x := uint64(0x64756d62636173)
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// chunker splits a stream at content-defined boundaries.
+type chunker struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: bufio.NewReaderSize(r, 64*1024), buf: make([]byte, 0, chunkMaxSize)}
+}
+
+// next returns the next chunk, which is only valid until the following call,
+// or io.EOF at the end of the stream.
+func (c *chunker) next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	fp := uint64(0)
+	for len(c.buf) < chunkMaxSize {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		fp = fp<<1 + gear[b]
+		if len(c.buf) >= chunkMinSize && fp&chunkMask == 0 {
+			break
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	return c.buf, nil
+}
+
+// ArchiveChunks adds the content of r to cas as content-defined chunks, so the
+// versions of a large file share the chunks of their unchanged parts, then the
+// manifest listing them. Returns the hash of the manifest and the number of
+// bytes of the chunks that were not already in cas.
+func ArchiveChunks(cas CasTable, r io.Reader) (string, int64, error) {
+	c := newChunker(r)
+	manifest := &bytes.Buffer{}
+	added := int64(0)
+	for {
+		data, err := c.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", 0, err
+		}
+		hash := HashBytes(cas.NewHash(), data)
+		fmt.Fprintf(manifest, "%s\n", hash)
+		if cas.Exists(hash) {
+			continue
+		}
+		if err := cas.AddEntry(bytes.NewReader(data), hash); err == nil {
+			added += int64(len(data))
+		} else if !os.IsExist(err) {
+			return "", 0, err
+		}
+	}
+	// The manifest goes last so it never references a missing chunk.
+	hash, err := AddBytes(cas, manifest.Bytes())
+	if err != nil && !os.IsExist(err) {
+		return "", 0, err
+	}
+	return hash, added, nil
+}
+
+// LoadManifest returns the chunks listed by the manifest hash, in order.
+func LoadManifest(cas CasTable, hash string) ([]string, error) {
+	f, err := cas.Open(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	chunks := []string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		chunks = append(chunks, s.Text())
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read the manifest %s: %s", hash, err)
+	}
+	return chunks, nil
+}
+
+// Objects returns the objects holding the content of the file e: its manifest
+// and its chunks if it was chunked, its hash otherwise.
+func (e *Entry) Objects(cas CasTable) ([]string, error) {
+	if e.Manifest != "" {
+		chunks, err := LoadManifest(cas, e.Manifest)
+		if err != nil {
+			return nil, err
+		}
+		return append([]string{e.Manifest}, chunks...), nil
+	}
+	if e.Sha1 != "" {
+		return []string{e.Sha1}, nil
+	}
+	return nil, nil
+}
+
+// OpenEntry opens the content of the file e, concatenating its chunks if it
+// was chunked. It fails if a chunk is missing.
+func OpenEntry(cas CasTable, e *Entry) (ReadSeekCloser, error) {
+	if e.Manifest == "" {
+		return cas.Open(e.Sha1)
+	}
+	chunks, err := LoadManifest(cas, e.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	found := cas.ExistsMany(chunks)
+	for _, chunk := range chunks {
+		if !found[chunk] {
+			return nil, &os.PathError{Op: "open", Path: chunk, Err: os.ErrNotExist}
+		}
+	}
+	return &chunksReader{cas: cas, chunks: chunks, size: e.Size, offsets: []int64{0}}, nil
+}
+
+// chunksReader reads the chunks of a file one after the other. The sizes of
+// the chunks are only looked up when seeking.
+type chunksReader struct {
+	cas    CasTable
+	chunks []string
+	size   int64
+	// offsets[i] is the offset of chunks[i] in the file, for the chunks read
+	// or seeked past so far.
+	offsets []int64
+	// index is the chunk at offset and skip the position of offset in it.
+	index  int
+	skip   int64
+	offset int64
+	cur    ReadSeekCloser
+}
+
+func (c *chunksReader) Read(p []byte) (int, error) {
+	for {
+		if c.index == len(c.chunks) || c.offset >= c.size {
+			return 0, io.EOF
+		}
+		if c.cur == nil {
+			f, err := c.cas.Open(c.chunks[c.index])
+			if err != nil {
+				return 0, fmt.Errorf("Failed to open chunk %s: %s", c.chunks[c.index], err)
+			}
+			c.cur = f
+			if c.skip != 0 {
+				if _, err := f.Seek(c.skip, io.SeekStart); err != nil {
+					return 0, err
+				}
+			}
+		}
+		n, err := c.cur.Read(p)
+		c.offset += int64(n)
+		c.skip += int64(n)
+		if err == io.EOF {
+			_ = c.Close()
+			c.index++
+			c.skip = 0
+			if len(c.offsets) == c.index {
+				c.offsets = append(c.offsets, c.offset)
+			}
+			err = nil
+		}
+		if n != 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (c *chunksReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += c.offset
+	case io.SeekEnd:
+		offset += c.size
+	}
+	if offset < 0 {
+		return c.offset, fmt.Errorf("negative position")
+	}
+	if offset == c.offset {
+		return offset, nil
+	}
+	index, err := c.chunkAt(offset)
+	if err != nil {
+		return c.offset, err
+	}
+	_ = c.Close()
+	c.index = index
+	c.offset = offset
+	if index < len(c.chunks) {
+		c.skip = offset - c.offsets[index]
+	}
+	return offset, nil
+}
+
+// chunkAt returns the index of the chunk holding pos, looking up the sizes of
+// the chunks up to it.
+func (c *chunksReader) chunkAt(pos int64) (int, error) {
+	for i := range c.chunks {
+		if i+1 == len(c.offsets) {
+			size, err := ContentSize(c.cas, c.chunks[i])
+			if err != nil {
+				return 0, err
+			}
+			c.offsets = append(c.offsets, c.offsets[i]+size)
+		}
+		if pos < c.offsets[i+1] {
+			return i, nil
+		}
+	}
+	return len(c.chunks), nil
+}
+
+func (c *chunksReader) Close() error {
+	if c.cur == nil {
+		return nil
+	}
+	err := c.cur.Close()
+	c.cur = nil
+	return err
+}
@@ -0,0 +1,126 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestArchiveChunksImpl(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	content := make([]byte, 5*1024*1024)
+	_, _ = rand.New(rand.NewSource(0)).Read(content)
+	manifest, added, err := ArchiveChunks(cas, bytes.NewReader(content))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, int64(len(content)), added)
+	chunks, err := LoadManifest(cas, manifest)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, len(chunks) > 2)
+	for i, chunk := range chunks {
+		size, err := ContentSize(cas, chunk)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, true, size <= chunkMaxSize)
+		ut.AssertEqual(t, true, size >= chunkMinSize || i == len(chunks)-1)
+	}
+
+	again, added, err := ArchiveChunks(cas, bytes.NewReader(content))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, int64(0), added)
+	ut.AssertEqual(t, manifest, again)
+
+	// An insertion only changes the chunk it is in.
+	inserted := append([]byte("inserted"), content...)
+	again, added, err = ArchiveChunks(cas, bytes.NewReader(inserted))
+	ut.AssertEqual(t, nil, err)
+	insertedChunks, err := LoadManifest(cas, again)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, chunks[1:], insertedChunks[1:])
+	ut.AssertEqual(t, true, added < chunkMaxSize)
+
+	manifest, added, err = ArchiveChunks(cas, bytes.NewReader(nil))
+	ut.AssertEqual(t, nil, err)
+	chunks, err = LoadManifest(cas, manifest)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, chunks)
+	ut.AssertEqual(t, int64(0), added)
+}
+
+func TestOpenEntryChunks(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	content := make([]byte, 3*1024*1024)
+	_, _ = rand.New(rand.NewSource(1)).Read(content)
+	manifest, _, err := ArchiveChunks(cas, bytes.NewReader(content))
+	ut.AssertEqual(t, nil, err)
+	chunks, err := LoadManifest(cas, manifest)
+	ut.AssertEqual(t, nil, err)
+	e := &Entry{Sha1: Sha1Bytes(content), Size: int64(len(content)), Manifest: manifest}
+	objects, err := e.Objects(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, append([]string{manifest}, chunks...), objects)
+	objects, err = (&Entry{Sha1: "a"}).Objects(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"a"}, objects)
+	_, err = (&Entry{Sha1: "a", Manifest: Sha1Bytes([]byte("missing"))}).Objects(cas)
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+
+	f, err := OpenEntry(cas, e)
+	ut.AssertEqual(t, nil, err)
+	actual, err := ioutil.ReadAll(f)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, bytes.Equal(content, actual))
+	for _, offset := range []int64{2 * 1024 * 1024, 10, chunkMinSize - 5, int64(len(content)) - 3} {
+		pos, err := f.Seek(offset, io.SeekStart)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, offset, pos)
+		buf := make([]byte, 10)
+		n, _ := io.ReadFull(f, buf)
+		ut.AssertEqual(t, content[offset:offset+int64(n)], buf[:n])
+	}
+	pos, err := f.Seek(0, io.SeekEnd)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, int64(len(content)), pos)
+	n, err := f.Read(make([]byte, 1))
+	ut.AssertEqual(t, 0, n)
+	ut.AssertEqual(t, io.EOF, err)
+	ut.AssertEqual(t, nil, f.Close())
+
+	// It is restored like any file.
+	root := makeTempDir(t, "open_entry_chunks")
+	defer removeDir(t, root)
+	count, err := RestoreEntry(nil, cas, &Entry{Files: map[string]*Entry{"big": e}}, root, false)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, count)
+	actual, err = ioutil.ReadFile(filepath.Join(root, "big"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, bytes.Equal(content, actual))
+
+	// It is served with range requests.
+	req := httptest.NewRequest("GET", "/big", nil)
+	req.Header.Set("Range", "bytes=2097152-2097161")
+	resp := httptest.NewRecorder()
+	(&entryFileSystem{&Entry{Files: map[string]*Entry{"big": e}}, cas}).ServeHTTP(resp, req)
+	ut.AssertEqual(t, 206, resp.Code)
+	ut.AssertEqual(t, content[2097152:2097162], resp.Body.Bytes())
+
+	ut.AssertEqual(t, nil, cas.Remove(chunks[1]))
+	_, err = OpenEntry(cas, e)
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+}
@@ -11,26 +11,36 @@ package dumbcaslib
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"time"
 
-	"github.com/maruel/interrupt"
+	"lukechampine.com/blake3"
 )
 
 // Table represents a flat table of data.
 type Table interface {
-	// Must be able to efficiently respond to an HTTP GET request.
+	// Must be able to efficiently respond to an HTTP GET request, including
+	// the Range and If-Range headers so large entries can be seeked into and
+	// their download resumed. http.ServeContent() over the ReadSeekCloser
+	// returned by Open() does it.
 	http.Handler
 	// Enumerate enumerates all the entries in the table.
 	Enumerate() <-chan EnumerationEntry
-	// Open opens an entry for reading.
+	// Open opens an entry for reading. Seek must reach any offset of the
+	// content, even when it is stored compressed, encrypted or remotely.
 	Open(name string) (ReadSeekCloser, error)
 	// Remove removes a node enumerated by Enumerate().
 	Remove(name string) error
@@ -43,9 +53,28 @@ type Corruptable interface {
 	Corrupt()
 }
 
+// sendEntry sends e to c unless ctx is done first. Returns false if the
+// enumeration must stop.
+func sendEntry(ctx context.Context, c chan<- EnumerationEntry, e EnumerationEntry) bool {
+	select {
+	case c <- e:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 // EnumerationEntry is one element in the enumeration functions.
 type EnumerationEntry struct {
-	Item  string
+	Item string
+	// Size is the size of the item as stored, which is smaller than its content
+	// when compressed. It is only set by CasTable.Enumerate().
+	Size int64
+	// Created is the creation time of a node. It is only set by
+	// NodesTable.Enumerate().
+	Created time.Time
+	// Tags are the tags of a node. It is only set by NodesTable.Enumerate().
+	Tags  map[string]string
 	Error error
 }
 
@@ -63,55 +92,251 @@ type TreeItem struct {
 	Error error
 }
 
-func recurseEnumerateTree(rootDir string, c chan<- TreeItem) bool {
-	f, err := os.Open(rootDir)
+// SymlinkMode defines how symlinks are handled when walking a tree.
+type SymlinkMode string
+
+const (
+	// SymlinkFollow walks the symlink target as if it was in the tree. A
+	// symlink to one of its parent directories is skipped to not loop forever.
+	SymlinkFollow SymlinkMode = "follow"
+	// SymlinkStore returns the symlink itself so its target can be recorded.
+	SymlinkStore SymlinkMode = "store"
+	// SymlinkSkip ignores the symlinks.
+	SymlinkSkip SymlinkMode = "skip"
+)
+
+// Check returns an error if the mode is unknown.
+func (m SymlinkMode) Check() error {
+	if m != SymlinkFollow && m != SymlinkStore && m != SymlinkSkip {
+		return fmt.Errorf("Invalid symlink mode %s", m)
+	}
+	return nil
+}
+
+// TreeOptions controls EnumerateTreeWithOptions().
+type TreeOptions struct {
+	// Excludes are the files and directories to skip.
+	Excludes Excludes
+	// Includes, when set, are the only files to return. They use the same
+	// patterns as Excludes, which take precedence. Unlike Excludes, they don't
+	// prune directories since a file deeper in the tree may match.
+	Includes Excludes
+	// Symlinks defaults to SymlinkFollow.
+	Symlinks SymlinkMode
+	// OneFileSystem skips the directories on another device than rootDir, like
+	// find -xdev. It is ignored on platforms not exposing the device IDs.
+	OneFileSystem bool
+	// EmptyDirs also returns the empty directories so they can be recreated.
+	// The other directories are never returned.
+	EmptyDirs bool
+}
+
+// treeWalker walks a tree. parents is the stack of directories being walked
+// to detect symlink loops.
+type treeWalker struct {
+	rootDir string
+	opts    TreeOptions
+	parents []os.FileInfo
+	c       chan<- TreeItem
+	ctx     context.Context
+	// dev is the device of rootDir, only set with opts.OneFileSystem.
+	dev    uint64
+	hasDev bool
+}
+
+// send sends item unless the walk is cancelled first. Returns false if the
+// walk must stop.
+func (t *treeWalker) send(item TreeItem) bool {
+	select {
+	case t.c <- item:
+		return true
+	case <-t.ctx.Done():
+		return false
+	}
+}
+
+func (t *treeWalker) recurse(relDir string) bool {
+	dirPath := filepath.Join(t.rootDir, relDir)
+	f, err := os.Open(dirPath)
 	if err != nil {
-		c <- TreeItem{Error: err}
+		t.send(TreeItem{Error: err})
 		return false
 	}
 	defer func() {
 		_ = f.Close()
 	}()
+	stat, err := f.Stat()
+	if err != nil {
+		t.send(TreeItem{Error: err})
+		return false
+	}
+	if relDir == "" && t.opts.OneFileSystem {
+		t.dev, t.hasDev = fileDevice(stat)
+	}
+	t.parents = append(t.parents, stat)
+	defer func() {
+		t.parents = t.parents[:len(t.parents)-1]
+	}()
+	entries := 0
 	for {
-		if interrupt.IsSet() {
+		if IsInterrupted() || t.ctx.Err() != nil {
 			break
 		}
 		dirs, err := f.Readdir(128)
 		if err != nil && err != io.EOF {
-			c <- TreeItem{Error: err}
+			t.send(TreeItem{Error: err})
 			return false
 		}
 		if len(dirs) == 0 {
+			if entries == 0 && relDir != "" && t.opts.EmptyDirs && t.isIncluded(relDir) {
+				return t.send(TreeItem{FullPath: dirPath, FileInfo: stat})
+			}
 			break
 		}
+		entries += len(dirs)
 		for _, d := range dirs {
-			if interrupt.IsSet() {
+			if IsInterrupted() || t.ctx.Err() != nil {
 				break
 			}
-			name := d.Name()
-			fullPath := filepath.Join(rootDir, name)
+			relPath := filepath.Join(relDir, d.Name())
+			if t.opts.Excludes.Match(relPath) {
+				// Skipping a directory prunes its whole subtree.
+				continue
+			}
+			fullPath := filepath.Join(t.rootDir, relPath)
+			if d.Mode()&os.ModeSymlink != 0 {
+				switch t.opts.Symlinks {
+				case SymlinkSkip:
+					continue
+				case SymlinkStore:
+					if !t.isIncluded(relPath) {
+						continue
+					}
+					if !t.send(TreeItem{FullPath: fullPath, FileInfo: d}) {
+						return false
+					}
+					continue
+				}
+				target, err := os.Stat(fullPath)
+				if err != nil {
+					// Broken symlink; report it and continue.
+					if !t.send(TreeItem{FullPath: fullPath, Error: err}) {
+						return false
+					}
+					continue
+				}
+				if target.IsDir() && t.isParent(target) {
+					continue
+				}
+				d = target
+			}
 			if d.IsDir() {
-				if !recurseEnumerateTree(fullPath, c) {
+				if t.isOtherDevice(d) {
+					continue
+				}
+				if !t.recurse(relPath) {
 					return false
 				}
-			} else {
-				c <- TreeItem{FullPath: fullPath, FileInfo: d}
+			} else if t.isIncluded(relPath) && !t.send(TreeItem{FullPath: fullPath, FileInfo: d}) {
+				return false
 			}
 		}
 	}
 	return true
 }
 
+// isIncluded returns true if the file relPath matches opts.Includes, if any.
+func (t *treeWalker) isIncluded(relPath string) bool {
+	return len(t.opts.Includes) == 0 || t.opts.Includes.Match(relPath)
+}
+
+// isOtherDevice returns true if dir is a mount point to skip.
+func (t *treeWalker) isOtherDevice(dir os.FileInfo) bool {
+	if !t.hasDev {
+		return false
+	}
+	dev, ok := fileDevice(dir)
+	return ok && dev != t.dev
+}
+
+func (t *treeWalker) isParent(dir os.FileInfo) bool {
+	for _, p := range t.parents {
+		if os.SameFile(p, dir) {
+			return true
+		}
+	}
+	return false
+}
+
 // EnumerateTree walks the directory tree.
 func EnumerateTree(rootDir string) <-chan TreeItem {
+	return EnumerateTreeWithOptions(rootDir, TreeOptions{})
+}
+
+// EnumerateTreeWithOptions walks the directory tree, skipping the files and
+// directories matching opts.Excludes and the files not matching opts.Includes,
+// and handling the symlinks according to opts.Symlinks. With
+// opts.OneFileSystem, the mount points are not crossed.
+func EnumerateTreeWithOptions(rootDir string, opts TreeOptions) <-chan TreeItem {
+	return EnumerateTreeCtx(context.Background(), rootDir, opts)
+}
+
+// EnumerateTreeCtx is like EnumerateTreeWithOptions() but stops and closes the
+// channel once ctx is done, so the caller can stop reading early.
+func EnumerateTreeCtx(ctx context.Context, rootDir string, opts TreeOptions) <-chan TreeItem {
+	if opts.Symlinks == "" {
+		opts.Symlinks = SymlinkFollow
+	}
 	c := make(chan TreeItem)
 	go func() {
-		recurseEnumerateTree(rootDir, c)
+		t := &treeWalker{rootDir: rootDir, opts: opts, c: c, ctx: ctx}
+		t.recurse("")
 		close(c)
 	}()
 	return c
 }
 
+// Excludes is a list of glob patterns as understood by filepath.Match. A
+// pattern containing a path separator is matched against the whole relative
+// path and the paths of its parent directories, otherwise against each path
+// element, so "*.tmp" or ".git" match at any depth. Either way, the files in a
+// matched directory match too.
+type Excludes []string
+
+// Check returns an error if a pattern is malformed.
+func (e Excludes) Check() error {
+	for _, pattern := range e {
+		if _, err := path.Match(filepath.ToSlash(pattern), ""); err != nil {
+			return fmt.Errorf("Invalid pattern %s: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Match returns true if relPath, using the OS path separator, matches one of
+// the patterns.
+func (e Excludes) Match(relPath string) bool {
+	relPath = filepath.ToSlash(relPath)
+	for _, pattern := range e {
+		pattern = filepath.ToSlash(pattern)
+		if strings.Contains(pattern, "/") {
+			pattern = strings.Trim(pattern, "/")
+			for p := relPath; p != "."; p = path.Dir(p) {
+				if ok, _ := path.Match(pattern, p); ok {
+					return true
+				}
+			}
+			continue
+		}
+		for _, element := range strings.Split(relPath, "/") {
+			if ok, _ := path.Match(pattern, element); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func isDir(path string) bool {
 	stat, _ := os.Stat(path)
 	return stat != nil && stat.IsDir()
@@ -129,6 +354,18 @@ func readDirNames(dirPath string) ([]string, error) {
 	return f.Readdirnames(0)
 }
 
+// Reads a directory list with the file information of each item.
+func readDirInfos(dirPath string) ([]os.FileInfo, error) {
+	f, err := os.Open(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return f.Readdir(0)
+}
+
 // Reads a directory list and guarantees to return a list.
 func readDirFancy(dirPath string) ([]string, error) {
 	names := []string{}
@@ -155,11 +392,45 @@ func readDirFancy(dirPath string) ([]string, error) {
 	return names, err
 }
 
+// DefaultHash is the hashing algorithm used when none is specified.
+const DefaultHash = "sha1"
+
+// hashAlgorithms are the supported hashing algorithms, keyed by name.
+var hashAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"blake3": func() hash.Hash { return blake3.New(32, nil) },
+}
+
+// hashName returns the name of the algorithm of h in hashAlgorithms. The
+// algorithms are told apart by the digest of an empty content.
+func hashName(h hash.Hash) string {
+	digest := HashBytes(h, nil)
+	for name, newHash := range hashAlgorithms {
+		if HashBytes(newHash(), nil) == digest {
+			return name
+		}
+	}
+	return ""
+}
+
 // Sha1Bytes returns the hex encoded SHA-1 from the content.
 func Sha1Bytes(content []byte) string {
-	hash := sha1.New()
-	_, _ = hash.Write(content)
-	return hex.EncodeToString(hash.Sum(nil))
+	return HashBytes(sha1.New(), content)
+}
+
+// HashBytes returns the hex encoded digest of the content using h.
+func HashBytes(h hash.Hash, content []byte) string {
+	_, _ = h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// HashReader returns the hex encoded digest of the content of r using h.
+func HashReader(h hash.Hash, r io.Reader) (string, error) {
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
 // LoadReaderAsJSON decodes JSON data from a io.Reader.
@@ -10,8 +10,12 @@ limitations under the License. */
 package dumbcaslib
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"testing"
 
 	"github.com/maruel/ut"
@@ -27,3 +31,168 @@ func removeDir(t testing.TB, tempDir string) {
 	err := os.RemoveAll(tempDir)
 	ut.AssertEqual(t, nil, err)
 }
+
+func TestExcludes(t *testing.T) {
+	t.Parallel()
+	e := Excludes{".git", "*.tmp", "dir1/build"}
+	ut.AssertEqual(t, nil, e.Check())
+	checks := map[string]bool{
+		"foo":                   false,
+		".git":                  true,
+		"src/.git":              true,
+		"src/.git/config":       true,
+		"a.tmp":                 true,
+		"dir/a.tmp":             true,
+		"a.tmpx":                false,
+		"dir1/build":            true,
+		"dir1/build/out":        true,
+		"dir1/builder":          false,
+		"dir2/dir1/build":       false,
+		filepath.Join("x", "y"): false,
+	}
+	for relPath, expected := range checks {
+		ut.AssertEqualf(t, expected, e.Match(filepath.FromSlash(relPath)), "%s", relPath)
+	}
+	ut.AssertEqual(t, false, Excludes{"[a"}.Check() == nil)
+}
+
+func TestEnumerateTreeExcluding(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "enumerate_excluding")
+	defer removeDir(t, tempData)
+	for _, p := range []string{"a", "b.tmp", "node_modules/x", "dir/c", "dir/node_modules/y"} {
+		p = filepath.Join(tempData, filepath.FromSlash(p))
+		ut.AssertEqual(t, nil, os.MkdirAll(filepath.Dir(p), 0700))
+		ut.AssertEqual(t, nil, ioutil.WriteFile(p, nil, 0600))
+	}
+	items := []string{}
+	for item := range EnumerateTreeWithOptions(tempData, TreeOptions{Excludes: Excludes{"*.tmp", "node_modules"}}) {
+		ut.AssertEqual(t, nil, item.Error)
+		rel, _ := filepath.Rel(tempData, item.FullPath)
+		items = append(items, filepath.ToSlash(rel))
+	}
+	sort.Strings(items)
+	ut.AssertEqual(t, []string{"a", "dir/c"}, items)
+}
+
+func TestEnumerateTreeIncluding(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "enumerate_including")
+	defer removeDir(t, tempData)
+	for _, p := range []string{"a.go", "b.tmp", "c.go.tmp", "node_modules/x.go", "dir/d.go", "dir/e", "dir/sub/h", "dir/sub/deep/i", "dir/subx/j", "src/f", "src/node_modules/g"} {
+		p = filepath.Join(tempData, filepath.FromSlash(p))
+		ut.AssertEqual(t, nil, os.MkdirAll(filepath.Dir(p), 0700))
+		ut.AssertEqual(t, nil, ioutil.WriteFile(p, nil, 0600))
+	}
+	// The excludes win over the includes, even when both match.
+	opts := TreeOptions{
+		Excludes: Excludes{"*.tmp", "node_modules"},
+		Includes: Excludes{"*.go", "*.tmp", "src", "dir/sub"},
+	}
+	items := []string{}
+	for item := range EnumerateTreeWithOptions(tempData, opts) {
+		ut.AssertEqual(t, nil, item.Error)
+		rel, _ := filepath.Rel(tempData, item.FullPath)
+		items = append(items, filepath.ToSlash(rel))
+	}
+	sort.Strings(items)
+	ut.AssertEqual(t, []string{"a.go", "dir/d.go", "dir/sub/deep/i", "dir/sub/h", "src/f"}, items)
+}
+
+func TestEnumerateTreeInterrupted(t *testing.T) {
+	// Not parallel since the interrupted state is global.
+	tempData := makeTempDir(t, "enumerate_interrupted")
+	defer removeDir(t, tempData)
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(tempData, "a"), nil, 0600))
+	SetInterrupted()
+	for item := range EnumerateTree(tempData) {
+		t.Fatalf("unexpected %s", item.FullPath)
+	}
+	ResetInterrupted()
+	ut.AssertEqual(t, false, IsInterrupted())
+	items := 0
+	for item := range EnumerateTree(tempData) {
+		ut.AssertEqual(t, nil, item.Error)
+		items++
+	}
+	ut.AssertEqual(t, 1, items)
+}
+
+func TestEnumerateTreeSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+	t.Parallel()
+	tempData := makeTempDir(t, "enumerate_symlinks")
+	defer removeDir(t, tempData)
+	ut.AssertEqual(t, nil, os.MkdirAll(filepath.Join(tempData, "dir"), 0700))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(tempData, "dir", "a"), []byte("a"), 0600))
+	ut.AssertEqual(t, nil, os.Symlink("a", filepath.Join(tempData, "dir", "link")))
+	ut.AssertEqual(t, nil, os.Symlink("..", filepath.Join(tempData, "dir", "loop")))
+	ut.AssertEqual(t, nil, os.Symlink("dir", filepath.Join(tempData, "dir2")))
+
+	checks := map[SymlinkMode][]string{
+		SymlinkFollow: {"dir/a", "dir/link", "dir2/a", "dir2/link"},
+		SymlinkStore:  {"dir/a", "dir/link", "dir/loop", "dir2"},
+		SymlinkSkip:   {"dir/a"},
+	}
+	for mode, expected := range checks {
+		items := []string{}
+		for item := range EnumerateTreeWithOptions(tempData, TreeOptions{Symlinks: mode}) {
+			ut.AssertEqual(t, nil, item.Error)
+			rel, _ := filepath.Rel(tempData, item.FullPath)
+			items = append(items, filepath.ToSlash(rel))
+			if mode == SymlinkFollow {
+				// The size is the one of the target.
+				ut.AssertEqual(t, int64(1), item.Size())
+			}
+		}
+		sort.Strings(items)
+		ut.AssertEqualf(t, expected, items, "%s", mode)
+	}
+	ut.AssertEqual(t, false, SymlinkMode("foo").Check() == nil)
+}
+
+func TestEnumerateTreeOneFileSystem(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("relies on /proc")
+	}
+	t.Parallel()
+	tempData := makeTempDir(t, "enumerate_xdev")
+	defer removeDir(t, tempData)
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(tempData, "a"), []byte("a"), 0600))
+	// The symlink target is on another file system.
+	ut.AssertEqual(t, nil, os.Symlink("/proc/self/fdinfo", filepath.Join(tempData, "proc")))
+
+	checks := map[bool]bool{false: true, true: false}
+	for oneFileSystem, expected := range checks {
+		found := false
+		for item := range EnumerateTreeWithOptions(tempData, TreeOptions{OneFileSystem: oneFileSystem}) {
+			rel, _ := filepath.Rel(tempData, item.FullPath)
+			if filepath.Dir(rel) == "proc" {
+				found = true
+			}
+		}
+		ut.AssertEqualf(t, expected, found, "%t", oneFileSystem)
+	}
+}
+
+func TestEnumerateTreeCtx(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "enumerate_ctx")
+	defer removeDir(t, tempData)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(tempData, name), []byte(name), 0600))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	items := EnumerateTreeCtx(ctx, tempData, TreeOptions{})
+	item := <-items
+	ut.AssertEqual(t, nil, item.Error)
+	cancel()
+	count := 1
+	for range items {
+		count++
+	}
+	ut.AssertEqual(t, true, count < 4)
+}
@@ -0,0 +1,198 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted entries have codecEncrypted set in their blob header, which is
+// followed by a random nonce. The content, compressed or not, is then split in
+// chunks of cryptChunkSize bytes each sealed with AES-GCM. The nonce of a chunk
+// is the nonce of the entry with the chunk index added to its last 8 bytes and
+// the last chunk is authenticated as such, so a truncated entry is detected.
+//
+// The entry is still named after the hash of its original content so
+// deduplication works; the random nonce only makes the encrypted content of
+// two tables differ.
+const cryptChunkSize = 64 * 1024
+
+// Default scrypt cost parameters for a new table.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// cryptCheck is sealed with a zero nonce in the table metadata to detect a
+// wrong passphrase.
+var cryptCheck = []byte("dumbcas")
+
+// ErrEncrypted is returned when reading or writing an encrypted table without
+// its passphrase.
+var ErrEncrypted = errors.New("The table is encrypted, a passphrase is needed")
+
+// casEncryption is saved in the metadata of an encrypted table.
+type casEncryption struct {
+	Salt  []byte `json:"salt"`
+	N     int    `json:"n"`
+	R     int    `json:"r"`
+	P     int    `json:"p"`
+	Check []byte `json:"check"`
+}
+
+// newCasEncryption returns the encryption parameters of a new table.
+func newCasEncryption(passphrase string) (*casEncryption, error) {
+	e := &casEncryption{Salt: make([]byte, 32), N: scryptN, R: scryptR, P: scryptP}
+	if _, err := io.ReadFull(rand.Reader, e.Salt); err != nil {
+		return nil, err
+	}
+	aead, err := e.deriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	e.Check = aead.Seal(nil, make([]byte, aead.NonceSize()), cryptCheck, nil)
+	return e, nil
+}
+
+func (e *casEncryption) deriveKey(passphrase string) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), e.Salt, e.N, e.R, e.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// open returns the cipher of the table, verifying the passphrase.
+func (e *casEncryption) open(passphrase string) (cipher.AEAD, error) {
+	aead, err := e.deriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := aead.Open(nil, make([]byte, aead.NonceSize()), e.Check, nil); err != nil {
+		return nil, errors.New("invalid passphrase")
+	}
+	return aead, nil
+}
+
+// chunkNonce returns the nonce of the chunk index of an entry.
+func chunkNonce(nonce []byte, index uint64) []byte {
+	out := make([]byte, len(nonce))
+	copy(out, nonce)
+	tail := out[len(out)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)+index)
+	return out
+}
+
+// chunkData is the additional data of a chunk, marking the last one.
+func chunkData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptingWriter seals the chunks written to w. Close() must be called to
+// write the last chunk.
+type encryptingWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	index uint64
+	buf   []byte
+}
+
+func newEncryptingWriter(w io.Writer, aead cipher.AEAD, nonce []byte) *encryptingWriter {
+	return &encryptingWriter{w: w, aead: aead, nonce: nonce, buf: make([]byte, 0, cryptChunkSize)}
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) != 0 {
+		// A full chunk is only sealed once more data is written, so the last
+		// chunk is known when closing.
+		if len(e.buf) == cryptChunkSize {
+			if err := e.seal(false); err != nil {
+				return n, err
+			}
+		}
+		l := copy(e.buf[len(e.buf):cryptChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+l]
+		p = p[l:]
+		n += l
+	}
+	return n, nil
+}
+
+func (e *encryptingWriter) seal(last bool) error {
+	sealed := e.aead.Seal(nil, chunkNonce(e.nonce, e.index), e.buf, chunkData(last))
+	e.index++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+func (e *encryptingWriter) Close() error {
+	return e.seal(true)
+}
+
+// decryptingReader opens the chunks read from r.
+type decryptingReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	index uint64
+	// buf is the data of the current chunk not yet read.
+	buf  []byte
+	done bool
+}
+
+func newDecryptingReader(r io.Reader, aead cipher.AEAD, nonce []byte) *decryptingReader {
+	return &decryptingReader{r: bufio.NewReader(r), aead: aead, nonce: nonce}
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		sealed := make([]byte, cryptChunkSize+d.aead.Overhead())
+		n, err := io.ReadFull(d.r, sealed)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		_, err = d.r.Peek(1)
+		last := err == io.EOF
+		if d.buf, err = d.aead.Open(sealed[:0], chunkNonce(d.nonce, d.index), sealed[:n], chunkData(last)); err != nil {
+			return 0, fmt.Errorf("chunk %d is corrupted: %s", d.index, err)
+		}
+		d.index++
+		d.done = last
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
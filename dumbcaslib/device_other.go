@@ -0,0 +1,29 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"os"
+)
+
+// fileDevice returns false; the device IDs are not available on this
+// platform so mount points are always crossed.
+func fileDevice(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
+
+// HardlinkID returns false; the inodes are not available on this platform so
+// the hardlinks are archived and restored as copies.
+func HardlinkID(fi os.FileInfo) (string, bool) {
+	return "", false
+}
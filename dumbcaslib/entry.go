@@ -10,21 +10,120 @@ limitations under the License. */
 package dumbcaslib
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
-// Entry is an element. It can only contain the 2 firsts or the last one.
+// Entry is an element. It is either a file (Sha1, Size and Mode), a symlink
+// (Symlink) or a directory (Files). An empty directory has no Files but
+// os.ModeDir in its Mode.
 // TODO(maruel): Investigate if map[string]Entry could be used instead for
 // performance reasons.
 type Entry struct {
-	Sha1  string            `json:"h,omitempty"`
-	Size  int64             `json:"s,omitempty"`
-	Files map[string]*Entry `json:"f,omitempty"`
+	Sha1 string `json:"h,omitempty"`
+	Size int64  `json:"s,omitempty"`
+	// Mode is the permission bits of a file. Entries archived before it was
+	// recorded have none; use Perm().
+	Mode os.FileMode `json:"m,omitempty"`
+	// Symlink is the target of a symlink archived with SymlinkStore.
+	Symlink string `json:"l,omitempty"`
+	// Xattrs are the extended attributes of a file archived with -xattrs, as
+	// returned by ReadXattrs().
+	Xattrs map[string]string `json:"x,omitempty"`
+	// Link is the hardlink group of a file archived with -hardlinks; the files
+	// of a group shared the same inode when archived.
+	Link int `json:"k,omitempty"`
+	// ModTime is the modification time of a file or of an empty directory, in
+	// UTC. The entries archived before it was recorded have none and are
+	// restored with the time of the restore.
+	ModTime time.Time `json:"t,omitzero"`
+	// Manifest is the object listing the chunks holding the content of a large
+	// file archived with -chunk-threshold; see ArchiveChunks(). Sha1 is then
+	// the hash of the whole content, which is not in the table. Use Objects()
+	// and OpenEntry() to handle both cases.
+	Manifest string            `json:"c,omitempty"`
+	Files    map[string]*Entry `json:"f,omitempty"`
+}
+
+// entryFields is Entry without its JSON methods.
+type entryFields Entry
+
+// entryJSON is the serialized form of an Entry. encoding/json replaces the
+// bytes of a string that are not valid UTF-8, which are common in the file
+// names on Linux, so these names are stored base64 encoded in Files and
+// listed in Encoded.
+type entryJSON struct {
+	*entryFields
+	Files   map[string]*Entry `json:"f,omitempty"`
+	Encoded []string          `json:"e,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (e *Entry) MarshalJSON() ([]byte, error) {
+	out := entryJSON{entryFields: (*entryFields)(e), Files: e.Files}
+	for name, child := range e.Files {
+		if utf8.ValidString(name) {
+			continue
+		}
+		if out.Encoded == nil {
+			// Don't modify e.
+			out.Files = make(map[string]*Entry, len(e.Files))
+			for k, v := range e.Files {
+				out.Files[k] = v
+			}
+		}
+		key := base64.StdEncoding.EncodeToString([]byte(name))
+		if _, ok := e.Files[key]; ok {
+			return nil, fmt.Errorf("%q and the encoding of %q are both in the same directory", key, name)
+		}
+		delete(out.Files, name)
+		out.Files[key] = child
+		out.Encoded = append(out.Encoded, key)
+	}
+	// The serialization must be stable since it is hashed.
+	sort.Strings(out.Encoded)
+	return json.Marshal(&out)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	in := entryJSON{entryFields: (*entryFields)(e)}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	e.Files = in.Files
+	for _, key := range in.Encoded {
+		child, ok := e.Files[key]
+		name, err := base64.StdEncoding.DecodeString(key)
+		if !ok || err != nil {
+			return fmt.Errorf("invalid encoded name %q", key)
+		}
+		delete(e.Files, key)
+		e.Files[string(name)] = child
+	}
+	return nil
+}
+
+// DefaultPerm is the permission of the files archived without their mode.
+const DefaultPerm os.FileMode = 0644
+
+// Perm returns the permission bits to restore the file with.
+func (e *Entry) Perm() os.FileMode {
+	if perm := e.Mode.Perm(); perm != 0 {
+		return perm
+	}
+	return DefaultPerm
 }
 
 // SortedFiles returns the child entry names sorted.
@@ -49,6 +148,67 @@ func (e *Entry) CountMembers() int {
 	return countI
 }
 
+// CountFiles returns the number of files referenced recursively, excluding
+// the directories.
+func (e *Entry) CountFiles() int {
+	count := 0
+	if e.Sha1 != "" {
+		count++
+	}
+	for _, v := range e.Files {
+		count += v.CountFiles()
+	}
+	return count
+}
+
+// TotalSize returns the sum of the size of the files referenced recursively.
+// It doesn't touch the table; see FillSizes() for old entries.
+func (e *Entry) TotalSize() int64 {
+	size := e.Size
+	for _, v := range e.Files {
+		size += v.TotalSize()
+	}
+	return size
+}
+
+// FillSizes sets the Size of the files archived before it was recorded by
+// looking at the table. Empty files are looked up too since they can't be
+// distinguished. Returns the number of entries updated.
+func (e *Entry) FillSizes(cas CasTable) (int, error) {
+	count := 0
+	if e.Sha1 != "" && e.Size == 0 && e.Manifest == "" {
+		size, err := ContentSize(cas, e.Sha1)
+		if err != nil {
+			return count, err
+		}
+		if size != 0 {
+			e.Size = size
+			count++
+		}
+	}
+	for _, v := range e.Files {
+		c, err := v.FillSizes(cas)
+		count += c
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// ContentSize returns the size of the content of the entry hash in the table
+// without reading it.
+func ContentSize(cas CasTable, hash string) (int64, error) {
+	f, err := cas.Open(hash)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return f.Seek(0, io.SeekEnd)
+}
+
 // Print prints the Entry in Yaml-inspired output.
 func (e *Entry) Print(w io.Writer, indent string) {
 	if e.Sha1 != "" {
@@ -61,8 +221,9 @@ func (e *Entry) Print(w io.Writer, indent string) {
 	}
 }
 
-func (e *Entry) isDir() bool {
-	return e.Files != nil
+// IsDir returns true if the entry is a directory, including an empty one.
+func (e *Entry) IsDir() bool {
+	return e.Files != nil || e.Mode&os.ModeDir != 0
 }
 
 type entryFileSystem struct {
@@ -111,7 +272,7 @@ func (e *entryFileSystem) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if toServe.isDir() {
+	if toServe.IsDir() {
 		if !hasTrailing {
 			localRedirect(w, r, filepath.Base(r.URL.Path)+"/")
 		} else {
@@ -121,18 +282,39 @@ func (e *entryFileSystem) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if hasTrailing {
 			localRedirect(w, r, filepath.Base(r.URL.Path))
 		} else {
+			if toServe.Manifest != "" {
+				e.serveChunks(w, r, toServe)
+				return
+			}
+			// Let the table set the headers for the file name.
+			r.URL.RawQuery = url.Values{"name": {path.Base(r.URL.Path)}}.Encode()
 			r.URL.Path = "/" + toServe.Sha1
 			e.cas.ServeHTTP(w, r)
 		}
 	}
 }
 
+// serveChunks serves a chunked file, which is not an object of the table.
+func (e *entryFileSystem) serveChunks(w http.ResponseWriter, r *http.Request, entry *Entry) {
+	f, err := OpenEntry(e.cas, entry)
+	if err != nil {
+		e.cas.SetFsckBit()
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	w.Header().Set("ETag", "\""+entry.Sha1+"\"")
+	http.ServeContent(w, r, path.Base(r.URL.Path), entry.ModTime, f)
+}
+
 // ServeDir returns the child entries for an Entry.
 func (e *Entry) ServeDir(w http.ResponseWriter) {
 	names := make([]string, len(e.Files))
 	i := 0
 	for name, entry := range e.Files {
-		if entry.isDir() {
+		if entry.IsDir() {
 			name = name + "/"
 		}
 		names[i] = name
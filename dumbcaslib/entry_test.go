@@ -0,0 +1,72 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"encoding/json"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/maruel/ut"
+)
+
+func TestEntryFillSizes(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	h1, err := AddBytes(cas, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	h2, err := AddBytes(cas, []byte{})
+	ut.AssertEqual(t, nil, err)
+
+	entry := &Entry{}
+	entry.AddFile("file1", h1, 8)
+	// Archived before the size was recorded.
+	entry.AddFile("dir1/file2", h1, 0)
+	entry.AddFile("dir1/empty", h2, 0)
+	ut.AssertEqual(t, int64(8), entry.TotalSize())
+
+	count, err := entry.FillSizes(cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, count)
+	ut.AssertEqual(t, int64(16), entry.TotalSize())
+	ut.AssertEqual(t, int64(8), entry.Files["dir1"].Files["file2"].Size)
+
+	entry.AddFile("missing", Sha1Bytes([]byte("missing")), 0)
+	_, err = entry.FillSizes(cas)
+	ut.AssertEqual(t, true, err != nil)
+}
+
+func TestEntryInvalidUTF8(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	h, err := AddBytes(cas, []byte("content"))
+	ut.AssertEqual(t, nil, err)
+	entry := &Entry{}
+	entry.AddFile("caf\xe9", h, 7)
+	entry.AddFile("dir\xff/caf\xe9", h, 7)
+	entry.AddFile("café", h, 7)
+
+	hash, err := ArchiveEntry(cas, entry)
+	ut.AssertEqual(t, nil, err)
+	// The original entry is not modified.
+	ut.AssertEqual(t, []string{"café", "caf\xe9", "dir\xff"}, entry.SortedFiles())
+	loaded, err := LoadEntry(cas, hash)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, entry, loaded)
+	data, err := json.Marshal(entry)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, utf8.Valid(data))
+
+	// The encoded name can't be used by another file in the same directory.
+	entry.AddFile("Y2Fm6Q==", h, 7)
+	_, err = json.Marshal(entry)
+	ut.AssertEqual(t, true, err != nil)
+	ut.AssertEqual(t, true, json.Unmarshal([]byte(`{"f":{"a":{}},"e":["a"]}`), &Entry{}) != nil)
+}
@@ -0,0 +1,126 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"path"
+	"time"
+)
+
+// ExportTar writes the files of the Entry tree as a tar stream to w, without
+// closing it. The members archived without their modification time and the
+// directories have modTime, e.g. the creation time of the node. The files of a
+// hardlink group are exported as hardlinks to the first one and the extended
+// attributes as PAX records.
+func ExportTar(cas CasTable, entry *Entry, w io.Writer, modTime time.Time) error {
+	// The size is required in the header of each file.
+	if _, err := entry.FillSizes(cas); err != nil {
+		return err
+	}
+	e := &tarExporter{cas: cas, w: tar.NewWriter(w), modTime: modTime, links: map[int]string{}}
+	for _, name := range entry.SortedFiles() {
+		if err := e.export(entry.Files[name], name); err != nil {
+			return err
+		}
+	}
+	return e.w.Close()
+}
+
+// tarExporter is the state of ExportTar() across the tree.
+type tarExporter struct {
+	cas     CasTable
+	w       *tar.Writer
+	modTime time.Time
+	// links are the first file exported of each hardlink group.
+	links map[int]string
+}
+
+func (e *tarExporter) export(entry *Entry, name string) error {
+	if IsInterrupted() {
+		return fmt.Errorf("Was interrupted.")
+	}
+	if !isValidEntryName(path.Base(name)) {
+		return fmt.Errorf("Refusing to export %q: invalid name", name)
+	}
+	hdr := &tar.Header{Name: name, ModTime: e.modTime, Format: tar.FormatPAX}
+	if !entry.ModTime.IsZero() {
+		hdr.ModTime = entry.ModTime
+	}
+	switch {
+	case entry.Sha1 != "":
+		hdr.Mode = int64(entry.Perm())
+		for k, v := range entry.Xattrs {
+			// The values are base64 encoded in the node, raw in the tar.
+			value, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				return fmt.Errorf("Refusing to export %q: invalid xattr %s: %s", name, k, err)
+			}
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords["SCHILY.xattr."+k] = string(value)
+		}
+		if first, ok := e.links[entry.Link]; ok && entry.Link != 0 {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			return e.w.WriteHeader(hdr)
+		}
+		if entry.Link != 0 {
+			e.links[entry.Link] = name
+		}
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = entry.Size
+		if err := e.w.WriteHeader(hdr); err != nil {
+			return err
+		}
+		return e.exportFile(entry, name)
+	case entry.Symlink != "":
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = entry.Symlink
+		hdr.Mode = 0777
+		return e.w.WriteHeader(hdr)
+	}
+	hdr.Typeflag = tar.TypeDir
+	hdr.Name = name + "/"
+	hdr.Mode = int64(entry.Mode.Perm())
+	if hdr.Mode == 0 {
+		hdr.Mode = 0755
+	}
+	if err := e.w.WriteHeader(hdr); err != nil {
+		return err
+	}
+	for _, child := range entry.SortedFiles() {
+		if err := e.export(entry.Files[child], name+"/"+child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportFile writes the content of a file entry.
+func (e *tarExporter) exportFile(entry *Entry, name string) error {
+	f, err := OpenEntry(e.cas, entry)
+	if err != nil {
+		// The node references an entry that is not present anymore.
+		e.cas.SetFsckBit()
+		return fmt.Errorf("Failed to fetch %s for %s: %s", entry.Sha1, name, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if _, err := io.CopyN(e.w, f, entry.Size); err != nil {
+		return fmt.Errorf("Failed to export %s: %s", name, err)
+	}
+	return nil
+}
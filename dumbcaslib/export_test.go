@@ -0,0 +1,84 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/maruel/ut"
+)
+
+func TestExportTar(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	foo, err := AddBytes(cas, []byte("foo"))
+	ut.AssertEqual(t, nil, err)
+	root := &Entry{}
+	e := root.AddFile("dir/foo", foo, 3)
+	e.Mode = 0600
+	e.Link = 1
+	e.Xattrs = map[string]string{"user.tag": base64.StdEncoding.EncodeToString([]byte("blue"))}
+	root.AddFile("dir/sub/bar", foo, 0).Link = 1
+	root.AddDir("empty", 0700)
+	root.AddSymlink("link", "dir/foo")
+
+	modTime := time.Date(2013, 6, 1, 0, 0, 0, 0, time.UTC)
+	buf := &bytes.Buffer{}
+	ut.AssertEqual(t, nil, ExportTar(cas, root, buf, modTime))
+
+	type member struct {
+		Typeflag byte
+		Mode     int64
+		Linkname string
+		Content  string
+	}
+	actual := map[string]member{}
+	names := []string{}
+	r := tar.NewReader(buf)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, true, hdr.ModTime.Equal(modTime))
+		content, err := ioutil.ReadAll(r)
+		ut.AssertEqual(t, nil, err)
+		names = append(names, hdr.Name)
+		actual[hdr.Name] = member{hdr.Typeflag, hdr.Mode, hdr.Linkname, string(content)}
+		if hdr.Name == "dir/foo" {
+			ut.AssertEqual(t, "blue", hdr.PAXRecords["SCHILY.xattr.user.tag"])
+		}
+	}
+	ut.AssertEqual(t, []string{"dir/", "dir/foo", "dir/sub/", "dir/sub/bar", "empty/", "link"}, names)
+	expected := map[string]member{
+		"dir/":        {tar.TypeDir, 0755, "", ""},
+		"dir/foo":     {tar.TypeReg, 0600, "", "foo"},
+		"dir/sub/":    {tar.TypeDir, 0755, "", ""},
+		"dir/sub/bar": {tar.TypeLink, 0644, "dir/foo", ""},
+		"empty/":      {tar.TypeDir, 0700, "", ""},
+		"link":        {tar.TypeSymlink, 0777, "dir/foo", ""},
+	}
+	ut.AssertEqual(t, expected, actual)
+
+	// A missing object fails the export.
+	root.AddFile("missing", Sha1Bytes([]byte("missing")), 7)
+	ut.AssertEqual(t, false, ExportTar(cas, root, ioutil.Discard, modTime) == nil)
+
+	// A crafted name can't escape the directory it is extracted to.
+	root = &Entry{Files: map[string]*Entry{"..": {Sha1: foo, Size: 3}}}
+	ut.AssertEqual(t, false, ExportTar(cas, root, ioutil.Discard, modTime) == nil)
+}
@@ -0,0 +1,195 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// ImportTar adds the files of the tar stream r to the table as they are read
+// and returns their tree, to be archived with ArchiveEntry(). The permission
+// bits, the modification times, the symlinks, the hardlinks and the extended
+// attributes stored as PAX records are kept; the owners aren't. The other
+// members, like devices, are logged to l, which may be nil, and skipped.
+func ImportTar(l *log.Logger, cas CasTable, r io.Reader) (*Entry, error) {
+	i := makeImporter(l, cas)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return i.root, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the tar stream: %s", err)
+		}
+		name, err := importName(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			continue
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			i.root.AddDir(name, mode).ModTime = hdr.ModTime.UTC()
+		case tar.TypeReg:
+			e, err := i.addFile(name, tr)
+			if err != nil {
+				return nil, err
+			}
+			e.Mode = mode
+			e.ModTime = hdr.ModTime.UTC()
+			for k, v := range hdr.PAXRecords {
+				if strings.HasPrefix(k, "SCHILY.xattr.") {
+					if e.Xattrs == nil {
+						e.Xattrs = map[string]string{}
+					}
+					// Stored base64 encoded like ReadXattrs() does.
+					e.Xattrs[k[len("SCHILY.xattr."):]] = base64.StdEncoding.EncodeToString([]byte(v))
+				}
+			}
+		case tar.TypeSymlink:
+			i.root.AddSymlink(name, hdr.Linkname)
+		case tar.TypeLink:
+			if err := i.addLink(name, hdr.Linkname); err != nil {
+				return nil, err
+			}
+		default:
+			i.skip(name, fmt.Sprintf("unsupported type %q", hdr.Typeflag))
+		}
+	}
+}
+
+// ImportZip is ImportTar() for a zip archive. The members are still read one
+// at a time.
+func ImportZip(l *log.Logger, cas CasTable, r *zip.Reader) (*Entry, error) {
+	i := makeImporter(l, cas)
+	for _, f := range r.File {
+		name, err := importName(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			continue
+		}
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			i.root.AddDir(name, mode).ModTime = f.Modified.UTC()
+		case mode&os.ModeSymlink != 0:
+			// The target is the content of the member.
+			r, err := f.Open()
+			if err != nil {
+				return nil, fmt.Errorf("Failed to import %s: %s", name, err)
+			}
+			target, err := ioutil.ReadAll(r)
+			_ = r.Close()
+			if err != nil {
+				return nil, fmt.Errorf("Failed to import %s: %s", name, err)
+			}
+			i.root.AddSymlink(name, string(target))
+		case mode.IsRegular():
+			r, err := f.Open()
+			if err != nil {
+				return nil, fmt.Errorf("Failed to import %s: %s", name, err)
+			}
+			e, err := i.addFile(name, r)
+			_ = r.Close()
+			if err != nil {
+				return nil, err
+			}
+			e.Mode = mode.Perm()
+			e.ModTime = f.Modified.UTC()
+		default:
+			i.skip(name, fmt.Sprintf("unsupported mode %s", mode))
+		}
+	}
+	return i.root, nil
+}
+
+// importName returns the path of a member relative to the root of the tree,
+// or "" for the root itself. A name escaping the root is an error.
+func importName(name string) (string, error) {
+	clean := strings.Trim(path.Clean("/"+name), "/")
+	if clean == "" {
+		return "", nil
+	}
+	for _, p := range strings.Split(clean, "/") {
+		if !isValidEntryName(p) {
+			return "", fmt.Errorf("Refusing to import %q: invalid name", name)
+		}
+	}
+	return clean, nil
+}
+
+// importer is the state of ImportTar() and ImportZip() across the members.
+type importer struct {
+	l    *log.Logger
+	cas  CasTable
+	root *Entry
+	// files are the files imported so far, to resolve the hardlinks.
+	files    map[string]*Entry
+	lastLink int
+}
+
+func makeImporter(l *log.Logger, cas CasTable) *importer {
+	return &importer{l: l, cas: cas, root: &Entry{}, files: map[string]*Entry{}}
+}
+
+// addFile adds the content of r to the table as the file name.
+func (i *importer) addFile(name string, r io.Reader) (*Entry, error) {
+	hash, size, err := ArchiveReader(i.cas, r)
+	if err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("Failed to import %s: %s", name, err)
+	}
+	e := i.root.AddFile(name, hash, size)
+	i.files[name] = e
+	return e, nil
+}
+
+// addLink adds name as a hardlink to the file target imported earlier.
+func (i *importer) addLink(name, target string) error {
+	target, err := importName(target)
+	if err != nil {
+		return err
+	}
+	first := i.files[target]
+	if first == nil {
+		return fmt.Errorf("Failed to import %s: the link target %s wasn't imported", name, target)
+	}
+	if first.Link == 0 {
+		i.lastLink++
+		first.Link = i.lastLink
+	}
+	e := i.root.AddFile(name, first.Sha1, first.Size)
+	e.Mode = first.Mode
+	e.ModTime = first.ModTime
+	e.Xattrs = first.Xattrs
+	e.Manifest = first.Manifest
+	e.Link = first.Link
+	i.files[name] = e
+	return nil
+}
+
+func (i *importer) skip(name, reason string) {
+	if i.l != nil {
+		i.l.Printf("Skipping %s: %s", name, reason)
+	}
+}
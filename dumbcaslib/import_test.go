@@ -0,0 +1,114 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/maruel/ut"
+)
+
+func TestImportTar(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	foo, err := AddBytes(cas, []byte("foo"))
+	ut.AssertEqual(t, nil, err)
+	root := &Entry{}
+	e := root.AddFile("dir/foo", foo, 3)
+	e.Mode = 0600
+	e.Link = 1
+	e.Xattrs = map[string]string{"user.tag": "blue"}
+	e.ModTime = time.Date(2012, 1, 2, 3, 4, 5, 0, time.UTC)
+	e = root.AddFile("dir/sub/bar", foo, 3)
+	e.Mode = 0600
+	e.Link = 1
+	e.Xattrs = map[string]string{"user.tag": "blue"}
+	e.ModTime = time.Date(2012, 1, 2, 3, 4, 5, 0, time.UTC)
+	root.AddDir("empty", 0700)
+	root.AddSymlink("link", "dir/foo")
+	buf := &bytes.Buffer{}
+	now := time.Date(2014, 5, 6, 7, 8, 9, 0, time.UTC)
+	ut.AssertEqual(t, nil, ExportTar(cas, root, buf, now))
+
+	// Import into another table so the content is verified to be copied.
+	other := MakeMemoryCasTable()
+	actual, err := ImportTar(nil, other, buf)
+	ut.AssertEqual(t, nil, err)
+	// The directories exported are recorded with their mode and the members
+	// without a modification time get the one of the export, except the
+	// symlinks which don't keep it.
+	root.Files["dir"].Mode = os.ModeDir | 0755
+	root.Files["dir"].ModTime = now
+	root.Files["dir"].Files["sub"].Mode = os.ModeDir | 0755
+	root.Files["dir"].Files["sub"].ModTime = now
+	root.Files["empty"].ModTime = now
+	ut.AssertEqual(t, root, actual)
+	ut.AssertEqual(t, "foo", readEntry(t, other, foo))
+
+	// A member can't escape the root, even with a relative path.
+	buf.Reset()
+	w := tar.NewWriter(buf)
+	ut.AssertEqual(t, nil, w.WriteHeader(&tar.Header{Name: "../../etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 3}))
+	_, err = w.Write([]byte("foo"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, w.WriteHeader(&tar.Header{Name: "fifo", Typeflag: tar.TypeFifo, Mode: 0644}))
+	ut.AssertEqual(t, nil, w.Close())
+	actual, err = ImportTar(nil, other, buf)
+	ut.AssertEqual(t, nil, err)
+	expected := &Entry{}
+	e = expected.AddFile("etc/passwd", foo, 3)
+	e.Mode = 0644
+	e.ModTime = time.Unix(0, 0).UTC()
+	ut.AssertEqual(t, expected, actual)
+}
+
+func TestImportZip(t *testing.T) {
+	t.Parallel()
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	modTime := time.Date(2012, 1, 2, 3, 4, 5, 0, time.UTC)
+	hdr := &zip.FileHeader{Name: "dir/foo", Method: zip.Deflate, Modified: modTime}
+	hdr.SetMode(0600)
+	f, err := w.CreateHeader(hdr)
+	ut.AssertEqual(t, nil, err)
+	_, err = f.Write([]byte("foo"))
+	ut.AssertEqual(t, nil, err)
+	hdr = &zip.FileHeader{Name: "link"}
+	hdr.SetMode(os.ModeSymlink | 0777)
+	f, err = w.CreateHeader(hdr)
+	ut.AssertEqual(t, nil, err)
+	_, err = f.Write([]byte("dir/foo"))
+	ut.AssertEqual(t, nil, err)
+	hdr = &zip.FileHeader{Name: "empty/", Modified: modTime}
+	hdr.SetMode(os.ModeDir | 0700)
+	_, err = w.CreateHeader(hdr)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, w.Close())
+
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	ut.AssertEqual(t, nil, err)
+	cas := MakeMemoryCasTable()
+	actual, err := ImportZip(nil, cas, z)
+	ut.AssertEqual(t, nil, err)
+	foo := Sha1Bytes([]byte("foo"))
+	expected := &Entry{}
+	e := expected.AddFile("dir/foo", foo, 3)
+	e.Mode = 0600
+	e.ModTime = modTime
+	expected.AddSymlink("link", "dir/foo")
+	expected.AddDir("empty", 0700).ModTime = modTime
+	ut.AssertEqual(t, expected, actual)
+	ut.AssertEqual(t, "foo", readEntry(t, cas, foo))
+}
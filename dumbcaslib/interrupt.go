@@ -0,0 +1,64 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"sync"
+)
+
+// interruption is the state of the interruption of the current operation.
+// Unlike github.com/maruel/interrupt, it can be reset so the tests can
+// interrupt an operation and then run the next ones.
+var interruption = struct {
+	lock sync.Mutex
+	c    chan struct{}
+}{c: make(chan struct{})}
+
+// Interrupted returns a channel closed once the current operation must stop,
+// e.g. on Ctrl-C; see SetInterrupted().
+func Interrupted() <-chan struct{} {
+	interruption.lock.Lock()
+	defer interruption.lock.Unlock()
+	return interruption.c
+}
+
+// IsInterrupted returns true once the current operation must stop. The long
+// operations check it to stop early, leaving a consistent state.
+func IsInterrupted() bool {
+	select {
+	case <-Interrupted():
+		return true
+	default:
+		return false
+	}
+}
+
+// SetInterrupted requests the current operation to stop. It is called on the
+// first SIGINT or SIGTERM.
+func SetInterrupted() {
+	interruption.lock.Lock()
+	defer interruption.lock.Unlock()
+	select {
+	case <-interruption.c:
+	default:
+		close(interruption.c)
+	}
+}
+
+// ResetInterrupted clears the state set by SetInterrupted().
+func ResetInterrupted() {
+	interruption.lock.Lock()
+	defer interruption.lock.Unlock()
+	select {
+	case <-interruption.c:
+		interruption.c = make(chan struct{})
+	default:
+	}
+}
@@ -0,0 +1,208 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const lockName = "lock"
+const exclusiveLockName = "exclusive"
+const sharedLockPrefix = "shared."
+
+// ErrLocked is returned by Locker.Lock() when the lock is held by another
+// operation.
+var ErrLocked = errors.New("Another dumbcas operation holds the lock")
+
+// Locker protects a root against concurrent operations. Any number of shared
+// locks can be held at once, which is what writers like archive need, or a
+// single exclusive lock, which is what gc needs so the blobs being written are
+// not seen as orphans.
+type Locker interface {
+	// Lock returns ErrLocked if the lock can't be acquired. It doesn't wait.
+	Lock(exclusive bool) (Lock, error)
+}
+
+// Lock is a lock acquired with Locker.Lock().
+type Lock interface {
+	Unlock() error
+}
+
+type localLocker struct {
+	lockDir string
+}
+
+type localLock struct {
+	path string
+}
+
+// MakeLocalLocker returns a Locker based on files in rootDir. Each lock file
+// contains the PID of its owner so the locks of dead processes are reclaimed.
+func MakeLocalLocker(rootDir string) Locker {
+	return &localLocker{filepath.Join(rootDir, lockName)}
+}
+
+func (l *localLocker) Lock(exclusive bool) (Lock, error) {
+	if err := os.MkdirAll(l.lockDir, 0750); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("Failed to create %s: %s", l.lockDir, err)
+	}
+	// The lock file is created before looking at the others; of two processes
+	// racing, at least one sees the other.
+	var lock *localLock
+	if exclusive {
+		p := filepath.Join(l.lockDir, exclusiveLockName)
+		for {
+			f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+			if err == nil {
+				lock = &localLock{p}
+				err = writePid(f)
+				if err != nil {
+					_ = lock.Unlock()
+					return nil, err
+				}
+				break
+			}
+			if !os.IsExist(err) {
+				return nil, fmt.Errorf("Failed to create %s: %s", p, err)
+			}
+			if isLockAlive(p) {
+				return nil, ErrLocked
+			}
+			// Stale lock.
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("Failed to reclaim %s: %s", p, err)
+			}
+		}
+	} else {
+		f, err := ioutil.TempFile(l.lockDir, fmt.Sprintf("%s%d.", sharedLockPrefix, os.Getpid()))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create a lock in %s: %s", l.lockDir, err)
+		}
+		lock = &localLock{f.Name()}
+		if err := writePid(f); err != nil {
+			_ = lock.Unlock()
+			return nil, err
+		}
+	}
+
+	names, err := readDirNames(l.lockDir)
+	if err != nil {
+		_ = lock.Unlock()
+		return nil, err
+	}
+	for _, name := range names {
+		p := filepath.Join(l.lockDir, name)
+		if p == lock.path || (!exclusive && !strings.HasPrefix(name, exclusiveLockName)) {
+			continue
+		}
+		if isLockAlive(p) {
+			_ = lock.Unlock()
+			return nil, ErrLocked
+		}
+		_ = os.Remove(p)
+	}
+	return lock, nil
+}
+
+func (l *localLock) Unlock() error {
+	return os.Remove(l.path)
+}
+
+func writePid(f *os.File) error {
+	_, err := f.WriteString(strconv.Itoa(os.Getpid()))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to write %s: %s", f.Name(), err)
+	}
+	return nil
+}
+
+// isLockAlive returns false if the process owning the lock file is dead. A lock
+// file being written is considered alive.
+func isLockAlive(p string) bool {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return !os.IsNotExist(err)
+	}
+	if len(data) == 0 {
+		return true
+	}
+	pid, err := strconv.Atoi(string(data))
+	if err != nil {
+		// Not a lock file written by this package.
+		return false
+	}
+	return isProcessAlive(pid)
+}
+
+func isProcessAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// FindProcess fails if the process doesn't exist.
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+type memoryLocker struct {
+	lock      sync.Mutex
+	shared    int
+	exclusive bool
+}
+
+type memoryLock struct {
+	l         *memoryLocker
+	exclusive bool
+}
+
+// MakeMemoryLocker returns an in-memory Locker for unit testing.
+func MakeMemoryLocker() Locker {
+	return &memoryLocker{}
+}
+
+func (m *memoryLocker) Lock(exclusive bool) (Lock, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.exclusive || (exclusive && m.shared != 0) {
+		return nil, ErrLocked
+	}
+	if exclusive {
+		m.exclusive = true
+	} else {
+		m.shared++
+	}
+	return &memoryLock{m, exclusive}, nil
+}
+
+func (m *memoryLock) Unlock() error {
+	m.l.lock.Lock()
+	defer m.l.lock.Unlock()
+	if m.exclusive {
+		m.l.exclusive = false
+	} else {
+		m.l.shared--
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func testLockerImpl(t *testing.T, l Locker) {
+	s1, err := l.Lock(false)
+	ut.AssertEqual(t, nil, err)
+	s2, err := l.Lock(false)
+	ut.AssertEqual(t, nil, err)
+	_, err = l.Lock(true)
+	ut.AssertEqual(t, ErrLocked, err)
+
+	ut.AssertEqual(t, nil, s1.Unlock())
+	ut.AssertEqual(t, nil, s2.Unlock())
+	e, err := l.Lock(true)
+	ut.AssertEqual(t, nil, err)
+	_, err = l.Lock(true)
+	ut.AssertEqual(t, ErrLocked, err)
+	_, err = l.Lock(false)
+	ut.AssertEqual(t, ErrLocked, err)
+
+	ut.AssertEqual(t, nil, e.Unlock())
+	s1, err = l.Lock(false)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, s1.Unlock())
+}
+
+func TestMemoryLocker(t *testing.T) {
+	t.Parallel()
+	testLockerImpl(t, MakeMemoryLocker())
+}
+
+func TestLocalLocker(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "lock")
+	defer removeDir(t, tempData)
+	testLockerImpl(t, MakeLocalLocker(tempData))
+}
+
+func TestLocalLockerStale(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "lock_stale")
+	defer removeDir(t, tempData)
+	l := MakeLocalLocker(tempData)
+	s, err := l.Lock(false)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, s.Unlock())
+
+	// Locks left behind by a dead process are reclaimed.
+	const deadPid = "1073741823"
+	lockDir := filepath.Join(tempData, lockName)
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(lockDir, exclusiveLockName), []byte(deadPid), 0600))
+	s, err = l.Lock(false)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, s.Unlock())
+
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(lockDir, sharedLockPrefix+deadPid), []byte(deadPid), 0600))
+	e, err := l.Lock(true)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, e.Unlock())
+	names, err := readDirNames(lockDir)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, names)
+}
@@ -11,12 +11,16 @@ package dumbcaslib
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
@@ -27,13 +31,154 @@ import (
 type Node struct {
 	Entry   string
 	Comment string `json:",omitempty"`
+	// Created is set by NodesTable.AddEntry() when not already set. It is the
+	// zero time for the nodes archived before it was recorded.
+	Created time.Time
+	// Tags are arbitrary key=value pairs to select the nodes by, e.g.
+	// "schedule": "daily". The value may be empty.
+	Tags map[string]string `json:",omitempty"`
+	// Parent is the node this one is an increment of, archived with -since.
+	Parent string `json:",omitempty"`
+	// Checksum is the sha-1 of the node file without its "Checksum" member,
+	// set by NodesTable.AddEntry() so a corrupted node file is detected when
+	// loaded. It is empty for the nodes archived before it was recorded.
+	Checksum string `json:",omitempty"`
+}
+
+// withCreated returns the serialized node, with Created set to now if it was
+// not set and its checksum.
+func (n *Node) withCreated(now time.Time) ([]byte, error) {
+	c := *n
+	if c.Created.IsZero() {
+		c.Created = now
+	}
+	c.Checksum = ""
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshall internal state: %s", err)
+	}
+	// Append the member to the serialized object so the bytes hashed are the
+	// ones stored.
+	member := []byte(`,"Checksum":"` + Sha1Bytes(data) + `"}`)
+	return append(data[:len(data)-1], member...), nil
+}
+
+// nodeChecksum returns the sha-1 of the serialized node data without its
+// "Checksum" member, whose value is sum. The raw bytes are hashed instead of
+// the decoded node so the fields unknown to this version are covered as is.
+func nodeChecksum(data []byte, sum string) string {
+	member := []byte(`,"Checksum":"` + sum + `"`)
+	if !bytes.Contains(data, member) {
+		// It is the first member.
+		member = []byte(`"Checksum":"` + sum + `",`)
+	}
+	return Sha1Bytes(bytes.Replace(data, member, nil, 1))
+}
+
+// decodeNode loads a serialized node from r and verifies its checksum, if
+// any.
+func decodeNode(r io.Reader, node *Node) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, node); err != nil {
+		return err
+	}
+	if node.Checksum == "" {
+		return nil
+	}
+	if nodeChecksum(data, node.Checksum) != node.Checksum {
+		return fmt.Errorf("Checksum mismatch; the node is corrupted")
+	}
+	return nil
+}
+
+// nodeMetadata returns the serialized node or an empty node if it is
+// corrupted, for the creation time and the tags reported by Enumerate().
+func nodeMetadata(data []byte) *Node {
+	node := &Node{}
+	if err := json.Unmarshal(data, node); err != nil {
+		return &Node{}
+	}
+	return node
+}
+
+// nodeTimeFormat is the format of the creation time embedded in node names;
+// see NodesTable.AddEntry().
+const nodeTimeFormat = "2006-01-02_15-04-05"
+
+var reNodeTimestamp = regexp.MustCompile(`(\d{4}-\d{2}-\d{2}_\d{2}-\d{2}-\d{2})_`)
+
+// NodeTime returns the creation time embedded in a node name, in UTC.
+func NodeTime(name string) (time.Time, error) {
+	match := reNodeTimestamp.FindStringSubmatch(filepath.Base(name))
+	if match == nil {
+		return time.Time{}, fmt.Errorf("%s doesn't contain a timestamp", name)
+	}
+	return time.Parse(nodeTimeFormat, match[1])
 }
 
 // NodesTable is an index to a CasTable.
 type NodesTable interface {
 	Table
+	// EnumerateCtx is like Enumerate() but stops and closes the channel once ctx
+	// is done, so the caller can stop reading early.
+	EnumerateCtx(ctx context.Context) <-chan EnumerationEntry
 	// AddEntry adds a node to the table.
 	AddEntry(node *Node, name string) (string, error)
+	// Rename renames the node oldName to newName without touching the content
+	// it references, e.g. to promote a tag. newName is validated with
+	// CheckNodeName(). It fails if newName exists, unless overwrite is set.
+	Rename(oldName, newName string, overwrite bool) error
+}
+
+// reNodeNameChars matches the characters allowed in each directory of a node
+// name given to Rename().
+var reNodeNameChars = regexp.MustCompile(`^[A-Za-z0-9._+=@()-]+$`)
+
+// CheckNodeName returns an error if name, relative to the nodes table and
+// using forward slashes or the OS separator, can't be used as a node name:
+// only letters, digits and ._+=@()- are allowed and it can't be in the trash.
+func CheckNodeName(name string) error {
+	p := filepath.ToSlash(name)
+	if !isValidNodePath(p) {
+		return fmt.Errorf("invalid node name %q", name)
+	}
+	parts := strings.Split(p, "/")
+	if parts[0] == trashName {
+		return fmt.Errorf("invalid node name %q: %s is reserved", name, trashName)
+	}
+	for _, part := range parts {
+		if part == "." || !reNodeNameChars.MatchString(part) {
+			return fmt.Errorf("invalid node name %q: only letters, digits and ._+=@()- are allowed", name)
+		}
+	}
+	return nil
+}
+
+// TagName returns the node name of the tag name.
+func TagName(name string) string {
+	return tagsName + "/" + name
+}
+
+// IsTag returns true if the node name, using forward slashes or the OS
+// separator, is a tag aliasing a node instead of a node.
+func IsTag(name string) bool {
+	return strings.HasPrefix(filepath.ToSlash(name), tagsName+"/")
+}
+
+// LoadNodesTable returns the NodesTable stored at root, either a local
+// directory or the URL of the nodes served by "dumbcas web" like
+// "http://host:8010/content/nodes".
+func LoadNodesTable(root string, cas CasTable) (NodesTable, error) {
+	if strings.HasPrefix(root, "http://") || strings.HasPrefix(root, "https://") {
+		return MakeHTTPNodesTable(root)
+	}
+	if IsRemote(root) {
+		return nil, fmt.Errorf("LoadNodesTable(%s): only the http and https URLs are supported", root)
+	}
+	return LoadLocalNodesTable(root, cas)
 }
 
 // EnumerateNodesAsList returns a sorted list of all the entries. It is means
@@ -77,7 +222,7 @@ func (m *memoryNodesTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				}
 
 				node := &Node{}
-				if err := json.Unmarshal(v, node); err != nil {
+				if err := decodeNode(bytes.NewReader(v), node); err != nil {
 					http.Error(w, fmt.Sprintf("Failed to load the entry file: %s", err), http.StatusNotFound)
 					return
 				}
@@ -122,18 +267,19 @@ func (m *memoryNodesTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (m *memoryNodesTable) AddEntry(node *Node, name string) (string, error) {
-	data, err := json.Marshal(node)
+	now := time.Now().UTC()
+	data, err := node.withCreated(now)
 	if err != nil {
-		return "", fmt.Errorf("Failed to marshall internal state: %s", err)
+		return "", err
 	}
-
-	now := time.Now().UTC()
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	monthName := now.Format("2006-01")
 
 	nodePath := ""
 	suffix := 0
 	for {
-		nodeName := now.Format("2006-01-02_15-04-05") + "_" + name
+		nodeName := now.Format(nodeTimeFormat) + "_" + name
 		if suffix != 0 {
 			nodeName += fmt.Sprintf("(%d)", suffix)
 		}
@@ -146,23 +292,30 @@ func (m *memoryNodesTable) AddEntry(node *Node, name string) (string, error) {
 		suffix++
 	}
 	// The real implementation creates a symlink if possible.
-	m.entries[tagsName+"/"+name] = data
+	m.entries[TagName(name)] = data
 	return nodePath, nil
 }
 
 func (m *memoryNodesTable) Enumerate() <-chan EnumerationEntry {
+	return m.EnumerateCtx(context.Background())
+}
+
+func (m *memoryNodesTable) EnumerateCtx(ctx context.Context) <-chan EnumerationEntry {
 	c := make(chan EnumerationEntry)
 	go func() {
+		defer close(c)
 		m.lock.Lock()
 		entries := make(map[string][]byte)
 		for k, v := range m.entries {
 			entries[k] = v
 		}
 		m.lock.Unlock()
-		for k := range entries {
-			c <- EnumerationEntry{Item: k}
+		for k, v := range entries {
+			node := nodeMetadata(v)
+			if !sendEntry(ctx, c, EnumerationEntry{Item: k, Created: node.Created, Tags: node.Tags}) {
+				return
+			}
 		}
-		close(c)
 	}()
 	return c
 }
@@ -187,6 +340,25 @@ func (m *memoryNodesTable) Remove(name string) error {
 	return nil
 }
 
+func (m *memoryNodesTable) Rename(oldName, newName string, overwrite bool) error {
+	if err := CheckNodeName(newName); err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	data, ok := m.entries[oldName]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if _, ok := m.entries[newName]; ok && !overwrite {
+		return os.ErrExist
+	}
+	// The tags are copies, not links.
+	delete(m.entries, oldName)
+	m.entries[newName] = data
+	return nil
+}
+
 func (m *memoryNodesTable) Corrupt() {
 	m.entries["tags/fictious"] = []byte("Invalid JSON")
 }
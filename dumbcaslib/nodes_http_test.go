@@ -0,0 +1,146 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestHTTPNodesTable(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	remote := MakeMemoryNodesTable(cas)
+	server := httptest.NewServer(MakeNodesHandler(remote, MakeMemoryLocker()))
+	defer server.Close()
+	nodes, err := LoadNodesTable(server.URL+"/", cas)
+	ut.AssertEqual(t, nil, err)
+
+	items, err := EnumerateNodesAsList(nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, items)
+
+	_, name, _ := archiveData(t, cas, nodes, map[string]string{"file1": "content1"})
+	items, err = EnumerateNodesAsList(nodes)
+	ut.AssertEqual(t, nil, err)
+	expected, err := EnumerateNodesAsList(remote)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, items)
+	ut.AssertEqual(t, 2, len(items))
+
+	local, err := LoadNode(remote, name)
+	ut.AssertEqual(t, nil, err)
+	node, err := LoadNode(nodes, name)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, local, node)
+	found := false
+	for item := range nodes.Enumerate() {
+		if item.Item == name {
+			found = true
+			ut.AssertEqual(t, true, node.Created.Equal(item.Created))
+		}
+	}
+	ut.AssertEqual(t, true, found)
+
+	ut.AssertEqual(t, nil, nodes.Remove(name))
+	ut.AssertEqual(t, true, os.IsNotExist(nodes.Remove(name)))
+	_, err = nodes.Open(name)
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+	items, err = EnumerateNodesAsList(remote)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{filepath.Join(tagsName, "fictious")}, items)
+}
+
+// brokenNodesTable fails its enumeration after the first node.
+type brokenNodesTable struct {
+	NodesTable
+}
+
+func (b *brokenNodesTable) EnumerateCtx(ctx context.Context) <-chan EnumerationEntry {
+	c := make(chan EnumerationEntry, 2)
+	c <- EnumerationEntry{Item: "node"}
+	c <- EnumerationEntry{Error: errors.New("disk failure")}
+	close(c)
+	return c
+}
+
+func TestHTTPNodesTableEnumerateError(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	server := httptest.NewServer(MakeNodesHandler(&brokenNodesTable{MakeMemoryNodesTable(cas)}, nil))
+	defer server.Close()
+	nodes, err := LoadNodesTable(server.URL+"/", cas)
+	ut.AssertEqual(t, nil, err)
+	// The list is not mistaken for a complete one.
+	_, err = EnumerateNodesAsList(nodes)
+	ut.AssertEqual(t, true, err != nil && strings.Contains(err.Error(), "disk failure"))
+
+	// Neither is a list without its last line.
+	truncated := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("{\"name\":\"node\"}\n"))
+	}))
+	defer truncated.Close()
+	nodes, err = LoadNodesTable(truncated.URL+"/", cas)
+	ut.AssertEqual(t, nil, err)
+	_, err = EnumerateNodesAsList(nodes)
+	ut.AssertEqual(t, true, err != nil && strings.Contains(err.Error(), "truncated"))
+}
+
+func TestHTTPNodesTableRename(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	server := httptest.NewServer(MakeNodesHandler(MakeMemoryNodesTable(cas), MakeMemoryLocker()))
+	defer server.Close()
+	nodes, err := LoadNodesTable(server.URL+"/", cas)
+	ut.AssertEqual(t, nil, err)
+	testNodesRenameImpl(t, nodes)
+}
+
+func TestNodesHandlerInvalid(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	nodes := MakeMemoryNodesTable(cas)
+	serve := func(h http.Handler, method, url, body string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, url, strings.NewReader(body)))
+		return w.Code
+	}
+	locker := MakeMemoryLocker()
+	h := MakeNodesHandler(nodes, locker)
+	ut.AssertEqual(t, 400, serve(h, "GET", "/../foo", ""))
+	ut.AssertEqual(t, 400, serve(h, "GET", "/a//b", ""))
+	ut.AssertEqual(t, 404, serve(h, "GET", "/foo", ""))
+	ut.AssertEqual(t, 400, serve(h, "POST", "/?name=a/b", "{}"))
+	ut.AssertEqual(t, 400, serve(h, "POST", "/?name=a", "not json"))
+	ut.AssertEqual(t, 405, serve(h, "PUT", "/foo", ""))
+
+	// The nodes are modified under the shared lock, so not while gc runs.
+	lock, err := locker.Lock(true)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 503, serve(h, "POST", "/?name=a", "{}"))
+	ut.AssertEqual(t, 503, serve(h, "POST", "/foo?rename=bar", ""))
+	ut.AssertEqual(t, 503, serve(h, "DELETE", "/foo", ""))
+	ut.AssertEqual(t, nil, lock.Unlock())
+	ut.AssertEqual(t, 201, serve(h, "POST", "/?name=a", "{}"))
+
+	// Read-only.
+	h = MakeNodesHandler(nodes, nil)
+	ut.AssertEqual(t, 405, serve(h, "POST", "/?name=a", "{}"))
+	ut.AssertEqual(t, 405, serve(h, "DELETE", "/foo", ""))
+	ut.AssertEqual(t, 200, serve(h, "GET", "/list", ""))
+}
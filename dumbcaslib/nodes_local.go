@@ -10,10 +10,11 @@ limitations under the License. */
 package dumbcaslib
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"html"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
@@ -22,8 +23,6 @@ import (
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/maruel/interrupt"
 )
 
 // The nodes are stored in a separate directory from the CAS store.
@@ -80,11 +79,11 @@ func LoadLocalNodesTable(rootDir string, cas CasTable) (NodesTable, error) {
 }
 
 func (n *nodesTable) AddEntry(node *Node, name string) (string, error) {
-	data, err := json.Marshal(node)
+	now := time.Now().UTC()
+	data, err := node.withCreated(now)
 	if err != nil {
-		return "", fmt.Errorf("Failed to marshall internal state: %s", err)
+		return "", err
 	}
-	now := time.Now().UTC()
 	// Create one directory store per month.
 	monthName := now.Format("2006-01")
 	monthDir := filepath.Join(n.nodesDir, monthName)
@@ -95,7 +94,7 @@ func (n *nodesTable) AddEntry(node *Node, name string) (string, error) {
 	nodeName := ""
 	nodePath := ""
 	for {
-		nodeName = n.hostname + "_" + now.Format("2006-01-02_15-04-05") + "_" + name
+		nodeName = n.hostname + "_" + now.Format(nodeTimeFormat) + "_" + name
 		if suffix != 0 {
 			nodeName += fmt.Sprintf("(%d)", suffix)
 		}
@@ -141,18 +140,87 @@ func (n *nodesTable) AddEntry(node *Node, name string) (string, error) {
 	return filepath.Join(monthName, nodeName), nil
 }
 
+func (n *nodesTable) Rename(oldName, newName string, overwrite bool) error {
+	if err := CheckNodeName(newName); err != nil {
+		return err
+	}
+	oldPath := filepath.Join(n.nodesDir, oldName)
+	newPath := filepath.Join(n.nodesDir, newName)
+	stat, err := os.Lstat(oldPath)
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		return fmt.Errorf("%s is not a node", oldName)
+	}
+	if _, err := os.Lstat(newPath); err == nil && !overwrite {
+		return &os.PathError{Op: "rename", Path: newName, Err: os.ErrExist}
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), 0750); err != nil {
+		return err
+	}
+	if stat.Mode()&os.ModeSymlink == 0 {
+		if err := os.Rename(oldPath, newPath); err != nil {
+			return err
+		}
+		return n.retargetTags(oldPath, newPath)
+	}
+	// The tags are relative symlinks so they are recreated from their new
+	// directory.
+	target, err := filepath.EvalSymlinks(oldPath)
+	if err != nil {
+		return err
+	}
+	if err := n.symlink(target, newPath); err != nil {
+		return err
+	}
+	return os.Remove(oldPath)
+}
+
+// symlink replaces path with a relative symlink to target.
+func (n *nodesTable) symlink(target, path string) error {
+	relPath, err := filepath.Rel(filepath.Dir(path), target)
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(path)
+	return os.Symlink(relPath, path)
+}
+
+// retargetTags updates the tags linking to the node moved from oldPath to
+// newPath.
+func (n *nodesTable) retargetTags(oldPath, newPath string) error {
+	return filepath.Walk(filepath.Join(n.nodesDir, tagsName), func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			// No tag or a copy of the node.
+			return nil
+		}
+		if target, err := os.Readlink(p); err == nil && filepath.Join(filepath.Dir(p), target) == oldPath {
+			return n.symlink(newPath, p)
+		}
+		return nil
+	})
+}
+
 func (n *nodesTable) Open(item string) (ReadSeekCloser, error) {
 	return os.Open(filepath.Join(n.nodesDir, item))
 }
 
 // Enumerates all the entries in the table.
 func (n *nodesTable) Enumerate() <-chan EnumerationEntry {
+	return n.EnumerateCtx(context.Background())
+}
+
+func (n *nodesTable) EnumerateCtx(ctx context.Context) <-chan EnumerationEntry {
 	items := make(chan EnumerationEntry)
-	c := EnumerateTree(n.nodesDir)
+	// The tree walk is stopped along with this enumeration.
+	ctx, cancel := context.WithCancel(ctx)
+	c := EnumerateTreeCtx(ctx, n.nodesDir, TreeOptions{})
 	go func() {
+		defer cancel()
 		for {
 			select {
-			case <-interrupt.Channel:
+			case <-Interrupted():
 				close(items)
 				return
 			case v, ok := <-c:
@@ -161,21 +229,36 @@ func (n *nodesTable) Enumerate() <-chan EnumerationEntry {
 					return
 				}
 				if v.Error != nil {
-					items <- EnumerationEntry{Error: v.Error}
+					if !sendEntry(ctx, items, EnumerationEntry{Error: v.Error}) {
+						close(items)
+						return
+					}
 					continue
 				}
 				if v.FileInfo.IsDir() {
 					continue
 				}
 				relPath := v.FullPath[len(n.nodesDir)+1:]
-				if filepath.Base(relPath) == trashName {
+				if strings.SplitN(filepath.ToSlash(relPath), "/", 2)[0] == trashName {
 					// TODO(maruel): Cancel iterating inside the directory!
 					continue
 				}
-				items <- EnumerationEntry{Item: relPath}
+				// Fall back to the file modification time for the nodes archived
+				// before the creation time was recorded.
+				node := &Node{}
+				if data, err := ioutil.ReadFile(v.FullPath); err == nil {
+					node = nodeMetadata(data)
+				}
+				created := node.Created
+				if created.IsZero() {
+					created = v.FileInfo.ModTime().UTC()
+				}
+				if !sendEntry(ctx, items, EnumerationEntry{Item: relPath, Created: created, Tags: node.Tags}) {
+					close(items)
+					return
+				}
 			}
 		}
-		close(items)
 	}()
 	return items
 }
@@ -232,7 +315,7 @@ func (n *nodesTable) getNode(url string) (*Node, string, error) {
 			rest = rest[i+1:]
 		}
 		// Convert to OS file path.
-		relPath := strings.Replace(strings.Trim(prefix, "/"), "/", string(filepath.Separator), 0)
+		relPath := filepath.FromSlash(strings.Trim(prefix, "/"))
 		f, err := os.Open(filepath.Join(n.nodesDir, relPath))
 		if err != nil {
 			return nil, "", err
@@ -246,7 +329,7 @@ func (n *nodesTable) getNode(url string) (*Node, string, error) {
 		}
 		if !stat.IsDir() {
 			node := &nodeCache{}
-			if err := LoadReaderAsJSON(f, &node.Node); err == nil {
+			if err := decodeNode(f, &node.Node); err == nil {
 				node.lastAccess = time.Now()
 				// Note that prefix is using "/" as path separator.
 				go n.updateNodeCache(prefix, node)
@@ -380,7 +463,7 @@ func (n *nodesTable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		localRedirect(w, r, path.Base(r.URL.Path)+"/")
 		return
 	}
-	files, _ := readDirFancy(strings.Replace(path.Join(n.nodesDir, name), "/", string(filepath.Separator), -1))
+	files, _ := readDirFancy(filepath.Join(n.nodesDir, filepath.FromSlash(name)))
 	dirList(w, files)
 	return
 }
@@ -10,7 +10,12 @@ limitations under the License. */
 package dumbcaslib
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/maruel/ut"
 )
@@ -27,3 +32,77 @@ func TestNodesTable(t *testing.T) {
 
 	testNodesTableImpl(t, cas, nodes)
 }
+
+func TestNodesTableRename(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "nodes")
+	defer removeDir(t, tempData)
+
+	nodes, err := LoadLocalNodesTable(tempData, MakeMemoryCasTable())
+	ut.AssertEqual(t, nil, err)
+	testNodesRenameImpl(t, nodes)
+
+	// The tag is still a symlink, now to the renamed node.
+	target, err := os.Readlink(filepath.Join(tempData, nodesName, tagsName, "2024-06-daily"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, false, filepath.IsAbs(target))
+}
+
+func TestNodesTableCreated(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "nodes")
+	defer removeDir(t, tempData)
+
+	cas := MakeMemoryCasTable()
+	nodes, err := LoadLocalNodesTable(tempData, cas)
+	ut.AssertEqual(t, nil, err)
+	start := time.Now().UTC()
+	_, nodeName, _ := archiveData(t, cas, nodes, map[string]string{"file1": "content1"})
+
+	// A node archived before the creation time was recorded.
+	oldDir := filepath.Join(tempData, nodesName, "2012-01")
+	ut.AssertEqual(t, nil, os.Mkdir(oldDir, 0750))
+	oldPath := filepath.Join(oldDir, "2012-01-02_03-04-05_old")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(oldPath, []byte("{\"Entry\":\"0123\"}"), 0640))
+	mtime := time.Date(2012, 1, 2, 3, 4, 5, 0, time.UTC)
+	ut.AssertEqual(t, nil, os.Chtimes(oldPath, mtime, mtime))
+
+	// Moved to the trash, e.g. by prune.
+	trashDir := filepath.Join(tempData, nodesName, trashName, "2012-01")
+	ut.AssertEqual(t, nil, os.MkdirAll(trashDir, 0750))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(trashDir, "2012-01-01_00-00-00_gone"), []byte("{}"), 0640))
+
+	created := map[string]time.Time{}
+	for item := range nodes.Enumerate() {
+		ut.AssertEqual(t, nil, item.Error)
+		created[item.Item] = item.Created
+	}
+	ut.AssertEqual(t, 3, len(created))
+	ut.AssertEqual(t, true, mtime.Equal(created[filepath.Join("2012-01", "2012-01-02_03-04-05_old")]))
+	ut.AssertEqual(t, false, created[nodeName].Before(start.Truncate(time.Second)))
+
+	node, err := LoadNode(nodes, nodeName)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, node.Created.Equal(created[nodeName]))
+}
+
+func TestNodesTableEnumerateCancel(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "nodes_cancel")
+	defer removeDir(t, tempData)
+
+	cas := MakeMemoryCasTable()
+	nodes, err := LoadLocalNodesTable(tempData, cas)
+	ut.AssertEqual(t, nil, err)
+	archiveData(t, cas, nodes, map[string]string{"file1": "content1"})
+	archiveData(t, cas, nodes, map[string]string{"file2": "content2"})
+
+	// Stop reading after the first node; the channel is closed.
+	ctx, cancel := context.WithCancel(context.Background())
+	c := nodes.EnumerateCtx(ctx)
+	item := <-c
+	ut.AssertEqual(t, nil, item.Error)
+	cancel()
+	for range c {
+	}
+}
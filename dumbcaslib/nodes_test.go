@@ -31,6 +31,116 @@ func TestFakeNodesTable(t *testing.T) {
 	testNodesTableImpl(t, cas, MakeMemoryNodesTable(cas))
 }
 
+func TestFakeNodesTableRename(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	testNodesRenameImpl(t, MakeMemoryNodesTable(cas))
+}
+
+func TestCheckNodeName(t *testing.T) {
+	t.Parallel()
+	valid := []string{"tags/2024-06-daily", "2024-06/host_name", "a.b+c=d@(e)_f", filepath.Join("tags", "foo")}
+	for _, name := range valid {
+		ut.AssertEqualf(t, nil, CheckNodeName(name), "%s", name)
+	}
+	invalid := []string{"", "/foo", "foo/", "../foo", "foo/../bar", "./foo", "trash/foo", "a b", "tags/é", "foo*", "foo//bar"}
+	for _, name := range invalid {
+		ut.AssertEqualf(t, true, CheckNodeName(name) != nil, "%s", name)
+	}
+}
+
+func TestIsTag(t *testing.T) {
+	t.Parallel()
+	ut.AssertEqual(t, "tags/daily", TagName("daily"))
+	ut.AssertEqual(t, true, IsTag(TagName("daily")))
+	ut.AssertEqual(t, true, IsTag(filepath.Join("tags", "daily")))
+	ut.AssertEqual(t, false, IsTag("2024-06/host_name"))
+	ut.AssertEqual(t, false, IsTag("tags"))
+}
+
+func TestNodeChecksum(t *testing.T) {
+	t.Parallel()
+	cas := MakeMemoryCasTable()
+	nodes := MakeMemoryNodesTable(cas)
+	name, err := nodes.AddEntry(&Node{Entry: "0123456789012345678901234567890123456789", Comment: "hello"}, "foo")
+	ut.AssertEqual(t, nil, err)
+	node, err := LoadNode(nodes, name)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 40, len(node.Checksum))
+
+	m := nodes.(*memoryNodesTable)
+	m.entries[name] = bytes.Replace(m.entries[name], []byte("hello"), []byte("jello"), 1)
+	_, err = LoadNode(nodes, name)
+	ut.AssertEqual(t, true, err != nil && strings.Contains(err.Error(), "Checksum mismatch"))
+
+	// The nodes archived before the checksum was recorded are still loaded.
+	m.entries[name] = []byte(`{"Entry":"0123456789012345678901234567890123456789","Created":"2013-01-01T00:00:00Z"}`)
+	node, err = LoadNode(nodes, name)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "", node.Checksum)
+
+	// A field unknown to this version is covered by the checksum as stored.
+	data := `{"Entry":"0123456789012345678901234567890123456789","Created":"2013-01-01T00:00:00Z","Future":{"b":1, "a":[2]}}`
+	sum := Sha1Bytes([]byte(data))
+	m.entries[name] = []byte(data[:len(data)-1] + `,"Checksum":"` + sum + `"}`)
+	node, err = LoadNode(nodes, name)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, sum, node.Checksum)
+	m.entries[name] = []byte(`{"Checksum":"` + sum + `",` + data[1:])
+	_, err = LoadNode(nodes, name)
+	ut.AssertEqual(t, nil, err)
+	m.entries[name] = bytes.Replace(m.entries[name], []byte(`"b":1`), []byte(`"b":2`), 1)
+	_, err = LoadNode(nodes, name)
+	ut.AssertEqual(t, true, err != nil && strings.Contains(err.Error(), "Checksum mismatch"))
+}
+
+// testNodesRenameImpl verifies Rename() on an empty NodesTable.
+func testNodesRenameImpl(t testing.TB, nodes NodesTable) {
+	entry := "0123456789012345678901234567890123456789"
+	name, err := nodes.AddEntry(&Node{Entry: entry}, "tmp")
+	ut.AssertEqual(t, nil, err)
+	tmp := filepath.Join(tagsName, "tmp")
+	daily := filepath.Join(tagsName, "2024-06-daily")
+
+	// Promote the tag.
+	ut.AssertEqual(t, nil, nodes.Rename(tmp, daily, false))
+	node, err := LoadNode(nodes, daily)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, entry, node.Entry)
+	_, err = nodes.Open(tmp)
+	ut.AssertEqual(t, true, err != nil)
+
+	// The tag still resolves once the node it references is renamed.
+	kept := filepath.Join("kept", "node")
+	ut.AssertEqual(t, nil, nodes.Rename(name, kept, false))
+	_, err = nodes.Open(name)
+	ut.AssertEqual(t, true, err != nil)
+	node, err = LoadNode(nodes, kept)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, entry, node.Entry)
+	node, err = LoadNode(nodes, daily)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, entry, node.Entry)
+
+	// An existing name is only replaced when asked to.
+	other := "1123456789012345678901234567890123456789"
+	_, err = nodes.AddEntry(&Node{Entry: other}, "other")
+	ut.AssertEqual(t, nil, err)
+	otherTag := filepath.Join(tagsName, "other")
+	ut.AssertEqual(t, true, os.IsExist(nodes.Rename(otherTag, daily, false)))
+	ut.AssertEqual(t, nil, nodes.Rename(otherTag, daily, true))
+	node, err = LoadNode(nodes, daily)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, other, node.Entry)
+
+	ut.AssertEqual(t, true, os.IsNotExist(nodes.Rename("missing", "renamed", false)))
+	for _, invalid := range []string{"a b", filepath.Join("..", "foo"), filepath.Join(trashName, "foo")} {
+		ut.AssertEqualf(t, true, nodes.Rename(kept, invalid, false) != nil, "%s", invalid)
+	}
+	_, err = LoadNode(nodes, kept)
+	ut.AssertEqual(t, nil, err)
+}
+
 func request(t testing.TB, nodes NodesTable, path string, expectedCode int, expectedBody string) string {
 	req, err := http.ReadRequest(bufio.NewReader(bytes.NewBufferString("GET " + path + " HTTP/1.1\r\nHost: test\r\n\r\n")))
 	ut.AssertEqual(t, nil, err)
@@ -93,7 +203,7 @@ func archiveData(t testing.TB, cas CasTable, nodes NodesTable, tree map[string]s
 
 	// And finally add the node.
 	now := time.Now().UTC()
-	nodeName, err := nodes.AddEntry(&Node{entrySha1, "useful comment"}, "fictious")
+	nodeName, err := nodes.AddEntry(&Node{Entry: entrySha1, Comment: "useful comment"}, "fictious")
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqualf(t, true, strings.HasPrefix(nodeName, now.Format("2006-01")+string(filepath.Separator)), "Invalid node name %s", nodeName)
 	return sha1tree, nodeName, entrySha1
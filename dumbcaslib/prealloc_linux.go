@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize reserves the blocks without changing the file size, so a
+// short write doesn't leave trailing zeros.
+const fallocKeepSize = 0x1
+
+// preallocate reserves size bytes for f so the file system can lay it out
+// contiguously. It is only a hint so any error, like EOPNOTSUPP on the file
+// systems not supporting it, is ignored; the write reports the real failures.
+func preallocate(f *os.File, size int64) {
+	_ = syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+}
@@ -0,0 +1,316 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FindLatestNode returns the name of the most recent node in the table. Tags
+// are ignored since they are only aliases to real nodes.
+func FindLatestNode(nodes NodesTable) (string, error) {
+	latest := ""
+	latestStamp := ""
+	for item := range nodes.Enumerate() {
+		if item.Error != nil {
+			return "", item.Error
+		}
+		if IsTag(item.Item) {
+			continue
+		}
+		stamp := item.Item
+		if match := reNodeTimestamp.FindStringSubmatch(item.Item); match != nil {
+			stamp = match[1]
+		}
+		if stamp > latestStamp || (stamp == latestStamp && item.Item > latest) {
+			latest = item.Item
+			latestStamp = stamp
+		}
+	}
+	if latest == "" {
+		return "", fmt.Errorf("No node found")
+	}
+	return latest, nil
+}
+
+// ResolveNode returns the name of the real node the node name refers to. A tag
+// is resolved to the node it aliases, found by content since a tag may be a
+// copy instead of a symlink; any other name is returned as is.
+func ResolveNode(nodes NodesTable, name string) (string, error) {
+	if !IsTag(name) {
+		return name, nil
+	}
+	data, err := readNode(nodes, name)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for item := range nodes.EnumerateCtx(ctx) {
+		if item.Error != nil {
+			return "", item.Error
+		}
+		if IsTag(item.Item) {
+			continue
+		}
+		if other, err := readNode(nodes, item.Item); err == nil && bytes.Equal(data, other) {
+			return item.Item, nil
+		}
+	}
+	return "", fmt.Errorf("No node found for %s", name)
+}
+
+// readNode returns the serialized node named name.
+func readNode(nodes NodesTable, name string) ([]byte, error) {
+	f, err := nodes.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return ioutil.ReadAll(f)
+}
+
+// LoadNode loads the node named name from the table and verifies its
+// checksum.
+func LoadNode(nodes NodesTable, name string) (*Node, error) {
+	f, err := nodes.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	node := &Node{}
+	if err := decodeNode(f, node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// RestoreEntry restores the files of the Entry tree into root. It keeps going
+// on in case of error and returns the number of files restored and the first
+// seen error. Files already present are not overwritten unless force is set,
+// otherwise it is an error. Each file is logged to l, which may be nil. The
+// files of a hardlink group are restored as hardlinks when possible.
+func RestoreEntry(l *log.Logger, cas CasTable, entry *Entry, root string, force bool) (int, error) {
+	r := &restorer{l: l, cas: cas, force: force, links: map[int]string{}}
+	return r.restore(entry, root)
+}
+
+// errXattrsUnsupported is returned by WriteXattrs() on the platforms without
+// extended attributes.
+var errXattrsUnsupported = errors.New("extended attributes are not supported on this platform")
+
+// restorer is the state of RestoreEntry() across the tree.
+type restorer struct {
+	l     *log.Logger
+	cas   CasTable
+	force bool
+	// links are the first file restored of each hardlink group.
+	links map[int]string
+	// xattrsWarned is set once errXattrsUnsupported was logged.
+	xattrsWarned bool
+}
+
+func (r *restorer) restore(entry *Entry, root string) (count int, out error) {
+	l := r.l
+	if IsInterrupted() {
+		return 0, fmt.Errorf("Was interrupted.")
+	}
+	if entry.Sha1 != "" {
+		out = r.restoreFile(entry, root)
+		if out == nil {
+			count++
+			if err := WriteXattrs(root, entry.Xattrs); err == errXattrsUnsupported {
+				// Only warn once instead of for each file.
+				if !r.xattrsWarned && l != nil {
+					l.Printf("The extended attributes are not restored: %s", err)
+				}
+				r.xattrsWarned = true
+			} else if err != nil && l != nil {
+				// Setting some namespaces requires privileges; keep the content.
+				l.Printf("%s: failed to set the extended attributes: %s", root, err)
+			}
+		}
+		if l != nil {
+			if out != nil {
+				l.Printf("%s(%d): %s", root, entry.Size, out)
+			} else {
+				l.Printf("%s(%d)", root, entry.Size)
+			}
+		}
+	} else if entry.Mode&os.ModeDir != 0 && len(entry.Files) == 0 {
+		out = restoreDir(entry, root)
+		if l != nil {
+			if out != nil {
+				l.Printf("%s/: %s", root, out)
+			} else {
+				l.Printf("%s/", root)
+			}
+		}
+	} else if entry.Symlink != "" {
+		out = restoreSymlink(entry, root, r.force)
+		if out == nil {
+			count++
+		}
+		if l != nil {
+			if out != nil {
+				l.Printf("%s -> %s: %s", root, entry.Symlink, out)
+			} else {
+				l.Printf("%s -> %s", root, entry.Symlink)
+			}
+		}
+	}
+	for name, child := range entry.Files {
+		if !isValidEntryName(name) {
+			// A crafted or corrupted node must not write outside root.
+			if out == nil {
+				out = fmt.Errorf("Refusing to restore %q in %s: invalid name", name, root)
+			}
+			continue
+		}
+		c, err := r.restore(child, filepath.Join(root, name))
+		if err != nil && out == nil {
+			out = err
+		}
+		count += c
+	}
+	return
+}
+
+// restoreFile restores a file entry to dst, as a hardlink to the file of its
+// group already restored if any. It falls back to a copy if the file system
+// doesn't support hardlinks.
+func (r *restorer) restoreFile(entry *Entry, dst string) error {
+	if first, ok := r.links[entry.Link]; ok && entry.Link != 0 {
+		if err := linkFile(first, dst, r.force); err == nil {
+			return nil
+		}
+	}
+	if err := restoreFile(r.cas, entry, dst, r.force); err != nil {
+		return err
+	}
+	if _, ok := r.links[entry.Link]; !ok && entry.Link != 0 {
+		r.links[entry.Link] = dst
+	}
+	return nil
+}
+
+// linkFile creates dst as a hardlink to src.
+func linkFile(src, dst string, force bool) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if force {
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Link(src, dst)
+}
+
+// isValidEntryName returns true if name is a single path component, so that
+// joining it onto the restore directory can't escape it. A backslash is a
+// valid file name character outside Windows.
+func isValidEntryName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/"+string(os.PathSeparator)) && !filepath.IsAbs(name) && filepath.VolumeName(name) == ""
+}
+
+// restoreFile restores a single file entry to dst.
+func restoreFile(cas CasTable, entry *Entry, dst string, force bool) error {
+	f, err := OpenEntry(cas, entry)
+	if err != nil {
+		// The node references an entry that is not present anymore.
+		cas.SetFsckBit()
+		return fmt.Errorf("Failed to fetch %s for %s: %s", entry.Sha1, dst, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	baseDir := filepath.Dir(dst)
+	if err = os.MkdirAll(baseDir, 0755); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Failed to create %s: %s", baseDir, err)
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	out, err := os.OpenFile(dst, flags, entry.Perm())
+	if err != nil {
+		return fmt.Errorf("Failed to create %s in %s: %s", dst, baseDir, err)
+	}
+	size, err := io.Copy(out, f)
+	_ = out.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to copy %s: %s", dst, err)
+	}
+	if size != entry.Size {
+		return fmt.Errorf("Failed to write %s, expected %d, wrote %d", dst, entry.Size, size)
+	}
+	// The umask and a preexisting file affect the mode at creation.
+	if err := os.Chmod(dst, entry.Perm()); err != nil {
+		return fmt.Errorf("Failed to set the mode of %s: %s", dst, err)
+	}
+	return setModTime(entry, dst)
+}
+
+// setModTime sets the modification time of dst to the one archived, if any.
+// The access time is left alone.
+func setModTime(entry *Entry, dst string) error {
+	if entry.ModTime.IsZero() {
+		return nil
+	}
+	if err := os.Chtimes(dst, time.Time{}, entry.ModTime); err != nil {
+		return fmt.Errorf("Failed to set the modification time of %s: %s", dst, err)
+	}
+	return nil
+}
+
+// restoreDir recreates an empty directory entry at dst. It is fine if it
+// already exists.
+func restoreDir(entry *Entry, dst string) error {
+	if err := os.MkdirAll(dst, entry.Mode.Perm()); err != nil {
+		return fmt.Errorf("Failed to create %s: %s", dst, err)
+	}
+	// The umask affects the mode at creation.
+	if err := os.Chmod(dst, entry.Mode.Perm()); err != nil {
+		return fmt.Errorf("Failed to set the mode of %s: %s", dst, err)
+	}
+	return setModTime(entry, dst)
+}
+
+// restoreSymlink recreates a symlink entry at dst.
+func restoreSymlink(entry *Entry, dst string, force bool) error {
+	baseDir := filepath.Dir(dst)
+	if err := os.MkdirAll(baseDir, 0755); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Failed to create %s: %s", baseDir, err)
+	}
+	if force {
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Failed to remove %s: %s", dst, err)
+		}
+	}
+	if err := os.Symlink(entry.Symlink, dst); err != nil {
+		return fmt.Errorf("Failed to create %s: %s", dst, err)
+	}
+	return nil
+}
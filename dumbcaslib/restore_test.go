@@ -0,0 +1,244 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/maruel/ut"
+)
+
+// TestArchiveRestore uses the library API end to end, the way an embedder
+// would.
+func TestArchiveRestore(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "archive_restore")
+	defer removeDir(t, tempData)
+
+	src := filepath.Join(tempData, "src")
+	ut.AssertEqual(t, nil, os.MkdirAll(filepath.Join(src, "dir"), 0700))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(src, "dir", "foo"), []byte("foo\n"), 0600))
+	ut.AssertEqual(t, nil, os.Chmod(filepath.Join(src, "dir", "foo"), 0750))
+
+	cas := MakeMemoryCasTable()
+	nodes := MakeMemoryNodesTable(cas)
+	root := &Entry{}
+	hash, size, err := ArchiveFile(cas, filepath.Join(src, "dir", "foo"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, int64(4), size)
+	root.AddFile(filepath.Join("dir", "foo"), hash, size).Mode = 0750
+	hash, err = AddBytes(cas, []byte("bar"))
+	ut.AssertEqual(t, nil, err)
+	root.AddFile("bar", hash, 3)
+	entryHash, err := ArchiveEntry(cas, root)
+	ut.AssertEqual(t, nil, err)
+	_, err = nodes.AddEntry(&Node{Entry: entryHash}, "backup")
+	ut.AssertEqual(t, nil, err)
+
+	latest, err := FindLatestNode(nodes)
+	ut.AssertEqual(t, nil, err)
+	resolved, err := ResolveNode(nodes, "tags/backup")
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, latest, resolved)
+	resolved, err = ResolveNode(nodes, latest)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, latest, resolved)
+	_, err = ResolveNode(nodes, "tags/missing")
+	ut.AssertEqual(t, false, err == nil)
+	node, err := LoadNode(nodes, latest)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, entryHash, node.Entry)
+	entry, err := LoadEntry(cas, node.Entry)
+	ut.AssertEqual(t, nil, err)
+
+	dst := filepath.Join(tempData, "dst")
+	count, err := RestoreEntry(nil, cas, entry, dst, false)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, count)
+	data, err := ioutil.ReadFile(filepath.Join(dst, "dir", "foo"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "foo\n", string(data))
+	if runtime.GOOS != "windows" {
+		// Entries without a mode are restored with the default.
+		stat, err := os.Stat(filepath.Join(dst, "dir", "foo"))
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, os.FileMode(0750), stat.Mode().Perm())
+		stat, err = os.Stat(filepath.Join(dst, "bar"))
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, DefaultPerm, stat.Mode().Perm())
+	}
+
+	// Files are not overwritten unless forced.
+	count, err = RestoreEntry(nil, cas, entry, dst, false)
+	ut.AssertEqual(t, false, err == nil)
+	ut.AssertEqual(t, 0, count)
+	count, err = RestoreEntry(nil, cas, entry, dst, true)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, count)
+}
+
+func TestRestoreSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks require privileges on Windows")
+	}
+	t.Parallel()
+	tempData := makeTempDir(t, "restore_symlink")
+	defer removeDir(t, tempData)
+
+	cas := MakeMemoryCasTable()
+	root := &Entry{}
+	root.AddSymlink(filepath.Join("dir", "link"), "../target")
+	for _, force := range []bool{false, true} {
+		count, err := RestoreEntry(nil, cas, root, tempData, force)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, 1, count)
+		target, err := os.Readlink(filepath.Join(tempData, "dir", "link"))
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, "../target", target)
+	}
+	_, err := RestoreEntry(nil, cas, root, tempData, false)
+	ut.AssertEqual(t, false, err == nil)
+}
+
+func TestRestoreInvalidName(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "restore_invalid")
+	defer removeDir(t, tempData)
+
+	cas := MakeMemoryCasTable()
+	hash, err := AddBytes(cas, []byte("content"))
+	ut.AssertEqual(t, nil, err)
+	out := filepath.Join(tempData, "out")
+	for _, name := range []string{"..", "../escape", "/escape", ""} {
+		root := &Entry{Files: map[string]*Entry{name: {Sha1: hash, Size: 7}}}
+		count, err := RestoreEntry(nil, cas, root, out, false)
+		ut.AssertEqualf(t, false, err == nil, "%q", name)
+		ut.AssertEqual(t, 0, count)
+	}
+	_, err = os.Stat(filepath.Join(tempData, "escape"))
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+}
+
+func TestRestoreBackslashName(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("a backslash is a path separator on Windows")
+	}
+	t.Parallel()
+	tempData := makeTempDir(t, "restore_backslash")
+	defer removeDir(t, tempData)
+
+	cas := MakeMemoryCasTable()
+	hash, err := AddBytes(cas, []byte("content"))
+	ut.AssertEqual(t, nil, err)
+	root := &Entry{Files: map[string]*Entry{"a\\b": {Sha1: hash, Size: 7}}}
+	count, err := RestoreEntry(nil, cas, root, tempData, false)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, count)
+	content, err := ioutil.ReadFile(filepath.Join(tempData, "a\\b"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "content", string(content))
+}
+
+func TestRestoreXattrs(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "restore_xattrs")
+	defer removeDir(t, tempData)
+
+	src := filepath.Join(tempData, "src")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(src, []byte("content"), 0600))
+	xattrs := map[string]string{"user.dumbcas": base64.StdEncoding.EncodeToString([]byte("value"))}
+	ut.AssertEqual(t, nil, WriteXattrs(src, xattrs))
+	actual, err := ReadXattrs(src)
+	ut.AssertEqual(t, nil, err)
+	if actual == nil {
+		t.Skip("extended attributes are not supported")
+	}
+	ut.AssertEqual(t, xattrs, actual)
+	// A file that can't be read is an error, not a file without attributes.
+	_, err = ReadXattrs(filepath.Join(tempData, "missing"))
+	ut.AssertEqual(t, false, err == nil)
+
+	cas := MakeMemoryCasTable()
+	hash, err := AddBytes(cas, []byte("content"))
+	ut.AssertEqual(t, nil, err)
+	root := &Entry{}
+	root.AddFile("dst", hash, 7).Xattrs = actual
+	count, err := RestoreEntry(nil, cas, root, filepath.Join(tempData, "out"), false)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, count)
+	actual, err = ReadXattrs(filepath.Join(tempData, "out", "dst"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, xattrs, actual)
+}
+
+func TestRestoreXattrsTarRoundTrip(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "restore_xattrs_tar")
+	defer removeDir(t, tempData)
+
+	probe := filepath.Join(tempData, "probe")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(probe, nil, 0600))
+	xattrs := map[string]string{"user.dumbcas": base64.StdEncoding.EncodeToString([]byte("value"))}
+	if WriteXattrs(probe, xattrs) != nil {
+		t.Skip("extended attributes are not supported")
+	}
+
+	cas := MakeMemoryCasTable()
+	hash, err := AddBytes(cas, []byte("content"))
+	ut.AssertEqual(t, nil, err)
+	root := &Entry{}
+	root.AddFile("dst", hash, 7).Xattrs = xattrs
+	buf := &bytes.Buffer{}
+	ut.AssertEqual(t, nil, ExportTar(cas, root, buf, time.Now()))
+	imported, err := ImportTar(nil, MakeMemoryCasTable(), buf)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, xattrs, imported.Files["dst"].Xattrs)
+
+	_, err = RestoreEntry(nil, cas, imported, filepath.Join(tempData, "out"), false)
+	ut.AssertEqual(t, nil, err)
+	actual, err := ReadXattrs(filepath.Join(tempData, "out", "dst"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, xattrs, actual)
+}
+
+func TestRestoreModTime(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "restore_modtime")
+	defer removeDir(t, tempData)
+
+	cas := MakeMemoryCasTable()
+	hash, err := AddBytes(cas, []byte("content"))
+	ut.AssertEqual(t, nil, err)
+	modTime := time.Date(2012, 1, 2, 3, 4, 5, 0, time.UTC)
+	root := &Entry{}
+	root.AddFile("file", hash, 7).ModTime = modTime
+	root.AddDir("empty", 0700).ModTime = modTime
+	// The entries archived without a modification time get the current one.
+	root.AddFile("old", hash, 7)
+	start := time.Now().Add(-time.Minute)
+	count, err := RestoreEntry(nil, cas, root, tempData, false)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, count)
+	for _, name := range []string{"file", "empty"} {
+		stat, err := os.Stat(filepath.Join(tempData, name))
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, true, modTime.Equal(stat.ModTime()))
+	}
+	stat, err := os.Stat(filepath.Join(tempData, "old"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, stat.ModTime().After(start))
+}
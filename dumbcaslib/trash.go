@@ -11,42 +11,244 @@ package dumbcaslib
 
 import (
 	"fmt"
+	"hash"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 const trashName = "trash"
 
+// trashTimeFormat is the name of the directories grouping the items moved to
+// the trash. It is like RFC 3339 without the colons, which Windows refuses in
+// file names.
+const trashTimeFormat = "2006-01-02T150405.000000000Z"
+
+// trashImpl moves the items to trash/<time>/<original path>. The same time
+// directory is used until an item is trashed twice, so nothing is overwritten
+// and the trash records when each item was moved.
 type trashImpl struct {
-	rootDir  string
-	trashDir string
-	created  bool
+	lock      sync.Mutex
+	rootDir   string
+	trashDir  string
+	namespace string
+	last      time.Time
 }
 
 type trash interface {
 	move(relPath string) error
+	enumerate() ([]EnumerationEntry, error)
+	restore(relPath string) error
+	empty() error
 }
 
 func makeTrash(rootDir string) trash {
-	if !filepath.IsAbs(rootDir) {
+	return makeTrashAt(rootDir, filepath.Join(rootDir, trashName))
+}
+
+// makeTrashAt returns a trash for the items of rootDir stored in trashDir,
+// which may be on another file system.
+func makeTrashAt(rootDir, trashDir string) trash {
+	if !filepath.IsAbs(rootDir) || !filepath.IsAbs(trashDir) {
 		return nil
 	}
-	return &trashImpl{rootDir: rootDir, trashDir: filepath.Join(rootDir, trashName)}
+	return &trashImpl{rootDir: rootDir, trashDir: trashDir}
+}
+
+// checkTrashDir returns an error if trashDir is inside rootDir but not at its
+// default location, where the enumeration would find it.
+func checkTrashDir(rootDir, trashDir string) error {
+	if trashDir == filepath.Join(rootDir, trashName) {
+		return nil
+	}
+	if rel, err := filepath.Rel(rootDir, trashDir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("the trash directory %s must not be inside %s", trashDir, rootDir)
+	}
+	return nil
+}
+
+// rename is os.Rename() falling back to a copy when src and dst are on
+// different file systems.
+func rename(src, dst string) error {
+	err := os.Rename(src, dst)
+	if l, ok := err.(*os.LinkError); !ok || l.Err != syscall.EXDEV {
+		return err
+	}
+	return renameAcross(src, dst)
+}
+
+// renameAcross copies the file or directory src to dst then deletes src.
+func renameAcross(src, dst string) error {
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, p)
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		return copyFile(p, target, info.Mode().Perm())
+	})
+	if err != nil {
+		_ = os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyFile copies the file src to dst, which must not exist.
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err2 := out.Sync(); err == nil {
+		err = err2
+	}
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	return err
 }
 
 func (t *trashImpl) move(relPath string) error {
-	if !t.created {
-		if err := os.Mkdir(t.trashDir, 0750); err != nil && !os.IsExist(err) {
-			return fmt.Errorf("Failed to create %s: %s", t.trashDir, err)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.namespace != "" {
+		if _, err := os.Lstat(filepath.Join(t.trashDir, t.namespace, relPath)); err == nil {
+			t.namespace = ""
+		}
+	}
+	if t.namespace == "" {
+		now := time.Now().UTC()
+		if !now.After(t.last) {
+			now = t.last.Add(time.Nanosecond)
+		}
+		t.last = now
+		t.namespace = now.Format(trashTimeFormat)
+	}
+	dst := filepath.Join(t.trashDir, t.namespace, relPath)
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return fmt.Errorf("Failed to create %s: %s", filepath.Dir(dst), err)
+	}
+	return rename(filepath.Join(t.rootDir, relPath), dst)
+}
+
+// trashOriginal returns the path an item of the trash was moved from. The
+// items trashed before they were grouped by time are directly in the trash.
+func trashOriginal(relPath string) string {
+	parts := strings.SplitN(filepath.ToSlash(relPath), "/", 2)
+	if len(parts) == 2 {
+		if _, err := time.Parse(trashTimeFormat, parts[0]); err == nil {
+			return filepath.FromSlash(parts[1])
 		}
-		t.created = true
 	}
-	relDir := filepath.Dir(relPath)
-	if relDir != "." {
-		dir := filepath.Join(t.trashDir, relDir)
-		if err := os.MkdirAll(dir, 0750); err != nil && !os.IsExist(err) {
-			return fmt.Errorf("Failed to create %s: %s", dir, err)
+	return relPath
+}
+
+// enumerate returns the files in the trash, relative to the trash directory.
+func (t *trashImpl) enumerate() ([]EnumerationEntry, error) {
+	items := []EnumerationEntry{}
+	err := filepath.Walk(t.trashDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == t.trashDir && os.IsNotExist(err) {
+				// No trash yet.
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(t.trashDir, p)
+			items = append(items, EnumerationEntry{Item: filepath.ToSlash(rel), Size: info.Size()})
 		}
+		return nil
+	})
+	return items, err
+}
+
+// restore moves back an item from the trash to its original path. It refuses
+// to overwrite an item present in the table.
+func (t *trashImpl) restore(relPath string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	dst := filepath.Join(t.rootDir, trashOriginal(relPath))
+	if _, err := os.Lstat(dst); err == nil {
+		return os.ErrExist
 	}
-	return os.Rename(filepath.Join(t.rootDir, relPath), filepath.Join(t.trashDir, relPath))
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Failed to create %s: %s", filepath.Dir(dst), err)
+	}
+	src := filepath.Join(t.trashDir, relPath)
+	if err := rename(src, dst); err != nil {
+		return err
+	}
+	// Clean up the directories left empty, up to the trash itself.
+	for dir := filepath.Dir(src); dir != t.trashDir && strings.HasPrefix(dir, t.trashDir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// empty permanently deletes the trash content.
+func (t *trashImpl) empty() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.namespace = ""
+	return os.RemoveAll(t.trashDir)
+}
+
+// TrashTable is implemented by the tables that move the removed and invalid
+// items to a trash instead of deleting them.
+type TrashTable interface {
+	// EnumerateTrash enumerates the items in the trash. The items use "/" as
+	// the path separator and are usually the path relative to the table
+	// prefixed by the time they were moved to the trash.
+	EnumerateTrash() <-chan EnumerationEntry
+	// RestoreTrash moves an item enumerated by EnumerateTrash() back into the
+	// table.
+	RestoreTrash(item string) error
+	// EmptyTrash permanently deletes the content of the trash.
+	EmptyTrash() error
+}
+
+// trashItemHash returns the hash of a CasTable entry from its path in the
+// trash, e.g. "<time>/abc/def..." for a prefix length of 3.
+func trashItemHash(item string, prefixLength int, validPath *regexp.Regexp) (string, error) {
+	rel := filepath.ToSlash(trashOriginal(item))
+	hash := strings.Replace(rel, "/", "", 1)
+	if !validPath.MatchString(hash) || len(rel) != len(hash)+1 || rel[prefixLength] != '/' {
+		return "", fmt.Errorf("%s is not a valid entry", item)
+	}
+	return hash, nil
+}
+
+// TrashItemHash returns the hash of a CasTable entry from an item enumerated
+// by EnumerateTrash(). The item is not validated.
+func TrashItemHash(item string) string {
+	return strings.Replace(filepath.ToSlash(trashOriginal(item)), "/", "", -1)
+}
+
+// verifyEntry checks that the content of an entry matches its name. It closes
+// f.
+func verifyEntry(f ReadSeekCloser, h hash.Hash, hash string) error {
+	defer func() {
+		_ = f.Close()
+	}()
+	return checkEntry(f, h, hash)
 }
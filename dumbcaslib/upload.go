@@ -0,0 +1,271 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadPrefix is the prefix of the files staging the chunked uploads, so the
+// sessions survive a restart of the server.
+const uploadPrefix = "dumbcas_upload_"
+
+// uploadExpiration is how long an abandoned upload is kept.
+const uploadExpiration = 24 * time.Hour
+
+// validSession is the form of the upload session ids generated by the server.
+var validSession = regexp.MustCompile("^[a-f0-9]{32}$")
+
+// stagingTable is implemented by the tables staging the uploads in their own
+// directory, so an entry stored as-is is renamed into place once verified
+// instead of being copied again.
+type stagingTable interface {
+	// uploadDir returns the directory staging the uploads.
+	uploadDir() string
+	// addStaged adds the file at p, whose content is hash, moving it if
+	// possible.
+	addStaged(p, hash string) error
+}
+
+// uploads are the chunked uploads in progress of a casHandler. A session is
+// written by one request at a time.
+type uploads struct {
+	lock sync.Mutex
+	busy map[string]bool
+}
+
+// acquire returns false if another request is writing to the session.
+func (u *uploads) acquire(session string) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.busy[session] {
+		return false
+	}
+	u.busy[session] = true
+	return true
+}
+
+func (u *uploads) release(session string) {
+	u.lock.Lock()
+	delete(u.busy, session)
+	u.lock.Unlock()
+}
+
+// uploadDir returns the directory staging the uploads, in the table when it
+// has one, in the temporary directory otherwise.
+func (h *casHandler) uploadDir() string {
+	if s, ok := h.cas.(stagingTable); ok {
+		return s.uploadDir()
+	}
+	return os.TempDir()
+}
+
+func (h *casHandler) uploadPath(session string) string {
+	return filepath.Join(h.uploadDir(), uploadPrefix+session)
+}
+
+// removeExpiredUploads removes the sessions abandoned by their client.
+func (h *casHandler) removeExpiredUploads() {
+	matches, _ := filepath.Glob(filepath.Join(h.uploadDir(), uploadPrefix+"*"))
+	for _, match := range matches {
+		if stat, err := os.Lstat(match); err == nil && time.Since(stat.ModTime()) > uploadExpiration {
+			_ = os.Remove(match)
+		}
+	}
+}
+
+// upload handles the chunked uploads, so a huge entry sent over a flaky link
+// doesn't have to be sent again from the start:
+//   - "POST /upload/" creates a session and replies its id.
+//   - "POST /upload/<session>?offset=N" appends the body to the session and
+//     replies the size received so far. It replies 409 when N is not the size
+//     received so far and 413 when the body is larger than maxPutSize.
+//   - "GET /upload/<session>" replies the size received so far, to resume.
+//   - "POST /upload/<session>?commit=<hash>" verifies the content received
+//     and adds it to the table, replying like "PUT /<hash>". The session is
+//     removed once committed, even if the content doesn't match, but not
+//     when the table is locked.
+//   - "DELETE /upload/<session>" aborts the upload.
+//
+// The sessions are staged in the table directory when it has one. The
+// sessions not written to for uploadExpiration are removed.
+func (h *casHandler) upload(w http.ResponseWriter, r *http.Request) {
+	if h.locker == nil {
+		http.Error(w, "The table is read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	session := strings.TrimPrefix(r.URL.Path, "/upload/")
+	if session == "" && r.Method == "POST" {
+		h.createUpload(w)
+		return
+	}
+	if !validSession.MatchString(session) {
+		http.Error(w, "Invalid upload session: "+session, http.StatusBadRequest)
+		return
+	}
+	if !h.uploads.acquire(session) {
+		http.Error(w, "The upload session is in use", http.StatusConflict)
+		return
+	}
+	defer h.uploads.release(session)
+	p := h.uploadPath(session)
+
+	switch r.Method {
+	case "GET", "HEAD":
+		stat, err := os.Lstat(p)
+		if err != nil || !stat.Mode().IsRegular() {
+			http.NotFound(w, r)
+			return
+		}
+		writeUploadOffset(w, stat.Size())
+	case "DELETE":
+		if err := os.Remove(p); err != nil {
+			http.NotFound(w, r)
+		}
+	case "POST":
+		q := r.URL.Query()
+		if hash := q.Get("commit"); hash != "" {
+			h.commitUpload(w, p, hash)
+			return
+		}
+		offset, err := strconv.ParseInt(q.Get("offset"), 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "Invalid offset: "+q.Get("offset"), http.StatusBadRequest)
+			return
+		}
+		f, err := os.OpenFile(p, os.O_WRONLY, 0)
+		if os.IsNotExist(err) {
+			http.Error(w, "Unknown upload session", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		size, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if size != offset {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(size, 10))
+			http.Error(w, fmt.Sprintf("Expected offset %d, got %d", size, offset), http.StatusConflict)
+			return
+		}
+		// Keep what was received if the connection drops, to resume from there.
+		n, err := io.Copy(f, http.MaxBytesReader(w, r.Body, maxPutSize))
+		if _, ok := err.(*http.MaxBytesError); ok {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read the chunk: %s", err), http.StatusBadRequest)
+			return
+		}
+		writeUploadOffset(w, size+n)
+	default:
+		http.Error(w, "Invalid Method", http.StatusMethodNotAllowed)
+	}
+}
+
+// createUpload creates an empty session named after a random id and replies
+// the id.
+func (h *casHandler) createUpload(w http.ResponseWriter) {
+	h.removeExpiredUploads()
+	if err := os.MkdirAll(h.uploadDir(), 0750); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	session := hex.EncodeToString(id)
+	f, err := os.OpenFile(h.uploadPath(session), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := f.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "%s\n", session)
+}
+
+// commitUpload adds the content staged at p as hash.
+func (h *casHandler) commitUpload(w http.ResponseWriter, p, hash string) {
+	if !h.validHash.MatchString("/" + hash) {
+		http.Error(w, "Invalid hash: "+hash, http.StatusBadRequest)
+		return
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		http.Error(w, "Unknown upload session", http.StatusNotFound)
+		return
+	}
+	err = checkHash(h.cas, f, hash)
+	_ = f.Close()
+	if err == nil {
+		err = writeLocked(h.locker, func() error {
+			if h.cas.Exists(hash) {
+				return os.ErrExist
+			}
+			if s, ok := h.cas.(stagingTable); ok {
+				return s.addStaged(p, hash)
+			}
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			return h.cas.AddEntry(f, hash)
+		})
+	}
+	// Keep the session to commit it again once the lock is released.
+	if err != ErrLocked {
+		_ = os.Remove(p)
+	}
+	writeAddResult(w, err)
+}
+
+func writeUploadOffset(w http.ResponseWriter, offset int64) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "%d\n", offset)
+}
+
+// readUploadOffset returns the offset replied by upload().
+func readUploadOffset(resp *http.Response) (int64, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64))
+	_ = resp.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
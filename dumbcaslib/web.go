@@ -9,7 +9,23 @@ limitations under the License. */
 
 package dumbcaslib
 
-import "net/http"
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
 
 // localRedirect gives a Moved Permanently response.
 // It does not convert relative paths to absolute paths like Redirect does.
@@ -20,3 +36,359 @@ func localRedirect(w http.ResponseWriter, r *http.Request, newPath string) {
 	w.Header().Set("Location", newPath)
 	w.WriteHeader(http.StatusMovedPermanently)
 }
+
+// entryHeaders sets the headers to serve the CAS entry hash and returns the
+// file name requested with ?name=, if any. The hash is used as the ETag since
+// the content can't change, so If-Range works even without a modification
+// time. With a name, http.ServeContent() sets the Content-Type from its
+// extension; without one, the content is sniffed.
+func entryHeaders(w http.ResponseWriter, r *http.Request, hash string) string {
+	w.Header().Set("ETag", "\""+hash+"\"")
+	name := path.Base(strings.Replace(r.URL.Query().Get("name"), "\\", "/", -1))
+	if name == "." || name == ".." || name == "/" {
+		return ""
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": name}))
+	return name
+}
+
+// isValidCasURL returns false if the path could escape the table. The hash
+// validation should catch it but it doesn't hurt to be defensive.
+func isValidCasURL(p string) bool {
+	return !strings.Contains(p, "..")
+}
+
+// RepairEntry fetches the entry hash from baseURL, the URL of a
+// CasTable.ServeHTTP() like "http://host:8010/content/retrieve/default", and
+// adds it to cas once its content is verified. A corrupted copy of the entry
+// must be removed from cas first. Credentials can be embedded in baseURL.
+func RepairEntry(cas CasTable, baseURL, hash string) error {
+	resp, err := http.Get(strings.TrimRight(baseURL, "/") + "/" + hash)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to fetch %s: %s", hash, resp.Status)
+	}
+	return addVerified(cas, resp.Body, hash)
+}
+
+// hashMismatchError is returned by addVerified() when the content doesn't
+// match its hash.
+type hashMismatchError struct {
+	hash   string
+	actual string
+}
+
+func (e *hashMismatchError) Error() string {
+	return fmt.Sprintf("Content of %s is corrupted, its hash is %s", e.hash, e.actual)
+}
+
+// addVerified stages the content of r in a temporary file and adds it to cas
+// only if it matches hash.
+func addVerified(cas CasTable, r io.Reader, hash string) error {
+	tmp, err := ioutil.TempFile("", "dumbcas_verify")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err := io.Copy(tmp, r); err != nil {
+		if _, ok := err.(*http.MaxBytesError); ok {
+			return err
+		}
+		return fmt.Errorf("Failed to read %s: %s", hash, err)
+	}
+	return addVerifiedFile(cas, tmp, hash)
+}
+
+// addVerifiedFile adds the content of the staged file f to cas only if it
+// matches hash.
+func addVerifiedFile(cas CasTable, f *os.File, hash string) error {
+	if err := checkHash(cas, f, hash); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return cas.AddEntry(f, hash)
+}
+
+// checkHash returns a *hashMismatchError if the content of f isn't hash.
+func checkHash(cas CasTable, f *os.File, hash string) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := cas.NewHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("Failed to read %s: %s", hash, err)
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != hash {
+		return &hashMismatchError{hash, actual}
+	}
+	return nil
+}
+
+// maxPutSize is the largest body accepted by "PUT /<hash>" and by each chunk
+// of an upload; larger entries are uploaded in chunks of uploadChunkSize.
+const maxPutSize = uploadChunkSize
+
+// writeLocked runs fn under a shared lock of locker, like the commands writing
+// to the table, so gc can't run meanwhile.
+func writeLocked(locker Locker, fn func() error) error {
+	lock, err := locker.Lock(false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = lock.Unlock()
+	}()
+	return fn()
+}
+
+type casHandler struct {
+	cas       CasTable
+	locker    Locker
+	validHash *regexp.Regexp
+	uploads   *uploads
+}
+
+// MakeCasHandler returns an http.Handler serving cas like its ServeHTTP() plus:
+//   - "GET /list" lists the entries, one per line; see list() for the options.
+//   - "GET /info" returns the hashing algorithm of the table as JSON.
+//   - "POST /exists" replies the entries present among the ones in the body,
+//     one per line. The body is limited to maxExistsHashes entries.
+//
+// When locker is not nil, it also accepts "PUT /<hash>" to add an entry, which is
+// verified first, "/upload/<session>" to add one in chunks; see upload(), and
+// "DELETE /<hash>" to remove one. PUT replies 201 when the
+// entry is created, 200 when it was already present and 400 when the content
+// doesn't match the hash, 413 when it is larger than maxPutSize and 503 when
+// locker is held exclusively. The modifications are done under the shared lock
+// of locker. This is the server of MakeHTTPCasTable().
+func MakeCasHandler(cas CasTable, locker Locker) http.Handler {
+	validHash := regexp.MustCompile(fmt.Sprintf("^/[a-f0-9]{%d}$", cas.NewHash().Size()*2))
+	return &casHandler{cas, locker, validHash, &uploads{busy: map[string]bool{}}}
+}
+
+func (h *casHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" && r.URL.Path == "/list" {
+		h.list(w, r)
+		return
+	}
+	if r.Method == "GET" && r.URL.Path == "/info" {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(&httpCasInfo{Hash: hashName(h.cas.NewHash())})
+		return
+	}
+	if r.Method == "POST" && r.URL.Path == "/exists" {
+		h.exists(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/upload/") {
+		h.upload(w, r)
+		return
+	}
+	if r.Method == "GET" || r.Method == "HEAD" {
+		h.cas.ServeHTTP(w, r)
+		return
+	}
+	if r.Method != "PUT" && r.Method != "DELETE" {
+		http.Error(w, "Invalid Method", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.locker == nil {
+		http.Error(w, "The table is read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.validHash.MatchString(r.URL.Path) {
+		http.Error(w, "Invalid CAS url: "+r.URL.Path, http.StatusBadRequest)
+		return
+	}
+	hash := r.URL.Path[1:]
+	if r.Method == "DELETE" {
+		err := writeLocked(h.locker, func() error {
+			return h.cas.Remove(hash)
+		})
+		if err == ErrLocked {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		} else if err != nil {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	if h.cas.Exists(hash) {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, maxPutSize)
+	writeAddResult(w, writeLocked(h.locker, func() error {
+		return addVerified(h.cas, body, hash)
+	}))
+}
+
+// writeAddResult replies the result of addVerified().
+func writeAddResult(w http.ResponseWriter, err error) {
+	if _, ok := err.(*hashMismatchError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else if os.IsExist(err) {
+		w.WriteHeader(http.StatusOK)
+	} else if err == ErrReadOnly || err == ErrEncrypted {
+		http.Error(w, err.Error(), http.StatusForbidden)
+	} else if _, ok := err.(*http.MaxBytesError); ok {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	} else if err == ErrLocked {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// maxExistsHashes is the largest number of entries accepted by
+// "POST /exists"; MakeHTTPCasTable() sends larger lookups in batches.
+const maxExistsHashes = 10000
+
+// exists replies the entries of the body found in the table, one per line.
+// Invalid entries are not found. It replies 413 when the body holds more than
+// maxExistsHashes entries.
+func (h *casHandler) exists(w http.ResponseWriter, r *http.Request) {
+	// Leaves room for "\r\n" line endings.
+	body := http.MaxBytesReader(w, r.Body, int64(maxExistsHashes*(h.cas.NewHash().Size()*2+2)))
+	hashes := []string{}
+	s := bufio.NewScanner(body)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			if len(hashes) == maxExistsHashes {
+				http.Error(w, fmt.Sprintf("More than %d entries", maxExistsHashes), http.StatusRequestEntityTooLarge)
+				return
+			}
+			hashes = append(hashes, line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		if _, ok := err.(*http.MaxBytesError); ok {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	found := h.cas.ExistsMany(hashes)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, hash := range hashes {
+		if found[hash] {
+			fmt.Fprintf(w, "%s\n", hash)
+		}
+	}
+}
+
+// list writes the entries of the table, one per line, or as a JSON list with
+// "?format=json". The entries are streamed in the enumeration order, which is
+// not sorted. "?after=<hash>" only lists the entries sorted after hash and
+// "?limit=N" returns the N first ones in sorted order, so the next page is
+// requested with "?after=<last hash>&limit=N". The enumeration is aborted
+// when the client disconnects.
+func (h *casHandler) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	after := q.Get("after")
+	limit := 0
+	if l := q.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit: "+l, http.StatusBadRequest)
+			return
+		}
+	}
+	format := q.Get("format")
+	if format != "" && format != "text" && format != "json" {
+		http.Error(w, "Invalid format: "+format, http.StatusBadRequest)
+		return
+	}
+	out := &listWriter{w: w, json: format == "json"}
+	out.start()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	items := h.cas.EnumerateCtx(ctx)
+	var page []EnumerationEntry
+	for item := range items {
+		if item.Error != nil {
+			// The status was already sent; truncate the response so the client
+			// doesn't mistake it for a complete list.
+			panic(http.ErrAbortHandler)
+		}
+		if item.Item <= after {
+			continue
+		}
+		if limit == 0 {
+			out.write(item)
+			continue
+		}
+		// Keep the limit smallest entries.
+		j := sort.Search(len(page), func(k int) bool { return page[k].Item > item.Item })
+		if j < limit {
+			page = append(page, EnumerationEntry{})
+			copy(page[j+1:], page[j:])
+			page[j] = item
+			if len(page) > limit {
+				page = page[:limit]
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		// The client is gone.
+		return
+	}
+	for _, i := range page {
+		out.write(i)
+	}
+	out.end()
+}
+
+// listEntry is an entry of "GET /list?format=json".
+type listEntry struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// listWriter writes the entries listed by casHandler.list() as they come.
+type listWriter struct {
+	w     http.ResponseWriter
+	json  bool
+	count int
+}
+
+func (l *listWriter) start() {
+	if l.json {
+		l.w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(l.w, "[")
+	} else {
+		l.w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+}
+
+func (l *listWriter) write(item EnumerationEntry) {
+	if !l.json {
+		fmt.Fprintf(l.w, "%s\n", item.Item)
+		return
+	}
+	if l.count != 0 {
+		_, _ = io.WriteString(l.w, ",")
+	}
+	l.count++
+	data, _ := json.Marshal(&listEntry{item.Item, item.Size})
+	fmt.Fprintf(l.w, "\n  %s", data)
+}
+
+func (l *listWriter) end() {
+	if l.json {
+		_, _ = io.WriteString(l.w, "\n]\n")
+	}
+}
@@ -0,0 +1,91 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"syscall"
+)
+
+// XattrsSupported is true when ReadXattrs() and WriteXattrs() are implemented
+// on this platform.
+const XattrsSupported = true
+
+// ReadXattrs returns the extended attributes of the file at path, with their
+// values base64 encoded. Returns nil if the file has none or the file system
+// doesn't support them.
+func ReadXattrs(path string) (map[string]string, error) {
+	names, err := xattrCall(func(dest []byte) (int, error) {
+		return syscall.Listxattr(path, dest)
+	})
+	if err != nil {
+		if err == syscall.ENOTSUP {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	out := map[string]string{}
+	for _, name := range bytes.Split(bytes.TrimRight(names, "\x00"), []byte{0}) {
+		value, err := xattrCall(func(dest []byte) (int, error) {
+			return syscall.Getxattr(path, string(name), dest)
+		})
+		if err == syscall.ENODATA {
+			// Removed in the meantime.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out[string(name)] = base64.StdEncoding.EncodeToString(value)
+	}
+	return out, nil
+}
+
+// WriteXattrs sets the extended attributes returned by ReadXattrs() on the file
+// at path. It is a no-op if the file system doesn't support them.
+func WriteXattrs(path string, xattrs map[string]string) error {
+	for name, encoded := range xattrs {
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return err
+		}
+		if err := syscall.Setxattr(path, name, value, 0); err == syscall.ENOTSUP {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// xattrCall calls fn with a buffer large enough for the result. fn is first
+// called with an empty buffer to get the size.
+func xattrCall(fn func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := fn(nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		dest := make([]byte, size)
+		size, err = fn(dest)
+		if err == syscall.ERANGE {
+			// Grew in the meantime.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return dest[:size], nil
+	}
+}
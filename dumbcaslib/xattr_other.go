@@ -0,0 +1,32 @@
+//go:build !linux
+// +build !linux
+
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package dumbcaslib
+
+// XattrsSupported is false; the extended attributes are not supported on this
+// platform.
+const XattrsSupported = false
+
+// ReadXattrs returns nil; the extended attributes are not supported on this
+// platform.
+func ReadXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+// WriteXattrs returns errXattrsUnsupported if there is any attribute to set;
+// the extended attributes are not supported on this platform.
+func WriteXattrs(path string, xattrs map[string]string) error {
+	if len(xattrs) != 0 {
+		return errXattrsUnsupported
+	}
+	return nil
+}
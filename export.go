@@ -0,0 +1,104 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdExport = &subcommands.Command{
+	UsageLine: "export <node>",
+	ShortDesc: "exports a node as a tar archive",
+	LongDesc:  "Writes the files of <node> as a tar stream to stdout or to -out, e.g. to hand a backup to someone without the whole table. Use \"latest\" as <node> to export the most recent node. The files archived without their modification time get the creation time of the node.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &exportRun{}
+		c.Init()
+		c.Flags.StringVar(&c.Format, "format", "tar", "Format of the archive, tar or tar.gz")
+		c.Flags.StringVar(&c.Out, "out", "", "File to write the archive to instead of stdout")
+		return c
+	},
+}
+
+type exportRun struct {
+	CommonFlags
+	Format string
+	Out    string
+}
+
+func (c *exportRun) main(a DumbcasApplication, nodeArg string) (err error) {
+	if c.Format != "tar" && c.Format != "tar.gz" {
+		return fmt.Errorf("Unknown -format %s; must be tar or tar.gz", c.Format)
+	}
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	if nodeArg == "latest" {
+		latest, err := dumbcaslib.FindLatestNode(c.nodes)
+		if err != nil {
+			return err
+		}
+		nodeArg = latest
+	}
+	node, err := dumbcaslib.LoadNode(c.nodes, nodeArg)
+	if err != nil {
+		return err
+	}
+	entry, err := dumbcaslib.LoadEntry(c.cas, node.Entry)
+	if err != nil {
+		return fmt.Errorf("Failed to load the tree of %s: %s", nodeArg, err)
+	}
+
+	var w io.Writer = a.GetOut()
+	if c.Out != "" {
+		f, err := os.Create(c.Out)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err2 := f.Close(); err == nil {
+				err = err2
+			}
+		}()
+		w = f
+	}
+	if c.Format == "tar.gz" {
+		gz := gzip.NewWriter(w)
+		defer func() {
+			if err2 := gz.Close(); err == nil {
+				err = err2
+			}
+		}()
+		w = gz
+	}
+	if err := dumbcaslib.ExportTar(c.cas, entry, w, node.Created); err != nil {
+		return err
+	}
+	a.GetLogger().Infof("Exported %d files of %s", entry.CountFiles(), nodeArg)
+	return nil
+}
+
+func (c *exportRun) Run(a subcommands.Application, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(a.GetErr(), "%s: Must only provide a <node>.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args[0]); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
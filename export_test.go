@@ -0,0 +1,77 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+// readTar returns the content of the files of a tar stream.
+func readTar(t *testing.T, r io.Reader) map[string]string {
+	out := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return out
+		}
+		ut.AssertEqual(t, nil, err)
+		if hdr.Typeflag == tar.TypeReg {
+			content, err := ioutil.ReadAll(tr)
+			ut.AssertEqual(t, nil, err)
+			out[hdr.Name] = string(content)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "export")
+	defer removeDir(t, tempData)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasOptions{})
+	_, _ = f.LoadNodesTable("", f.cas)
+	tree := map[string]string{
+		"file1":           "content1",
+		"dir1/dir2/file2": "content2",
+	}
+	_, nodeName, _ := archiveData(f.TB, f.cas, f.nodes, tree)
+
+	f.Run([]string{"export", "-root=" + mockRoot("export"), nodeName}, 0)
+	ut.AssertEqual(t, tree, readTar(t, f.GetOut().(*bytes.Buffer)))
+	f.CheckBuffer(false, false)
+
+	out := filepath.Join(tempData, "backup.tar.gz")
+	f.Run([]string{"export", "-root=" + mockRoot("export"), "-format=tar.gz", "-out=" + out, "latest"}, 0)
+	f.CheckBuffer(false, false)
+	gz, err := os.Open(out)
+	ut.AssertEqual(t, nil, err)
+	defer func() {
+		_ = gz.Close()
+	}()
+	r, err := gzip.NewReader(gz)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, tree, readTar(t, r))
+
+	f.Run([]string{"export", "-root=" + mockRoot("export"), "-format=zip", nodeName}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"export", "-root=" + mockRoot("export")}, 1)
+	f.CheckBuffer(false, true)
+}
@@ -0,0 +1,163 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdFind = &subcommands.Command{
+	UsageLine: "find -object <hash> | -path <glob>",
+	ShortDesc: "finds the nodes referencing an object or a path",
+	LongDesc:  "Scans the tree of each node and prints the node and the path of each file matching -object and -path, e.g. to know which backups are affected by a corrupted object found by fsck.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &findRun{}
+		c.Init()
+		c.Flags.StringVar(&c.Object, "object", "", "Hash of the object to find")
+		c.Flags.StringVar(&c.Path, "path", "", "Glob pattern of the paths to find, with the same syntax as archive -exclude")
+		c.Flags.BoolVar(&c.JSON, "json", false, "Print the matches as a JSON array")
+		return c
+	},
+}
+
+type findRun struct {
+	CommonFlags
+	Object string
+	Path   string
+	JSON   bool
+}
+
+// findMatch is a file of a node matched by find.
+type findMatch struct {
+	Node string `json:"node"`
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+}
+
+// findRecurse appends the files of entry matching hash and pattern to out.
+// hash matches the content of a file, or the manifest or a chunk of a chunked
+// file. An empty hash or pattern matches everything.
+func findRecurse(out []findMatch, cas dumbcaslib.CasTable, node, relPath string, entry *dumbcaslib.Entry, hash string, pattern dumbcaslib.Excludes) ([]findMatch, error) {
+	if entry.Sha1 != "" && (len(pattern) == 0 || pattern.Match(relPath)) {
+		match := hash == "" || entry.Sha1 == hash
+		if !match && entry.Manifest != "" {
+			objects, err := entry.Objects(cas)
+			if err != nil {
+				return out, fmt.Errorf("Failed to read the manifest of %s: %s", relPath, err)
+			}
+			for _, object := range objects {
+				match = match || object == hash
+			}
+		}
+		if match {
+			out = append(out, findMatch{node, relPath, entry.Sha1})
+		}
+	}
+	for _, name := range entry.SortedFiles() {
+		var err error
+		if out, err = findRecurse(out, cas, node, path.Join(relPath, name), entry.Files[name], hash, pattern); err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+func (c *findRun) main(a DumbcasApplication) error {
+	if c.Object == "" && c.Path == "" {
+		return errors.New("Must provide -object or -path")
+	}
+	var pattern dumbcaslib.Excludes
+	if c.Path != "" {
+		pattern = dumbcaslib.Excludes{c.Path}
+		if err := pattern.Check(); err != nil {
+			return err
+		}
+	}
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+
+	names := []string{}
+	for item := range c.nodes.Enumerate() {
+		if item.Error != nil {
+			return item.Error
+		}
+		// Tags are only aliases to real nodes.
+		if !dumbcaslib.IsTag(item.Item) {
+			names = append(names, item.Item)
+		}
+	}
+	sort.Strings(names)
+
+	matches := []findMatch{}
+	failed := 0
+	for _, name := range names {
+		if dumbcaslib.IsInterrupted() {
+			return fmt.Errorf("Was interrupted.")
+		}
+		// Keep going on a broken node; the other ones may still be searched.
+		node, err := dumbcaslib.LoadNode(c.nodes, name)
+		if err != nil {
+			a.GetLogger().Errorf("Failed opening node %s: %s", name, err)
+			failed++
+			continue
+		}
+		if c.Object != "" && node.Entry == c.Object && c.Path == "" {
+			// The object is the tree of the node itself.
+			matches = append(matches, findMatch{name, ".", node.Entry})
+		}
+		entry, err := dumbcaslib.LoadEntry(c.cas, node.Entry)
+		if err != nil {
+			a.GetLogger().Errorf("Failed to load the tree of %s: %s", name, err)
+			failed++
+			continue
+		}
+		if matches, err = findRecurse(matches, c.cas, name, "", entry, c.Object, pattern); err != nil {
+			a.GetLogger().Errorf("Node %s: %s", name, err)
+			failed++
+		}
+	}
+
+	if c.JSON {
+		data, err := json.MarshalIndent(matches, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(a.GetOut(), "%s\n", data)
+	} else {
+		for _, m := range matches {
+			fmt.Fprintf(a.GetOut(), "%s %s %s\n", m.Node, m.Path, m.Hash)
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("Failed to search %d nodes", failed)
+	}
+	return nil
+}
+
+func (c *findRun) Run(a subcommands.Application, args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,89 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestFind(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasOptions{})
+	_, _ = f.LoadNodesTable("", f.cas)
+	sha1tree, node1, entry1 := archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file1":      "content1",
+		"dir1/file3": "content3",
+	})
+	_, node2, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"dir2/file1": "content1",
+	})
+	if node2 < node1 {
+		node1, node2 = node2, node1
+	}
+
+	f.Run([]string{"find", "-root=" + mockRoot("find"), "-object", sha1tree["file1"]}, 0)
+	out := f.GetOut().(*bytes.Buffer).String()
+	f.GetOut().(*bytes.Buffer).Reset()
+	ut.AssertEqual(t, true, out == fmt.Sprintf("%s file1 %s\n%s dir2/file1 %s\n", node1, sha1tree["file1"], node2, sha1tree["file1"]) ||
+		out == fmt.Sprintf("%s dir2/file1 %s\n%s file1 %s\n", node1, sha1tree["file1"], node2, sha1tree["file1"]))
+
+	f.Run([]string{"find", "-root=" + mockRoot("find"), "-path", "file3", "-json"}, 0)
+	matches := []findMatch{}
+	ut.AssertEqual(t, nil, json.Unmarshal(f.GetOut().(*bytes.Buffer).Bytes(), &matches))
+	f.GetOut().(*bytes.Buffer).Reset()
+	ut.AssertEqual(t, 1, len(matches))
+	ut.AssertEqual(t, "dir1/file3", matches[0].Path)
+	ut.AssertEqual(t, sha1tree["dir1/file3"], matches[0].Hash)
+
+	// Both must match.
+	f.Run([]string{"find", "-root=" + mockRoot("find"), "-path", "dir1/*", "-object", sha1tree["file1"]}, 0)
+	f.CheckBuffer(false, false)
+
+	f.Run([]string{"find", "-root=" + mockRoot("find"), "-object", entry1}, 0)
+	out = f.GetOut().(*bytes.Buffer).String()
+	f.GetOut().(*bytes.Buffer).Reset()
+	ut.AssertEqual(t, true, bytes.Contains([]byte(out), []byte(" . "+entry1+"\n")))
+
+	// A chunked file is found by its manifest and its chunks.
+	content := make([]byte, 3*1024*1024)
+	_, _ = rand.New(rand.NewSource(0)).Read(content)
+	manifest, size, err := dumbcaslib.ArchiveChunks(f.cas, bytes.NewReader(content))
+	ut.AssertEqual(t, nil, err)
+	chunks, err := dumbcaslib.LoadManifest(f.cas, manifest)
+	ut.AssertEqual(t, nil, err)
+	big := dumbcaslib.Sha1Bytes(content)
+	root := &dumbcaslib.Entry{Files: map[string]*dumbcaslib.Entry{"big": {Sha1: big, Size: size, Manifest: manifest}}}
+	rootHash, err := dumbcaslib.ArchiveEntry(f.cas, root)
+	ut.AssertEqual(t, nil, err)
+	_, err = f.nodes.AddEntry(&dumbcaslib.Node{Entry: rootHash}, "chunked")
+	ut.AssertEqual(t, nil, err)
+	for _, hash := range []string{big, manifest, chunks[1]} {
+		f.Run([]string{"find", "-root=" + mockRoot("find"), "-object", hash, "-json"}, 0)
+		matches = []findMatch{}
+		ut.AssertEqual(t, nil, json.Unmarshal(f.GetOut().(*bytes.Buffer).Bytes(), &matches))
+		f.GetOut().(*bytes.Buffer).Reset()
+		ut.AssertEqual(t, 1, len(matches))
+		ut.AssertEqual(t, "big", matches[0].Path)
+		ut.AssertEqual(t, big, matches[0].Hash)
+	}
+
+	f.Run([]string{"find", "-root=" + mockRoot("find")}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"find", "-root=" + mockRoot("find"), "-path", "["}, 1)
+	f.CheckBuffer(false, true)
+}
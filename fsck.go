@@ -10,8 +10,15 @@ limitations under the License. */
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"path"
 	"regexp"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/maruel/dumbcas/dumbcaslib"
 	"github.com/maruel/subcommands"
@@ -19,99 +26,437 @@ import (
 
 var cmdFsck = &subcommands.Command{
 	UsageLine: "fsck",
-	ShortDesc: "moves to trash all objects that are not valid content anymore",
-	LongDesc:  "Recalculate the sha-1 of each dumbcas entry and remove any that are corrupted",
+	ShortDesc: "verifies the consistency of the table and moves to trash all objects that are not valid content anymore",
+	LongDesc:  "Verifies the structure of the table and of the nodes. The objects are verified by -jobs workers while the table is enumerated: the hash of each dumbcas entry is recalculated and the corrupted ones are moved to trash, unless -fast is used. With -repair-from, the corrupted and missing objects are fetched from the web server of another copy of the table. With -gc, also moves to trash the objects not referenced anymore for -keep-unreferenced-for like gc does, saving the second scan of running gc afterward.",
 	CommandRun: func() subcommands.CommandRun {
 		c := &fsckRun{}
 		c.Init()
+		c.Flags.BoolVar(&c.Fast, "fast", false, "Don't rehash the content of each object, only find the empty ones left by failed writes and verify the nodes")
+		c.Flags.BoolVar(&c.JSON, "json", false, "Print a JSON report of the actions taken to stdout")
+		c.Flags.BoolVar(&c.GC, "gc", false, "Once the table is verified, move to trash the objects not referenced by any node like gc does; skipped if the table is still flagged for fsck")
+		c.Flags.DurationVar(&c.KeepUnreferencedFor, "keep-unreferenced-for", defaultKeepUnreferencedFor, keepUnreferencedForHelp)
+		c.Flags.StringVar(&c.RepairFrom, "repair-from", "", "URL of the objects served by dumbcas web on another copy of the table, e.g. http://host:8010/content/retrieve/default")
 		return c
 	},
 }
 
 type fsckRun struct {
 	CommonFlags
+	Fast       bool
+	JSON       bool
+	GC         bool
+	RepairFrom string
+	// KeepUnreferencedFor is shared with gc through orphans.json.
+	KeepUnreferencedFor time.Duration
+
+	// lock protects the fields below modified by the workers of scanEntries().
+	lock        sync.Mutex
+	attempted   map[string]bool
+	repaired    syncInt
+	unrepaired  syncInt
+	quarantined []string
+	// truncated are the empty objects not named after the empty content, which
+	// are left by failed writes. They are moved to the trash too.
+	truncated []string
+	// missing is the number of objects referenced by the nodes that couldn't be
+	// read.
+	missing int
+	// sizes and referenced are only filled with -gc.
+	sizes      map[string]int64
+	referenced map[string]bool
 }
 
-func (c *fsckRun) main(a DumbcasApplication) error {
-	if err := c.Parse(a, true); err != nil {
-		return err
+// fsckReport is printed with -json.
+type fsckReport struct {
+	// Entries is the number of objects scanned; Valid excludes the ones found
+	// corrupted, which are not looked for with -fast, and the truncated ones,
+	// i.e. empty but not named after the empty content.
+	Entries        int               `json:"entries"`
+	Valid          int               `json:"valid"`
+	Quarantined    []fsckQuarantined `json:"quarantined"`
+	Truncated      []string          `json:"truncated,omitempty"`
+	Nodes          int               `json:"nodes"`
+	CorruptedNodes []string          `json:"corrupted_nodes"`
+	Missing        int               `json:"missing"`
+	MismatchedSize int               `json:"mismatched_sizes"`
+	Repaired       int64             `json:"repaired"`
+	Unrepaired     int64             `json:"unrepaired"`
+	FsckBitCleared bool              `json:"fsck_bit_cleared"`
+	Orphans        []string          `json:"orphans,omitempty"`
+	ReclaimedBytes int64             `json:"reclaimed_bytes,omitempty"`
+	// ScanDuration is the wall-clock time taken to scan the CAS table and
+	// Duration the one of the whole run.
+	ScanDuration time.Duration `json:"scan_duration_ns"`
+	Duration     time.Duration `json:"duration_ns"`
+}
+
+// fsckQuarantined is an object moved to the trash.
+type fsckQuarantined struct {
+	Hash string `json:"hash"`
+	// Trash is the item as listed by trash list, if found.
+	Trash string `json:"trash,omitempty"`
+}
+
+// repair fetches a corrupted or missing object from -repair-from. Each object
+// is only attempted once. Returns true if the object was repaired.
+func (c *fsckRun) repair(a DumbcasApplication, item string) bool {
+	c.lock.Lock()
+	attempted := c.attempted[item]
+	c.attempted[item] = true
+	c.lock.Unlock()
+	if attempted {
+		return false
+	}
+	if err := dumbcaslib.RepairEntry(c.cas, c.RepairFrom, item); err != nil {
+		a.GetLogger().Errorf("Failed to repair %s: %s", item, err)
+		c.unrepaired.Add(1)
+		return false
 	}
+	a.GetLogger().Infof("Repaired %s", item)
+	c.repaired.Add(1)
+	return true
+}
 
-	count := 0
+// scanEntries enumerates the CAS table. The empty entries are verified to not
+// be truncated by a pool of c.Jobs workers. Unless -fast, the workers also
+// rehash each entry and the corrupted ones are moved to the trash. Returns the
+// number of entries scanned and found corrupted, excluding the truncated ones.
+func (c *fsckRun) scanEntries(a DumbcasApplication) (int, int, error) {
+	jobs := c.Jobs
+	if jobs <= 0 {
+		jobs = dumbcaslib.DefaultJobs
+	}
+	emptyHash := hex.EncodeToString(c.cas.NewHash().Sum(nil))
+	items := make(chan dumbcaslib.EnumerationEntry)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
 	corrupted := 0
-	for item := range c.cas.Enumerate() {
+	var out error
+	// The enumeration is stopped on the first error.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fail := func(err error) {
+		lock.Lock()
+		if out == nil {
+			out = err
+			cancel()
+		}
+		lock.Unlock()
+	}
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range items {
+				lock.Lock()
+				failed := out != nil
+				lock.Unlock()
+				if failed {
+					// Drain the channel.
+					continue
+				}
+				if item.Size == 0 && item.Item != emptyHash {
+					truncated, err := c.checkTruncated(a, item.Item)
+					if err != nil {
+						fail(err)
+					}
+					if truncated {
+						continue
+					}
+				}
+				c.recordSize(item)
+				if c.Fast {
+					continue
+				}
+				bad, err := c.verifyEntry(a, item.Item)
+				if bad {
+					lock.Lock()
+					corrupted++
+					lock.Unlock()
+				}
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+	count := 0
+	for item := range c.cas.EnumerateCtx(ctx) {
 		if item.Error != nil {
-			a.GetLog().Printf("While enumerating the CAS table: %s", item.Error)
+			a.GetLogger().Errorf("While enumerating the CAS table: %s", item.Error)
 			continue
 		}
 		count++
-		f, err := c.cas.Open(item.Item)
-		if err != nil {
-			// TODO(maruel): Leaks channel.
-			return fmt.Errorf("Failed to open %s: %s", item.Item, err)
-		}
-		defer func() {
-			_ = f.Close()
-		}()
-		actual, err := sha1Reader(f)
-		if err != nil {
-			// Probably Disk error.
-			// TODO(maruel): Leaks channel.
-			return fmt.Errorf("Aborting! Failed to calcultate the sha1 of %s: %s. Please find a valid copy of your CAS table ASAP.", item.Item, err)
+		if !c.Fast || (item.Size == 0 && item.Item != emptyHash) {
+			items <- item
+		} else {
+			c.recordSize(item)
 		}
-		if actual != item.Item {
-			corrupted++
-			a.GetLog().Printf("Found corrupted object, %s != %s", item.Item, actual)
-			if err := c.cas.Remove(item.Item); err != nil {
-				// TODO(maruel): Leaks channel.
-				return fmt.Errorf("Failed to trash object %s: %s", item.Item, err)
-			}
+	}
+	close(items)
+	wg.Wait()
+	// The workers complete in any order.
+	sort.Strings(c.quarantined)
+	sort.Strings(c.truncated)
+	return count, corrupted, out
+}
+
+// recordSize records the size of a valid entry for -gc.
+func (c *fsckRun) recordSize(item dumbcaslib.EnumerationEntry) {
+	if c.sizes != nil {
+		c.lock.Lock()
+		c.sizes[item.Item] = item.Size
+		c.lock.Unlock()
+	}
+}
+
+// checkTruncated moves an entry to the trash if it is empty. It must only be
+// called for the entries not named after the empty content. The size is
+// verified since not all the tables know it while enumerating. Returns true
+// if it was truncated.
+func (c *fsckRun) checkTruncated(a DumbcasApplication, item string) (bool, error) {
+	if size, err := dumbcaslib.ContentSize(c.cas, item); err != nil || size != 0 {
+		// Let the rehash find out.
+		return false, nil
+	}
+	c.cas.SetFsckBit()
+	a.GetLogger().Warningf("Found truncated object %s: it is empty", item)
+	if err := c.cas.Remove(item); err != nil {
+		return true, fmt.Errorf("Failed to trash object %s: %s", item, err)
+	}
+	c.lock.Lock()
+	c.truncated = append(c.truncated, item)
+	c.lock.Unlock()
+	if c.RepairFrom != "" {
+		c.repair(a, item)
+	}
+	return true, nil
+}
+
+// verifyEntry rehashes an entry and moves it to the trash if its content
+// doesn't match its name. Returns true if it was corrupted.
+func (c *fsckRun) verifyEntry(a DumbcasApplication, item string) (bool, error) {
+	f, err := c.cas.Open(item)
+	if err != nil {
+		return false, fmt.Errorf("Failed to open %s: %s", item, err)
+	}
+	actual, err := hashReader(c.cas.NewHash(), f)
+	_ = f.Close()
+	if err != nil {
+		// Probably Disk error.
+		return false, fmt.Errorf("Aborting! Failed to calcultate the sha1 of %s: %s. Please find a valid copy of your CAS table ASAP.", item, err)
+	}
+	if actual == item {
+		return false, nil
+	}
+	// Flag the table in case fsck doesn't complete.
+	c.cas.SetFsckBit()
+	a.GetLogger().Warningf("Found corrupted object, %s != %s", item, actual)
+	if err := c.cas.Remove(item); err != nil {
+		return true, fmt.Errorf("Failed to trash object %s: %s", item, err)
+	}
+	c.lock.Lock()
+	c.quarantined = append(c.quarantined, item)
+	c.lock.Unlock()
+	if c.RepairFrom != "" {
+		c.repair(a, item)
+	}
+	return true, nil
+}
+
+func (c *fsckRun) main(a DumbcasApplication) error {
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	start := time.Now()
+	c.attempted = map[string]bool{}
+	if c.GC {
+		// Like gc, don't remove the objects being archived.
+		if err := c.Lock(a, true); err != nil {
+			return err
 		}
+		defer c.Unlock()
+		c.sizes = map[string]int64{}
+		c.referenced = map[string]bool{}
+	}
+
+	count, corrupted, err := c.scanEntries(a)
+	if err != nil {
+		return err
 	}
-	a.GetLog().Printf("Scanned %d entries in CasTable; found %d corrupted.", count, corrupted)
+	scanDuration := time.Since(start)
+	a.GetLogger().Infof("Scanned %d entries in CasTable in %s; found %d corrupted and %d truncated.", count, scanDuration.Round(time.Millisecond), corrupted, len(c.truncated))
+	report := &fsckReport{Entries: count, Valid: count - corrupted - len(c.truncated), Truncated: c.truncated, CorruptedNodes: []string{}, ScanDuration: scanDuration}
 
-	// TODO(maruel): Get the value from CasTable.
-	hashLength := 40
+	hashLength := c.cas.NewHash().Size() * 2
 	resha1 := regexp.MustCompile(fmt.Sprintf("^([a-f0-9]{%d})$", hashLength))
 	count = 0
 	corrupted = 0
+	mismatched := 0
 	for item := range c.nodes.Enumerate() {
 		// TODO(maruel): Can't differentiate between an I/O error or a corrupted node.
 		// NodesTable.Enumerate() automatically clears corrupted nodes.
 		// TODO(maruel): This is a layering error.
 		if item.Error != nil {
-			a.GetLog().Printf("While enumerating the Nodes table: %s", item.Error)
+			a.GetLogger().Errorf("While enumerating the Nodes table: %s", item.Error)
 			continue
 		}
 		count++
-		f, err := c.nodes.Open(item.Item)
+		// LoadNode() also verifies the checksum of the node.
+		node, err := dumbcaslib.LoadNode(c.nodes, item.Item)
 		if err != nil {
-			a.GetLog().Printf("Failed opening node %s: %s", item.Item, err)
+			a.GetLogger().Errorf("Failed opening node %s: %s", item.Item, err)
 			_ = c.nodes.Remove(item.Item)
 			corrupted++
+			report.CorruptedNodes = append(report.CorruptedNodes, item.Item)
 			continue
 		}
-		defer func() {
-			_ = f.Close()
-		}()
-		node := &dumbcaslib.Node{}
-		if err := dumbcaslib.LoadReaderAsJSON(f, node); err != nil {
-			a.GetLog().Printf("Failed opening node %s: %s", item.Item, err)
+		if !resha1.MatchString(node.Entry) {
+			a.GetLogger().Warningf("Node %s is corrupted: %v", item.Item, node)
 			_ = c.nodes.Remove(item.Item)
 			corrupted++
+			report.CorruptedNodes = append(report.CorruptedNodes, item.Item)
 			continue
 		}
-		if !resha1.MatchString(node.Entry) {
-			a.GetLog().Printf("Node %s is corrupted: %v", item.Item, node)
-			_ = c.nodes.Remove(item.Item)
-			corrupted++
+		entry, err := dumbcaslib.LoadEntry(c.cas, node.Entry)
+		if err != nil && c.RepairFrom != "" && c.repair(a, node.Entry) {
+			entry, err = dumbcaslib.LoadEntry(c.cas, node.Entry)
+		}
+		if err != nil {
+			a.GetLogger().Warningf("Node %s: %s", item.Item, err)
+			c.missing++
 			continue
 		}
+		// The manifests are repaired first, so their chunks are referenced.
+		mismatched += c.checkSizes(a, item.Item, "", entry)
+		if c.referenced != nil {
+			c.referenced[node.Entry] = true
+			if err := tagRecurse(c.cas, c.referenced, entry); err != nil {
+				// Already counted as missing; the table stays flagged so -gc
+				// is skipped.
+				a.GetLogger().Warningf("Node %s: %s", item.Item, err)
+			}
+		}
+	}
+	a.GetLogger().Infof("Scanned %d entries in NodesTable; found %d corrupted.", count, corrupted)
+	a.GetLogger().Infof("Found %d files with a size not matching their content.", mismatched)
+	if c.RepairFrom != "" {
+		a.GetLogger().Infof("Repaired %d objects; failed to repair %d.", c.repaired.Get(), c.unrepaired.Get())
+	}
+
+	// The corrupted objects and nodes were moved out of the way; the table is
+	// only clean if all the nodes can be fully restored.
+	if c.missing == 0 && mismatched == 0 {
+		c.cas.ClearFsckBit()
+	} else {
+		c.cas.SetFsckBit()
+		a.GetLogger().Warningf("The table is still flagged for fsck: %d objects are missing and %d sizes mismatch.", c.missing, mismatched)
+	}
+	var gcErr error
+	if c.GC {
+		report.Orphans, report.ReclaimedBytes, gcErr = c.collectGarbage(a)
+	}
+	report.Duration = time.Since(start)
+	a.GetLogger().Infof("fsck completed in %s.", report.Duration.Round(time.Millisecond))
+	if !c.JSON {
+		return gcErr
+	}
+	report.Nodes = count
+	report.Missing = c.missing
+	report.MismatchedSize = mismatched
+	report.Repaired = c.repaired.Get()
+	report.Unrepaired = c.unrepaired.Get()
+	report.FsckBitCleared = !c.cas.GetFsckBit()
+	report.Quarantined = c.trashItems()
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.GetOut(), "%s\n", data)
+	return gcErr
+}
+
+// collectGarbage moves to trash the objects found by scanEntries() that no
+// node references, like gc. It is only safe once all the nodes were loaded,
+// i.e. the fsck bit was cleared. Returns the orphans and their total size.
+func (c *fsckRun) collectGarbage(a DumbcasApplication) ([]string, int64, error) {
+	if c.cas.GetFsckBit() {
+		return nil, 0, fmt.Errorf("Skipping gc: the table is still flagged for fsck")
+	}
+	// Already moved to the trash.
+	for _, hash := range c.quarantined {
+		delete(c.sizes, hash)
+	}
+	orphans, _, orphanSize := findOrphans(c.sizes, c.referenced)
+	if c.KeepUnreferencedFor > 0 {
+		expired, kept, keptSize, err := keepOrphans(c.lockRoot, orphans, c.sizes, c.KeepUnreferencedFor, true)
+		if err != nil {
+			return nil, 0, err
+		}
+		a.GetLogger().Infof("Keeping %d bytes in %d orphans for less than %s", keptSize, kept, c.KeepUnreferencedFor)
+		orphans = expired
+		orphanSize -= keptSize
+	}
+	a.GetLogger().Infof("Reclaiming %d bytes in %d orphans", orphanSize, len(orphans))
+	return orphans, orphanSize, removeOrphans(c.cas, orphans)
+}
+
+// trashItems returns the objects quarantined with their item in the trash.
+func (c *fsckRun) trashItems() []fsckQuarantined {
+	items := map[string]string{}
+	if trash, ok := c.cas.(dumbcaslib.TrashTable); ok && len(c.quarantined) != 0 {
+		for v := range trash.EnumerateTrash() {
+			if v.Error == nil {
+				items[dumbcaslib.TrashItemHash(v.Item)] = v.Item
+			}
+		}
 	}
-	a.GetLog().Printf("Scanned %d entries in NodesTable; found %d corrupted.", count, corrupted)
+	out := make([]fsckQuarantined, 0, len(c.quarantined))
+	for _, hash := range c.quarantined {
+		out = append(out, fsckQuarantined{Hash: hash, Trash: items[hash]})
+	}
+	return out
+}
 
-	c.cas.ClearFsckBit()
-	return nil
+// checkSizes verifies that the content of each file is in the table, repairing
+// it with -repair-from, and that its recorded size matches. Returns the number
+// of mismatches. The size of the files archived before it was recorded is not
+// verified.
+func (c *fsckRun) checkSizes(a DumbcasApplication, nodeName, relPath string, entry *dumbcaslib.Entry) int {
+	mismatched := 0
+	if entry.Sha1 != "" {
+		objects, err := entry.Objects(c.cas)
+		if err != nil && c.RepairFrom != "" && c.repair(a, entry.Manifest) {
+			objects, err = entry.Objects(c.cas)
+		}
+		if err == nil && entry.Manifest != "" {
+			// The size of a chunked file is the sum of its chunks.
+			objects = objects[1:]
+		}
+		size := int64(0)
+		for _, hash := range objects {
+			s, err2 := dumbcaslib.ContentSize(c.cas, hash)
+			if err2 != nil && c.RepairFrom != "" && c.repair(a, hash) {
+				s, err2 = dumbcaslib.ContentSize(c.cas, hash)
+			}
+			if err2 != nil {
+				err = err2
+				break
+			}
+			size += s
+		}
+		if err != nil {
+			a.GetLogger().Errorf("Node %s: failed to open %s: %s", nodeName, relPath, err)
+			c.missing++
+		} else if entry.Size != 0 && size != entry.Size {
+			a.GetLogger().Warningf("Node %s: %s is %d bytes but recorded as %d", nodeName, relPath, size, entry.Size)
+			mismatched++
+		}
+	}
+	for _, name := range entry.SortedFiles() {
+		mismatched += c.checkSizes(a, nodeName, path.Join(relPath, name), entry.Files[name])
+	}
+	return mismatched
 }
 
 func (c *fsckRun) Run(a subcommands.Application, args []string) int {
@@ -10,6 +10,15 @@ limitations under the License. */
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/maruel/dumbcas/dumbcaslib"
@@ -19,7 +28,7 @@ import (
 func TestFsckEmpty(t *testing.T) {
 	t.Parallel()
 	f := makeDumbcasAppMock(t)
-	args := []string{"fsck", "-root=\\test_fsck_empty"}
+	args := []string{"fsck", "-root=" + mockRoot("fsck_empty")}
 	f.Run(args, 0)
 	items, err := dumbcaslib.EnumerateCasAsList(f.cas)
 	ut.AssertEqual(t, nil, err)
@@ -32,7 +41,7 @@ func TestFsckEmpty(t *testing.T) {
 func TestFsckCorruptCasFile(t *testing.T) {
 	t.Parallel()
 	f := makeDumbcasAppMock(t)
-	args := []string{"fsck", "-root=\\test_fsck_cas"}
+	args := []string{"fsck", "-root=" + mockRoot("fsck_cas")}
 	f.Run(args, 0)
 
 	archiveData(f.TB, f.cas, f.nodes, map[string]string{
@@ -67,10 +76,29 @@ func TestFsckCorruptCasFile(t *testing.T) {
 	ut.AssertEqual(t, 2, len(n1))
 }
 
+func TestFsckFast(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"fsck", "-root=" + mockRoot("fsck_fast"), "-fast"}
+	f.Run(args, 0)
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	f.cas.(dumbcaslib.Corruptable).Corrupt()
+
+	// The content is not rehashed with -fast.
+	f.Run(args, 0)
+	i1, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 3, len(i1))
+	f.Run([]string{"fsck", "-root=" + mockRoot("fsck_fast"), "-jobs=2"}, 0)
+	i1, err = dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(i1))
+}
+
 func TestFsckCorruptNodeEntry(t *testing.T) {
 	t.Parallel()
 	f := makeDumbcasAppMock(t)
-	args := []string{"fsck", "-root=\\test_fsck_corrupt"}
+	args := []string{"fsck", "-root=" + mockRoot("fsck_corrupt")}
 	f.Run(args, 0)
 
 	// Create a tree of stuff.
@@ -90,3 +118,242 @@ func TestFsckCorruptNodeEntry(t *testing.T) {
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqual(t, 1, len(n1))
 }
+
+func TestFsckCheckSizes(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"fsck", "-root=" + mockRoot("fsck_sizes")}
+	f.Run(args, 0)
+
+	h, err := dumbcaslib.AddBytes(f.cas, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	entry := &dumbcaslib.Entry{}
+	entry.AddFile("file1", h, 8)
+	entry.AddFile("dir1/file2", h, 3)
+	// Archived before the size was recorded.
+	entry.AddFile("dir1/file3", h, 0)
+	c := &fsckRun{}
+	c.cas = f.cas
+	ut.AssertEqual(t, 1, c.checkSizes(f, "node", "", entry))
+}
+
+func TestFsckRepairFrom(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"fsck", "-root=" + mockRoot("fsck_repair")}
+	f.Run(args, 0)
+
+	// The other copy of the table, served over HTTP.
+	other := dumbcaslib.MakeMemoryCasTable()
+	tree := map[string]string{
+		"file1":           "content1",
+		"dir1/dir2/file2": "content2",
+	}
+	sha1tree, _, _ := archiveData(f.TB, other, dumbcaslib.MakeMemoryNodesTable(other), tree)
+	archiveData(f.TB, f.cas, f.nodes, tree)
+	server := httptest.NewServer(other)
+	defer server.Close()
+
+	// One object is missing, another is corrupted and can't be repaired.
+	ut.AssertEqual(t, nil, f.cas.Remove(sha1tree["file1"]))
+	f.cas.(dumbcaslib.Corruptable).Corrupt()
+
+	f.Run([]string{"fsck", "-root=" + mockRoot("fsck_repair"), "-repair-from=" + server.URL}, 0)
+	f.CheckBuffer(false, false)
+	r, err := f.cas.Open(sha1tree["file1"])
+	ut.AssertEqual(t, nil, err)
+	_ = r.Close()
+	items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 3, len(items))
+}
+
+func TestFsckJSON(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"fsck", "-root=" + mockRoot("fsck_json"), "-json"}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file1": "content1",
+	})
+	f.cas.(dumbcaslib.Corruptable).Corrupt()
+	f.nodes.(dumbcaslib.Corruptable).Corrupt()
+	f.Run(args, 0)
+	report := &fsckReport{}
+	ut.AssertEqual(t, nil, json.Unmarshal(f.GetOut().(*bytes.Buffer).Bytes(), report))
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, true, report.Duration >= report.ScanDuration)
+	report.ScanDuration = 0
+	report.Duration = 0
+	corrupted := dumbcaslib.Sha1Bytes([]byte{0, 1})
+	expected := &fsckReport{
+		Entries:        3,
+		Valid:          2,
+		Quarantined:    []fsckQuarantined{{Hash: corrupted, Trash: corrupted}},
+		Nodes:          2,
+		CorruptedNodes: []string{"tags/fictious"},
+		FsckBitCleared: true,
+	}
+	ut.AssertEqual(t, expected, report)
+}
+
+func TestFsckNodeChecksum(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "fsck_node_checksum")
+	defer removeDir(t, tempData)
+	f.cas = dumbcaslib.MakeMemoryCasTable()
+	nodes, err := dumbcaslib.LoadLocalNodesTable(tempData, f.cas)
+	ut.AssertEqual(t, nil, err)
+	f.nodes = nodes
+	_, nodeName, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file1": "content1",
+	})
+
+	// The node is still valid JSON, only its checksum gives it away.
+	p := filepath.Join(tempData, "nodes", nodeName)
+	data, err := ioutil.ReadFile(p)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, os.Remove(p))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(p, bytes.Replace(data, []byte("useful"), []byte("faulty"), 1), 0600))
+	_, err = dumbcaslib.LoadNode(f.nodes, nodeName)
+	ut.AssertEqual(t, true, err != nil && strings.Contains(err.Error(), "Checksum mismatch"))
+
+	f.Run([]string{"fsck", "-root=" + mockRoot("fsck_checksum"), "-json"}, 0)
+	report := &fsckReport{}
+	ut.AssertEqual(t, nil, json.Unmarshal(f.GetOut().(*bytes.Buffer).Bytes(), report))
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, true, len(report.CorruptedNodes) != 0)
+	ut.AssertEqual(t, nodeName, filepath.FromSlash(report.CorruptedNodes[0]))
+	_, err = os.Stat(p)
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+}
+
+func TestFsckTruncated(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"fsck", "-root=" + mockRoot("fsck_truncated"), "-json"}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file1": "content1",
+		"empty": "",
+	})
+	// A write that failed before any content was written.
+	truncated := sha1String("content2")
+	ut.AssertEqual(t, nil, f.cas.AddEntry(&bytes.Buffer{}, truncated))
+
+	// It is found without -deep.
+	f.Run(args, 0)
+	report := &fsckReport{}
+	ut.AssertEqual(t, nil, json.Unmarshal(f.GetOut().(*bytes.Buffer).Bytes(), report))
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, 4, report.Entries)
+	ut.AssertEqual(t, 3, report.Valid)
+	ut.AssertEqual(t, []string{truncated}, report.Truncated)
+	ut.AssertEqual(t, []fsckQuarantined{}, report.Quarantined)
+	_, err := f.cas.Open(truncated)
+	ut.AssertEqual(t, false, err == nil)
+	// The empty content is valid.
+	_, err = f.cas.Open(sha1String(""))
+	ut.AssertEqual(t, nil, err)
+}
+
+func TestFsckJobs(t *testing.T) {
+	t.Parallel()
+	for _, jobs := range []string{"-jobs=1", "-jobs=16"} {
+		f := makeDumbcasAppMock(t)
+		args := []string{"fsck", "-root=" + mockRoot("fsck_jobs"), "-json", "-gc", jobs, "-keep-unreferenced-for=0"}
+		f.Run(args, 0)
+		f.CheckBuffer(true, false)
+
+		archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+		truncated := make([]string, 0, 20)
+		for i := 0; i < 20; i++ {
+			hash := sha1String(fmt.Sprintf("content%d", i+2))
+			ut.AssertEqual(t, nil, f.cas.AddEntry(&bytes.Buffer{}, hash))
+			truncated = append(truncated, hash)
+		}
+		sort.Strings(truncated)
+
+		f.Run(args, 0)
+		report := &fsckReport{}
+		ut.AssertEqual(t, nil, json.Unmarshal(f.GetOut().(*bytes.Buffer).Bytes(), report))
+		f.CheckBuffer(true, false)
+		ut.AssertEqual(t, 22, report.Entries)
+		ut.AssertEqual(t, 2, report.Valid)
+		ut.AssertEqual(t, truncated, report.Truncated)
+		ut.AssertEqual(t, []string(nil), report.Orphans)
+		ut.AssertEqual(t, true, report.FsckBitCleared)
+	}
+}
+
+func TestFsckBit(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"fsck", "-root=" + mockRoot("fsck_bit")}
+	f.Run(args, 0)
+	sha1tree, _, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file1": "content1",
+	})
+	f.cas.SetFsckBit()
+	f.Run(args, 0)
+	ut.AssertEqual(t, false, f.cas.GetFsckBit())
+
+	// An object referenced by a node is missing; the table is not clean.
+	ut.AssertEqual(t, nil, f.cas.Remove(sha1tree["file1"]))
+	f.Run(args, 0)
+	ut.AssertEqual(t, true, f.cas.GetFsckBit())
+
+	ut.AssertEqual(t, nil, f.cas.(dumbcaslib.TrashTable).RestoreTrash(sha1tree["file1"]))
+	f.Run(args, 0)
+	ut.AssertEqual(t, false, f.cas.GetFsckBit())
+}
+
+func TestFsckGc(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"fsck", "-root=" + mockRoot("fsck_gc"), "-gc", "-json", "-keep-unreferenced-for=0"}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file1":           "content1",
+		"dir1/dir2/file2": "content2",
+	})
+	i1, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	n1, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file3":  "content3",
+		"file1a": "content1",
+	})
+	i2, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+
+	// Same as gc.
+	ut.AssertEqual(t, nil, f.nodes.Remove(n1[0]))
+	f.Run(args, 0)
+	report := &fsckReport{}
+	ut.AssertEqual(t, nil, json.Unmarshal(f.GetOut().(*bytes.Buffer).Bytes(), report))
+	f.CheckBuffer(true, false)
+	orphans := Sub(i1, []string{sha1String("content1")})
+	ut.AssertEqual(t, orphans, report.Orphans)
+	i3, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, Sub(i2, orphans), i3)
+
+	// Nothing is removed while an object is missing.
+	ut.AssertEqual(t, nil, f.cas.Remove(sha1String("content3")))
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file4": "content4"})
+	ut.AssertEqual(t, nil, f.nodes.Remove("tags/fictious"))
+	f.Run([]string{"fsck", "-root=" + mockRoot("fsck_gc"), "-gc", "-keep-unreferenced-for=0"}, 1)
+	f.CheckBuffer(false, true)
+	i4, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, len(i3)+1, len(i4))
+}
@@ -10,7 +10,14 @@ limitations under the License. */
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
 
 	"github.com/maruel/dumbcas/dumbcaslib"
 	"github.com/maruel/subcommands"
@@ -19,62 +26,152 @@ import (
 var cmdGc = &subcommands.Command{
 	UsageLine: "gc",
 	ShortDesc: "moves to trash all objects that are not referenced anymore",
-	LongDesc:  "Scans each node and each entry file to determine if each cas entry is referenced or not.",
+	LongDesc:  "Scans each node and each entry file to determine if each cas entry is referenced or not. The pack files holding removed objects are then rewritten to reclaim their space and the small pack files left by each run are merged. The time an object is first found unreferenced is recorded and the object is only removed by a later run once it stayed unreferenced for -keep-unreferenced-for, 24h by default, so an archive racing with gc has the time to write its node.",
 	CommandRun: func() subcommands.CommandRun {
 		c := &gcRun{}
 		c.Init()
+		c.Flags.BoolVar(&c.DryRun, "dry-run", false, "Only log the orphans and the space that would be reclaimed, without removing anything")
+		c.Flags.DurationVar(&c.KeepUnreferencedFor, "keep-unreferenced-for", defaultKeepUnreferencedFor, keepUnreferencedForHelp)
 		return c
 	},
 }
 
 type gcRun struct {
 	CommonFlags
+	DryRun              bool
+	KeepUnreferencedFor time.Duration
 }
 
-func tagRecurse(entries map[string]bool, entry *dumbcaslib.Entry) {
-	if entry.Sha1 != "" {
-		entries[entry.Sha1] = true
+// orphansName is the file of the nodes root recording when each object was
+// first found unreferenced.
+const orphansName = "orphans.json"
+
+// defaultKeepUnreferencedFor leaves the time to an archive racing with gc to
+// write the node referencing the objects it added.
+const defaultKeepUnreferencedFor = 24 * time.Hour
+
+const keepUnreferencedForHelp = "Only remove the objects found unreferenced by gc and fsck -gc runs spanning at least this duration, e.g. 168h; 0 removes them right away"
+
+// loadOrphansSeen returns the time each object was first found unreferenced.
+// A missing or corrupted file is an empty index.
+func loadOrphansSeen(path string) map[string]time.Time {
+	seen := map[string]time.Time{}
+	f, err := os.Open(path)
+	if err != nil {
+		return seen
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if err := dumbcaslib.LoadReaderAsJSON(f, &seen); err != nil {
+		return map[string]time.Time{}
+	}
+	return seen
+}
+
+// saveOrphansSeen writes the index, removing the file when it is empty.
+func saveOrphansSeen(path string, seen map[string]time.Time) error {
+	if len(seen) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(seen)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	// Write then rename so an interruption doesn't leave a truncated file.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// expiredOrphans returns the orphans unreferenced for at least keep according
+// to seen, and the updated index. The objects not orphaned anymore are dropped
+// from the index so their timer restarts if they become orphans again.
+func expiredOrphans(orphans []string, seen map[string]time.Time, now time.Time, keep time.Duration) ([]string, map[string]time.Time) {
+	expired := []string{}
+	next := map[string]time.Time{}
+	for _, orphan := range orphans {
+		first, ok := seen[orphan]
+		if !ok || first.After(now) {
+			first = now
+		}
+		if now.Sub(first) >= keep {
+			expired = append(expired, orphan)
+		} else {
+			next[orphan] = first
+		}
+	}
+	return expired, next
+}
+
+// tagRecurse marks the objects of entry and of its files as referenced. It
+// fails if the manifest of a chunked file can't be read, since its chunks
+// would be collected otherwise.
+func tagRecurse(cas dumbcaslib.CasTable, entries map[string]bool, entry *dumbcaslib.Entry) error {
+	objects, err := entry.Objects(cas)
+	if err != nil {
+		return err
+	}
+	for _, hash := range objects {
+		entries[hash] = true
 	}
 	for _, i := range entry.Files {
-		tagRecurse(entries, i)
+		if err := tagRecurse(cas, entries, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setFsckBit flags the table as inconsistent, unless running in dry-run mode
+// where the table must be left untouched.
+func (c *gcRun) setFsckBit() {
+	if !c.DryRun {
+		c.cas.SetFsckBit()
 	}
 }
 
 func (c *gcRun) main(a DumbcasApplication) error {
+	// The enumeration must not move the unexpected files to the trash either.
+	c.ReadOnly = c.DryRun
 	if err := c.Parse(a, false); err != nil {
 		return err
 	}
+	if err := c.Lock(a, true); err != nil {
+		return err
+	}
+	defer c.Unlock()
 
+	// Stops the enumerations when returning early.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	entries := map[string]bool{}
-	for item := range c.cas.Enumerate() {
+	sizes := map[string]int64{}
+	for item := range c.cas.EnumerateCtx(ctx) {
 		if item.Error != nil {
-			// TODO(maruel): Leaks channel.
-			c.cas.SetFsckBit()
+			c.setFsckBit()
 			return fmt.Errorf("Failed enumerating the CAS table %s", item.Error)
 		}
-		entries[item.Item] = false
+		sizes[item.Item] = item.Size
 	}
-	a.GetLog().Printf("Found %d entries", len(entries))
+	a.GetLogger().Debugf("Found %d entries", len(sizes))
 
 	// Load all the nodes.
-	for item := range c.nodes.Enumerate() {
+	for item := range c.nodes.EnumerateCtx(ctx) {
 		if item.Error != nil {
-			// TODO(maruel): Leaks channel.
 			return item.Error
 		}
-		f, err := c.nodes.Open(item.Item)
+		node, err := dumbcaslib.LoadNode(c.nodes, item.Item)
 		if err != nil {
-			// TODO(maruel): Leaks channel.
-			c.cas.SetFsckBit()
-			return fmt.Errorf("Failed opening node %s: %s", item.Item, err)
-		}
-		defer func() {
-			_ = f.Close()
-		}()
-		node := &dumbcaslib.Node{}
-		if err := dumbcaslib.LoadReaderAsJSON(f, node); err != nil {
-			// TODO(maruel): Leaks channel.
-			c.cas.SetFsckBit()
+			c.setFsckBit()
 			return fmt.Errorf("Failed opening node %s: %s", item.Item, err)
 		}
 
@@ -83,19 +180,88 @@ func (c *gcRun) main(a DumbcasApplication) error {
 		if err != nil {
 			return err
 		}
-		tagRecurse(entries, entry)
+		if err := tagRecurse(c.cas, entries, entry); err != nil {
+			c.setFsckBit()
+			return fmt.Errorf("Failed to load the tree of %s: %s", item.Item, err)
+		}
+	}
+
+	orphans, liveSize, orphanSize := findOrphans(sizes, entries)
+	a.GetLogger().Infof("Found %d orphan", len(orphans))
+	fmt.Fprintf(a.GetOut(), "Live: %d bytes in %d entries\n", liveSize, len(sizes)-len(orphans))
+	if c.KeepUnreferencedFor > 0 {
+		expired, kept, keptSize, err := keepOrphans(c.lockRoot, orphans, sizes, c.KeepUnreferencedFor, !c.DryRun)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(a.GetOut(), "Keeping %d bytes in %d orphans for less than %s\n", keptSize, kept, c.KeepUnreferencedFor)
+		orphans = expired
+		orphanSize -= keptSize
+	}
+	fmt.Fprintf(a.GetOut(), "Reclaiming %d bytes in %d orphans\n", orphanSize, len(orphans))
+	if c.DryRun {
+		for _, orphan := range orphans {
+			a.GetLogger().Infof("Would remove %s (%d bytes)", orphan, sizes[orphan])
+		}
+		return nil
+	}
+	if err := removeOrphans(c.cas, orphans); err != nil {
+		return err
+	}
+	if p, ok := c.cas.(dumbcaslib.PackTable); ok {
+		packs, reclaimed, err := p.Repack()
+		if err != nil {
+			c.cas.SetFsckBit()
+			return fmt.Errorf("Failed to repack: %s", err)
+		}
+		if packs != 0 {
+			fmt.Fprintf(a.GetOut(), "Repacked %d packs, reclaiming %d bytes\n", packs, reclaimed)
+		}
+	}
+	return nil
+}
+
+// keepOrphans records in the orphans.json of lockRoot when each orphan was
+// first found unreferenced, unless save is false, and returns the ones
+// unreferenced for at least keep. Also returns the number and the total size
+// of the orphans kept.
+func keepOrphans(lockRoot string, orphans []string, sizes map[string]int64, keep time.Duration, save bool) ([]string, int, int64, error) {
+	path := filepath.Join(lockRoot, orphansName)
+	expired, seen := expiredOrphans(orphans, loadOrphansSeen(path), time.Now(), keep)
+	if save {
+		if err := saveOrphansSeen(path, seen); err != nil {
+			return nil, 0, 0, fmt.Errorf("Failed to save %s: %s", path, err)
+		}
+	}
+	var keptSize int64
+	for orphan := range seen {
+		keptSize += sizes[orphan]
 	}
+	return expired, len(seen), keptSize, nil
+}
 
+// findOrphans returns the sorted entries of sizes that are not referenced,
+// along with the total size of the referenced and of the orphaned entries.
+func findOrphans(sizes map[string]int64, referenced map[string]bool) ([]string, int64, int64) {
 	orphans := []string{}
-	for entry, tagged := range entries {
-		if !tagged {
+	var liveSize, orphanSize int64
+	for entry, size := range sizes {
+		if !referenced[entry] {
 			orphans = append(orphans, entry)
+			orphanSize += size
+		} else {
+			liveSize += size
 		}
 	}
-	a.GetLog().Printf("Found %d orphan", len(orphans))
+	sort.Strings(orphans)
+	return orphans, liveSize, orphanSize
+}
+
+// removeOrphans moves the orphans to the trash.
+func removeOrphans(cas dumbcaslib.CasTable, orphans []string) error {
 	for _, orphan := range orphans {
-		if err := c.cas.Remove(orphan); err != nil {
-			c.cas.SetFsckBit()
+		if err := cas.Remove(orphan); err != nil {
+			cas.SetFsckBit()
 			return fmt.Errorf("Internal error while removing %s: %s", orphan, err)
 		}
 	}
@@ -10,8 +10,19 @@ limitations under the License. */
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/maruel/dumbcas/dumbcaslib"
 	"github.com/maruel/ut"
@@ -20,17 +31,25 @@ import (
 func TestGcEmpty(t *testing.T) {
 	t.Parallel()
 	f := makeDumbcasAppMock(t)
-	args := []string{"gc", "-root=\\test_gc_empty"}
+	args := []string{"gc", "-root=" + mockRoot("gc_empty"), "-keep-unreferenced-for=0"}
 	f.Run(args, 0)
 	i, err := dumbcaslib.EnumerateCasAsList(f.cas)
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqual(t, []string{}, i)
 }
 
+func TestGcRemoteNodes(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	// The local lock can't exclude the archives of the other machines.
+	f.Run([]string{"gc", "-root=http://localhost:1/content/retrieve/default"}, 1)
+	ut.AssertEqual(t, true, strings.Contains(f.GetErr().(*bytes.Buffer).String(), "run it on the server"))
+}
+
 func TestGcKept(t *testing.T) {
 	t.Parallel()
 	f := makeDumbcasAppMock(t)
-	args := []string{"gc", "-root=\\test_gc_kept"}
+	args := []string{"gc", "-root=" + mockRoot("gc_kept"), "-keep-unreferenced-for=0"}
 	f.Run(args, 0) // Instantiate f.cas and f.nodes
 
 	// Create a tree of stuff.
@@ -60,7 +79,7 @@ func TestGcKept(t *testing.T) {
 func TestGcTrim(t *testing.T) {
 	t.Parallel()
 	f := makeDumbcasAppMock(t)
-	args := []string{"gc", "-root=\\test_gc_trim"}
+	args := []string{"gc", "-root=" + mockRoot("gc_trim"), "-keep-unreferenced-for=0"}
 	f.Run(args, 0) // Instantiate f.cas and f.nodes
 
 	// Create a tree of stuff.
@@ -107,3 +126,247 @@ func TestGcTrim(t *testing.T) {
 	sort.Strings(rest)
 	ut.AssertEqual(t, i3, rest)
 }
+
+func TestGcRepackWrapped(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "gc_repack")
+	defer removeDir(t, tempData)
+	local, err := dumbcaslib.MakeLocalCasTable(tempData, dumbcaslib.CasOptions{PackThreshold: 1024})
+	ut.AssertEqual(t, nil, err)
+	// Like -secondary, the table is wrapped.
+	f.cas = dumbcaslib.MakeFallbackCasTable(local, dumbcaslib.MakeMemoryCasTable())
+	_, _ = f.LoadNodesTable("", f.cas)
+	_, node, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content2"})
+	ut.AssertEqual(t, nil, f.nodes.Remove(node))
+
+	f.Run([]string{"gc", "-root=" + mockRoot("gc_repack"), "-keep-unreferenced-for=0"}, 0)
+	f.CheckOut("Live: 113 bytes in 2 entries\nReclaiming 113 bytes in 2 orphans\nRepacked 1 packs, reclaiming 113 bytes\n")
+}
+
+func TestGcDryRun(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"gc", "-root=" + mockRoot("gc_dry_run"), "-dry-run", "-keep-unreferenced-for=0"}
+	f.Run(args, 0) // Instantiate f.cas and f.nodes
+	f.CheckOut("Live: 0 bytes in 0 entries\nReclaiming 0 bytes in 0 orphans\n")
+
+	_, _, entrySha1 := archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file1":           "content1",
+		"dir1/dir2/file2": "content2",
+	})
+	e, err := f.cas.Open(entrySha1)
+	ut.AssertEqual(t, nil, err)
+	entrySize, err := e.Seek(0, io.SeekEnd)
+	ut.AssertEqual(t, nil, err)
+	_ = e.Close()
+	_, err = dumbcaslib.AddBytes(f.cas, []byte("orphan"))
+	ut.AssertEqual(t, nil, err)
+	i1, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+
+	f.Run(args, 0)
+	f.CheckOut(fmt.Sprintf("Live: %d bytes in 3 entries\nReclaiming 6 bytes in 1 orphans\n", 16+entrySize))
+
+	// Nothing disapeared.
+	i2, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, i1, i2)
+	ut.AssertEqual(t, false, f.cas.GetFsckBit())
+	ut.AssertEqual(t, true, f.casOptions.ReadOnly)
+}
+
+// snapshotDir returns the metadata and the content of each file under root.
+func snapshotDir(t testing.TB, root string) map[string]string {
+	out := map[string]string{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		v := fmt.Sprintf("%s %s", info.Mode(), info.ModTime())
+		if info.Mode().IsRegular() {
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			v += " " + string(data)
+		}
+		out[p] = v
+		return nil
+	})
+	ut.AssertEqual(t, nil, err)
+	return out
+}
+
+func TestGcDryRunLocal(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	f.local = true
+	tempData := makeTempDir(t, "gc_dry_run_local")
+	defer removeDir(t, tempData)
+	f.Run([]string{"gc", "-root=" + tempData, "-prefix-length=1", "-keep-unreferenced-for=0"}, 0) // Create the tables.
+	f.CheckBuffer(true, false)
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	_, err := dumbcaslib.AddBytes(f.cas, []byte("orphan"))
+	ut.AssertEqual(t, nil, err)
+	// Files unexpected in the table.
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(tempData, "cas", "junk"), []byte("junk"), 0600))
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(tempData, "cas", "0", "junk"), []byte("junk"), 0600))
+	before := snapshotDir(t, tempData)
+
+	f.Run([]string{"gc", "-root=" + tempData, "-dry-run", "-keep-unreferenced-for=0"}, 0)
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, before, snapshotDir(t, tempData))
+	ut.AssertEqual(t, false, f.cas.GetFsckBit())
+
+	// Without -dry-run, they are moved to the trash.
+	f.Run([]string{"gc", "-root=" + tempData, "-keep-unreferenced-for=0"}, 0)
+	f.CheckBuffer(true, false)
+	_, err = os.Stat(filepath.Join(tempData, "cas", "junk"))
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+	ut.AssertEqual(t, true, f.cas.GetFsckBit())
+}
+
+func TestGcDryRunCorrupted(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"gc", "-root=" + mockRoot("gc_dry_run_corrupted"), "-dry-run", "-keep-unreferenced-for=0"}
+	f.Run(args, 0) // Instantiate f.cas and f.nodes
+	f.CheckBuffer(true, false)
+	archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	i1, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+
+	// A node that can't be read aborts without touching the table.
+	f.nodes.(dumbcaslib.Corruptable).Corrupt()
+	f.Run(args, 1)
+	f.CheckBuffer(false, true)
+	ut.AssertEqual(t, false, f.cas.GetFsckBit())
+	i2, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, i1, i2)
+}
+
+func TestGcLocked(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"gc", "-root=" + mockRoot("gc_locked"), "-keep-unreferenced-for=0"}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+
+	// An archive is in progress.
+	lock, err := f.MakeLocker("").Lock(false)
+	ut.AssertEqual(t, nil, err)
+	f.Run(args, 1)
+	f.CheckBuffer(false, true)
+
+	ut.AssertEqual(t, nil, lock.Unlock())
+	f.Run(args, 0)
+}
+
+func TestGcKeepUnreferencedFor(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "gc_keep")
+	defer removeDir(t, tempData)
+	root := filepath.Join(tempData, "root")
+	args := []string{"gc", "-root=" + root, "-keep-unreferenced-for=1h"}
+	f.Run(args, 0) // Instantiate f.cas and f.nodes
+	f.CheckOut("Live: 0 bytes in 0 entries\nKeeping 0 bytes in 0 orphans for less than 1h0m0s\nReclaiming 0 bytes in 0 orphans\n")
+
+	hash, err := dumbcaslib.AddBytes(f.cas, []byte("orphan"))
+	ut.AssertEqual(t, nil, err)
+	f.Run(args, 0)
+	f.CheckOut("Live: 0 bytes in 0 entries\nKeeping 6 bytes in 1 orphans for less than 1h0m0s\nReclaiming 0 bytes in 0 orphans\n")
+	i, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{hash}, i)
+	path := filepath.Join(root, orphansName)
+	seen := loadOrphansSeen(path)
+	ut.AssertEqual(t, 1, len(seen))
+
+	// fsck -gc shares the record and keeps the orphan by default.
+	f.Run([]string{"fsck", "-root=" + root, "-gc"}, 0)
+	f.CheckBuffer(false, false)
+	i, err = dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{hash}, i)
+	ut.AssertEqual(t, seen, loadOrphansSeen(path))
+
+	// Age the record past the grace period.
+	seen[hash] = seen[hash].Add(-2 * time.Hour)
+	ut.AssertEqual(t, nil, saveOrphansSeen(path, seen))
+	f.Run([]string{"fsck", "-root=" + root, "-gc", "-keep-unreferenced-for=3h"}, 0)
+	f.CheckBuffer(false, false)
+	i, err = dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{hash}, i)
+	f.Run(args, 0)
+	f.CheckOut("Live: 0 bytes in 0 entries\nKeeping 0 bytes in 0 orphans for less than 1h0m0s\nReclaiming 6 bytes in 1 orphans\n")
+	i, err = dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{}, i)
+	_, err = os.Stat(path)
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+}
+
+func TestExpiredOrphans(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1000000, 0)
+	seen := map[string]time.Time{
+		"old":        now.Add(-2 * time.Hour),
+		"recent":     now.Add(-time.Minute),
+		"referenced": now.Add(-3 * time.Hour),
+	}
+	expired, next := expiredOrphans([]string{"new", "old", "recent"}, seen, now, time.Hour)
+	ut.AssertEqual(t, []string{"old"}, expired)
+	expected := map[string]time.Time{
+		"new":    now,
+		"recent": now.Add(-time.Minute),
+	}
+	ut.AssertEqual(t, expected, next)
+}
+
+// erroringCasTable fails its enumeration then enumerates entries forever, so
+// a consumer returning on the error leaks the producer unless it cancels.
+type erroringCasTable struct {
+	dumbcaslib.CasTable
+}
+
+func (e *erroringCasTable) Enumerate() <-chan dumbcaslib.EnumerationEntry {
+	return e.EnumerateCtx(context.Background())
+}
+
+func (e *erroringCasTable) EnumerateCtx(ctx context.Context) <-chan dumbcaslib.EnumerationEntry {
+	c := make(chan dumbcaslib.EnumerationEntry)
+	go func() {
+		defer close(c)
+		item := dumbcaslib.EnumerationEntry{Error: errors.New("broken")}
+		for {
+			select {
+			case c <- item:
+				item = dumbcaslib.EnumerationEntry{Item: sha1String("content")}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func TestGcEnumerationErrorNoLeak(t *testing.T) {
+	// Not parallel, to count the goroutines.
+	f := makeDumbcasAppMock(t)
+	f.cas = &erroringCasTable{dumbcaslib.MakeMemoryCasTable()}
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		f.Run([]string{"gc", "-root=" + mockRoot("gc_leak")}, 1)
+		f.CheckBuffer(false, true)
+	}
+	// The producers exit asynchronously once cancelled.
+	for i := 0; runtime.NumGoroutine() > before && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ut.AssertEqual(t, true, runtime.NumGoroutine() <= before)
+}
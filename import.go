@@ -0,0 +1,137 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdImport = &subcommands.Command{
+	UsageLine: "import <archive> -name <name>",
+	ShortDesc: "creates a node from a tar or zip archive",
+	LongDesc:  "Adds the files of a tar, tar.gz or zip archive to the table as they are read, without extracting them first, and creates a node of them. Use - to read a tar or tar.gz stream from stdin. The permission bits, the modification times, the symlinks and the hardlinks are kept.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &importRun{}
+		c.Init()
+		c.Flags.StringVar(&c.Name, "name", "", "Name of the node")
+		c.Flags.StringVar(&c.Comment, "comment", "", "Comment to embed in the node")
+		c.Flags.Var(&c.Compress, "compress", "Compress the imported content with gzip, or with zstd with -compress=zstd")
+		c.Flags.IntVar(&c.CompressLevel, "compress-level", 0, "Level of -compress, between 1 and 9 for gzip and 1 and 22 for zstd; defaults to the default of the algorithm")
+		c.Flags.Int64Var(&c.PackThreshold, "pack-threshold", 0, "Append the files up to this size in bytes to pack files instead of storing each as its own object; local tables only")
+		return c
+	},
+}
+
+type importRun struct {
+	CommonFlags
+	Name    string
+	Comment string
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zipMagic  = []byte("PK\x03\x04")
+)
+
+// importArchive returns the tree of the archive at p, detecting its format
+// from its content.
+func (c *importRun) importArchive(a DumbcasApplication, p string) (*dumbcaslib.Entry, error) {
+	var f *os.File
+	var in io.Reader = a.GetIn()
+	if p != "-" {
+		var err error
+		if f, err = os.Open(p); err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		in = f
+	}
+	r := bufio.NewReader(in)
+	magic, _ := r.Peek(len(zipMagic))
+	if bytes.HasPrefix(magic, zipMagic) {
+		// The directory of a zip archive is at its end.
+		if f == nil {
+			return nil, errors.New("Can't import a zip archive from stdin")
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		z, err := zip.NewReader(f, stat.Size())
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %s: %s", p, err)
+		}
+		return dumbcaslib.ImportZip(a.GetLog(), c.cas, z)
+	}
+	if bytes.HasPrefix(magic, gzipMagic) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %s: %s", p, err)
+		}
+		defer func() {
+			_ = gz.Close()
+		}()
+		return dumbcaslib.ImportTar(a.GetLog(), c.cas, gz)
+	}
+	return dumbcaslib.ImportTar(a.GetLog(), c.cas, r)
+}
+
+func (c *importRun) main(a DumbcasApplication, p string) error {
+	if !isValidName(c.Name) {
+		return errors.New("Must provide a node name with -name")
+	}
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	if err := c.Lock(a, false); err != nil {
+		return err
+	}
+	defer c.Unlock()
+
+	root, err := c.importArchive(a, p)
+	if err != nil {
+		return err
+	}
+	entry, err := dumbcaslib.ArchiveEntry(c.cas, root)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	nodeName, err := c.nodes.AddEntry(&dumbcaslib.Node{Entry: entry, Comment: c.Comment}, c.Name)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(a.GetOut(), "Imported %d files as %s\n", root.CountFiles(), nodeName)
+	return nil
+}
+
+func (c *importRun) Run(a subcommands.Application, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(a.GetErr(), "%s: Must only provide an <archive>.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args[0]); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
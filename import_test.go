@@ -0,0 +1,85 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestImport(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	tempData := makeTempDir(t, "import")
+	defer removeDir(t, tempData)
+	tree := map[string]string{
+		"file1":           "content1",
+		"dir1/dir2/file2": "content2",
+	}
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	z := &bytes.Buffer{}
+	zw := zip.NewWriter(z)
+	for _, name := range []string{"file1", "dir1/dir2/file2"} {
+		ut.AssertEqual(t, nil, tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(tree[name]))}))
+		_, err := tw.Write([]byte(tree[name]))
+		ut.AssertEqual(t, nil, err)
+		w, err := zw.Create(name)
+		ut.AssertEqual(t, nil, err)
+		_, err = w.Write([]byte(tree[name]))
+		ut.AssertEqual(t, nil, err)
+	}
+	ut.AssertEqual(t, nil, tw.Close())
+	ut.AssertEqual(t, nil, gz.Close())
+	ut.AssertEqual(t, nil, zw.Close())
+	tgzPath := filepath.Join(tempData, "backup.tar.gz")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(tgzPath, buf.Bytes(), 0600))
+	zipPath := filepath.Join(tempData, "backup.zip")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(zipPath, z.Bytes(), 0600))
+
+	for i, p := range []string{tgzPath, zipPath} {
+		name := []string{"tgz", "zip"}[i]
+		f.Run([]string{"import", "-root=" + mockRoot("import"), "-name=" + name, p}, 0)
+		ut.AssertEqual(t, true, strings.HasPrefix(f.GetOut().(*bytes.Buffer).String(), "Imported 2 files as "))
+		f.GetOut().(*bytes.Buffer).Reset()
+		f.CheckBuffer(false, false)
+
+		out := filepath.Join(tempData, "out_"+name)
+		f.Run([]string{"restore", "-root=" + mockRoot("import"), "-out=" + out, dumbcaslib.TagName(name)}, 0)
+		f.CheckBuffer(true, false)
+		actual, err := readTree(out)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, tree, actual)
+	}
+
+	// The tar stream can be read from stdin, but not a zip.
+	f.in = bytes.NewReader(buf.Bytes())
+	f.Run([]string{"import", "-root=" + mockRoot("import"), "-name=stdin", "-"}, 0)
+	f.GetOut().(*bytes.Buffer).Reset()
+	f.in = bytes.NewReader(z.Bytes())
+	f.Run([]string{"import", "-root=" + mockRoot("import"), "-name=stdin", "-"}, 1)
+	f.CheckBuffer(false, true)
+
+	f.Run([]string{"import", "-root=" + mockRoot("import"), tgzPath}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"import", "-root=" + mockRoot("import"), "-name=missing", filepath.Join(tempData, "missing")}, 1)
+	f.CheckBuffer(false, true)
+}
@@ -16,7 +16,6 @@ import (
 	"sort"
 
 	"github.com/maruel/dumbcas/dumbcaslib"
-	"github.com/maruel/interrupt"
 	"github.com/maruel/subcommands"
 )
 
@@ -39,6 +38,9 @@ func printEntry(out io.Writer, entry *dumbcaslib.Entry, relPath string) (count i
 	if entry.Sha1 != "" {
 		fmt.Fprintf(out, " %s(%d)\n", relPath, entry.Size)
 		count++
+	} else if entry.Symlink != "" {
+		fmt.Fprintf(out, " %s -> %s\n", relPath, entry.Symlink)
+		count++
 	}
 	names := make([]string, 0, len(entry.Files))
 	for name := range entry.Files {
@@ -86,7 +88,6 @@ func (c *infoRun) Run(a subcommands.Application, args []string) int {
 		fmt.Fprintf(a.GetErr(), "%s: Must only provide a <node>.\n", a.GetName())
 		return 1
 	}
-	interrupt.HandleCtrlC()
 	d := a.(DumbcasApplication)
 	if err := c.main(d, args[0]); err != nil {
 		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
@@ -11,6 +11,8 @@ package main
 
 import (
 	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
 )
 
 func TestInfo(t *testing.T) {
@@ -18,7 +20,7 @@ func TestInfo(t *testing.T) {
 	f := makeDumbcasAppMock(t)
 	// Force the creation of CAS and NodesTable so content can be archived in
 	// memory before running the command.
-	_, _ = f.MakeCasTable("")
+	_, _ = f.MakeCasTable("", dumbcaslib.CasOptions{})
 	_, _ = f.LoadNodesTable("", f.cas)
 
 	// Create an archive.
@@ -31,7 +33,7 @@ func TestInfo(t *testing.T) {
 	}
 	_, nodeName, _ := archiveData(f.TB, f.cas, f.nodes, tree)
 
-	args := []string{"info", "-root=\\test_archive", nodeName}
+	args := []string{"info", "-root=" + mockRoot("archive"), nodeName}
 	f.Run(args, 0)
 
 	expected := " dir1/bar(4)\n dir1/dir2/dir3/foo(4)\n dir1/dir2/file2(8)\n file1(8)\n x(2)\nTotal 5\n"
@@ -0,0 +1,148 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdList = &subcommands.Command{
+	UsageLine: "list",
+	ShortDesc: "lists the nodes in a dumbcas archive",
+	LongDesc:  "Lists each node with its creation time, its root entry and the number and total size of the files it references.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &listRun{}
+		c.Init()
+		c.Flags.BoolVar(&c.JSON, "json", false, "Print the nodes as a JSON array")
+		c.Flags.Var(&c.Tags, "tag", "Only list the nodes with this tag, as key or key=value; can be repeated to require all of them")
+		return c
+	},
+}
+
+type listRun struct {
+	CommonFlags
+	JSON bool
+	Tags stringsFlag
+}
+
+// nodeInfo is the description of a node printed by list.
+type nodeInfo struct {
+	Name    string            `json:"name"`
+	Created time.Time         `json:"created"`
+	Entry   string            `json:"entry"`
+	Files   int               `json:"files"`
+	Size    int64             `json:"size"`
+	Comment string            `json:"comment,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+// tagsString returns the tags sorted by key, as key=value pairs.
+func (n *nodeInfo) tagsString() string {
+	tags := make([]string, 0, len(n.Tags))
+	for k, v := range n.Tags {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return strings.Join(tags, ",")
+}
+
+func (c *listRun) main(a DumbcasApplication) error {
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+
+	names := []string{}
+	created := map[string]time.Time{}
+	for item := range c.nodes.Enumerate() {
+		if item.Error != nil {
+			return item.Error
+		}
+		// Tags are only aliases to real nodes.
+		if dumbcaslib.IsTag(item.Item) {
+			continue
+		}
+		matched := true
+		for _, filter := range c.Tags {
+			if !matchTag(item.Tags, filter) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			names = append(names, item.Item)
+			created[item.Item] = item.Created
+		}
+	}
+	sort.Strings(names)
+
+	infos := make([]nodeInfo, 0, len(names))
+	for _, name := range names {
+		if dumbcaslib.IsInterrupted() {
+			return fmt.Errorf("Was interrupted.")
+		}
+		node, err := dumbcaslib.LoadNode(c.nodes, name)
+		if err != nil {
+			return fmt.Errorf("Failed opening node %s: %s", name, err)
+		}
+		entry, err := dumbcaslib.LoadEntry(c.cas, node.Entry)
+		if err != nil {
+			return err
+		}
+		// Entries archived before the size was recorded. Keep going on a
+		// broken node; the other ones may still be listed.
+		if _, err := entry.FillSizes(c.cas); err != nil {
+			a.GetLogger().Errorf("Failed to get the size of node %s: %s", name, err)
+			continue
+		}
+		infos = append(infos, nodeInfo{name, created[name], node.Entry, entry.CountFiles(), entry.TotalSize(), node.Comment, node.Tags})
+	}
+
+	if c.JSON {
+		data, err := json.MarshalIndent(infos, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(a.GetOut(), "%s\n", data)
+		return nil
+	}
+	for _, info := range infos {
+		created := "-"
+		if !info.Created.IsZero() {
+			created = info.Created.Format(time.RFC3339)
+		}
+		tags := ""
+		if len(info.Tags) != 0 {
+			tags = " " + info.tagsString()
+		}
+		fmt.Fprintf(a.GetOut(), "%s %s %s %d files %d bytes%s\n", info.Name, created, info.Entry, info.Files, info.Size, tags)
+	}
+	fmt.Fprintf(a.GetOut(), "Total %d\n", len(infos))
+	return nil
+}
+
+func (c *listRun) Run(a subcommands.Application, args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
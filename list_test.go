@@ -0,0 +1,92 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestList(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasOptions{})
+	_, _ = f.LoadNodesTable("", f.cas)
+
+	tree := map[string]string{
+		"dir1/bar":        "bar\n",
+		"dir1/dir2/file2": "content2",
+		"file1":           "content1",
+	}
+	_, nodeName, entrySha1 := archiveData(f.TB, f.cas, f.nodes, tree)
+	node, err := dumbcaslib.LoadNode(f.nodes, nodeName)
+	ut.AssertEqual(t, nil, err)
+
+	args := []string{"list", "-root=" + mockRoot("archive")}
+	f.Run(args, 0)
+	f.CheckOut(fmt.Sprintf("%s %s %s 3 files 20 bytes\nTotal 1\n", nodeName, node.Created.Format(time.RFC3339), entrySha1))
+
+	args = []string{"list", "-root=" + mockRoot("archive"), "-json"}
+	f.Run(args, 0)
+	expected, err := json.MarshalIndent([]nodeInfo{{nodeName, node.Created, entrySha1, 3, 20, "useful comment", nil}}, "", "  ")
+	ut.AssertEqual(t, nil, err)
+	f.CheckOut(string(expected) + "\n")
+	f.CheckBuffer(false, false)
+
+	// A node whose size can't be filled is skipped.
+	root := &dumbcaslib.Entry{}
+	root.AddFile("missing", dumbcaslib.Sha1Bytes([]byte("missing")), 0)
+	rootHash, err := dumbcaslib.ArchiveEntry(f.cas, root)
+	ut.AssertEqual(t, nil, err)
+	_, err = f.nodes.AddEntry(&dumbcaslib.Node{Entry: rootHash}, "broken")
+	ut.AssertEqual(t, nil, err)
+	f.Run([]string{"list", "-root=" + mockRoot("archive"), "-json"}, 0)
+	infos := []nodeInfo{}
+	ut.AssertEqual(t, nil, json.Unmarshal(f.GetOut().(*bytes.Buffer).Bytes(), &infos))
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, 1, len(infos))
+	ut.AssertEqual(t, nodeName, infos[0].Name)
+}
+
+func TestListTags(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasOptions{})
+	_, _ = f.LoadNodesTable("", f.cas)
+	_, _, entrySha1 := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	daily, err := f.nodes.AddEntry(&dumbcaslib.Node{Entry: entrySha1, Tags: map[string]string{"schedule": "daily", "host": "a"}}, "daily")
+	ut.AssertEqual(t, nil, err)
+	weekly, err := f.nodes.AddEntry(&dumbcaslib.Node{Entry: entrySha1, Tags: map[string]string{"schedule": "weekly"}}, "weekly")
+	ut.AssertEqual(t, nil, err)
+	dailyNode, err := dumbcaslib.LoadNode(f.nodes, daily)
+	ut.AssertEqual(t, nil, err)
+
+	f.Run([]string{"list", "-root=" + mockRoot("archive"), "-tag=schedule=daily"}, 0)
+	f.CheckOut(fmt.Sprintf("%s %s %s 1 files 8 bytes host=a,schedule=daily\nTotal 1\n", daily, dailyNode.Created.Format(time.RFC3339), entrySha1))
+
+	f.Run([]string{"list", "-root=" + mockRoot("archive"), "-tag=schedule", "-json"}, 0)
+	infos := []nodeInfo{}
+	ut.AssertEqual(t, nil, json.Unmarshal(f.GetOut().(*bytes.Buffer).Bytes(), &infos))
+	ut.AssertEqual(t, 2, len(infos))
+	ut.AssertEqual(t, weekly, infos[1].Name)
+	ut.AssertEqual(t, map[string]string{"schedule": "weekly"}, infos[1].Tags)
+	f.GetOut().(*bytes.Buffer).Reset()
+
+	// All the tags must match.
+	f.Run([]string{"list", "-root=" + mockRoot("archive"), "-tag=schedule", "-tag=host=b"}, 0)
+	f.CheckOut("Total 0\n")
+	f.CheckBuffer(false, false)
+}
@@ -0,0 +1,106 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// logLevel is the severity of a log line. The lines more verbose than the
+// level of the leveledLogger are dropped.
+type logLevel int32
+
+const (
+	levelError logLevel = iota
+	levelWarning
+	levelInfo
+	// levelDebug is enabled with -v.
+	levelDebug
+	// levelTrace is enabled with -vv; it is for the lines logged per object or
+	// per request.
+	levelTrace
+)
+
+// levelPrefixes are prepended to the lines so the severity is visible.
+var levelPrefixes = map[logLevel]string{
+	levelError:   "ERROR: ",
+	levelWarning: "WARNING: ",
+}
+
+// leveledLogger writes the lines up to its level to a log.Logger. It is safe
+// for concurrent use.
+type leveledLogger struct {
+	out   *log.Logger
+	level int32
+}
+
+func newLeveledLogger(out *log.Logger) *leveledLogger {
+	return &leveledLogger{out: out, level: int32(levelInfo)}
+}
+
+// SetLevel sets the most verbose level logged.
+func (l *leveledLogger) SetLevel(level logLevel) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+// Enabled returns true if the lines at level are logged, to skip building
+// expensive lines.
+func (l *leveledLogger) Enabled(level logLevel) bool {
+	return level <= logLevel(atomic.LoadInt32(&l.level))
+}
+
+func (l *leveledLogger) logf(level logLevel, format string, v ...interface{}) {
+	if l.Enabled(level) {
+		_ = l.out.Output(3, levelPrefixes[level]+fmt.Sprintf(format, v...))
+	}
+}
+
+func (l *leveledLogger) Errorf(format string, v ...interface{}) {
+	l.logf(levelError, format, v...)
+}
+
+func (l *leveledLogger) Warningf(format string, v ...interface{}) {
+	l.logf(levelWarning, format, v...)
+}
+
+func (l *leveledLogger) Infof(format string, v ...interface{}) {
+	l.logf(levelInfo, format, v...)
+}
+
+func (l *leveledLogger) Debugf(format string, v ...interface{}) {
+	l.logf(levelDebug, format, v...)
+}
+
+func (l *leveledLogger) Tracef(format string, v ...interface{}) {
+	l.logf(levelTrace, format, v...)
+}
+
+// Logger returns a log.Logger logging at level, for dumbcaslib and the code
+// predating the levels.
+func (l *leveledLogger) Logger(level logLevel) *log.Logger {
+	return log.New(&levelWriter{l, level}, "", 0)
+}
+
+// levelWriter writes each line at a level.
+type levelWriter struct {
+	l     *leveledLogger
+	level logLevel
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	if w.l.Enabled(w.level) {
+		if err := w.l.out.Output(4, levelPrefixes[w.level]+string(p)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
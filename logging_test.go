@@ -0,0 +1,45 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestLeveledLogger(t *testing.T) {
+	t.Parallel()
+	buf := &bytes.Buffer{}
+	l := newLeveledLogger(log.New(buf, "", 0))
+	l.Errorf("a %d", 1)
+	l.Warningf("b")
+	l.Infof("c")
+	l.Debugf("d")
+	l.Tracef("e")
+	l.Logger(levelWarning).Printf("f")
+	l.Logger(levelDebug).Printf("g")
+	ut.AssertEqual(t, "ERROR: a 1\nWARNING: b\nc\nWARNING: f\n", buf.String())
+
+	buf.Reset()
+	l.SetLevel(levelTrace)
+	l.Debugf("d")
+	l.Tracef("e")
+	l.Logger(levelDebug).Printf("g")
+	ut.AssertEqual(t, "d\ne\ng\n", buf.String())
+
+	buf.Reset()
+	l.SetLevel(levelError)
+	l.Warningf("b")
+	l.Errorf("a")
+	ut.AssertEqual(t, "ERROR: a\n", buf.String())
+}
@@ -10,8 +10,12 @@ limitations under the License. */
 package main
 
 import (
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/maruel/dumbcas/dumbcaslib"
 	"github.com/maruel/subcommands"
@@ -23,11 +27,23 @@ var application = &subcommands.DefaultApplication{
 	Title: "Dumbcas is a simple Content Addressed Datastore to be used as a simple backup tool.",
 	Commands: []*subcommands.Command{
 		cmdArchive,
+		cmdBenchmark,
+		cmdCache,
+		cmdCat,
+		cmdExport,
+		cmdFind,
 		cmdFsck,
 		cmdGc,
+		cmdImport,
 		subcommands.CmdHelp,
 		cmdInfo,
+		cmdList,
+		cmdPrune,
+		cmdRename,
 		cmdRestore,
+		cmdStats,
+		cmdTrash,
+		cmdVerify,
 		cmdVersion,
 		cmdWeb,
 	},
@@ -37,14 +53,30 @@ var application = &subcommands.DefaultApplication{
 type DumbcasApplication interface {
 	subcommandstest.Application
 	// LoadCache must return a valid Cache instance even in case of failure.
-	LoadCache() (dumbcaslib.Cache, error)
-	MakeCasTable(rootDir string) (dumbcaslib.CasTable, error)
+	// filePath is the cache file, the default one if empty.
+	LoadCache(filePath string) (dumbcaslib.Cache, error)
+	MakeCasTable(rootDir string, opts dumbcaslib.CasOptions) (dumbcaslib.CasTable, error)
 	LoadNodesTable(rootDir string, cas dumbcaslib.CasTable) (dumbcaslib.NodesTable, error)
+	MakeLocker(rootDir string) dumbcaslib.Locker
+	// GetIn returns the standard input, e.g. for archive -stdin.
+	GetIn() io.Reader
+	// LoadConfig returns the configuration file defining the repositories
+	// selected with -repo; it is empty if there is none.
+	LoadConfig() (*config, error)
+	// GetLogger returns the leveled logger. GetLog() logs at the info level
+	// through it.
+	GetLogger() *leveledLogger
 }
 
 type dumbapp struct {
 	*subcommands.DefaultApplication
-	log *log.Logger
+	logger *leveledLogger
+	log    *log.Logger
+}
+
+func makeDumbapp(l *log.Logger) *dumbapp {
+	logger := newLeveledLogger(l)
+	return &dumbapp{application, logger, logger.Logger(levelInfo)}
 }
 
 // Implementes subcommandstest.Application.
@@ -52,20 +84,53 @@ func (d *dumbapp) GetLog() *log.Logger {
 	return d.log
 }
 
-func (d *dumbapp) LoadCache() (dumbcaslib.Cache, error) {
-	return dumbcaslib.LoadCache()
+func (d *dumbapp) GetLogger() *leveledLogger {
+	return d.logger
+}
+
+func (d *dumbapp) LoadCache(filePath string) (dumbcaslib.Cache, error) {
+	return dumbcaslib.LoadCache(filePath)
 }
 
-func (d *dumbapp) MakeCasTable(rootDir string) (dumbcaslib.CasTable, error) {
-	return dumbcaslib.MakeLocalCasTable(rootDir)
+func (d *dumbapp) MakeCasTable(rootDir string, opts dumbcaslib.CasOptions) (dumbcaslib.CasTable, error) {
+	return dumbcaslib.MakeCasTable(rootDir, opts)
 }
 
 func (d *dumbapp) LoadNodesTable(rootDir string, cas dumbcaslib.CasTable) (dumbcaslib.NodesTable, error) {
-	return dumbcaslib.LoadLocalNodesTable(rootDir, cas)
+	return dumbcaslib.LoadNodesTable(rootDir, cas)
+}
+
+func (d *dumbapp) MakeLocker(rootDir string) dumbcaslib.Locker {
+	return dumbcaslib.MakeLocalLocker(rootDir)
+}
+
+func (d *dumbapp) LoadConfig() (*config, error) {
+	filePath, err := getConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	return loadConfig(filePath)
+}
+
+func (d *dumbapp) GetIn() io.Reader {
+	return os.Stdin
+}
+
+// handleSignals calls interrupted on the first signal received so the commands
+// can stop cleanly and exit on the second one.
+func handleSignals(c <-chan os.Signal, w io.Writer, interrupted func(), exit func(int)) {
+	<-c
+	fmt.Fprintf(w, "Interrupted, waiting for the current operation to terminate. Interrupt again to exit immediately.\n")
+	interrupted()
+	<-c
+	exit(1)
 }
 
 func main() {
 	log.SetFlags(log.Lmicroseconds)
-	d := &dumbapp{application, log.New(application.GetErr(), "", log.LstdFlags|log.Lmicroseconds)}
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go handleSignals(c, os.Stderr, dumbcaslib.SetInterrupted, os.Exit)
+	d := makeDumbapp(log.New(application.GetErr(), "", log.LstdFlags|log.Lmicroseconds))
 	os.Exit(subcommands.Run(d, nil))
 }
@@ -10,6 +10,12 @@ limitations under the License. */
 package main
 
 import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
 
 	"github.com/maruel/dumbcas/dumbcaslib"
@@ -26,9 +32,24 @@ func init() {
 type DumbcasAppMock struct {
 	*subcommandstest.ApplicationMock
 	// Statefullness
-	cache dumbcaslib.Cache
-	cas   dumbcaslib.CasTable
-	nodes dumbcaslib.NodesTable
+	cache  dumbcaslib.Cache
+	logger *leveledLogger
+	cas    dumbcaslib.CasTable
+	nodes  dumbcaslib.NodesTable
+	locker dumbcaslib.Locker
+	// casOptions are the options of the last MakeCasTable() call.
+	casOptions dumbcaslib.CasOptions
+	// cachePath is the file of the last LoadCache() call.
+	cachePath string
+	// nodesRoot is the root of the last LoadNodesTable() call.
+	nodesRoot string
+	// config is returned by LoadConfig(); empty by default.
+	config *config
+	// in is the standard input; empty by default.
+	in io.Reader
+	// local makes MakeCasTable() and LoadNodesTable() open the local tables at
+	// the root they are given, with the options given.
+	local bool
 }
 
 func (a *DumbcasAppMock) Run(args []string, expected int) {
@@ -37,14 +58,23 @@ func (a *DumbcasAppMock) Run(args []string, expected int) {
 	ut.AssertEqual(a, expected, returncode)
 }
 
-func (a *DumbcasAppMock) MakeCasTable(rootDir string) (dumbcaslib.CasTable, error) {
+func (a *DumbcasAppMock) MakeCasTable(rootDir string, opts dumbcaslib.CasOptions) (dumbcaslib.CasTable, error) {
+	a.casOptions = opts
+	if a.local {
+		cas, err := dumbcaslib.MakeLocalCasTable(rootDir, opts)
+		if err == nil {
+			a.cas = cas
+		}
+		return cas, err
+	}
 	if a.cas == nil {
 		a.cas = dumbcaslib.MakeMemoryCasTable()
 	}
 	return a.cas, nil
 }
 
-func (a *DumbcasAppMock) LoadCache() (dumbcaslib.Cache, error) {
+func (a *DumbcasAppMock) LoadCache(filePath string) (dumbcaslib.Cache, error) {
+	a.cachePath = filePath
 	if a.cache == nil {
 		a.cache = dumbcaslib.MakeMemoryCache()
 	}
@@ -52,14 +82,55 @@ func (a *DumbcasAppMock) LoadCache() (dumbcaslib.Cache, error) {
 }
 
 func (a *DumbcasAppMock) LoadNodesTable(rootDir string, cas dumbcaslib.CasTable) (dumbcaslib.NodesTable, error) {
+	a.nodesRoot = rootDir
+	if a.local {
+		nodes, err := dumbcaslib.LoadLocalNodesTable(rootDir, cas)
+		if err == nil {
+			a.nodes = nodes
+		}
+		return nodes, err
+	}
 	if a.nodes == nil {
 		a.nodes = dumbcaslib.MakeMemoryNodesTable(a.cas)
 	}
 	return a.nodes, nil
 }
 
+func (a *DumbcasAppMock) MakeLocker(rootDir string) dumbcaslib.Locker {
+	if a.locker == nil {
+		a.locker = dumbcaslib.MakeMemoryLocker()
+	}
+	return a.locker
+}
+
+func (a *DumbcasAppMock) LoadConfig() (*config, error) {
+	if a.config == nil {
+		return &config{}, nil
+	}
+	return a.config, nil
+}
+
+func (a *DumbcasAppMock) GetIn() io.Reader {
+	if a.in == nil {
+		return &bytes.Buffer{}
+	}
+	return a.in
+}
+
+func (a *DumbcasAppMock) GetLogger() *leveledLogger {
+	return a.logger
+}
+
+// mockRoot returns the -root of the tests using DumbcasAppMock. The mock
+// tables are in memory so nothing is written there.
+func mockRoot(name string) string {
+	return filepath.Join(os.TempDir(), "dumbcas_mock", name)
+}
+
 func makeDumbcasAppMock(t *testing.T) *DumbcasAppMock {
-	return &DumbcasAppMock{ApplicationMock: subcommandstest.MakeAppMock(t, application)}
+	a := &DumbcasAppMock{ApplicationMock: subcommandstest.MakeAppMock(t, application)}
+	a.logger = newLeveledLogger(a.ApplicationMock.GetLog())
+	return a
 }
 
 func TestMainHelp(t *testing.T) {
@@ -70,3 +141,16 @@ func TestMainHelp(t *testing.T) {
 	ut.AssertEqual(t, 0, r)
 	a.CheckBuffer(true, false)
 }
+
+func TestHandleSignals(t *testing.T) {
+	// Not parallel since the interrupted state is global.
+	defer dumbcaslib.ResetInterrupted()
+	c := make(chan os.Signal)
+	exited := make(chan int)
+	go handleSignals(c, ioutil.Discard, dumbcaslib.SetInterrupted, func(code int) { exited <- code })
+	c <- os.Interrupt
+	<-dumbcaslib.Interrupted()
+	ut.AssertEqual(t, true, dumbcaslib.IsInterrupted())
+	c <- syscall.SIGTERM
+	ut.AssertEqual(t, 1, <-exited)
+}
@@ -0,0 +1,151 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdPrune = &subcommands.Command{
+	UsageLine: "prune",
+	ShortDesc: "removes old nodes",
+	LongDesc:  "Moves to trash the nodes older than -older-than and not in the -keep-last most recent ones, except the ones tagged with -keep-tag. The objects they referenced are reclaimed by running gc afterward.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &pruneRun{}
+		c.Init()
+		c.Flags.IntVar(&c.KeepLast, "keep-last", 0, "Number of most recent nodes to keep")
+		c.Flags.DurationVar(&c.OlderThan, "older-than", 0, "Only remove the nodes older than this, e.g. 720h")
+		c.Flags.BoolVar(&c.DryRun, "dry-run", false, "Only print the nodes that would be removed")
+		c.Flags.Var(&c.KeepTags, "keep-tag", "Never remove the nodes with this tag, as key or key=value, e.g. daily; can be repeated")
+		return c
+	},
+}
+
+type pruneRun struct {
+	CommonFlags
+	KeepLast  int
+	OlderThan time.Duration
+	DryRun    bool
+	KeepTags  stringsFlag
+}
+
+type prunedNode struct {
+	name    string
+	created time.Time
+}
+
+// selectPrunedNodes returns the nodes to remove, given the nodes sorted from
+// the most recent. A zero keepLast or olderThan doesn't restrict the selection.
+func selectPrunedNodes(nodes []prunedNode, keepLast int, olderThan time.Duration, now time.Time) []string {
+	out := []string{}
+	for i, node := range nodes {
+		if i < keepLast {
+			continue
+		}
+		if olderThan != 0 && !node.created.Before(now.Add(-olderThan)) {
+			continue
+		}
+		out = append(out, node.name)
+	}
+	return out
+}
+
+func (c *pruneRun) main(a DumbcasApplication) error {
+	if c.KeepLast < 0 || c.OlderThan < 0 {
+		return errors.New("-keep-last and -older-than must be positive")
+	}
+	if c.KeepLast == 0 && c.OlderThan == 0 {
+		return errors.New("Must provide -keep-last or -older-than")
+	}
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+
+	nodes := []prunedNode{}
+	tagged := map[string]bool{}
+	// Stops the enumeration when returning early.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for item := range c.nodes.EnumerateCtx(ctx) {
+		if item.Error != nil {
+			return item.Error
+		}
+		// Tags are only aliases to real nodes.
+		if dumbcaslib.IsTag(item.Item) {
+			continue
+		}
+		if item.Created.IsZero() {
+			// Unknown age; never remove it.
+			a.GetLogger().Debugf("Keeping %s: unknown creation time", item.Item)
+			continue
+		}
+		nodes = append(nodes, prunedNode{item.Item, item.Created})
+		for _, filter := range c.KeepTags {
+			if matchTag(item.Tags, filter) {
+				tagged[item.Item] = true
+				break
+			}
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if !nodes[i].created.Equal(nodes[j].created) {
+			return nodes[i].created.After(nodes[j].created)
+		}
+		return nodes[i].name > nodes[j].name
+	})
+
+	toRemove := []string{}
+	for _, name := range selectPrunedNodes(nodes, c.KeepLast, c.OlderThan, time.Now()) {
+		if tagged[name] {
+			a.GetLogger().Debugf("Keeping %s: tagged", name)
+			continue
+		}
+		toRemove = append(toRemove, name)
+	}
+	if len(toRemove) != 0 && len(toRemove) == len(nodes) {
+		// Most likely a typo in -older-than.
+		return fmt.Errorf("Refusing to remove all the %d nodes; use -keep-last to keep some", len(nodes))
+	}
+	sort.Strings(toRemove)
+	for _, name := range toRemove {
+		if c.DryRun {
+			fmt.Fprintf(a.GetOut(), "Would remove %s\n", name)
+			continue
+		}
+		if err := c.nodes.Remove(name); err != nil {
+			return fmt.Errorf("Failed to remove %s: %s", name, err)
+		}
+		fmt.Fprintf(a.GetOut(), "Removed %s\n", name)
+	}
+	if !c.DryRun && len(toRemove) != 0 {
+		a.GetLogger().Infof("Run gc to reclaim the space")
+	}
+	return nil
+}
+
+func (c *pruneRun) Run(a subcommands.Application, args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
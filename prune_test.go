@@ -0,0 +1,85 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestSelectPrunedNodes(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2013, 6, 1, 0, 0, 0, 0, time.UTC)
+	nodes := []prunedNode{
+		{"d", now.Add(-time.Hour)},
+		{"c", now.Add(-48 * time.Hour)},
+		{"b", now.Add(-72 * time.Hour)},
+		{"a", now.Add(-96 * time.Hour)},
+	}
+	ut.AssertEqual(t, []string{"b", "a"}, selectPrunedNodes(nodes, 2, 0, now))
+	ut.AssertEqual(t, []string{"c", "b", "a"}, selectPrunedNodes(nodes, 0, 24*time.Hour, now))
+	ut.AssertEqual(t, []string{"a"}, selectPrunedNodes(nodes, 3, 24*time.Hour, now))
+	ut.AssertEqual(t, []string{}, selectPrunedNodes(nodes, 1, 100*time.Hour, now))
+}
+
+func TestPrune(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasOptions{})
+	_, _ = f.LoadNodesTable("", f.cas)
+	_, node1, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	_, node2, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content2"})
+	_, node3, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content3"})
+
+	f.Run([]string{"prune", "-root=" + mockRoot("prune")}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"prune", "-root=" + mockRoot("prune"), "-keep-last=-1"}, 1)
+	f.CheckBuffer(false, true)
+
+	// A typo would remove everything.
+	f.Run([]string{"prune", "-root=" + mockRoot("prune"), "-older-than=1ns"}, 1)
+	f.CheckBuffer(false, true)
+
+	f.Run([]string{"prune", "-root=" + mockRoot("prune"), "-older-than=1h"}, 0)
+	f.CheckBuffer(false, false)
+
+	f.Run([]string{"prune", "-root=" + mockRoot("prune"), "-keep-last=1", "-dry-run"}, 0)
+	f.CheckOut(fmt.Sprintf("Would remove %s\nWould remove %s\n", node1, node2))
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 4, len(nodes))
+
+	f.Run([]string{"prune", "-root=" + mockRoot("prune"), "-keep-last=1"}, 0)
+	f.CheckOut(fmt.Sprintf("Removed %s\nRemoved %s\n", node1, node2))
+	nodes, err = dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{node3, "tags/fictious"}, nodes)
+}
+
+func TestPruneKeepTag(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasOptions{})
+	_, _ = f.LoadNodesTable("", f.cas)
+	_, node1, entrySha1 := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	tagged, err := f.nodes.AddEntry(&dumbcaslib.Node{Entry: entrySha1, Tags: map[string]string{"schedule": "daily"}}, "daily")
+	ut.AssertEqual(t, nil, err)
+	_, node3, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content3"})
+
+	f.Run([]string{"prune", "-root=" + mockRoot("prune"), "-keep-last=1", "-keep-tag=schedule=weekly", "-keep-tag=schedule=daily"}, 0)
+	f.CheckOut(fmt.Sprintf("Removed %s\n", node1))
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{tagged, node3, "tags/daily", "tags/fictious"}, nodes)
+}
@@ -0,0 +1,74 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdRename = &subcommands.Command{
+	UsageLine: "rename <old> <new>",
+	ShortDesc: "renames a node",
+	LongDesc:  "Renames a node, as printed by list, e.g. to promote tags/tmp to tags/2024-06-daily. The content it references is not touched and the tags linking to it follow it. The new name may only have letters, digits and ._+=@()- in each of its directories.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &renameRun{}
+		c.Init()
+		c.Flags.BoolVar(&c.Force, "force", false, "Replace the node <new> if it exists")
+		return c
+	},
+}
+
+type renameRun struct {
+	CommonFlags
+	Force bool
+}
+
+func (c *renameRun) main(a DumbcasApplication, oldName, newName string) error {
+	oldName = filepath.FromSlash(oldName)
+	newName = filepath.FromSlash(newName)
+	if err := dumbcaslib.CheckNodeName(newName); err != nil {
+		return err
+	}
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	// gc must not enumerate the nodes while one is missing.
+	if err := c.Lock(a, false); err != nil {
+		return err
+	}
+	defer c.Unlock()
+
+	if err := c.nodes.Rename(oldName, newName, c.Force); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%s already exists; use -force to replace it", newName)
+		}
+		return fmt.Errorf("Failed to rename %s: %s", oldName, err)
+	}
+	fmt.Fprintf(a.GetOut(), "Renamed %s to %s\n", oldName, newName)
+	return nil
+}
+
+func (c *renameRun) Run(a subcommands.Application, args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintf(a.GetErr(), "%s: Must provide <old> and <new>.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args[0], args[1]); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,47 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestRename(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasOptions{})
+	_, _ = f.LoadNodesTable("", f.cas)
+	_, node, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+
+	f.Run([]string{"rename", "-root=" + mockRoot("rename"), "tags/fictious"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"rename", "-root=" + mockRoot("rename"), "tags/fictious", "tags/a b"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"rename", "-root=" + mockRoot("rename"), "tags/missing", "tags/daily"}, 1)
+	f.CheckBuffer(false, true)
+
+	f.Run([]string{"rename", "-root=" + mockRoot("rename"), "tags/fictious", "tags/2024-06-daily"}, 0)
+	f.CheckOut("Renamed tags/fictious to tags/2024-06-daily\n")
+	nodes, err := dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{node, "tags/2024-06-daily"}, nodes)
+
+	// Replacing an existing node requires -force.
+	f.Run([]string{"rename", "-root=" + mockRoot("rename"), node, "tags/2024-06-daily"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"rename", "-root=" + mockRoot("rename"), "-force", node, "tags/2024-06-daily"}, 0)
+	f.CheckOut("Renamed " + node + " to tags/2024-06-daily\n")
+	nodes, err = dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"tags/2024-06-daily"}, nodes)
+}
@@ -11,107 +11,60 @@ package main
 
 import (
 	"fmt"
-	"io"
-	"log"
-	"os"
-	"path/filepath"
 
 	"github.com/maruel/dumbcas/dumbcaslib"
-	"github.com/maruel/interrupt"
 	"github.com/maruel/subcommands"
 )
 
 var cmdRestore = &subcommands.Command{
 	UsageLine: "restore <node> -out <out>",
 	ShortDesc: "restores a tree from a dumbcas archive",
-	LongDesc:  "Restores files listed in <node> archive to a directory from a DumbCas(tm) archive.",
+	LongDesc:  "Restores files listed in <node> archive to a directory from a DumbCas(tm) archive. Use \"latest\" as <node> to restore the most recent node.",
 	CommandRun: func() subcommands.CommandRun {
 		c := &restoreRun{}
 		c.Init()
 		c.Flags.StringVar(&c.Out, "out", "", "Directory to restore data to; required.")
+		c.Flags.BoolVar(&c.Force, "force", false, "Overwrite files already present in -out.")
 		return c
 	},
 }
 
 type restoreRun struct {
 	CommonFlags
-	Out string
-}
-
-// Restores entries and keep going on in case of error. Returns the first seen
-// error.
-// Do not overwrite files. A file already present is considered an error.
-func restoreEntry(l *log.Logger, cas dumbcaslib.CasTable, entry *dumbcaslib.Entry, root string) (count int, out error) {
-	if entry.Sha1 != "" {
-		f, err := cas.Open(entry.Sha1)
-		if err != nil {
-			out = fmt.Errorf("Failed to fetch %s for %s: %s", entry.Sha1, root, err)
-		} else {
-			defer func() {
-				_ = f.Close()
-			}()
-			baseDir := filepath.Dir(root)
-			if err = os.MkdirAll(baseDir, 0755); err != nil && !os.IsExist(err) {
-				out = fmt.Errorf("Failed to create %s: %s", baseDir, err)
-			} else {
-				dst, err := os.OpenFile(root, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
-				if err != nil {
-					out = fmt.Errorf("Failed to create %s in %s: %s", root, baseDir, err)
-				} else {
-					size, err := io.Copy(dst, f)
-					if err != nil {
-						out = fmt.Errorf("Failed to copy %s: %s", root, err)
-					} else if size != entry.Size {
-						out = fmt.Errorf("Failed to write %s, expected %d, wrote %d", root, entry.Size, size)
-					} else {
-						count++
-					}
-				}
-			}
-		}
-		if out != nil {
-			l.Printf("%s(%d): %s", root, entry.Size, out)
-		} else {
-			l.Printf("%s(%d)", root, entry.Size)
-		}
-	}
-	for name, child := range entry.Files {
-		c, err := restoreEntry(l, cas, child, filepath.Join(root, name))
-		if err != nil && out == nil {
-			out = err
-		}
-		count += c
-	}
-	return
+	Out   string
+	Force bool
 }
 
 func (c *restoreRun) main(a DumbcasApplication, nodeArg string) error {
+	if c.Out == "" {
+		return fmt.Errorf("Must provide -out")
+	}
 	if err := c.Parse(a, true); err != nil {
 		return err
 	}
 
+	if nodeArg == "latest" {
+		latest, err := dumbcaslib.FindLatestNode(c.nodes)
+		if err != nil {
+			return err
+		}
+		a.GetLogger().Infof("Restoring %s", latest)
+		nodeArg = latest
+	}
+
 	// Load the Node and process it.
 	// Do it serially for now, assuming that it is I/O bound on magnetic disks.
 	// For a network CAS, it would be good to implement concurrent fetches.
-
-	f, err := c.nodes.Open(nodeArg)
+	node, err := dumbcaslib.LoadNode(c.nodes, nodeArg)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		_ = f.Close()
-	}()
-	node := &dumbcaslib.Node{}
-	if err := dumbcaslib.LoadReaderAsJSON(f, node); err != nil {
-		return err
-	}
-
 	entry, err := dumbcaslib.LoadEntry(c.cas, node.Entry)
 	if err != nil {
 		return err
 	}
 	// TODO(maruel): Progress bar.
-	count, err := restoreEntry(a.GetLog(), c.cas, entry, c.Out)
+	count, err := dumbcaslib.RestoreEntry(a.GetLog(), c.cas, entry, c.Out, c.Force)
 	fmt.Fprintf(a.GetOut(), "Restored %d files in %s\n", count, c.Out)
 	return err
 }
@@ -121,7 +74,6 @@ func (c *restoreRun) Run(a subcommands.Application, args []string) int {
 		fmt.Fprintf(a.GetErr(), "%s: Must only provide a <node>.\n", a.GetName())
 		return 1
 	}
-	interrupt.HandleCtrlC()
 	d := a.(DumbcasApplication)
 	if err := c.main(d, args[0]); err != nil {
 		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
@@ -15,6 +15,7 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/maruel/dumbcas/dumbcaslib"
 	"github.com/maruel/ut"
 )
 
@@ -47,7 +48,7 @@ func TestRestore(t *testing.T) {
 	f := makeDumbcasAppMock(t)
 	// Force the creation of CAS and NodesTable so content can be archived in
 	// memory before running the command.
-	_, _ = f.MakeCasTable("")
+	_, _ = f.MakeCasTable("", dumbcaslib.CasOptions{})
 	_, _ = f.LoadNodesTable("", f.cas)
 
 	// Create an archive.
@@ -63,7 +64,37 @@ func TestRestore(t *testing.T) {
 	tempData := makeTempDir(t, "restore")
 	defer removeDir(t, tempData)
 
-	args := []string{"restore", "-root=\\test_archive", "-out=" + tempData, nodeName}
+	args := []string{"restore", "-root=" + mockRoot("archive"), "-out=" + tempData, nodeName}
+	f.Run(args, 0)
+	f.CheckBuffer(true, false)
+
+	actualTree, err := readTree(tempData)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, tree, actualTree)
+}
+
+func TestRestoreLatestForce(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasOptions{})
+	_, _ = f.LoadNodesTable("", f.cas)
+
+	tree := map[string]string{
+		"dir1/bar": "bar\n",
+		"file1":    "content1",
+	}
+	archiveData(f.TB, f.cas, f.nodes, tree)
+
+	tempData := makeTempDir(t, "restore_latest")
+	defer removeDir(t, tempData)
+	ut.AssertEqual(t, nil, createTree(tempData, map[string]string{"file1": "old"}))
+
+	// A file already present is not overwritten.
+	args := []string{"restore", "-root=" + mockRoot("archive"), "-out=" + tempData, "latest"}
+	f.Run(args, 1)
+	f.CheckBuffer(true, true)
+
+	args = []string{"restore", "-root=" + mockRoot("archive"), "-out=" + tempData, "-force", "latest"}
 	f.Run(args, 0)
 	f.CheckBuffer(true, false)
 
@@ -0,0 +1,126 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdStats = &subcommands.Command{
+	UsageLine: "stats",
+	ShortDesc: "summarizes the storage usage",
+	LongDesc:  "Prints the number of objects and bytes stored, the number of nodes, the bytes they reference and the resulting deduplication ratio.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &statsRun{}
+		c.Init()
+		c.Flags.BoolVar(&c.JSON, "json", false, "Print the statistics as JSON")
+		return c
+	},
+}
+
+type statsRun struct {
+	CommonFlags
+	JSON bool
+}
+
+// storageStats is the summary printed by stats.
+type storageStats struct {
+	// Blobs and PhysicalBytes are what is stored in the table, including the
+	// entry trees, after compression.
+	Blobs         int   `json:"blobs"`
+	PhysicalBytes int64 `json:"physical_bytes"`
+	Nodes         int   `json:"nodes"`
+	// LogicalBytes is the sum of the files referenced by each node, as if each
+	// node was restored.
+	LogicalBytes int64   `json:"logical_bytes"`
+	DedupRatio   float64 `json:"dedup_ratio"`
+}
+
+func (c *statsRun) main(a DumbcasApplication) error {
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+
+	// Stops the enumerations when returning early.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := storageStats{}
+	for item := range c.cas.EnumerateCtx(ctx) {
+		if item.Error != nil {
+			return fmt.Errorf("Failed enumerating the CAS table %s", item.Error)
+		}
+		s.Blobs++
+		s.PhysicalBytes += item.Size
+	}
+
+	for item := range c.nodes.EnumerateCtx(ctx) {
+		if item.Error != nil {
+			return item.Error
+		}
+		if dumbcaslib.IsInterrupted() {
+			return fmt.Errorf("Was interrupted.")
+		}
+		// Tags are only aliases to real nodes.
+		if dumbcaslib.IsTag(item.Item) {
+			continue
+		}
+		node, err := dumbcaslib.LoadNode(c.nodes, item.Item)
+		if err != nil {
+			return fmt.Errorf("Failed opening node %s: %s", item.Item, err)
+		}
+		entry, err := dumbcaslib.LoadEntry(c.cas, node.Entry)
+		if err != nil {
+			return err
+		}
+		// Keep going on a broken node; the other ones may still be counted.
+		if _, err := entry.FillSizes(c.cas); err != nil {
+			a.GetLogger().Errorf("Failed to get the size of node %s: %s", item.Item, err)
+			continue
+		}
+		s.Nodes++
+		s.LogicalBytes += entry.TotalSize()
+	}
+	if s.PhysicalBytes != 0 {
+		s.DedupRatio = float64(s.LogicalBytes) / float64(s.PhysicalBytes)
+	}
+
+	if c.JSON {
+		data, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(a.GetOut(), "%s\n", data)
+		return nil
+	}
+	fmt.Fprintf(a.GetOut(), "Blobs:       %d\n", s.Blobs)
+	fmt.Fprintf(a.GetOut(), "Physical:    %d bytes\n", s.PhysicalBytes)
+	fmt.Fprintf(a.GetOut(), "Nodes:       %d\n", s.Nodes)
+	fmt.Fprintf(a.GetOut(), "Logical:     %d bytes\n", s.LogicalBytes)
+	fmt.Fprintf(a.GetOut(), "Dedup ratio: %.2f\n", s.DedupRatio)
+	return nil
+}
+
+func (c *statsRun) Run(a subcommands.Application, args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(a.GetErr(), "%s: Unsupported arguments.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,64 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasOptions{})
+	_, _ = f.LoadNodesTable("", f.cas)
+
+	args := []string{"stats", "-root=" + mockRoot("stats")}
+	f.Run(args, 0)
+	f.CheckOut("Blobs:       0\nPhysical:    0 bytes\nNodes:       0\nLogical:     0 bytes\nDedup ratio: 0.00\n")
+
+	// The same content twice is stored once.
+	tree := map[string]string{
+		"file1":      "content1",
+		"dir1/file2": "content1",
+	}
+	_, _, entrySha1 := archiveData(f.TB, f.cas, f.nodes, tree)
+	entrySize, err := dumbcaslib.ContentSize(f.cas, entrySha1)
+	ut.AssertEqual(t, nil, err)
+	physical := 8 + entrySize
+	f.Run(args, 0)
+	f.CheckOut(fmt.Sprintf("Blobs:       2\nPhysical:    %d bytes\nNodes:       1\nLogical:     16 bytes\nDedup ratio: %.2f\n", physical, 16./float64(physical)))
+
+	args = []string{"stats", "-root=" + mockRoot("stats"), "-json"}
+	f.Run(args, 0)
+	expected, err := json.MarshalIndent(storageStats{2, physical, 1, 16, 16. / float64(physical)}, "", "  ")
+	ut.AssertEqual(t, nil, err)
+	f.CheckOut(string(expected) + "\n")
+	f.CheckBuffer(false, false)
+
+	// A node whose size can't be filled is skipped.
+	root := &dumbcaslib.Entry{}
+	root.AddFile("missing", dumbcaslib.Sha1Bytes([]byte("missing")), 0)
+	rootHash, err := dumbcaslib.ArchiveEntry(f.cas, root)
+	ut.AssertEqual(t, nil, err)
+	_, err = f.nodes.AddEntry(&dumbcaslib.Node{Entry: rootHash}, "broken")
+	ut.AssertEqual(t, nil, err)
+	f.Run(args, 0)
+	s := storageStats{}
+	ut.AssertEqual(t, nil, json.Unmarshal(f.GetOut().(*bytes.Buffer).Bytes(), &s))
+	f.CheckBuffer(true, false)
+	ut.AssertEqual(t, 1, s.Nodes)
+	ut.AssertEqual(t, int64(16), s.LogicalBytes)
+}
@@ -0,0 +1,87 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdTrash = &subcommands.Command{
+	UsageLine: "trash <list|restore <item>|empty>",
+	ShortDesc: "manages the objects moved to the trash",
+	LongDesc:  "Lists the objects moved to the trash by gc and fsck, restores one of them back into the CAS table after verifying its content or permanently deletes them all.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &trashRun{}
+		c.Init()
+		return c
+	},
+}
+
+type trashRun struct {
+	CommonFlags
+}
+
+func (c *trashRun) main(a DumbcasApplication, args []string) error {
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	t, ok := c.cas.(dumbcaslib.TrashTable)
+	if !ok {
+		return errors.New("This table has no trash")
+	}
+
+	switch args[0] {
+	case "list":
+		items := []dumbcaslib.EnumerationEntry{}
+		for item := range t.EnumerateTrash() {
+			if item.Error != nil {
+				return item.Error
+			}
+			items = append(items, item)
+		}
+		sort.Slice(items, func(i, j int) bool { return items[i].Item < items[j].Item })
+		var total int64
+		for _, item := range items {
+			fmt.Fprintf(a.GetOut(), "%s(%d)\n", item.Item, item.Size)
+			total += item.Size
+		}
+		fmt.Fprintf(a.GetOut(), "Total %d items, %d bytes\n", len(items), total)
+	case "restore":
+		if err := t.RestoreTrash(args[1]); err != nil {
+			return fmt.Errorf("Failed to restore %s: %s", args[1], err)
+		}
+		a.GetLogger().Infof("Restored %s", args[1])
+	case "empty":
+		if err := t.EmptyTrash(); err != nil {
+			return fmt.Errorf("Failed to empty the trash: %s", err)
+		}
+	}
+	return nil
+}
+
+func (c *trashRun) Run(a subcommands.Application, args []string) int {
+	valid := len(args) == 1 && (args[0] == "list" || args[0] == "empty")
+	valid = valid || (len(args) == 2 && args[0] == "restore")
+	if !valid {
+		fmt.Fprintf(a.GetErr(), "%s: Must provide one of list, restore <item> or empty.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
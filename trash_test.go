@@ -0,0 +1,47 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestTrash(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	args := []string{"trash", "-root=" + mockRoot("trash"), "list"}
+	f.Run(args, 0)
+	f.CheckOut("Total 0 items, 0 bytes\n")
+
+	hash, err := dumbcaslib.AddBytes(f.cas, []byte("content1"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, f.cas.Remove(hash))
+	f.Run(args, 0)
+	f.CheckOut(hash + "(8)\nTotal 1 items, 8 bytes\n")
+
+	f.Run([]string{"trash", "-root=" + mockRoot("trash"), "restore", hash}, 0)
+	f.CheckBuffer(false, false)
+	items, err := dumbcaslib.EnumerateCasAsList(f.cas)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{hash}, items)
+	f.Run([]string{"trash", "-root=" + mockRoot("trash"), "restore", hash}, 1)
+	f.CheckBuffer(false, true)
+
+	ut.AssertEqual(t, nil, f.cas.Remove(hash))
+	f.Run([]string{"trash", "-root=" + mockRoot("trash"), "empty"}, 0)
+	f.Run(args, 0)
+	f.CheckOut("Total 0 items, 0 bytes\n")
+
+	f.Run([]string{"trash", "-root=" + mockRoot("trash"), "restore"}, 1)
+	f.CheckBuffer(false, true)
+}
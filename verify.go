@@ -0,0 +1,156 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/subcommands"
+)
+
+var cmdVerify = &subcommands.Command{
+	UsageLine: "verify <node>",
+	ShortDesc: "verifies a single node is restorable",
+	LongDesc:  "Verifies that all the files referenced by <node> are present in the table. Use \"latest\" as <node> to verify the most recent node. It is much faster than fsck since only the objects of this node are looked at.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &verifyRun{}
+		c.Init()
+		c.Flags.BoolVar(&c.Deep, "deep", false, "Also verify the content of each file matches its hash, which reads everything")
+		c.Flags.IntVar(&c.MaxErrors, "max-errors", 10, "Number of missing or corrupted files to print")
+		return c
+	},
+}
+
+type verifyRun struct {
+	CommonFlags
+	Deep      bool
+	MaxErrors int
+	// quiet logs the missing or corrupted files instead of printing them, and
+	// skips the summary, so archive -output-format json or quiet is not
+	// corrupted.
+	quiet bool
+	// Number of files verified and of missing or corrupted ones.
+	files int
+	bad   int
+	// verified is the result of each object already verified, so the content
+	// shared by multiple files is only read once.
+	verified map[string]error
+}
+
+func (c *verifyRun) main(a DumbcasApplication, nodeArg string) error {
+	if err := c.Parse(a, true); err != nil {
+		return err
+	}
+	if nodeArg == "latest" {
+		latest, err := dumbcaslib.FindLatestNode(c.nodes)
+		if err != nil {
+			return err
+		}
+		nodeArg = latest
+	}
+	node, err := dumbcaslib.LoadNode(c.nodes, nodeArg)
+	if err != nil {
+		return err
+	}
+	return c.verifyNode(a, nodeArg, node.Entry)
+}
+
+// verifyNode verifies the files of the tree entryHash of the node nodeName.
+// Only c.cas needs to be set, so archive can reuse it.
+func (c *verifyRun) verifyNode(a DumbcasApplication, nodeName, entryHash string) error {
+	entry, err := dumbcaslib.LoadEntry(c.cas, entryHash)
+	if err != nil {
+		return fmt.Errorf("Failed to load the tree of %s: %s", nodeName, err)
+	}
+	c.verify(a, "", entry)
+	if !c.quiet {
+		fmt.Fprintf(a.GetOut(), "Verified %d files of %s.\n", c.files, nodeName)
+	}
+	if c.bad != 0 {
+		return fmt.Errorf("%d files are missing or corrupted", c.bad)
+	}
+	return nil
+}
+
+// verify recurses into entry and reports the missing or corrupted files.
+func (c *verifyRun) verify(a DumbcasApplication, relPath string, entry *dumbcaslib.Entry) {
+	if entry.Sha1 != "" {
+		c.files++
+		objects, err := entry.Objects(c.cas)
+		if err != nil {
+			err = fmt.Errorf("failed to read the manifest %s: %s", entry.Manifest, err)
+		}
+		for i := 0; err == nil && i < len(objects); i++ {
+			err = c.verifyObject(objects[i])
+		}
+		if err != nil {
+			c.bad++
+			if c.quiet {
+				a.GetLogger().Errorf("%s: %s", relPath, err)
+			} else if c.bad <= c.MaxErrors {
+				fmt.Fprintf(a.GetOut(), "%s: %s\n", relPath, err)
+			}
+		}
+	}
+	for _, name := range entry.SortedFiles() {
+		c.verify(a, path.Join(relPath, name), entry.Files[name])
+	}
+}
+
+// verifyObject returns the result of verifyFile(), only calling it once per
+// object.
+func (c *verifyRun) verifyObject(hash string) error {
+	if c.verified == nil {
+		c.verified = map[string]error{}
+	}
+	err, ok := c.verified[hash]
+	if !ok {
+		err = c.verifyFile(hash)
+		c.verified[hash] = err
+	}
+	return err
+}
+
+func (c *verifyRun) verifyFile(hash string) error {
+	f, err := c.cas.Open(hash)
+	if err != nil {
+		return fmt.Errorf("missing %s", hash)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	if !c.Deep {
+		return nil
+	}
+	actual, err := hashReader(c.cas.NewHash(), f)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", hash, err)
+	}
+	if actual != hash {
+		c.cas.SetFsckBit()
+		return fmt.Errorf("corrupted %s, its content hash is %s", hash, actual)
+	}
+	return nil
+}
+
+func (c *verifyRun) Run(a subcommands.Application, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(a.GetErr(), "%s: Must only provide a <node>.\n", a.GetName())
+		return 1
+	}
+	d := a.(DumbcasApplication)
+	if err := c.main(d, args[0]); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,75 @@
+/* Copyright 2012 Marc-Antoine Ruel. Licensed under the Apache License, Version
+2.0 (the "License"); you may not use this file except in compliance with the
+License.  You may obtain a copy of the License at
+http://www.apache.org/licenses/LICENSE-2.0. Unless required by applicable law or
+agreed to in writing, software distributed under the License is distributed on
+an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+or implied. See the License for the specific language governing permissions and
+limitations under the License. */
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/maruel/dumbcas/dumbcaslib"
+	"github.com/maruel/ut"
+)
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasOptions{})
+	_, _ = f.LoadNodesTable("", f.cas)
+	sha1tree, nodeName, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file1":           "content1",
+		"dir1/dir2/file2": "content2",
+		"dir1/file3":      "content3",
+	})
+
+	f.Run([]string{"verify", "-root=" + mockRoot("verify"), nodeName}, 0)
+	f.CheckOut("Verified 3 files of " + nodeName + ".\n")
+	f.Run([]string{"verify", "-root=" + mockRoot("verify"), "-deep", "latest"}, 0)
+	f.CheckBuffer(true, false)
+
+	ut.AssertEqual(t, nil, f.cas.Remove(sha1tree["dir1/file3"]))
+	f.Run([]string{"verify", "-root=" + mockRoot("verify"), nodeName}, 1)
+	f.CheckBuffer(true, true)
+	ut.AssertEqual(t, nil, f.cas.Remove(sha1tree["file1"]))
+	f.Run([]string{"verify", "-root=" + mockRoot("verify"), "-max-errors=1", nodeName}, 1)
+	out := f.GetOut().(*bytes.Buffer).String()
+	f.CheckBuffer(true, true)
+	ut.AssertEqual(t, true, strings.HasPrefix(out, "dir1/file3: missing "))
+	ut.AssertEqual(t, false, strings.Contains(out, "file1"))
+
+	f.Run([]string{"verify", "-root=" + mockRoot("verify"), "foo"}, 1)
+	f.CheckBuffer(false, true)
+	f.Run([]string{"verify", "-root=" + mockRoot("verify")}, 1)
+	f.CheckBuffer(false, true)
+}
+
+func TestVerifyDuplicates(t *testing.T) {
+	t.Parallel()
+	f := makeDumbcasAppMock(t)
+	_, _ = f.MakeCasTable("", dumbcaslib.CasOptions{})
+	_, _ = f.LoadNodesTable("", f.cas)
+	_, nodeName, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{
+		"file1":      "content1",
+		"dir1/file2": "content1",
+		"dir1/file3": "content3",
+	})
+	node, err := dumbcaslib.LoadNode(f.nodes, nodeName)
+	ut.AssertEqual(t, nil, err)
+
+	// The content shared by file1 and file2 is only read once.
+	r := &recordingCasTable{CasTable: f.cas}
+	v := &verifyRun{Deep: true}
+	v.cas = r
+	ut.AssertEqual(t, nil, v.verifyNode(f, nodeName, node.Entry))
+	ut.AssertEqual(t, 3, v.files)
+	// The tree is opened too.
+	ut.AssertEqual(t, 3, len(r.opened))
+	f.CheckBuffer(true, false)
+}
@@ -10,31 +10,55 @@ limitations under the License. */
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/maruel/dumbcas/dumbcaslib"
 	"github.com/maruel/subcommands"
 )
 
+// webContentPath serves the objects to MakeHTTPCasTable() and webNodesPath the
+// nodes to MakeHTTPNodesTable().
+const (
+	webContentPath = "/content/retrieve/default"
+	webNodesPath   = "/content/nodes"
+)
+
 var cmdWeb = &subcommands.Command{
 	UsageLine: "web",
 	ShortDesc: "starts a web service to access the dumbcas",
-	LongDesc:  "Serves each node as a full virtual tree of the archived files.",
+	LongDesc:  "Serves each node as a full virtual tree of the archived files. The nodes are also served as JSON under /api/nodes and as stored under /content/nodes, for the -nodes-root of the other dumbcas. GET /healthz returns 200 when the table is readable and doesn't need fsck, 503 otherwise; it doesn't require authentication.",
 	CommandRun: func() subcommands.CommandRun {
 		c := &webRun{}
 		c.Init()
+		c.Flags.StringVar(&c.http, "http", "", "address to listen on, like :8080 or 127.0.0.1:9000; overrides -port and -local. Use port 0 for an ephemeral port")
 		c.Flags.IntVar(&c.port, "port", 8010, "port number")
 		c.Flags.BoolVar(&c.local, "local", false, "only listed on localhost")
+		c.Flags.StringVar(&c.auth, "auth", "", "user:password required with HTTP Basic authentication")
+		c.Flags.StringVar(&c.token, "token", "", "token required as an Authorization: Bearer header; either this or -auth is accepted when both are set")
+		c.Flags.BoolVar(&c.writable, "writable", false, "accept uploads of objects with PUT /content/retrieve/default/<hash> and of nodes with POST /content/nodes/, and their removal with DELETE; requires -auth or -token")
+		c.Flags.BoolVar(&c.metrics, "metrics", false, "serve Prometheus metrics at /metrics")
+		c.Flags.BoolVar(&c.ReadOnly, "readonly", false, "never modify the table, not even to flag it for fsck when a corruption is found")
+		c.Flags.Int64Var(&c.CacheSize, "cache-size", 0, "bytes of memory used to keep the most recently served objects up to 1MiB, e.g. the trees of the nodes; 0 disables the cache")
 		return c
 	},
 }
 
 type webRun struct {
 	CommonFlags
-	port  int
-	local bool
+	http     string
+	port     int
+	local    bool
+	auth     string
+	token    string
+	metrics  bool
+	writable bool
 }
 
 // Converts an handler to log every HTTP request.
@@ -47,11 +71,17 @@ type loggingResponseWriter struct {
 	http.ResponseWriter
 	length int
 	status int
+	// failed is set when the response couldn't be fully sent, e.g. when the
+	// client disconnected.
+	failed bool
 }
 
 func (l *loggingResponseWriter) Write(data []byte) (size int, err error) {
 	size, err = l.ResponseWriter.Write(data)
 	l.length += size
+	if err != nil {
+		l.failed = true
+	}
 	return
 }
 
@@ -71,6 +101,61 @@ func (l *loggingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		r.RequestURI)
 }
 
+// Requires the requests to be authenticated with HTTP Basic authentication
+// and/or a bearer token. Empty credentials are disabled.
+type authHandler struct {
+	http.Handler
+	user     string
+	password string
+	token    string
+}
+
+func (a *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.user != "" {
+		if user, password, ok := r.BasicAuth(); ok && equal(user, a.user) && equal(password, a.password) {
+			a.Handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	if a.token != "" {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") && equal(auth[len("Bearer "):], a.token) {
+			a.Handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	// The challenges are only sent along the 401.
+	if a.user != "" {
+		w.Header().Add("WWW-Authenticate", `Basic realm="dumbcas"`)
+	}
+	if a.token != "" {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="dumbcas"`)
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// Compares secrets in constant time.
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Wraps h with authentication if requested.
+func (c *webRun) authenticate(h http.Handler) (http.Handler, error) {
+	if c.auth == "" && c.token == "" {
+		return h, nil
+	}
+	a := &authHandler{Handler: h, token: c.token}
+	if c.auth != "" {
+		i := strings.Index(c.auth, ":")
+		if i <= 0 || i == len(c.auth)-1 {
+			return nil, fmt.Errorf("-auth must be in the form user:password")
+		}
+		a.user = c.auth[:i]
+		a.password = c.auth[i+1:]
+	}
+	return a, nil
+}
+
 type restricted struct {
 	http.Handler
 	methods []string
@@ -93,41 +178,203 @@ func restrict(h http.Handler, m ...string) http.Handler {
 	return restricted{h, m}
 }
 
+// webMetrics are exported at /metrics in the Prometheus text format.
+type webMetrics struct {
+	cas         dumbcaslib.CasTable
+	blobs       syncInt
+	bytes       syncInt
+	enumeration syncInt
+}
+
+// countBlobs counts the objects and bytes successfully served by h, either
+// by hash or as the files of a node, once fully sent. The listings are not
+// counted.
+func (m *webMetrics) countBlobs(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// h may rewrite the path.
+		p := r.URL.Path
+		lW := &loggingResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(lW, r)
+		if r.Method == "GET" && p != "/list" && p != "/info" && !strings.HasSuffix(p, "/") && lW.status < 300 && !lW.failed {
+			m.blobs.Add(1)
+			m.bytes.Add(int64(lW.length))
+		}
+	})
+}
+
+// timeNodes accumulates the time spent enumerating and browsing the nodes.
+func (m *webMetrics) timeNodes(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		h.ServeHTTP(w, r)
+		m.enumeration.Add(int64(time.Since(start)))
+	})
+}
+
+func (m *webMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fsck := 0
+	if m.cas.GetFsckBit() {
+		fsck = 1
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP dumbcas_blobs_served_total Objects served from the table.\n")
+	fmt.Fprintf(w, "# TYPE dumbcas_blobs_served_total counter\n")
+	fmt.Fprintf(w, "dumbcas_blobs_served_total %d\n", m.blobs.Get())
+	fmt.Fprintf(w, "# HELP dumbcas_bytes_served_total Bytes of the objects served from the table.\n")
+	fmt.Fprintf(w, "# TYPE dumbcas_bytes_served_total counter\n")
+	fmt.Fprintf(w, "dumbcas_bytes_served_total %d\n", m.bytes.Get())
+	fmt.Fprintf(w, "# HELP dumbcas_nodes_enumeration_seconds_total Time spent enumerating the nodes.\n")
+	fmt.Fprintf(w, "# TYPE dumbcas_nodes_enumeration_seconds_total counter\n")
+	fmt.Fprintf(w, "dumbcas_nodes_enumeration_seconds_total %g\n", time.Duration(m.enumeration.Get()).Seconds())
+	fmt.Fprintf(w, "# HELP dumbcas_fsck_needed Whether the table needs to be checked with fsck.\n")
+	fmt.Fprintf(w, "# TYPE dumbcas_fsck_needed gauge\n")
+	fmt.Fprintf(w, "dumbcas_fsck_needed %d\n", fsck)
+}
+
+// healthHandler serves /healthz for the load balancers and the uptime
+// monitoring.
+type healthHandler struct {
+	cas dumbcaslib.CasTable
+	// root is the root of a local table, "" for a remote one.
+	root string
+}
+
+// check returns why the table can't be served. It must not modify the table,
+// so a local table is only stat'ed since enumerating it moves the unexpected
+// files to the trash. Reading the first entry of a remote table is enough to
+// know it is readable.
+func (h *healthHandler) check(ctx context.Context) error {
+	if h.root != "" {
+		if err := dumbcaslib.CheckLocalCasTable(h.root); err != nil {
+			return fmt.Errorf("The table is unreadable: %s", err)
+		}
+	} else {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		for item := range h.cas.EnumerateCtx(ctx) {
+			if item.Error != nil {
+				return fmt.Errorf("The table is unreadable: %s", item.Error)
+			}
+			break
+		}
+	}
+	if h.cas.GetFsckBit() {
+		return fmt.Errorf("The table needs fsck")
+	}
+	return nil
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if err := h.check(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "ok\n")
+}
+
 func (c *webRun) main(d DumbcasApplication, ready chan<- net.Listener) error {
 	if err := c.Parse(d, true); err != nil {
 		return err
 	}
 
 	serveMux := http.NewServeMux()
+	// Protects both the content and the nodes.
+	authenticated, err := c.authenticate(serveMux)
+	if err != nil {
+		return err
+	}
+	// The health check is polled by load balancers, which have no credentials.
+	handler := http.NewServeMux()
+	health := &healthHandler{cas: c.cas}
+	if !dumbcaslib.IsRemote(c.Root) {
+		health.root = c.Root
+	}
+	handler.Handle("/healthz", restrict(health, "GET", "HEAD"))
+	handler.Handle("/", authenticated)
 
-	x := http.StripPrefix("/content/retrieve/default", c.cas)
-	serveMux.Handle("/content/retrieve/default/", restrict(x, "GET"))
-	x = http.StripPrefix("/content/retrieve/nodes", c.nodes)
+	if c.writable && c.ReadOnly {
+		return fmt.Errorf("-writable and -readonly are mutually exclusive")
+	}
+	// Anyone who can reach the server could otherwise modify the table.
+	if c.writable && c.auth == "" && c.token == "" {
+		return fmt.Errorf("-writable requires -auth or -token")
+	}
+	var locker dumbcaslib.Locker
+	if c.writable {
+		locker = d.MakeLocker(c.lockRoot)
+	}
+	cas := dumbcaslib.MakeCasHandler(c.cas, locker)
+	// HEAD and "POST /exists" look up the entries without downloading them.
+	methods := []string{"GET", "HEAD", "POST"}
+	if c.writable {
+		methods = append(methods, "PUT", "DELETE")
+	}
+	var nodes http.Handler = c.nodes
+	api := dumbcaslib.MakeNodesAPIHandler(c.cas, c.nodes)
+	if c.metrics {
+		m := &webMetrics{cas: c.cas}
+		cas = m.countBlobs(cas)
+		nodes = m.timeNodes(m.countBlobs(nodes))
+		api = m.timeNodes(api)
+		serveMux.Handle("/metrics", restrict(m, "GET"))
+	}
+	x := http.StripPrefix(webContentPath, cas)
+	serveMux.Handle(webContentPath+"/", restrict(x, methods...))
+	x = http.StripPrefix("/content/retrieve/nodes", nodes)
 	serveMux.Handle("/content/retrieve/nodes/", restrict(x, "GET"))
+	x = http.StripPrefix(webNodesPath, dumbcaslib.MakeNodesHandler(c.nodes, locker))
+	nodeMethods := []string{"GET", "HEAD"}
+	if c.writable {
+		nodeMethods = append(nodeMethods, "POST", "DELETE")
+	}
+	serveMux.Handle(webNodesPath+"/", restrict(x, nodeMethods...))
+	x = http.StripPrefix("/api/nodes", api)
+	serveMux.Handle("/api/nodes", restrict(x, "GET"))
+	serveMux.Handle("/api/nodes/", restrict(x, "GET"))
 	serveMux.Handle("/", restrict(http.RedirectHandler("/content/retrieve/nodes/", http.StatusFound), "GET"))
 
-	var addr string
-	if c.local {
-		addr = fmt.Sprintf("localhost:%d", c.port)
-	} else {
-		addr = fmt.Sprintf(":%d", c.port)
+	addr := c.http
+	if addr == "" {
+		if c.local {
+			addr = fmt.Sprintf("localhost:%d", c.port)
+		} else {
+			addr = fmt.Sprintf(":%d", c.port)
+		}
 	}
 	s := &http.Server{
 		Addr:    addr,
-		Handler: &loggingHandler{serveMux, d.GetLog()},
+		Handler: &loggingHandler{handler, d.GetLogger().Logger(levelDebug)},
 	}
 	ls, e := net.Listen("tcp", s.Addr)
 	if e != nil {
 		return e
 	}
 
-	_, portStr, _ := net.SplitHostPort(ls.Addr().String())
-	d.GetLog().Printf("Serving %s on port %s", c.Root, portStr)
+	// Print the actual address, which matters when binding to port 0.
+	d.GetLogger().Infof("Serving %s on %s", c.Root, ls.Addr())
+
+	// Let the in-flight downloads complete on Ctrl-C.
+	done := make(chan struct{})
+	defer close(done)
+	shutdown := make(chan error, 1)
+	go func() {
+		select {
+		case <-dumbcaslib.Interrupted():
+			d.GetLogger().Infof("Shutting down")
+			shutdown <- s.Shutdown(context.Background())
+		case <-done:
+		}
+	}()
 
 	if ready != nil {
 		ready <- ls
 	}
-	return s.Serve(ls)
+	if err := s.Serve(ls); err != http.ErrServerClosed {
+		return err
+	}
+	return <-shutdown
 }
 
 func (c *webRun) Run(a subcommands.Application, args []string) int {
@@ -10,16 +10,21 @@ limitations under the License. */
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/maruel/dumbcas/dumbcaslib"
 	"github.com/maruel/subcommands"
 	"github.com/maruel/subcommands/subcommandstest"
 	"github.com/maruel/ut"
@@ -28,15 +33,22 @@ import (
 // Starts the web server in a separate threads and looks for expected results.
 type WebDumbcasAppMock struct {
 	*DumbcasAppMock
-	socket  net.Listener
-	closed  chan bool
-	baseURL string
+	socket    net.Listener
+	closed    chan bool
+	baseURL   string
+	metrics   bool
+	writable  bool
+	cacheSize int64
+	auth      string
+	// root is -root; the mock tables ignore it unless local is set.
+	root string
 }
 
 func makeWebDumbcasAppMock(t *testing.T) *WebDumbcasAppMock {
 	return &WebDumbcasAppMock{
 		DumbcasAppMock: makeDumbcasAppMock(t),
 		closed:         make(chan bool),
+		root:           mockRoot("web"),
 	}
 }
 
@@ -44,10 +56,14 @@ func (f *WebDumbcasAppMock) goWeb() {
 	ut.AssertEqual(f, nil, f.socket)
 	cmd := subcommands.FindCommand(f, "web")
 	r := cmd.CommandRun().(*webRun)
-	r.Root = "\\foo"
-	// Simulate -local. It is important to use it while testing otherwise it
-	// may trigger the Windows firewall.
-	r.local = true
+	r.Root = f.root
+	r.metrics = f.metrics
+	r.writable = f.writable
+	r.CacheSize = f.cacheSize
+	r.auth = f.auth
+	// Listen on localhost, it is important to use it while testing otherwise it
+	// may trigger the Windows firewall. Use an ephemeral port.
+	r.http = "localhost:0"
 	c := make(chan net.Listener)
 	go func() {
 		err := r.main(f, c)
@@ -68,6 +84,11 @@ func (f *WebDumbcasAppMock) closeWeb() {
 	f.CheckBuffer(false, false)
 }
 
+// authURL returns the base URL with the credentials of -auth embedded.
+func (f *WebDumbcasAppMock) authURL() string {
+	return strings.Replace(f.baseURL, "http://", "http://"+f.auth+"@", 1)
+}
+
 func (f *WebDumbcasAppMock) get(url string, expectedURL string) *http.Response {
 	r, err := http.Get(f.baseURL + url)
 	ut.AssertEqual(f, nil, err)
@@ -99,13 +120,12 @@ func TestWeb(t *testing.T) {
 	cmd := subcommands.FindCommand(f, "web")
 	ut.AssertEqual(t, true, cmd != nil)
 	run := cmd.CommandRun().(*webRun)
-	// Sets -root to an invalid non-empty string.
-	run.Root = "\\test_web"
+	run.Root = mockRoot("web")
 
 	// Create a tree of stuff. Call the factory functions directly because we
 	// can't use Run(). The reason Run() can't be used is because we need the
 	// channel to get the socket address back.
-	_, _ = f.DumbcasAppMock.MakeCasTable("")
+	_, _ = f.DumbcasAppMock.MakeCasTable("", dumbcaslib.CasOptions{})
 	_, _ = f.DumbcasAppMock.LoadNodesTable("", f.cas)
 	tree1 := map[string]string{
 		"file1":           "content1",
@@ -138,7 +158,291 @@ func TestWeb(t *testing.T) {
 	r = f.get("/content/retrieve/default/"+sha1tree["file1"], "/content/retrieve/default/"+sha1tree["file1"])
 	expectedBody(f.TB, r, "content1")
 	r = f.get("/content/retrieve/nodes/"+nodeName+"/file1", "")
+	ut.AssertEqual(t, "inline; filename=file1", r.Header.Get("Content-Disposition"))
 	expectedBody(f.TB, r, "content1")
 	r = f.get("/content/retrieve/nodes/"+nodeName+"/dir1/dir2/file2", "")
 	expectedBody(f.TB, r, "content2")
+
+	f.GetLog().Print("T: Browse the node with the JSON API.")
+	r = f.get("/api/nodes/"+nodeName+"?tree=dir1/dir2", "")
+	ut.AssertEqual(t, 200, r.StatusCode)
+	expectedBody(f.TB, r, fmt.Sprintf("[{\"name\":\"file2\",\"hash\":\"%s\",\"size\":8,\"mode\":420,\"modTime\":\"2012-01-02T03:04:05Z\"}]\n", sha1tree["dir1/dir2/file2"]))
+}
+
+func TestWebAuth(t *testing.T) {
+	t.Parallel()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+	c := &webRun{}
+	h, err := c.authenticate(ok)
+	ut.AssertEqual(t, nil, err)
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+	ut.AssertEqual(t, 200, resp.Code)
+
+	c = &webRun{auth: "user:pass", token: "secret"}
+	h, err = c.authenticate(ok)
+	ut.AssertEqual(t, nil, err)
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest("GET", "/content/retrieve/nodes/", nil))
+	ut.AssertEqual(t, 401, resp.Code)
+	ut.AssertEqual(t, []string{`Basic realm="dumbcas"`, `Bearer realm="dumbcas"`}, resp.Header()["Www-Authenticate"])
+
+	req := httptest.NewRequest("GET", "/content/retrieve/default/", nil)
+	req.SetBasicAuth("user", "wrong")
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	ut.AssertEqual(t, 401, resp.Code)
+
+	req.SetBasicAuth("user", "pass")
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	ut.AssertEqual(t, 200, resp.Code)
+	ut.AssertEqual(t, "ok", resp.Body.String())
+	ut.AssertEqual(t, "", resp.Header().Get("WWW-Authenticate"))
+
+	req.Header.Set("Authorization", "Bearer secret")
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	ut.AssertEqual(t, 200, resp.Code)
+	ut.AssertEqual(t, "", resp.Header().Get("WWW-Authenticate"))
+
+	for _, auth := range []string{"user", ":pass", "user:"} {
+		c = &webRun{auth: auth}
+		_, err = c.authenticate(ok)
+		ut.AssertEqual(t, false, err == nil)
+	}
+}
+
+func TestWebMetrics(t *testing.T) {
+	t.Parallel()
+	f := makeWebDumbcasAppMock(t)
+	f.metrics = true
+	_, _ = f.DumbcasAppMock.MakeCasTable("", dumbcaslib.CasOptions{})
+	_, _ = f.DumbcasAppMock.LoadNodesTable("", f.cas)
+	sha1tree, nodeName, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	nodeName = filepath.ToSlash(nodeName)
+
+	f.goWeb()
+	defer f.closeWeb()
+	expectedBody(f.TB, f.get("/content/retrieve/default/"+sha1tree["file1"], ""), "content1")
+	f.get404("/content/retrieve/default/" + dumbcaslib.Sha1Bytes([]byte("missing")))
+	_ = readBody(f.TB, f.get("/content/retrieve/nodes/", ""))
+	// The files downloaded from a node are counted, not the listings.
+	_ = readBody(f.TB, f.get("/content/retrieve/nodes/"+nodeName+"/", ""))
+	expectedBody(f.TB, f.get("/content/retrieve/nodes/"+nodeName+"/file1", ""), "content1")
+	f.cas.SetFsckBit()
+
+	r := f.get("/metrics", "")
+	ut.AssertEqual(t, 200, r.StatusCode)
+	actual := readBody(f.TB, r)
+	ut.AssertEqual(t, true, strings.Contains(actual, "\ndumbcas_blobs_served_total 2\n"))
+	ut.AssertEqual(t, true, strings.Contains(actual, "\ndumbcas_bytes_served_total 16\n"))
+	ut.AssertEqual(t, true, strings.Contains(actual, "\ndumbcas_nodes_enumeration_seconds_total "))
+	ut.AssertEqual(t, true, strings.Contains(actual, "\ndumbcas_fsck_needed 1\n"))
+}
+
+// disconnectedResponseWriter fails the writes like a client that went away.
+type disconnectedResponseWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (d *disconnectedResponseWriter) Write(data []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestWebMetricsFailed(t *testing.T) {
+	t.Parallel()
+	m := &webMetrics{}
+	h := m.countBlobs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("content1"))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/file1", nil))
+	ut.AssertEqual(t, int64(1), m.blobs.Get())
+	ut.AssertEqual(t, int64(8), m.bytes.Get())
+
+	// The objects not fully sent are not counted.
+	h.ServeHTTP(&disconnectedResponseWriter{httptest.NewRecorder()}, httptest.NewRequest("GET", "/file1", nil))
+	ut.AssertEqual(t, int64(1), m.blobs.Get())
+	ut.AssertEqual(t, int64(8), m.bytes.Get())
+}
+
+func TestWebHealth(t *testing.T) {
+	t.Parallel()
+	f := makeWebDumbcasAppMock(t)
+	f.auth = "user:pass"
+	tempData := makeTempDir(t, "web_health")
+	defer removeDir(t, tempData)
+	f.local = true
+	f.root = tempData
+
+	f.goWeb()
+	defer f.closeWeb()
+	// The rest requires authentication.
+	r := f.get("/content/retrieve/nodes/", "")
+	ut.AssertEqual(t, 401, r.StatusCode)
+	_ = readBody(f.TB, r)
+
+	// An unexpected file is left alone.
+	junk := filepath.Join(tempData, "cas", "junk")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(junk, []byte("junk"), 0600))
+	r = f.get("/healthz", "")
+	ut.AssertEqual(t, 200, r.StatusCode)
+	expectedBody(f.TB, r, "ok\n")
+	_, err := os.Stat(junk)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, false, f.cas.GetFsckBit())
+
+	f.cas.SetFsckBit()
+	r = f.get("/healthz", "")
+	ut.AssertEqual(t, 503, r.StatusCode)
+	expectedBody(f.TB, r, "The table needs fsck\n")
+}
+
+// unreadableCasTable fails the enumerations like a table whose root was
+// unmounted.
+type unreadableCasTable struct {
+	dumbcaslib.CasTable
+}
+
+func (u *unreadableCasTable) EnumerateCtx(ctx context.Context) <-chan dumbcaslib.EnumerationEntry {
+	items := make(chan dumbcaslib.EnumerationEntry, 1)
+	items <- dumbcaslib.EnumerationEntry{Error: errors.New("permission denied")}
+	close(items)
+	return items
+}
+
+func TestWebHealthMissing(t *testing.T) {
+	t.Parallel()
+	tempData := makeTempDir(t, "web_health_missing")
+	defer removeDir(t, tempData)
+	h := &healthHandler{dumbcaslib.MakeMemoryCasTable(), tempData}
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest("GET", "/healthz", nil))
+	ut.AssertEqual(t, 503, resp.Code)
+	ut.AssertEqual(t, true, strings.HasPrefix(resp.Body.String(), "The table is unreadable: "))
+}
+
+func TestWebHealthUnreadable(t *testing.T) {
+	t.Parallel()
+	h := &healthHandler{&unreadableCasTable{dumbcaslib.MakeMemoryCasTable()}, ""}
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest("GET", "/healthz", nil))
+	ut.AssertEqual(t, 503, resp.Code)
+	ut.AssertEqual(t, "The table is unreadable: permission denied\n", resp.Body.String())
+}
+
+func TestWebCache(t *testing.T) {
+	t.Parallel()
+	f := makeWebDumbcasAppMock(t)
+	f.cacheSize = 1024
+	_, _ = f.DumbcasAppMock.MakeCasTable("", dumbcaslib.CasOptions{})
+	_, _ = f.DumbcasAppMock.LoadNodesTable("", f.cas)
+	sha1tree, _, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+
+	f.goWeb()
+	defer f.closeWeb()
+	expectedBody(f.TB, f.get("/content/retrieve/default/"+sha1tree["file1"], ""), "content1")
+	// It is still served from memory once removed from the table underneath.
+	ut.AssertEqual(t, nil, f.cas.Remove(sha1tree["file1"]))
+	expectedBody(f.TB, f.get("/content/retrieve/default/"+sha1tree["file1"], ""), "content1")
+}
+
+func TestWebWritable(t *testing.T) {
+	t.Parallel()
+	f := makeWebDumbcasAppMock(t)
+	_, _ = f.DumbcasAppMock.MakeCasTable("", dumbcaslib.CasOptions{})
+	_, _ = f.DumbcasAppMock.LoadNodesTable("", f.cas)
+	f.auth = "user:pass"
+	hash := dumbcaslib.Sha1Bytes([]byte("content1"))
+	do := func(method, baseURL string) int {
+		req, err := http.NewRequest(method, baseURL+"/content/retrieve/default/"+hash, strings.NewReader("content1"))
+		ut.AssertEqual(t, nil, err)
+		resp, err := http.DefaultClient.Do(req)
+		ut.AssertEqual(t, nil, err)
+		_ = readBody(f.TB, resp)
+		return resp.StatusCode
+	}
+
+	// Uploads are refused by default.
+	f.goWeb()
+	ut.AssertEqual(t, 405, do("PUT", f.authURL()))
+	f.closeWeb()
+
+	f.writable = true
+	f.goWeb()
+	defer f.closeWeb()
+	ut.AssertEqual(t, 401, do("PUT", f.baseURL))
+	ut.AssertEqual(t, 201, do("PUT", f.authURL()))
+	ut.AssertEqual(t, 200, do("PUT", f.authURL()))
+	resp, err := http.Get(f.authURL() + "/content/retrieve/default/" + hash)
+	ut.AssertEqual(t, nil, err)
+	expectedBody(f.TB, resp, "content1")
+	ut.AssertEqual(t, 401, do("DELETE", f.baseURL))
+	ut.AssertEqual(t, 200, do("DELETE", f.authURL()))
+	ut.AssertEqual(t, false, f.cas.Exists(hash))
+}
+
+func TestWebWritableRequiresAuth(t *testing.T) {
+	t.Parallel()
+	f := makeWebDumbcasAppMock(t)
+	r := subcommands.FindCommand(f, "web").CommandRun().(*webRun)
+	r.Root = f.root
+	r.writable = true
+	r.http = "localhost:0"
+	ut.AssertEqual(t, errors.New("-writable requires -auth or -token"), r.main(f, make(chan net.Listener)))
+	f.CheckBuffer(false, false)
+}
+
+func TestWebExists(t *testing.T) {
+	t.Parallel()
+	f := makeWebDumbcasAppMock(t)
+	_, _ = f.DumbcasAppMock.MakeCasTable("", dumbcaslib.CasOptions{})
+	_, _ = f.DumbcasAppMock.LoadNodesTable("", f.cas)
+	sha1tree, _, _ := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+	missing := dumbcaslib.Sha1Bytes([]byte("missing"))
+
+	f.goWeb()
+	defer f.closeWeb()
+	cas, err := dumbcaslib.MakeHTTPCasTable(f.baseURL+"/content/retrieve/default", dumbcaslib.CasOptions{})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, cas.Exists(sha1tree["file1"]))
+	ut.AssertEqual(t, false, cas.Exists(missing))
+	ut.AssertEqual(t, map[string]bool{sha1tree["file1"]: true}, cas.ExistsMany([]string{sha1tree["file1"], missing}))
+}
+
+func TestWebNodes(t *testing.T) {
+	t.Parallel()
+	f := makeWebDumbcasAppMock(t)
+	_, _ = f.DumbcasAppMock.MakeCasTable("", dumbcaslib.CasOptions{})
+	_, _ = f.DumbcasAppMock.LoadNodesTable("", f.cas)
+	_, _, entry := archiveData(f.TB, f.cas, f.nodes, map[string]string{"file1": "content1"})
+
+	f.auth = "user:pass"
+
+	// The nodes can't be added by default.
+	f.goWeb()
+	nodes, err := dumbcaslib.LoadNodesTable(f.authURL()+"/content/nodes", f.cas)
+	ut.AssertEqual(t, nil, err)
+	items, err := dumbcaslib.EnumerateNodesAsList(nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(items))
+	_, err = nodes.AddEntry(&dumbcaslib.Node{Entry: entry}, "remote")
+	ut.AssertEqual(t, false, err == nil)
+	f.closeWeb()
+
+	f.writable = true
+	f.goWeb()
+	defer f.closeWeb()
+	nodes, err = dumbcaslib.LoadNodesTable(f.authURL()+"/content/nodes", f.cas)
+	ut.AssertEqual(t, nil, err)
+	name, err := nodes.AddEntry(&dumbcaslib.Node{Entry: entry, Comment: "over http"}, "remote")
+	ut.AssertEqual(t, nil, err)
+	node, err := dumbcaslib.LoadNode(f.nodes, name)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "over http", node.Comment)
+	items, err = dumbcaslib.EnumerateNodesAsList(f.nodes)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 4, len(items))
 }